@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// envPrefix is the prefix of environment variables setting flags, e.g. HASS2CH_BATCH_SIZE sets --batch-size
+const envPrefix = "HASS2CH_"
+
+// domainOverrideFlags are the flags set by options of the domains section of the configuration file,
+// each option of a domain adds a domain=value item to the flag
+var domainOverrideFlags = map[string]string{
+	"round-precision": "round-precision",
+	"rate-limit":      "rate-limit",
+	"flap-detection":  "flap-detection",
+	"table-engine":    "table-engines",
+	"database":        "clickhouse-table-databases",
+}
+
+// tableOverrideFlags are the flags set by options of the tables section of the configuration file,
+// with the separator of their items. The match option routes each of its domains and entity patterns
+// to the table, the other options add a table=value item.
+var tableOverrideFlags = map[string]struct {
+	flag      string
+	separator string
+}{
+	"match":        {"table-routes", ","},
+	"state-type":   {"table-state-types", ";"},
+	"order-by":     {"table-order-by", ";"},
+	"partition-by": {"table-partition-by", ";"},
+}
+
+// fileConfig is the configuration file. Any flag can be set by its name at the top level, and the filters
+// and domains sections group the options of filters and of single domains, and the tables section the custom
+// tables entities are routed to:
+//
+//	clickhouse-url: http://clickhouse:8123
+//	labels: {site: cabin}
+//	filters:
+//	  origins: [LOCAL]
+//	  rate-limit: {binary_sensor: "1:10"}
+//	domains:
+//	  sensor: {round-precision: 2, database: sensors}
+//	tables:
+//	  power: {match: [sensor.power_*], state-type: Float64}
+//
+// Lists are joined with commas and maps turned into key=value lists, the syntax of the flags.
+type fileConfig struct {
+	Flags   map[string]any            `yaml:",inline"`
+	Filters map[string]any            `yaml:"filters"`
+	Domains map[string]map[string]any `yaml:"domains"`
+	Tables  map[string]map[string]any `yaml:"tables"`
+}
+
+// parseConfig parses a configuration file into values of flags
+func parseConfig(r io.Reader) (map[string]string, error) {
+	var conf fileConfig
+	decoder := yaml.NewDecoder(r)
+	if err := decoder.Decode(&conf); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, section := range []map[string]any{conf.Flags, conf.Filters} {
+		for name, value := range section {
+			s, err := flagValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %w", name, err)
+			}
+			if _, ok := values[name]; ok {
+				return nil, fmt.Errorf("%s is set more than once", name)
+			}
+			values[name] = s
+		}
+	}
+
+	domains := make([]string, 0, len(conf.Domains))
+	for domain := range conf.Domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		for option, value := range conf.Domains[domain] {
+			name, ok := domainOverrideFlags[option]
+			if !ok {
+				return nil, fmt.Errorf("unknown option %s of domain %s", option, domain)
+			}
+			s, err := flagValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of %s of domain %s: %w", option, domain, err)
+			}
+
+			item := domain + "=" + s
+			if values[name] != "" {
+				item = values[name] + "," + item
+			}
+			values[name] = item
+		}
+	}
+
+	tables := make([]string, 0, len(conf.Tables))
+	for table := range conf.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		options := make([]string, 0, len(conf.Tables[table]))
+		for option := range conf.Tables[table] {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+
+		for _, option := range options {
+			override, ok := tableOverrideFlags[option]
+			if !ok {
+				return nil, fmt.Errorf("unknown option %s of table %s", option, table)
+			}
+
+			var items []string
+			if option == "match" {
+				matches, err := flagValue(conf.Tables[table][option])
+				if err != nil {
+					return nil, fmt.Errorf("invalid value of %s of table %s: %w", option, table, err)
+				}
+				for _, match := range strings.Split(matches, ",") {
+					items = append(items, match+"="+table)
+				}
+			} else {
+				value, ok := conf.Tables[table][option].(string)
+				if !ok {
+					return nil, fmt.Errorf("invalid value of %s of table %s: expected a string", option, table)
+				}
+				items = append(items, table+"="+value)
+			}
+
+			for _, item := range items {
+				if values[override.flag] != "" {
+					item = values[override.flag] + override.separator + item
+				}
+				values[override.flag] = item
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// flagValue formats a value of the configuration file in the syntax of flags
+func flagValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		items := make([]string, 0, len(v))
+		for _, key := range keys {
+			s, err := flagValue(v[key])
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("value of %s must not be a list", key)
+			}
+			items = append(items, key+"="+s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// applyConfig sets the flags of the set not passed on the command line from HASS2CH_* environment variables
+// and then from the configuration file, if any. Flags take precedence over environment variables,
+// and environment variables over the configuration file.
+func applyConfig(fs *flag.FlagSet, path string) error {
+	values := make(map[string]string)
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read configuration file: %w", err)
+		}
+		if values, err = parseConfig(bytes.NewReader(content)); err != nil {
+			return fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok {
+			values[f.Name] = value
+		}
+	})
+
+	// Flags set from the configuration count as passed afterwards, e.g. they are not overridden by a profile
+	passed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		passed[f.Name] = true
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "config" {
+			return errors.New("config cannot be set by the configuration file or the environment")
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %s", name)
+		}
+		if passed[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("invalid value of %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateConfig checks the effective configuration of flags, environment variables and the configuration file
+// the way the commands would use it, without connecting to Home Assistant or ClickHouse
+func validateConfig() error {
+	var errs []error
+	if _, err := zerolog.ParseLevel(*logLevel); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log level: %w", err))
+	}
+	if *profile != "" {
+		if _, ok := profiles[*profile]; !ok {
+			errs = append(errs, fmt.Errorf("unknown profile %q", *profile))
+		}
+	}
+	if *memoryLimit != "" {
+		if _, err := parseByteSize(*memoryLimit); err != nil {
+			errs = append(errs, fmt.Errorf("invalid memory limit: %w", err))
+		}
+	}
+	if *chProtocol != "http" && *chProtocol != "native" {
+		errs = append(errs, fmt.Errorf("unknown ClickHouse protocol %q, expected http or native", *chProtocol))
+	}
+	if *hassCACert != "" {
+		if _, err := clickhouse.NewTLSConfig(*hassCACert, "", "", *hassInsecure); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Home Assistant TLS configuration: %w", err))
+		}
+	}
+	if _, err := clickhouseClientOptions("validate-config"); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := pipelineOptions(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
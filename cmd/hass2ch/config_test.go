@@ -0,0 +1,283 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "flags and filters",
+			config: `
+clickhouse-url: http://clickhouse:8123
+batch-size: 500
+export-attributes: true
+labels: {site: cabin, floor: 1}
+include-domains: [sensor, binary_sensor]
+filters:
+  origins: [LOCAL]
+  rate-limit: {binary_sensor: "1:10"}
+`,
+			want: map[string]string{
+				"clickhouse-url":    "http://clickhouse:8123",
+				"batch-size":        "500",
+				"export-attributes": "true",
+				"labels":            "floor=1,site=cabin",
+				"include-domains":   "sensor,binary_sensor",
+				"origins":           "LOCAL",
+				"rate-limit":        "binary_sensor=1:10",
+			},
+		},
+		{
+			name: "domains",
+			config: `
+domains:
+  sensor: {round-precision: 2, database: sensors}
+  light: {table-engine: MergeTree}
+`,
+			want: map[string]string{
+				"round-precision":            "sensor=2",
+				"clickhouse-table-databases": "sensor=sensors",
+				"table-engines":              "light=MergeTree",
+			},
+		},
+		{
+			name: "domains are added to filters of the same flag",
+			config: `
+filters:
+  rate-limit: {binary_sensor: "1:10"}
+domains:
+  sensor: {rate-limit: "5:60"}
+`,
+			want: map[string]string{
+				"rate-limit": "binary_sensor=1:10,sensor=5:60",
+			},
+		},
+		{
+			name: "tables",
+			config: `
+tables:
+  power: {match: [sensor.power_*, sensor.energy_*], state-type: Float64, order-by: "entity_id, last_updated"}
+  climate: {match: climate, partition-by: toYYYYMM(last_updated)}
+`,
+			want: map[string]string{
+				"table-routes":       "climate=climate,sensor.power_*=power,sensor.energy_*=power",
+				"table-state-types":  "power=Float64",
+				"table-order-by":     "power=entity_id, last_updated",
+				"table-partition-by": "climate=toYYYYMM(last_updated)",
+			},
+		},
+		{
+			name:   "empty file",
+			config: "",
+			want:   map[string]string{},
+		},
+		{
+			name: "flag set at the top level and in filters",
+			config: `
+origins: [LOCAL]
+filters:
+  origins: [REMOTE]
+`,
+			wantErr: "origins is set more than once",
+		},
+		{
+			name: "unknown option of a domain",
+			config: `
+domains:
+  sensor: {precision: 2}
+`,
+			wantErr: "unknown option precision of domain sensor",
+		},
+		{
+			name: "unknown option of a table",
+			config: `
+tables:
+  power: {match: [sensor.power_*], engine: MergeTree}
+`,
+			wantErr: "unknown option engine of table power",
+		},
+		{
+			name: "list in a map",
+			config: `
+labels: {site: [cabin, garage]}
+`,
+			wantErr: "invalid value of labels: value of site must not be a list",
+		},
+		{
+			name: "list of a domain option",
+			config: `
+domains:
+  sensor: {rate-limit: {a: [1, 2]}}
+`,
+			wantErr: "invalid value of rate-limit of domain sensor: value of a must not be a list",
+		},
+		{
+			name: "table option that is not a string",
+			config: `
+tables:
+  power: {match: [sensor.power_*], state-type: [Float64]}
+`,
+			wantErr: "invalid value of state-type of table power: expected a string",
+		},
+		{
+			name:    "invalid YAML",
+			config:  "batch-size: [500",
+			wantErr: "yaml:",
+		},
+		{
+			name:    "section that is not a map",
+			config:  "domains: [sensor]",
+			wantErr: "cannot unmarshal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfig(strings.NewReader(tt.config))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// configFlags returns a flag set of a few flags of each kind, parsed from the arguments
+func configFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+
+	fs := flag.NewFlagSet("hass2ch", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.String("config", "", "")
+	fs.String("clickhouse-url", "http://localhost:8123", "")
+	fs.String("log-level", "info", "")
+	fs.Int("batch-size", 1000, "")
+	fs.Bool("export-attributes", false, "")
+	require.NoError(t, fs.Parse(args))
+
+	return fs
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "hass2ch.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestApplyConfig_Precedence(t *testing.T) {
+	path := writeConfig(t, `
+clickhouse-url: http://file:8123
+log-level: warn
+batch-size: 500
+`)
+	t.Setenv("HASS2CH_LOG_LEVEL", "debug")
+	t.Setenv("HASS2CH_BATCH_SIZE", "200")
+
+	fs := configFlags(t, "--batch-size=100")
+	require.NoError(t, applyConfig(fs, path))
+
+	// The command line beats the environment, which beats the configuration file, which beats the defaults
+	assert.Equal(t, "100", fs.Lookup("batch-size").Value.String())
+	assert.Equal(t, "debug", fs.Lookup("log-level").Value.String())
+	assert.Equal(t, "http://file:8123", fs.Lookup("clickhouse-url").Value.String())
+	assert.Equal(t, "false", fs.Lookup("export-attributes").Value.String())
+
+	// Flags set from the configuration count as passed
+	passed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { passed[f.Name] = true })
+	assert.Equal(t, map[string]bool{"batch-size": true, "log-level": true, "clickhouse-url": true}, passed)
+}
+
+func TestApplyConfig_EnvironmentWithoutFile(t *testing.T) {
+	t.Setenv("HASS2CH_EXPORT_ATTRIBUTES", "true")
+
+	fs := configFlags(t)
+	require.NoError(t, applyConfig(fs, ""))
+
+	assert.Equal(t, "true", fs.Lookup("export-attributes").Value.String())
+	assert.Equal(t, "1000", fs.Lookup("batch-size").Value.String())
+}
+
+func TestApplyConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "unknown option",
+			config:  "batch-sise: 500",
+			wantErr: "unknown option batch-sise",
+		},
+		{
+			name:    "unknown option passed on the command line too",
+			config:  "batch-sise: 500",
+			args:    []string{"--batch-size=100"},
+			wantErr: "unknown option batch-sise",
+		},
+		{
+			name:    "config set by the configuration file",
+			config:  "config: other.yaml",
+			wantErr: "config cannot be set by the configuration file or the environment",
+		},
+		{
+			name:    "config set by the environment",
+			env:     map[string]string{"HASS2CH_CONFIG": "other.yaml"},
+			wantErr: "config cannot be set by the configuration file or the environment",
+		},
+		{
+			name:    "invalid value in the configuration file",
+			config:  "batch-size: many",
+			wantErr: "invalid value of batch-size",
+		},
+		{
+			name:    "invalid value in the environment",
+			env:     map[string]string{"HASS2CH_EXPORT_ATTRIBUTES": "sometimes"},
+			wantErr: "invalid value of export-attributes",
+		},
+		{
+			name:    "invalid configuration file",
+			config:  "domains: {sensor: {precision: 2}}",
+			wantErr: "invalid configuration file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			path := ""
+			if tt.config != "" {
+				path = writeConfig(t, tt.config)
+			}
+
+			assert.ErrorContains(t, applyConfig(configFlags(t, tt.args...), path), tt.wantErr)
+		})
+	}
+}
+
+func TestApplyConfig_MissingFile(t *testing.T) {
+	err := applyConfig(configFlags(t), filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorContains(t, err, "failed to read configuration file")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/ingestion"
+)
+
+// dumpStateOnSignal logs a report of the internal state of the Home Assistant client and the pipeline
+// whenever the process receives SIGUSR1, until the context is done
+func dumpStateOnSignal(ctx context.Context, c *hass.Client, pipeline *ingestion.Pipeline) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				log.Info().
+					Interface("hass", c.Status()).
+					Interface("pipeline", pipeline.DebugReport()).
+					Msg("state dump")
+			}
+		}
+	}()
+}
+
+// toggleDebugOnSignal switches the global log level to debug whenever the process receives SIGUSR2,
+// and back to the configured level on the next one, until the context is done
+func toggleDebugOnSignal(ctx context.Context, configured zerolog.Level) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				level := zerolog.DebugLevel
+				if zerolog.GlobalLevel() == zerolog.DebugLevel {
+					level = configured
+				}
+				zerolog.SetGlobalLevel(level)
+				log.Log().Str("level", level.String()).Msg("Changed log level")
+			}
+		}
+	}()
+}
@@ -1,12 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/signal"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/goccy/go-json"
@@ -14,111 +27,1689 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/jkaflik/hass2ch/hass"
-	"github.com/jkaflik/hass2ch/internal/ingestion"
 	"github.com/jkaflik/hass2ch/internal/metrics"
 	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+	"github.com/jkaflik/hass2ch/pkg/ingestion"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
 )
 
+// Set by goreleaser at build time
 var (
-	logLevel  = flag.String("log-level", "info", "Log level")
-	prettyLog = flag.Bool("pretty-log", false, "Enable pretty console logging instead of JSON")
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+var (
+	configFile = flag.String("config", "", "YAML configuration file setting flags not passed on the command line or by HASS2CH_* environment variables")
+	logLevel   = flag.String("log-level", "info", "Log level")
+	prettyLog  = flag.Bool("pretty-log", false, "Enable pretty console logging instead of JSON")
+
+	// Home Assistant connection
+	host              = flag.String("host", "homeassistant.local", "Home Assistant host")
+	secure            = flag.Bool("secure", false, "Use secure connection")
+	hassCACert        = flag.String("hass-ca-cert", "", "PEM bundle of CA certificates trusted in addition to the system ones when connecting to Home Assistant; implies --secure")
+	hassInsecure      = flag.Bool("hass-insecure", false, "Do not verify the certificate of Home Assistant (insecure, e.g. for self-signed certificates); implies --secure")
+	discover          = flag.Bool("discover", false, "Discover the Home Assistant instance on the local network via zeroconf when --host is not set")
+	hassStateCacheTTL = flag.Duration("hass-state-cache-ttl", 0, "Cache entity states kept up to date by subscriptions and refresh them fully after this period (0 disables the cache)")
+	hassFallbackTypes = flag.String("hass-fallback-event-types", string(hass.EventTypeStateChanged), "Comma-separated event types subscribed to individually when Home Assistant rejects subscribing to all events")
+
+	// Home Assistant reconnect storm protection
+	hassReconnectBudget        = flag.Int("hass-reconnect-budget", 20, "Consecutive failed reconnect attempts before only probing Home Assistant every --hass-reconnect-probe-interval (0 disables)")
+	hassReconnectCooldown      = flag.Duration("hass-reconnect-cooldown", 5*time.Second, "Minimum time between two reconnect attempts to Home Assistant")
+	hassReconnectProbeInterval = flag.Duration("hass-reconnect-probe-interval", 5*time.Minute, "Interval of reconnect attempts after the reconnect budget is exhausted")
+	hassHeartbeatInterval      = flag.Duration("hass-heartbeat-interval", 30*time.Second, "Interval of pings detecting stale Home Assistant connections (0 disables)")
+	hassHeartbeatTimeout       = flag.Duration("hass-heartbeat-timeout", 10*time.Second, "Time a pong is waited for before the Home Assistant connection is considered stale and reconnected")
+
+	// Home Assistant OAuth2, used when HASS_REFRESH_TOKEN is set instead of HASS_TOKEN
+	hassClientID = flag.String("hass-client-id", "https://github.com/jkaflik/hass2ch", "OAuth2 client ID the Home Assistant refresh token is issued to")
+
+	// ClickHouse connection
+	chUrl            = flag.String("clickhouse-url", "http://localhost:8123", "ClickHouse HTTP URL")
+	chReadURL        = flag.String("clickhouse-read-url", "", "ClickHouse HTTP URL of a replica for read-only queries (default: --clickhouse-url)")
+	chUserAgent      = flag.String("clickhouse-user-agent", "", "User-Agent of ClickHouse requests and client name of native connections (default: hass2ch/<version> (<command>; <go version>))")
+	chSessionID      = flag.String("clickhouse-session-id", "", "ClickHouse session of inserts and DDL, so chproxy and load balancers route them to the same host, e.g. hass2ch-{hostname} (sent one at a time)")
+	chQuotaKey       = flag.String("clickhouse-quota-key", "", "Quota key ClickHouse accounts the queries of the instance to, e.g. hass2ch-{hostname}")
+	chHeaders        = flag.String("clickhouse-headers", "", "Extra headers of ClickHouse HTTP requests, e.g. X-ClickHouse-Quota-Key=home or the credentials of an authenticating proxy")
+	chDatabase       = flag.String("clickhouse-database", "hass", "ClickHouse database")
+	chTableDatabases = flag.String("clickhouse-table-databases", "", "Databases of tables stored outside of --clickhouse-database, e.g. light=lights,attribute_changes=audit")
+	chUsername       = flag.String("clickhouse-username", "default", "ClickHouse username")
+	chPassword       = flag.String("clickhouse-password", "", "ClickHouse password. It can also be set via CLICKHOUSE_PASSWORD environment variable")
+	chProtocol       = flag.String("clickhouse-protocol", "http", "Protocol the pipeline inserts rows with: http (JSONEachRow) or native (columnar blocks over TCP)")
+	chNativeAddr     = flag.String("clickhouse-native-addr", "localhost:9000", "ClickHouse native protocol address, used with --clickhouse-protocol=native")
+	chCompression    = flag.String("clickhouse-compression", "zstd", "Compression of insert bodies sent over HTTP: zstd, lz4, gzip or none")
+	chCAFile         = flag.String("clickhouse-ca-file", "", "PEM bundle of CA certificates trusted in addition to the system ones when connecting to ClickHouse over TLS")
+	chCertFile       = flag.String("clickhouse-cert-file", "", "PEM client certificate presented to ClickHouse for mutual TLS, requires --clickhouse-key-file")
+	chKeyFile        = flag.String("clickhouse-key-file", "", "PEM private key of --clickhouse-cert-file")
+	chInsecureTLS    = flag.Bool("clickhouse-insecure-skip-verify", false, "Do not verify the certificate of ClickHouse (insecure, for testing only)")
+
+	// ClickHouse retry settings
+	chMaxRetries      = flag.Int("clickhouse-max-retries", 5, "Maximum number of retries for ClickHouse operations")
+	chInitialInterval = flag.Duration("clickhouse-initial-interval", 500*time.Millisecond, "Initial retry interval for ClickHouse operations")
+	chMaxInterval     = flag.Duration("clickhouse-max-interval", 30*time.Second, "Maximum retry interval for ClickHouse operations")
+	chTimeout         = flag.Duration("clickhouse-timeout", 60*time.Second, "Timeout for ClickHouse operations")
+
+	chInsertWorkers   = flag.Int("clickhouse-insert-workers", 4, "Number of batches inserted into ClickHouse concurrently")
+	chTableWorkers    = flag.Int("clickhouse-table-insert-workers", 4, "Number of tables of a batch routed to more than one table inserted into ClickHouse concurrently")
+	transformWorkers  = flag.Int("transform-workers", 2, "Number of batches resolved and transformed concurrently")
+	batchSize         = flag.Int("batch-size", 100_000, "Maximum number of events in a batch of a single table")
+	batchWait         = flag.Duration("batch-wait", time.Second, "Maximum time events wait in a batch before it is inserted")
+	batchAlign        = flag.Duration("batch-align", 0, "Insert all pending batches at every multiple of this duration of the wall clock, e.g. 1m at :00 of every minute, instead of after --batch-wait (0 disables)")
+	batchMaxBytes     = flag.String("batch-max-bytes", "", "Maximum estimated size of a batch of a single table, e.g. 16MiB (0 or empty means no limit)")
+	batchPendingBytes = flag.String("batch-pending-bytes", "", "Budget of the estimated size of events pending in all batches, the largest batches are inserted early beyond it, e.g. 64MiB (0 or empty means no limit)")
+	eventBuffer       = flag.Int("event-buffer", 1_000, "Number of filtered events buffered in front of the batcher")
+	insertStats       = flag.Duration("insert-stats-interval", 0, "Store statistics of every insert in the insert_stats table, flushed at this interval (0 disables)")
+	asyncInsertLog    = flag.Duration("async-insert-feedback-interval", 0, "Read system.asynchronous_insert_log and system.part_log at this interval and expose flushed inserts and created parts as metrics (0 disables)")
+
+	// Backpressure
+	backpressureHighWater = flag.Int("backpressure-high-water", 0, "Pause Home Assistant subscriptions while more events than this are in flight (0 disables)")
+	backpressureLowWater  = flag.Int("backpressure-low-water", 0, "Resume paused Home Assistant subscriptions once no more events than this are in flight (default: half of --backpressure-high-water)")
+
+	// Sharding
+	shard = flag.String("shard", "", "Ingest only the entities of a shard given as index/count, e.g. 0/3 for the first of three instances")
+
+	// Labels
+	labels = flag.String("labels", "", "Static labels stored in a column of every row, e.g. site=cabin,tenant=acme")
+
+	// Row model
+	rowModels = flag.String("row-models", "v1", "Comma-separated row models to write state changes with, the first one is primary. Use v1,v2 to dual-write during a migration")
+
+	// Table DDL
+	ddlTemplate = flag.String("ddl-template", "", "Go template file with a custom DDL of state change tables")
+	ddlCodec    = flag.String("ddl-codec", "", "Compression codec passed to the DDL template as .Codec, e.g. ZSTD(3)")
+	ddlTTL      = flag.String("ddl-ttl", "", "TTL expression passed to the DDL template as .TTL, e.g. toDateTime(last_updated) + INTERVAL 1 YEAR")
+	chTopology  = flag.Bool("clickhouse-topology", false, "Discover the cluster, shard and replica of the ClickHouse server from system.clusters and system.macros on startup and pass them to the DDL template")
+	chCluster   = flag.String("clickhouse-cluster", "", "Cluster passed to the DDL template as .Cluster, discovered with --clickhouse-topology if empty")
+	chDBCreate  = flag.Bool("clickhouse-create-database", false, "Create the ClickHouse databases written to on startup if they do not exist")
+	chDBEngine  = flag.String("clickhouse-database-engine", "", "Engine of created databases, e.g. Replicated('/clickhouse/databases/hass', '{shard}', '{replica}'); implies --clickhouse-create-database")
+	chDBComment = flag.String("clickhouse-database-comment", "", "Comment of created databases; implies --clickhouse-create-database")
+	noDDL       = flag.Bool("no-ddl", false, "Disable automatic DDL and expect all tables to be created in advance; only the INSERT grant is required")
+
+	// Data quality
+	strictMode    = flag.Bool("strict", false, "Reject rows with unknown fields and store rows rejected by ClickHouse in the dead_letter table")
+	deadLetterDir = flag.String("dead-letter-dir", "", "Directory dead letters of strict mode are appended to as NDJSON files instead of the dead_letter table")
+
+	// Schema export
+	schemaOffline = flag.Bool("schema-offline", false, "Export only the tables hass2ch would generate, without querying ClickHouse")
+
+	// Compression tuning
+	tuneTables     = flag.String("tune-tables", "", "Comma-separated tables benchmarked by the tune command (default: all non-empty tables)")
+	tuneSampleRows = flag.Int("tune-sample-rows", 100_000, "Number of rows sampled from every table by the tune command")
+	tuneOrderBy    = flag.String("tune-order-by", "", "Semicolon-separated candidate sorting keys compared by the tune command, e.g. (entity_id, last_updated);(last_updated)")
+	tuneJSON       = flag.Bool("tune-json", false, "Print the report of the tune command as JSON")
+
+	// DLQ
+	dlqTables = flag.String("dlq-tables", "", "Comma-separated destination tables whose dead letters are retried by the dlq retry command (default: all)")
+	dlqLimit  = flag.Int("dlq-limit", 0, "Maximum number of dead letters retried per database by the dlq retry command (0 retries all)")
+	dlqDryRun = flag.Bool("dlq-dry-run", false, "Reprocess dead letters with the dlq retry command without inserting or deleting them")
+
+	// Tail filters
+	tailEntity = flag.String("tail-entity", "*", "Glob pattern of entity IDs printed by the tail command")
+	tailTable  = flag.String("tail-table", "*", "Glob pattern of destination tables printed by the tail command")
+
+	recordFixtures = flag.String("record-fixtures", "", "Directory the tail command writes anonymized test fixtures of events printed to, one per table and error")
+	recordTraffic  = flag.String("record-traffic", "", "Directory the pipeline command records received events and statements sent to ClickHouse to, to be compared with another version by the replay command")
+
+	// Transformations
+	stages             = flag.String("stages", "", "Comma-separated order of the configured filter and enricher stages, e.g. flap_detection,rate_limit,rounding,value_delta")
+	attributeChanges   = flag.Bool("attribute-changes", false, "Record state changes with an unchanged state in the attribute_changes table instead of the domain table")
+	availability       = flag.Bool("availability", false, "Record transitions of entities to and from the unavailable and unknown states in the availability table")
+	attributeColumns   = flag.String("attribute-columns", "", "Attributes stored in typed columns of the state change tables of their domain, e.g. climate.current_temperature=Float64,numeric_sensor.battery_level=UInt8")
+	valueDelta         = flag.Bool("value-delta", false, "Store the difference from the previously stored value of numeric entities in the value_delta column")
+	attributeDiff      = flag.Duration("attribute-diff-snapshot-interval", 0, "Store only the attributes changed since the old state, with a full snapshot per entity at this interval (0 stores full attributes)")
+	storageTiers       = flag.String("storage-tiers", "", "Move parts of new state change tables to volumes or disks as they age, per table or * for all, e.g. *=30d:volume:cold,*=365d:disk:s3")
+	storagePolicy      = flag.String("storage-policy", "", "Storage policy of new state change tables, holding the volumes and disks of --storage-tiers, e.g. tiered")
+	tableEngines       = flag.String("table-engines", "", "Engines of new state change tables per table or * for all: merge_tree, replacing[:version column] or collapsing, e.g. light=replacing:received_at")
+	tableRoutes        = flag.String("table-routes", "", "Route state changes of domains or entity ID glob patterns into custom tables instead of the tables of their domains, e.g. sensor.power_*=power")
+	tableStateTypes    = flag.String("table-state-types", "", "Semicolon-separated state column types of custom tables of --table-routes, e.g. power=Float64 (default: String)")
+	tableOrderBy       = flag.String("table-order-by", "", "Semicolon-separated sorting keys of custom tables of --table-routes, e.g. power=(entity_id, last_updated)")
+	tablePartitionBy   = flag.String("table-partition-by", "", "Semicolon-separated partition keys of custom tables of --table-routes, e.g. power=toYYYYMMDD(last_updated) (default: toYYYYMM(last_updated))")
+	stateEnumDomains   = flag.String("state-enums", "", "Comma-separated domains with enumerated states stored in Enum8 state columns of new tables: climate, media_player, alarm_control_panel or all")
+	stateLabels        = flag.String("state-labels", "", "Semicolon-separated labels of enumerated states in the state_labels table in addition to the English ones, e.g. de:climate.heat=Heizen")
+	eventHash          = flag.Bool("event-hash", false, "Add the event_hash column identifying state changes across repeated ingestion")
+	eventHashDedup     = flag.Bool("event-hash-dedup", false, "Create new state change tables with the ReplacingMergeTree engine deduplicating rows by event_hash (implies --event-hash)")
+	lateEventThreshold = flag.Duration("late-event-threshold", 0, "Flag state changes updated longer than this before the latest one of their table with the is_late column (0 disables)")
+	heartbeatInterval  = flag.Duration("heartbeat-interval", 0, "Emit a row into the heartbeats table for entities without a state change for this long (0 disables)")
+	eventTypes         = flag.String("event-types", "", "Comma-separated event types ingested in addition to state_changed, each into a table named after the event type, e.g. call_service,automation_triggered")
+	restartLog         = flag.Bool("restart-log", false, "Record Home Assistant starts, stops and core configuration changes in the restarts table")
+	gapBackfill        = flag.Bool("gap-backfill", false, "Re-sync windows in which the connection to Home Assistant was lost from its history and record them in the gaps table")
+	reportOrphans      = flag.Bool("report-orphans", true, "Log tables of the databases of hass2ch not produced by the configuration on startup")
+	migrateSchemaFlag  = flag.Bool("migrate-schema", false, "Apply safe schema changes (new columns, TTL, comments) to existing tables on startup and log incompatible ones")
+	initialSnapshot    = flag.Bool("initial-snapshot", false, "Insert the current state of every entity on startup, so tables are not empty for entities that rarely change")
+	readinessGrace     = flag.Duration("readiness-grace", time.Minute, "Period after startup the pipeline waits for its first insert before /ready reports it ready without one")
+	entityMetadata     = flag.Bool("entity-metadata", false, "Maintain the entities table with the friendly name, device, area, device class and unit of every entity")
+	statsInterval      = flag.Duration("statistics-interval", 0, "Import the hourly long-term statistics of Home Assistant into the statistics table every interval (0 disables)")
+	statsLookback      = flag.Duration("statistics-lookback", 24*time.Hour, "Period of long-term statistics read by every import")
+	origins            = flag.String("origins", "", "Comma-separated event origins to ingest, LOCAL or REMOTE (default: all)")
+	actor              = flag.String("actor", "", "Ingest only state changes caused by a user (user) or by automations and integrations (automation)")
+	rateLimit          = flag.String("rate-limit", "", "Token bucket limits of state changes per entity as rate per second and burst, per entity, domain or * for all, e.g. binary_sensor=1:10")
+	flapDetection      = flag.String("flap-detection", "", "Detect entities flapping with at least threshold transitions within a window, per domain or entity, e.g. binary_sensor=10s:6")
+	flapCollapse       = flag.Bool("flap-collapse", false, "Collapse state changes of flapping entities into a single row with the flap_count column")
+	contextGrouping    = flag.Duration("context-grouping", 0, "Hold state changes sharing a context for this long, insert them in the same batch of every table and stamp them with the context_batch_id column (0 disables)")
+	roundPrecision     = flag.String("round-precision", "", "Decimal places to round numeric states to, per domain or entity, e.g. numeric_sensor=2,sensor.power=0")
+
+	// Energy cost enrichment
+	energyPrice         = flag.Float64("energy-price", 0, "Static energy price per kWh used to compute the cost of energy consumption")
+	energyPriceSchedule = flag.String("energy-price-schedule", "", "Time-of-day energy price schedule, e.g. 00:00=0.20,07:00=0.35,22:00=0.20")
+	energyPriceEntity   = flag.String("energy-price-entity", "", "Entity ID whose state is the current energy price per kWh")
+	energyEntities      = flag.String("energy-entities", "", "Comma-separated energy entity IDs to compute cost for (default: sensors with the energy device class)")
+
+	// Write-ahead log
+	bufferDir     = flag.String("buffer-dir", "", "Directory batches failing after all ClickHouse retries are spilled to and replayed from once ClickHouse recovers (disabled if empty)")
+	bufferMaxSize = flag.String("buffer-max-size", "1GiB", "Maximum size of batches spilled to --buffer-dir, batches are dropped beyond it (0 means no limit)")
+
+	// Runtime
+	profile         = flag.String("profile", "", "Preset of defaults of other flags: low-memory for small devices like a Raspberry Pi")
+	gogc            = flag.Int("gogc", 100, "Garbage collection target percentage, like the GOGC environment variable (negative disables the collector, applied only if set)")
+	memoryLimit     = flag.String("memory-limit", "", "Runtime memory limit, like the GOMEMLIMIT environment variable, e.g. 256MiB")
+	softMemoryLimit = flag.String("soft-memory-limit", "", "Flush pending batches early while the heap exceeds this size, e.g. 192MiB")
+
+	// Metrics server
+	metricsAddr   = flag.String("metrics-addr", ":9090", "Address to expose Prometheus metrics on")
+	enableMetrics = flag.Bool("enable-metrics", true, "Enable Prometheus metrics server")
+	adminToken    = flag.String("admin-token", "", "Bearer token of the /admin/loglevel endpoint of the metrics server changing the log level at runtime (disabled if empty)")
+)
+
+func hassClient(ctx context.Context) (*hass.Client, error) {
+	schema := "ws"
+	if *secure || *hassCACert != "" || *hassInsecure {
+		schema = "wss"
+	}
+
+	url := fmt.Sprintf("%s://%s", schema, *host)
+
+	opts := []func(*hass.Client){
+		hass.WithReconnectConfig(
+			1*time.Second,  // Initial reconnect interval
+			30*time.Second, // Max reconnect interval
+			1.5,            // Backoff multiplier
+		),
+		hass.WithReconnectBudget(*hassReconnectBudget, *hassReconnectCooldown, *hassReconnectProbeInterval),
+		hass.WithHeartbeat(*hassHeartbeatInterval, *hassHeartbeatTimeout),
+	}
+
+	if *hassFallbackTypes != "" {
+		var eventTypes []hass.EventType
+		for _, eventType := range strings.Split(*hassFallbackTypes, ",") {
+			eventTypes = append(eventTypes, hass.EventType(strings.TrimSpace(eventType)))
+		}
+		opts = append(opts, hass.WithFallbackEventTypes(eventTypes...))
+	}
+
+	if *hassStateCacheTTL > 0 {
+		opts = append(opts, hass.WithStateCache(*hassStateCacheTTL))
+	}
+
+	var tokenOpts []func(*hass.RefreshTokenSource)
+	if *hassCACert != "" || *hassInsecure {
+		tlsConfig, err := clickhouse.NewTLSConfig(*hassCACert, "", "", *hassInsecure)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Home Assistant TLS configuration: %w", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		opts = append(opts, hass.WithTLSConfig(tlsConfig))
+		tokenOpts = append(tokenOpts, hass.WithTokenHTTPClient(&http.Client{Transport: transport}))
+	}
+
+	token := os.Getenv("HASS_TOKEN")
+	if refreshToken := os.Getenv("HASS_REFRESH_TOKEN"); token == "" && refreshToken != "" {
+		opts = append(opts, hass.WithTokenSource(hass.NewRefreshTokenSource(hass.HTTPURL(url), *hassClientID, refreshToken, tokenOpts...)))
+	} else if token == "" {
+		return nil, fmt.Errorf("HASS_TOKEN or HASS_REFRESH_TOKEN environment variable not set")
+	}
+
+	// Create client with reconnection settings
+	c := hass.NewClient(url, token, opts...)
+
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return c, c.WaitAuthenticated(ctx)
+}
+
+// discoverHost sets the Home Assistant host to the first instance found on the local network
+func discoverHost(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	log.Info().Msg("Discovering Home Assistant on the local network")
+
+	instances, err := hass.Discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	u, err := neturl.Parse(instances[0].URL)
+	if err != nil {
+		return fmt.Errorf("invalid URL of discovered instance: %w", err)
+	}
+
+	*host = u.Host
+	*secure = u.Scheme == "https"
+
+	log.Info().
+		Str("name", instances[0].Name).
+		Str("url", instances[0].URL).
+		Int("instances", len(instances)).
+		Msg("Discovered Home Assistant")
+
+	return nil
+}
+
+// authorize bootstraps OAuth2 authentication by exchanging an authorization code for a refresh token
+func authorize(ctx context.Context) error {
+	schema := "http"
+	if *secure {
+		schema = "https"
+	}
+	baseURL := fmt.Sprintf("%s://%s", schema, *host)
+
+	fmt.Println("Open the following URL in a browser and log in to Home Assistant:")
+	fmt.Println()
+	fmt.Println("  " + hass.AuthorizeURL(baseURL, *hassClientID, *hassClientID))
+	fmt.Println()
+	fmt.Print("Paste the code parameter of the URL you have been redirected to: ")
+
+	var code string
+	if _, err := fmt.Scanln(&code); err != nil {
+		return fmt.Errorf("failed to read authorization code: %w", err)
+	}
+
+	tokens, err := hass.ExchangeAuthCode(ctx, baseURL, *hassClientID, strings.TrimSpace(code))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Println("Set the following environment variable to run hass2ch with this refresh token:")
+	fmt.Println()
+	fmt.Printf("  HASS_REFRESH_TOKEN=%s\n", tokens.RefreshToken)
+
+	return nil
+}
+
+func dumpEvents(ctx context.Context, c *hass.Client) {
+	cv, err := c.SubscribeEvents(ctx)
+
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to subscribe to events")
+		return
+	}
+
+	go recovery.Run("dump", func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-cv:
+				log.Info().
+					Str("event_type", string(event.Event.EventType)).
+					Str("entity_id", event.Event.Data.EntityID).
+					Msg("Event received")
+				// Print the full event structure as JSON for debugging
+				if jsonData, err := json.MarshalIndent(event, "", "  "); err == nil {
+					fmt.Println(string(jsonData))
+				}
+			}
+		}
+	})
+}
+
+// pipelineOptions returns the pipeline transformations configured with flags
+func pipelineOptions() ([]ingestion.PipelineOption, error) {
+	pipelineOpts := []ingestion.PipelineOption{
+		ingestion.WithInsertWorkers(*chInsertWorkers),
+		ingestion.WithTableInsertWorkers(*chTableWorkers),
+		ingestion.WithTransformWorkers(*transformWorkers),
+		ingestion.WithBatchSize(*batchSize),
+		ingestion.WithBatchWait(*batchWait),
+		ingestion.WithBatchAlignment(*batchAlign),
+		ingestion.WithEventBuffer(*eventBuffer),
+		ingestion.WithReadinessGrace(*readinessGrace),
+	}
+
+	if *roundPrecision != "" {
+		roundingConf, err := ingestion.ParseRoundingConfig(*roundPrecision)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rounding precision: %w", err)
+		}
+
+		pipelineOpts = append(pipelineOpts, ingestion.WithRounding(roundingConf))
+	}
+
+	if *origins != "" || *actor != "" {
+		originConf, err := ingestion.ParseOriginConfig(*origins, *actor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse origin filter: %w", err)
+		}
+
+		pipelineOpts = append(pipelineOpts, ingestion.WithOriginFilter(originConf))
+	}
+
+	if *rateLimit != "" {
+		rateLimitConf, err := ingestion.ParseRateLimitConfig(*rateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rate limit: %w", err)
+		}
+
+		pipelineOpts = append(pipelineOpts, ingestion.WithRateLimit(rateLimitConf))
+	}
+
+	if *flapDetection != "" {
+		flapConf, err := ingestion.ParseFlapConfig(*flapDetection)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse flap detection: %w", err)
+		}
+		flapConf.Collapse = *flapCollapse
+
+		pipelineOpts = append(pipelineOpts, ingestion.WithFlapDetection(flapConf))
+	}
+
+	if *contextGrouping > 0 {
+		pipelineOpts = append(pipelineOpts, ingestion.WithContextGrouping(*contextGrouping))
+	}
+
+	if *shard != "" {
+		parsedShard, err := ingestion.ParseShard(*shard)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse shard: %w", err)
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithShard(parsedShard))
+	}
+
+	if *chTableDatabases != "" {
+		databases, err := ingestion.ParseTableDatabases(*chTableDatabases)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse table databases: %w", err)
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithTableDatabases(databases))
+	}
+
+	if *labels != "" {
+		parsedLabels, err := ingestion.ParseLabels(*labels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse labels: %w", err)
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithLabels(parsedLabels))
+	}
+
+	models, err := ingestion.ParseRowModels(*rowModels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse row models: %w", err)
+	}
+	pipelineOpts = append(pipelineOpts, ingestion.WithRowModels(models...))
+
+	if *ddlTemplate != "" {
+		tmpl, err := ingestion.LoadDDLTemplate(*ddlTemplate)
+		if err != nil {
+			return nil, err
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithDDLTemplate(ingestion.DDLTemplateConfig{
+			Template: tmpl,
+			Codec:    *ddlCodec,
+			TTL:      *ddlTTL,
+		}))
+	}
+
+	if *chDBCreate || *chDBEngine != "" || *chDBComment != "" {
+		pipelineOpts = append(pipelineOpts, ingestion.WithDatabaseCreation(ingestion.DatabaseConfig{
+			Engine:  *chDBEngine,
+			Comment: *chDBComment,
+		}))
+	}
+
+	if *chTopology || *chCluster != "" {
+		pipelineOpts = append(pipelineOpts, ingestion.WithClusterTopology(ingestion.ClusterTopology{Cluster: *chCluster}))
+	}
+
+	if *strictMode {
+		pipelineOpts = append(pipelineOpts, ingestion.WithStrictMode())
+	}
+
+	if *deadLetterDir != "" {
+		pipelineOpts = append(pipelineOpts, ingestion.WithDeadLetterDir(*deadLetterDir))
+	}
+
+	if *attributeChanges {
+		pipelineOpts = append(pipelineOpts, ingestion.WithAttributeChanges())
+	}
+
+	if *availability {
+		pipelineOpts = append(pipelineOpts, ingestion.WithAvailability())
+	}
+
+	if *attributeColumns != "" {
+		columns, err := ingestion.ParseAttributeColumns(*attributeColumns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse attribute columns: %w", err)
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithAttributeColumns(columns...))
+	}
+
+	// Deltas are computed from the stored, possibly rounded, values
+	if *valueDelta {
+		pipelineOpts = append(pipelineOpts, ingestion.WithValueDelta())
+	}
+
+	if *heartbeatInterval > 0 {
+		pipelineOpts = append(pipelineOpts, ingestion.WithHeartbeats(*heartbeatInterval))
+	}
+
+	if *eventTypes != "" {
+		var types []hass.EventType
+		for _, eventType := range splitList(*eventTypes) {
+			types = append(types, hass.EventType(eventType))
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithEventTypes(types...))
+	}
+
+	if *restartLog {
+		pipelineOpts = append(pipelineOpts, ingestion.WithRestartLog())
+	}
+
+	if *gapBackfill {
+		pipelineOpts = append(pipelineOpts, ingestion.WithGapBackfill())
+	}
+
+	if *reportOrphans {
+		pipelineOpts = append(pipelineOpts, ingestion.WithOrphanReport())
+	}
+
+	if *migrateSchemaFlag {
+		pipelineOpts = append(pipelineOpts, ingestion.WithSchemaMigration())
+	}
+
+	if *initialSnapshot {
+		pipelineOpts = append(pipelineOpts, ingestion.WithInitialSnapshot())
+	}
+
+	if *entityMetadata {
+		pipelineOpts = append(pipelineOpts, ingestion.WithEntityMetadata())
+	}
+
+	if *statsInterval > 0 {
+		pipelineOpts = append(pipelineOpts, ingestion.WithStatistics(ingestion.StatisticsConfig{
+			Interval: *statsInterval,
+			Lookback: *statsLookback,
+		}))
+	}
+
+	if *insertStats > 0 {
+		pipelineOpts = append(pipelineOpts, ingestion.WithInsertStats(*insertStats))
+	}
+
+	if *asyncInsertLog > 0 {
+		pipelineOpts = append(pipelineOpts, ingestion.WithAsyncInsertFeedback(*asyncInsertLog))
+	}
+
+	if *noDDL {
+		pipelineOpts = append(pipelineOpts, ingestion.WithoutDDL())
+	}
+
+	if *lateEventThreshold > 0 {
+		pipelineOpts = append(pipelineOpts, ingestion.WithLateEvents(*lateEventThreshold))
+	}
+
+	if *attributeDiff > 0 {
+		pipelineOpts = append(pipelineOpts, ingestion.WithAttributeDiff(*attributeDiff))
+	}
+
+	if *tableEngines != "" {
+		tableEngineConf, err := ingestion.ParseTableEngineConfig(*tableEngines)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse table engines: %w", err)
+		}
+
+		pipelineOpts = append(pipelineOpts, ingestion.WithTableEngines(tableEngineConf))
+	}
+
+	if *storageTiers != "" || *storagePolicy != "" {
+		storageTieringConf, err := ingestion.ParseStorageTieringConfig(*storageTiers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse storage tiers: %w", err)
+		}
+		storageTieringConf.Policy = *storagePolicy
+
+		pipelineOpts = append(pipelineOpts, ingestion.WithStorageTiering(storageTieringConf))
+	}
+
+	if *tableRoutes != "" || *tableStateTypes != "" || *tableOrderBy != "" || *tablePartitionBy != "" {
+		overrides, err := ingestion.ParseTableOverrides(*tableRoutes, *tableStateTypes, *tableOrderBy, *tablePartitionBy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse table overrides: %w", err)
+		}
+
+		pipelineOpts = append(pipelineOpts, ingestion.WithTableOverrides(overrides...))
+	}
+
+	if *stateEnumDomains != "" || *stateLabels != "" {
+		stateEnumConf, err := ingestion.ParseStateEnums(*stateEnumDomains, *stateLabels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse state enums: %w", err)
+		}
+
+		pipelineOpts = append(pipelineOpts, ingestion.WithStateEnums(stateEnumConf))
+	}
+
+	if *eventHash || *eventHashDedup {
+		pipelineOpts = append(pipelineOpts, ingestion.WithEventHash(ingestion.EventHashConfig{Deduplicate: *eventHashDedup}))
+	}
+
+	if *stages != "" {
+		pipelineOpts = append(pipelineOpts, ingestion.WithStageOrder(ingestion.ParseStageOrder(*stages)...))
+	}
+
+	if *energyPrice != 0 || *energyPriceSchedule != "" || *energyPriceEntity != "" {
+		schedule, err := ingestion.ParsePriceSchedule(*energyPriceSchedule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse energy price schedule: %w", err)
+		}
+
+		pipelineOpts = append(pipelineOpts, ingestion.WithCostEnrichment(ingestion.CostConfig{
+			Price:         *energyPrice,
+			Schedule:      schedule,
+			PriceEntityID: *energyPriceEntity,
+			EntityIDs:     splitList(*energyEntities),
+		}))
+	}
+
+	if *backpressureHighWater > 0 {
+		lowWater := *backpressureLowWater
+		if lowWater == 0 {
+			lowWater = *backpressureHighWater / 2
+		}
+		if lowWater >= *backpressureHighWater {
+			return nil, fmt.Errorf("backpressure low-water mark %d must be below the high-water mark %d", lowWater, *backpressureHighWater)
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithBackpressure(*backpressureHighWater, lowWater))
+	}
+
+	if *batchMaxBytes != "" || *batchPendingBytes != "" {
+		var sizes [2]uint64
+		for i, value := range []string{*batchMaxBytes, *batchPendingBytes} {
+			if value == "" {
+				continue
+			}
+			size, err := parseByteSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid batch byte limit: %w", err)
+			}
+			sizes[i] = size
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithBatchBytes(int(sizes[0]), int(sizes[1])))
+	}
+
+	if *softMemoryLimit != "" {
+		limit, err := parseByteSize(*softMemoryLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid soft memory limit: %w", err)
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithSoftMemoryLimit(limit))
+	}
+
+	if *bufferDir != "" {
+		maxSize, err := parseByteSize(*bufferMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid buffer max size: %w", err)
+		}
+		pipelineOpts = append(pipelineOpts, ingestion.WithWAL(*bufferDir, maxSize))
+	}
+
+	return pipelineOpts, nil
+}
+
+// profiles are presets of flag values applied to flags not passed on the command line
+var profiles = map[string]map[string]string{
+	// The defaults are tuned for servers, small devices next to Home Assistant ingest far fewer events
+	"low-memory": {
+		"batch-size":                      "5000",
+		"batch-wait":                      "5s",
+		"batch-pending-bytes":             "32MiB",
+		"event-buffer":                    "100",
+		"clickhouse-insert-workers":       "1",
+		"clickhouse-table-insert-workers": "1",
+		"transform-workers":               "1",
+		"gogc":                            "50",
+	},
+}
+
+// applyProfile sets the flags of the profile that have not been passed on the command line
+func applyProfile(name string) error {
+	values, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	for flagName, value := range values {
+		if isFlagSet(flagName) {
+			continue
+		}
+		if err := flag.Set(flagName, value); err != nil {
+			return fmt.Errorf("failed to set %s of profile %s: %w", flagName, name, err)
+		}
+	}
+
+	log.Info().Str("profile", name).Msg("applied profile")
+	return nil
+}
+
+// applyRuntimeLimits configures the garbage collector from the runtime flags
+func applyRuntimeLimits() error {
+	if isFlagSet("gogc") {
+		previous := debug.SetGCPercent(*gogc)
+		log.Info().Int("gogc", *gogc).Int("previous", previous).Msg("set garbage collection target percentage")
+	}
+
+	if *memoryLimit != "" {
+		limit, err := parseByteSize(*memoryLimit)
+		if err != nil {
+			return fmt.Errorf("invalid memory limit: %w", err)
+		}
+		debug.SetMemoryLimit(int64(limit))
+		log.Info().Uint64("memory_limit", limit).Msg("set runtime memory limit")
+	}
+
+	return nil
+}
+
+// byteSizeUnits are the suffixes of sizes accepted by parseByteSize, longest first
+var byteSizeUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"B", 1},
+}
+
+// parseByteSize parses a size in bytes with an optional unit, e.g. 512MiB, 1GB or 1048576
+func parseByteSize(size string) (uint64, error) {
+	s := strings.TrimSpace(size)
+	unit := uint64(1)
+	for _, u := range byteSizeUnits {
+		if number, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, unit = strings.TrimSpace(number), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: expected a number of bytes with an optional unit, e.g. 256MiB", size)
+	}
+	return n * unit, nil
+}
+
+// isFlagSet reports whether a flag has been passed on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// checksumExcludedFlags are flags that do not change how data is ingested or are expected
+// to differ between replicas, e.g. secrets
+var checksumExcludedFlags = map[string]bool{
+	"config":                true,
+	"log-level":             true,
+	"pretty-log":            true,
+	"clickhouse-password":   true,
+	"admin-token":           true,
+	"clickhouse-headers":    true,
+	"clickhouse-user-agent": true,
+	"clickhouse-session-id": true,
+	"clickhouse-quota-key":  true,
+	"schema-offline":        true,
+	"tune-tables":           true,
+	"tune-sample-rows":      true,
+	"tune-order-by":         true,
+	"tune-json":             true,
+	"dlq-tables":            true,
+	"dlq-limit":             true,
+	"dlq-dry-run":           true,
+	"dead-letter-dir":       true,
+	"tail-entity":           true,
+	"tail-table":            true,
+	"record-fixtures":       true,
+	"record-traffic":        true,
+	"gogc":                  true,
+	"memory-limit":          true,
+	"soft-memory-limit":     true,
+	"buffer-dir":            true,
+	"buffer-max-size":       true,
+	"metrics-addr":          true,
+	"enable-metrics":        true,
+}
+
+// configChecksum returns a checksum of the effective configuration, so replicas running divergent
+// configurations can be told apart. The DDL template is included by its content.
+func configChecksum() (string, error) {
+	h := sha256.New()
+	flag.VisitAll(func(f *flag.Flag) {
+		if !checksumExcludedFlags[f.Name] {
+			fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value.String())
+		}
+	})
+
+	if *ddlTemplate != "" {
+		content, err := os.ReadFile(*ddlTemplate)
+		if err != nil {
+			return "", fmt.Errorf("failed to read DDL template: %w", err)
+		}
+		h.Write(content)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// splitList splits a comma-separated flag value, ignoring empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func tailRows(ctx context.Context, c *hass.Client) {
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure pipeline")
+		return
+	}
+
+	pipeline := ingestion.NewPipeline(c, nil, *chDatabase, pipelineOpts...)
+
+	var recorder *ingestion.FixtureRecorder
+	if *recordFixtures != "" {
+		if recorder, err = ingestion.NewFixtureRecorder(*recordFixtures); err != nil {
+			log.Fatal().Err(err).Msg("Failed to record fixtures")
+			return
+		}
+	}
+
+	fmt.Printf("%-12s %-20s %-40s %-20s %s\n", "TIME", "TABLE", "ENTITY", "STATE", "DETAILS")
+
+	err = pipeline.Tail(ctx, func(row ingestion.Row) {
+		entityID := row.Event.Event.Data.EntityID
+		if ok, _ := path.Match(*tailEntity, entityID); !ok {
+			return
+		}
+		if ok, _ := path.Match(*tailTable, row.Table); !ok && row.Err == nil {
+			return
+		}
+
+		if recorder != nil {
+			if fixture, err := recorder.Record(row.Event); err != nil {
+				log.Error().Err(err).Str("entity_id", entityID).Msg("Failed to record fixture")
+			} else if fixture != "" {
+				log.Info().Str("path", fixture).Msg("Recorded fixture")
+			}
+		}
+
+		table, state, details := "-", "-", ""
+		switch input := row.Input.(type) {
+		case *ingestion.StateChange:
+			table = row.Table
+			state = fmt.Sprint(input.State)
+			details = fmt.Sprintf("old_state=%v", input.OldState)
+			if input.ValueDelta != nil {
+				details += fmt.Sprintf(" value_delta=%g", *input.ValueDelta)
+			}
+			if input.Cost != nil {
+				details += fmt.Sprintf(" cost=%g", *input.Cost)
+			}
+		case *ingestion.AttributeChange:
+			table = row.Table
+			details = fmt.Sprintf("changed_keys=%s", strings.Join(input.ChangedKeys, ","))
+		}
+
+		if row.Err != nil {
+			details = fmt.Sprintf("skipped: %s", row.Err)
+		}
+
+		fmt.Printf("%-12s %-20s %-40s %-20s %s\n", time.Now().Format("15:04:05.000"), table, entityID, state, details)
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to tail rows")
+	}
+}
+
+// clickhouseClient creates a ClickHouse client configured with flags, tagging queries with the command
+func clickhouseClient(command string) (*clickhouse.Client, error) {
+	// Create custom HTTP client with timeout
+	httpClient := &http.Client{
+		Timeout: *chTimeout,
+	}
+
+	if *chPassword == "" && os.Getenv("CLICKHOUSE_PASSWORD") != "" {
+		*chPassword = os.Getenv("CLICKHOUSE_PASSWORD")
+	}
+
+	options, err := clickhouseClientOptions(command)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create ClickHouse client with retry capabilities
+	chClient, err := clickhouse.NewClient(
+		*chUrl,
+		*chUsername,
+		*chPassword,
+		append(options,
+			clickhouse.WithHTTPClient(httpClient),
+			clickhouse.WithReadURL(*chReadURL),
+		)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Int("max_retries", *chMaxRetries).
+		Dur("initial_interval", *chInitialInterval).
+		Dur("max_interval", *chMaxInterval).
+		Msg("Configured ClickHouse client with retry capabilities")
+
+	return chClient, nil
+}
+
+// clickhouseClientOptions returns the options shared by the HTTP and native protocol clients
+func clickhouseClientOptions(command string) ([]clickhouse.ClientOption, error) {
+	options := []clickhouse.ClientOption{
+		clickhouse.WithRetryConfig(clickhouse.RetryConfig{
+			MaxRetries:          *chMaxRetries,
+			InitialInterval:     *chInitialInterval,
+			MaxInterval:         *chMaxInterval,
+			Multiplier:          2.0,
+			RandomizationFactor: 0.5,
+		}),
+		clickhouse.WithLogComment(map[string]string{
+			"application": "hass2ch",
+			"version":     version,
+			"command":     command,
+		}),
+	}
+
+	userAgent := *chUserAgent
+	if userAgent == "" {
+		userAgent = fmt.Sprintf("hass2ch/%s (%s; %s)", version, command, runtime.Version())
+	}
+	options = append(options, clickhouse.WithUserAgent(userAgent))
+
+	if *chSessionID != "" {
+		sessionID, err := expandInstance(*chSessionID)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, clickhouse.WithSessionID(sessionID))
+	}
+	if *chQuotaKey != "" {
+		quotaKey, err := expandInstance(*chQuotaKey)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, clickhouse.WithDefaultQuotaKey(quotaKey))
+	}
+
+	if *chHeaders != "" {
+		headers, err := clickhouse.ParseHeaders(*chHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ClickHouse headers: %w", err)
+		}
+		options = append(options, clickhouse.WithHeaders(headers))
+	}
+
+	compression, err := clickhouse.ParseCompression(*chCompression)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, clickhouse.WithCompression(compression))
+
+	if *chCAFile != "" || *chCertFile != "" || *chKeyFile != "" || *chInsecureTLS {
+		tlsConfig, err := clickhouse.NewTLSConfig(*chCAFile, *chCertFile, *chKeyFile, *chInsecureTLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ClickHouse TLS configuration: %w", err)
+		}
+		options = append(options, clickhouse.WithTLSConfig(tlsConfig))
+	}
+
+	return options, nil
+}
+
+// expandInstance replaces {hostname} in a value identifying the instance, e.g. a ClickHouse session ID,
+// with the hostname, which is the pod name on Kubernetes
+func expandInstance(value string) (string, error) {
+	if !strings.Contains(value, "{hostname}") {
+		return value, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+	return strings.ReplaceAll(value, "{hostname}", hostname), nil
+}
+
+// nativeSink inserts rows over the native protocol and sends read queries, e.g. of the grants check, over HTTP
+type nativeSink struct {
+	*clickhouse.NativeClient
+	http *clickhouse.Client
+}
+
+func (s nativeSink) Query(ctx context.Context, query string, fn func(row json.RawMessage) error, opts ...clickhouse.QueryOption) error {
+	return s.http.Query(ctx, query, fn, opts...)
+}
+
+// pipelineSink creates the ClickHouse client the pipeline inserts with, selected by --clickhouse-protocol
+func pipelineSink(ctx context.Context, command string) (ingestion.Sink, error) {
+	chClient, err := clickhouseClient(command)
+	if err != nil {
+		return nil, err
+	}
+
+	switch *chProtocol {
+	case "http":
+		return chClient, nil
+	case "native":
+	default:
+		return nil, fmt.Errorf("unknown ClickHouse protocol %q, expected http or native", *chProtocol)
+	}
+
+	options, err := clickhouseClientOptions(command)
+	if err != nil {
+		return nil, err
+	}
+
+	nativeClient, err := clickhouse.NewNativeClient(ctx, *chNativeAddr, *chUsername, *chPassword, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("addr", *chNativeAddr).Msg("Inserting into ClickHouse over the native protocol")
+	return nativeSink{NativeClient: nativeClient, http: chClient}, nil
+}
+
+// exportSchema prints the catalog of tables the pipeline would generate and the ones existing in ClickHouse as JSON
+func exportSchema(ctx context.Context) error {
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure pipeline: %w", err)
+	}
+
+	var sink ingestion.Sink
+	if !*schemaOffline {
+		chClient, err := clickhouseClient("schema")
+		if err != nil {
+			return fmt.Errorf("failed to create ClickHouse client: %w", err)
+		}
+		sink = chClient
+	}
+
+	catalog, err := ingestion.NewPipeline(nil, sink, *chDatabase, pipelineOpts...).Catalog(ctx)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(catalog)
+}
+
+// writeSchemaDocs writes Markdown or HTML documentation of the catalog of tables, with the attribute keys
+// found in samples of the existing state change tables
+func writeSchemaDocs(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("schema docs", flag.ContinueOnError)
+	format := flags.String("format", ingestion.SchemaDocsMarkdown, "Format of the documentation: markdown or html")
+	output := flags.String("output", "", "File the documentation is written to (default: stdout)")
+	sampleRows := flags.Int("sample-rows", 10_000, "Rows of every existing state change table sampled for attribute keys (0 disables)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure pipeline: %w", err)
+	}
+
+	var sink ingestion.Sink
+	if !*schemaOffline {
+		chClient, err := clickhouseClient("schema")
+		if err != nil {
+			return fmt.Errorf("failed to create ClickHouse client: %w", err)
+		}
+		sink = chClient
+	}
+
+	pipeline := ingestion.NewPipeline(nil, sink, *chDatabase, pipelineOpts...)
+	catalog, err := pipeline.Catalog(ctx)
+	if err != nil {
+		return err
+	}
+	if sink != nil && *sampleRows > 0 {
+		if err := pipeline.SampleAttributes(ctx, catalog, *sampleRows); err != nil {
+			return err
+		}
+	}
+
+	var docs bytes.Buffer
+	if err := ingestion.WriteSchemaDocs(&docs, catalog, *format); err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(docs.Bytes())
+		return err
+	}
+	return os.WriteFile(*output, docs.Bytes(), 0o644)
+}
+
+// runSandbox resolves recorded events, e.g. written by the dump command, with the configuration and prints
+// the tables they would be stored in, failing if there are more than --max-tables
+func runSandbox(args []string) error {
+	flags := flag.NewFlagSet("sandbox", flag.ContinueOnError)
+	eventsFile := flags.String("events", "", "File of recorded events, e.g. the output of the dump command, or - for stdin")
+	maxTables := flags.Int("max-tables", 0, "Fail if the events would be stored in more tables (0 disables)")
+	asJSON := flags.Bool("json", false, "Print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *eventsFile == "" {
+		return errors.New("--events is required")
+	}
+
+	var r io.Reader = os.Stdin
+	if *eventsFile != "-" {
+		f, err := os.Open(*eventsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	events, err := ingestion.ReadEvents(r)
+	if err != nil {
+		return err
+	}
+
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure pipeline: %w", err)
+	}
+
+	report, err := ingestion.NewPipeline(nil, nil, *chDatabase, pipelineOpts...).Sandbox(events)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tSTATE TYPE\tROWS\tOVERFLOW\tENTITIES\tGENERATED")
+		for _, table := range report.Tables {
+			fmt.Fprintf(w, "%s.%s\t%s\t%d\t%d\t%d\t%t\n",
+				table.Database, table.Table, table.StateType, table.Rows, table.Overflow, table.Entities, table.Generated)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		errs := make([]string, 0, len(report.Errors))
+		for message := range report.Errors {
+			errs = append(errs, message)
+		}
+		sort.Strings(errs)
+		for _, message := range errs {
+			fmt.Printf("skipped %d events: %s\n", report.Errors[message], message)
+		}
+		fmt.Println(report)
+	}
+
+	if *maxTables > 0 && len(report.Tables) > *maxTables {
+		return fmt.Errorf("events would be stored in %d tables, more than %d", len(report.Tables), *maxTables)
+	}
+	return nil
+}
+
+// runReplay replays a recording of the pipeline command with the configuration and compares the rows and DDL
+// with the recorded ones, failing if they differ
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	recording := flags.String("recording", "", "Directory of the recording, written with --record-traffic")
+	asJSON := flags.Bool("json", false, "Print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *recording == "" {
+		return errors.New("--recording is required")
+	}
+
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure pipeline: %w", err)
+	}
+
+	report, err := ingestion.NewPipeline(nil, nil, *chDatabase, pipelineOpts...).VerifyRecording(context.Background(), *recording)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tRECORDED\tREPLAYED\tMISSING\tUNEXPECTED\tDDL")
+		for _, table := range report.Tables {
+			ddl := "same"
+			if len(table.MissingDDL) > 0 || len(table.UnexpectedDDL) > 0 {
+				ddl = "differs"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n",
+				table.Table, table.RecordedRows, table.ReplayedRows, table.MissingRows, table.UnexpectedRows, ddl)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		for _, table := range report.Tables {
+			for _, statement := range table.MissingDDL {
+				fmt.Printf("\n- %s\n", statement)
+			}
+			for _, statement := range table.UnexpectedDDL {
+				fmt.Printf("\n+ %s\n", statement)
+			}
+			for _, row := range table.MissingSamples {
+				fmt.Printf("- %s %s\n", table.Table, row)
+			}
+			for _, row := range table.UnexpectedSamples {
+				fmt.Printf("+ %s %s\n", table.Table, row)
+			}
+		}
+		if len(report.Skipped) > 0 {
+			fmt.Printf("skipped tables not written by the ingestion of state changes: %s\n", strings.Join(report.Skipped, ", "))
+		}
+	}
+
+	if !report.Matches() {
+		return errors.New("the replay differs from the recording")
+	}
+	return nil
+}
+
+// tuneCodecs benchmarks compression codecs of existing tables and prints the report
+//
+//nolint:gocyclo
+func tuneCodecs(ctx context.Context) error {
+	chClient, err := clickhouseClient("tune")
+	if err != nil {
+		return fmt.Errorf("failed to create ClickHouse client: %w", err)
+	}
+
+	opts := ingestion.TuneOptions{SampleRows: *tuneSampleRows}
+	for _, table := range strings.Split(*tuneTables, ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			opts.Tables = append(opts.Tables, table)
+		}
+	}
+	for _, orderBy := range strings.Split(*tuneOrderBy, ";") {
+		if orderBy = strings.TrimSpace(orderBy); orderBy != "" {
+			opts.OrderBys = append(opts.OrderBys, orderBy)
+		}
+	}
+
+	report, err := ingestion.NewPipeline(nil, chClient, *chDatabase).Tune(ctx, opts)
+	if err != nil {
+		return err
+	}
 
-	// Home Assistant connection
-	host   = flag.String("host", "homeassistant.local", "Home Assistant host")
-	secure = flag.Bool("secure", false, "Use secure connection")
+	if *tuneJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
 
-	// ClickHouse connection
-	chUrl      = flag.String("clickhouse-url", "http://localhost:8123", "ClickHouse HTTP URL")
-	chDatabase = flag.String("clickhouse-database", "hass", "ClickHouse database")
-	chUsername = flag.String("clickhouse-username", "default", "ClickHouse username")
-	chPassword = flag.String("clickhouse-password", "", "ClickHouse password. It can also be set via CLICKHOUSE_PASSWORD environment variable")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, table := range report.Tables {
+		fmt.Fprintf(w, "%s.%s\t%d rows, %d sampled\t%s -> %s\n", table.Database, table.Name, table.Rows, table.SampledRows,
+			formatBytes(table.CompressedBytes), formatBytes(table.EstimatedBytes))
+		for _, column := range table.Columns {
+			suggestion := "keep"
+			if column.BestCodec != "" {
+				suggestion = fmt.Sprintf("CODEC(%s), %s -> %s", column.BestCodec, formatBytes(column.CompressedBytes), formatBytes(column.EstimatedBytes))
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", column.Name, column.Type, column.Codec, suggestion)
+		}
+		var sample uint64
+		for _, column := range table.Columns {
+			sample += column.SampleBytes
+		}
+		for _, ordering := range table.Orderings {
+			fmt.Fprintf(w, "  ORDER BY %s\tsample %s (current %s %s)\t\t\n", ordering.OrderBy, formatBytes(ordering.SampleBytes), table.OrderBy, formatBytes(sample))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
 
-	// ClickHouse retry settings
-	chMaxRetries      = flag.Int("clickhouse-max-retries", 5, "Maximum number of retries for ClickHouse operations")
-	chInitialInterval = flag.Duration("clickhouse-initial-interval", 500*time.Millisecond, "Initial retry interval for ClickHouse operations")
-	chMaxInterval     = flag.Duration("clickhouse-max-interval", 30*time.Second, "Maximum retry interval for ClickHouse operations")
-	chTimeout         = flag.Duration("clickhouse-timeout", 60*time.Second, "Timeout for ClickHouse operations")
+	fmt.Println()
+	fmt.Println("-- Suggested codecs apply to new parts; run OPTIMIZE TABLE ... FINAL to recompress existing data")
+	for _, table := range report.Tables {
+		for _, alter := range table.Alters {
+			fmt.Println(alter + ";")
+		}
+	}
 
-	// Metrics server
-	metricsAddr   = flag.String("metrics-addr", ":9090", "Address to expose Prometheus metrics on")
-	enableMetrics = flag.Bool("enable-metrics", true, "Enable Prometheus metrics server")
-)
+	return nil
+}
 
-func hassClient(ctx context.Context) (*hass.Client, error) {
-	schema := "ws"
-	if *secure {
-		schema = "wss"
+// reconcileOrphans prints the tables of the databases of the pipeline not produced by the configuration
+// and drops or archives them with --prune-orphans after confirmation
+func reconcileOrphans(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("orphans", flag.ContinueOnError)
+	prune := flags.Bool("prune-orphans", false, "Drop the orphaned tables, or move them into --archive-database")
+	archiveDatabase := flags.String("archive-database", "", "Database orphaned tables are moved into instead of being dropped")
+	yes := flags.Bool("yes", false, "Prune without asking for confirmation")
+	if err := flags.Parse(args); err != nil {
+		return err
 	}
 
-	url := fmt.Sprintf("%s://%s", schema, *host)
+	chClient, err := clickhouseClient("orphans")
+	if err != nil {
+		return fmt.Errorf("failed to create ClickHouse client: %w", err)
+	}
 
-	token := os.Getenv("HASS_TOKEN")
-	if token == "" {
-		return nil, fmt.Errorf("HASS_TOKEN environment variable not set")
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure pipeline: %w", err)
 	}
 
-	// Create client with reconnection settings
-	c := hass.NewClient(
-		url,
-		token,
-		hass.WithReconnectConfig(
-			1*time.Second,  // Initial reconnect interval
-			30*time.Second, // Max reconnect interval
-			1.5,            // Backoff multiplier
-		),
-	)
+	pipeline := ingestion.NewPipeline(nil, chClient, *chDatabase, pipelineOpts...)
+	orphans, err := pipeline.FindOrphans(ctx)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		fmt.Println("no orphaned tables")
+		return nil
+	}
 
-	if err := c.Connect(ctx); err != nil {
-		return nil, err
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tENGINE\tROWS\tSIZE")
+	for _, orphan := range orphans {
+		fmt.Fprintf(w, "%s.%s\t%s\t%d\t%s\n", orphan.Database, orphan.Name, orphan.Engine, orphan.TotalRows, formatBytes(orphan.TotalBytes))
+	}
+	if err := w.Flush(); err != nil {
+		return err
 	}
 
-	return c, c.WaitAuthenticated(ctx)
+	if !*prune {
+		return nil
+	}
+
+	if !*yes {
+		action := "Drop"
+		if *archiveDatabase != "" {
+			action = "Move into " + *archiveDatabase
+		}
+		fmt.Printf("%s %d tables? Type yes to confirm: ", action, len(orphans))
+		var answer string
+		if _, err := fmt.Scanln(&answer); err != nil || answer != "yes" {
+			return errors.New("pruning not confirmed")
+		}
+	}
+
+	return pipeline.PruneOrphans(ctx, orphans, *archiveDatabase)
 }
 
-func dumpEvents(ctx context.Context, c *hass.Client) {
-	cv, err := c.SubscribeEvents(ctx)
+// checkOrder scans the tables of state changes for rows inserted out of order and prints them per table
+// and entity, failing if there are any
+func checkOrder(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("check-order", flag.ContinueOnError)
+	since := flags.Duration("since", 0, "Check the rows received in this period only, e.g. 24h (0 checks all rows)")
+	tables := flags.String("table", "", "Comma-separated glob patterns of the checked tables (default: all)")
+	maxEntities := flags.Int("entities", 10, "Number of entities with most out-of-order rows printed per table")
+	asJSON := flags.Bool("json", false, "Print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
 
+	chClient, err := clickhouseClient("check-order")
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to subscribe to events")
-		return
+		return fmt.Errorf("failed to create ClickHouse client: %w", err)
 	}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case event := <-cv:
-				log.Info().
-					Str("event_type", string(event.Event.EventType)).
-					Str("entity_id", event.Event.Data.EntityID).
-					Msg("Event received")
-				// Print the full event structure as JSON for debugging
-				if jsonData, err := json.MarshalIndent(event, "", "  "); err == nil {
-					fmt.Println(string(jsonData))
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure pipeline: %w", err)
+	}
+
+	opts := ingestion.OrderCheckOptions{Tables: splitList(*tables)}
+	if *since > 0 {
+		opts.Since = time.Now().Add(-*since)
+	}
+	report, err := ingestion.NewPipeline(nil, chClient, *chDatabase, pipelineOpts...).CheckOrder(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	var outOfOrder uint64
+	for _, table := range report {
+		outOfOrder += table.OutOfOrder
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tROWS\tOUT OF ORDER\tENTITIES")
+		for _, table := range report {
+			fmt.Fprintf(w, "%s.%s\t%d\t%d\t%d\n", table.Database, table.Table, table.Rows, table.OutOfOrder, len(table.Entities))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if outOfOrder > 0 {
+			fmt.Println()
+			w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TABLE\tENTITY\tOUT OF ORDER\tMAX LAG")
+			for _, table := range report {
+				for _, entity := range table.Entities[:min(len(table.Entities), *maxEntities)] {
+					fmt.Fprintf(w, "%s.%s\t%s\t%d\t%s\n", table.Database, table.Table, entity.EntityID, entity.OutOfOrder, entity.MaxLag)
 				}
 			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
 		}
-	}()
+	}
+
+	if outOfOrder > 0 {
+		return fmt.Errorf("found %d rows inserted out of order", outOfOrder)
+	}
+	return nil
+}
+
+// migrateSchema diffs the existing tables against the generated schema, applies the safe changes
+// and fails if incompatible differences are left
+func migrateSchema(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Print the changes without applying them")
+	asJSON := flags.Bool("json", false, "Print the changes as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	chClient, err := clickhouseClient("migrate")
+	if err != nil {
+		return fmt.Errorf("failed to create ClickHouse client: %w", err)
+	}
+
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure pipeline: %w", err)
+	}
+
+	pipeline := ingestion.NewPipeline(nil, chClient, *chDatabase, pipelineOpts...)
+	changes, err := pipeline.PlanMigration(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(changes); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tCOLUMN\tCHANGE\tSTATEMENT")
+		for _, change := range changes {
+			statement := change.Statement
+			if !change.Safe() {
+				statement = change.Detail
+			}
+			fmt.Fprintf(w, "%s.%s\t%s\t%s\t%s\n", change.Database, change.Table, change.Column, change.Kind, statement)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if !*dryRun {
+		applied, err := pipeline.Migrate(ctx, changes)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("applied", applied).Msg("applied safe schema changes")
+	}
+
+	incompatible := 0
+	for _, change := range changes {
+		if !change.Safe() {
+			incompatible++
+		}
+	}
+	if incompatible > 0 {
+		return fmt.Errorf("%d incompatible schema differences must be resolved manually", incompatible)
+	}
+	return nil
+}
+
+// retryDeadLetters runs the dlq retry command, reprocessing dead letters of the dead letter tables with the
+// configured pipeline and printing the outcome per table
+func retryDeadLetters(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "retry" {
+		return fmt.Errorf("unknown dlq command, expected: dlq retry")
+	}
+
+	flags := flag.NewFlagSet("dlq retry", flag.ContinueOnError)
+	progress := flags.String("progress", "", "File recording the dead letters recovered so far, so an interrupted retry can be resumed")
+	resume := flags.Bool("resume", false, "Resume the interrupted retry recorded in the --progress file")
+	from := flags.String("from", "", "Retry dead letters failed at or after this time, e.g. 2024-01-31 or 2024-01-31T12:00:00Z")
+	to := flags.String("to", "", "Retry dead letters failed before this time")
+	entities := flags.String("entity", "", "Comma-separated glob patterns of the entity IDs of the retried rows (default: all)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *resume && *progress == "" {
+		return fmt.Errorf("--resume requires --progress")
+	}
+
+	opts := ingestion.DeadLetterRetryOptions{
+		Tables:   splitList(*dlqTables),
+		Limit:    *dlqLimit,
+		DryRun:   *dlqDryRun,
+		Progress: *progress,
+		Resume:   *resume,
+		Entities: splitList(*entities),
+	}
+	var err error
+	if *from != "" {
+		if opts.From, err = parseTime(*from); err != nil {
+			return err
+		}
+	}
+	if *to != "" {
+		if opts.To, err = parseTime(*to); err != nil {
+			return err
+		}
+	}
+
+	chClient, err := clickhouseClient("dlq")
+	if err != nil {
+		return fmt.Errorf("failed to create ClickHouse client: %w", err)
+	}
+
+	// Dead letters are reprocessed with the configured row models, labels and strict mode
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure pipeline: %w", err)
+	}
+
+	report, err := ingestion.NewPipeline(nil, chClient, *chDatabase, pipelineOpts...).RetryDeadLetters(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	tables := make([]string, 0, len(report.Tables))
+	for table := range report.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tRETRIED\tRECOVERED\tFAILED\tLAST ERROR")
+	for _, name := range tables {
+		table := report.Tables[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", name, table.Retried, table.Recovered, table.Failed, table.LastError)
+	}
+	return w.Flush()
+}
+
+// formatBytes formats a number of bytes in binary units
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// timeLayouts are the layouts of times accepted by the backfill command, in the local time zone without an offset
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// parseTime parses a time in one of timeLayouts
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected e.g. 2024-01-31 or 2024-01-31T12:00:00Z", s)
+}
+
+// backfill inserts the history recorded by Home Assistant in the period given by the command's flags
+func backfill(ctx context.Context, c *hass.Client, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	from := flags.String("from", "", "Start of the backfilled period, e.g. 2024-01-31 or 2024-01-31T12:00:00Z (required)")
+	to := flags.String("to", "", "End of the backfilled period (default: now)")
+	entities := flags.String("entity", "", "Comma-separated glob patterns of the backfilled entity IDs (default: all)")
+	window := flags.Duration("window", time.Hour, "Period of history read from Home Assistant at once")
+	concurrency := flags.Int("concurrency", 1, "Number of windows of history read from Home Assistant at the same time")
+	rate := flags.Float64("rate", 0, "Maximum requests of history sent to Home Assistant per second (default: unlimited)")
+	checkpoint := flags.String("checkpoint", "", "Local file storing the progress of the backfill, to resume it after an interruption (there is no state store yet)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == "" {
+		return fmt.Errorf("--from is required")
+	}
+	opts := ingestion.BackfillOptions{
+		Entities:    splitList(*entities),
+		Window:      *window,
+		Concurrency: *concurrency,
+		RequestRate: *rate,
+		Checkpoint:  *checkpoint,
+	}
+	var err error
+	if opts.From, err = parseTime(*from); err != nil {
+		return err
+	}
+	if *to != "" {
+		if opts.To, err = parseTime(*to); err != nil {
+			return err
+		}
+	}
+
+	chClient, err := pipelineSink(ctx, "backfill")
+	if err != nil {
+		return fmt.Errorf("failed to create ClickHouse client: %w", err)
+	}
+
+	pipelineOpts, err := pipelineOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure pipeline: %w", err)
+	}
+
+	report, err := ingestion.NewPipeline(c, chClient, *chDatabase, pipelineOpts...).Backfill(ctx, opts)
+	if report != nil {
+		if report.ResumedFrom != nil {
+			log.Info().Time("resumed_from", *report.ResumedFrom).Msg("Resumed backfill from checkpoint")
+		}
+		log.Info().
+			Int("entities", report.Entities).
+			Int("windows", report.Windows).
+			Int("state_changes", report.StateChanges).
+			Int("failed_batches", report.FailedBatches).
+			Msg("Backfill finished")
+	}
+	if err != nil {
+		return err
+	}
+	if report.FailedBatches > 0 {
+		return fmt.Errorf("%d batches failed to be inserted", report.FailedBatches)
+	}
+	return nil
 }
 
-//nolint:gocyclo
 func main() {
 	flag.Parse()
 	args := flag.Args()
 
+	// The configuration may set the log level, so it is applied before the logger is configured
+	configErr := applyConfig(flag.CommandLine, *configFile)
+
 	ll, err := zerolog.ParseLevel(*logLevel)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to parse log level")
 	}
 
+	// The level is set globally, so it can be changed at runtime by /admin/loglevel and SIGUSR2
+	zerolog.SetGlobalLevel(ll)
 	if *prettyLog {
 		// Use console writer for pretty output
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).Level(ll)
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	} else {
 		// Use JSON logging by default
 		zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger().Level(ll)
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	}
+
+	if configErr != nil {
+		log.Fatal().Err(configErr).Msg("Failed to apply configuration")
 	}
 
 	if len(args) == 0 || args[0] == "help" {
@@ -126,18 +1717,150 @@ func main() {
 		fmt.Println()
 		fmt.Println("Commands:")
 		fmt.Println("  help     Show this help message")
+		fmt.Println("  auth     Obtain a Home Assistant refresh token via the OAuth2 login flow")
 		fmt.Println("  dump     Dump events to stdout")
+		fmt.Println("  tail     Print transformed rows and their destination tables without inserting them")
+		fmt.Println("  schema   Export the catalog of tables and columns as JSON")
+		fmt.Println("  schema docs Write Markdown or HTML documentation of the tables: schema docs [--format html] [--output schema.html] [--sample-rows 10000]")
+		fmt.Println("  dlq retry Reprocess rows of the dead_letter table and delete the recovered ones: dlq retry [--from ...] [--to ...] [--entity 'sensor.*'] [--progress dlq.json] [--resume]")
+		fmt.Println("  replay-dlq Same as dlq retry")
+		fmt.Println("  orphans  List tables not produced by the configuration and drop or archive them: orphans [--prune-orphans] [--archive-database archive] [--yes]")
+		fmt.Println("  migrate  Apply safe schema changes (new columns, TTL, comments) to existing tables and report incompatible ones: migrate [--dry-run] [--json]")
+		fmt.Println("  check-order Report rows of entities inserted out of last_updated order: check-order [--since 24h] [--table 'sensor*'] [--entities 10] [--json]")
+		fmt.Println("  tune     Benchmark compression codecs on samples of existing tables and suggest ALTERs")
+		fmt.Println("  backfill Insert the history recorded by Home Assistant: backfill --from 2024-01-01 [--to ...] [--entity 'sensor.*'] [--window 1h] [--concurrency 1] [--rate 2] [--checkpoint backfill.json]")
+		fmt.Println("  replay   Replay a recording of --record-traffic with the configuration and compare the rows and DDL: replay --recording ./recording [--json]")
+		fmt.Println("  sandbox  Report the tables a recorded sample of events would be stored in with the configuration: sandbox --events events.json [--max-tables 50] [--json]")
+		fmt.Println("  validate-config Check the configuration file, environment variables and flags without connecting anywhere")
+		fmt.Println("  self-update Replace the binary with the latest GitHub release: self-update [--check] [--version 1.4.0] [--public-key cosign.pub]")
 		fmt.Println("  pipeline Run the ingestion pipeline (Home Assistant to ClickHouse)")
 		return
 	}
 
+	// The profile is applied before any command, including the ones that do not connect anywhere
+	if *profile != "" {
+		if err := applyProfile(*profile); err != nil {
+			log.Fatal().Err(err).Msg("Failed to apply profile")
+		}
+	}
+
+	if args[0] == "validate-config" {
+		if err := validateConfig(); err != nil {
+			log.Fatal().Err(err).Msg("Invalid configuration")
+		}
+		fmt.Println("configuration is valid")
+		return
+	}
+
+	if args[0] == "sandbox" {
+		if err := runSandbox(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("Sandbox run failed")
+		}
+		return
+	}
+
+	if args[0] == "replay" {
+		if err := runReplay(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("Replay failed")
+		}
+		return
+	}
+
+	if args[0] == "self-update" {
+		if err := selfUpdate(context.Background(), args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("Failed to update hass2ch")
+		}
+		return
+	}
+
+	if err := applyRuntimeLimits(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure runtime")
+	}
+
+	checksum, err := configChecksum()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to compute configuration checksum")
+	}
+	metrics.ConfigInfo.WithLabelValues(checksum, version).Set(1)
+
+	log.Info().Str("version", version).Str("commit", commit).Str("date", date).Str("command", args[0]).Str("config_checksum", checksum).Msg("Starting hass2ch")
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
+	toggleDebugOnSignal(ctx, ll)
+
+	if *discover && !isFlagSet("host") {
+		if err := discoverHost(ctx); err != nil {
+			log.Fatal().Err(err).Msg("Failed to discover Home Assistant")
+		}
+	}
+
+	if args[0] == "auth" {
+		if err := authorize(ctx); err != nil {
+			log.Fatal().Err(err).Msg("Failed to authorize with Home Assistant")
+		}
+		return
+	}
+
+	if args[0] == "schema" && len(args) > 1 && args[1] == "docs" {
+		if err := writeSchemaDocs(ctx, args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate schema documentation")
+		}
+		return
+	}
+
+	if args[0] == "schema" {
+		if err := exportSchema(ctx); err != nil {
+			log.Fatal().Err(err).Msg("Failed to export schema")
+		}
+		return
+	}
+
+	if args[0] == "dlq" || args[0] == "replay-dlq" {
+		dlqArgs := args[1:]
+		// replay-dlq is a shorthand of dlq retry
+		if args[0] == "replay-dlq" {
+			dlqArgs = append([]string{"retry"}, dlqArgs...)
+		}
+		if err := retryDeadLetters(ctx, dlqArgs); err != nil {
+			log.Fatal().Err(err).Msg("Failed to retry dead letters")
+		}
+		return
+	}
+
+	if args[0] == "orphans" {
+		if err := reconcileOrphans(ctx, args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("Failed to reconcile orphaned tables")
+		}
+		return
+	}
+
+	if args[0] == "check-order" {
+		if err := checkOrder(ctx, args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("Failed to check the order of rows")
+		}
+		return
+	}
+
+	if args[0] == "migrate" {
+		if err := migrateSchema(ctx, args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("Failed to migrate schema")
+		}
+		return
+	}
+
+	if args[0] == "tune" {
+		if err := tuneCodecs(ctx); err != nil {
+			log.Fatal().Err(err).Msg("Failed to benchmark compression codecs")
+		}
+		return
+	}
 
 	// Start metrics server if enabled
 	var metricsServer *metrics.Server
 	if *enableMetrics {
 		metricsServer = metrics.NewServer(*metricsAddr)
+		metricsServer.EnableLogLevelEndpoint(*adminToken)
 		go func() {
 			if err := metricsServer.Start(); err != nil {
 				log.Error().Err(err).Msg("Failed to start metrics server")
@@ -155,49 +1878,53 @@ func main() {
 	switch args[0] {
 	case "dump":
 		dumpEvents(ctx, c)
-	case "pipeline":
-		// Create custom HTTP client with timeout
-		httpClient := &http.Client{
-			Timeout: *chTimeout,
-		}
-
-		// Configure retry settings
-		retryConfig := clickhouse.RetryConfig{
-			MaxRetries:          *chMaxRetries,
-			InitialInterval:     *chInitialInterval,
-			MaxInterval:         *chMaxInterval,
-			Multiplier:          2.0,
-			RandomizationFactor: 0.5,
+	case "tail":
+		tailRows(ctx, c)
+	case "backfill":
+		if err := backfill(ctx, c, args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("Failed to backfill history")
 		}
-
-		if *chPassword == "" && os.Getenv("CLICKHOUSE_PASSWORD") != "" {
-			*chPassword = os.Getenv("CLICKHOUSE_PASSWORD")
+		cancel()
+	case "pipeline":
+		chClient, err := pipelineSink(ctx, args[0])
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create ClickHouse client")
+			return
 		}
 
-		// Create ClickHouse client with retry capabilities
-		chClient, err := clickhouse.NewClient(
-			*chUrl,
-			*chUsername,
-			*chPassword,
-			clickhouse.WithHTTPClient(httpClient),
-			clickhouse.WithRetryConfig(retryConfig),
-		)
+		pipelineOpts, err := pipelineOptions()
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to create ClickHouse client")
+			log.Fatal().Err(err).Msg("Failed to configure pipeline")
 			return
 		}
 
-		log.Info().
-			Int("max_retries", *chMaxRetries).
-			Dur("initial_interval", *chInitialInterval).
-			Dur("max_interval", *chMaxInterval).
-			Msg("Configured ClickHouse client with retry capabilities")
+		var recorder *ingestion.TrafficRecorder
+		if *recordTraffic != "" {
+			recorder, err = ingestion.NewTrafficRecorder(*recordTraffic)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to record traffic")
+				return
+			}
+			defer recorder.Close()
+			pipelineOpts = append(pipelineOpts, ingestion.WithTrafficRecorder(recorder))
+			log.Info().Str("dir", *recordTraffic).Msg("Recording traffic")
+		}
 
 		// Create and run the pipeline
-		pipeline := ingestion.NewPipeline(chClient, c, *chDatabase)
+		pipeline := ingestion.NewPipeline(c, chClient, *chDatabase, pipelineOpts...)
+		if metricsServer != nil {
+			metricsServer.SetReadinessCheck(pipeline.Ready)
+		}
+		dumpStateOnSignal(ctx, c, pipeline)
 		log.Info().Str("database", *chDatabase).Msg("Starting ingestion pipeline")
 
 		if err := pipeline.Run(ctx); err != nil {
+			// log.Fatal exits without running deferred calls, so the recording is closed first
+			if recorder != nil {
+				if err := recorder.Close(); err != nil {
+					log.Error().Err(err).Msg("Failed to close traffic recording")
+				}
+			}
 			log.Fatal().Err(err).Msg("Pipeline failed")
 			return
 		}
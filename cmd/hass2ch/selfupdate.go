@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	releasesURL = "https://api.github.com/repos/jkaflik/hass2ch/releases"
+
+	// maxReleaseAssetSize limits the size of downloaded release assets
+	maxReleaseAssetSize = 256 << 20
+)
+
+// updatePublicKey is the ECDSA public key verifying signatures of release checksums, PEM-encoded or as the
+// base64 of its PEM body, set at build time with -ldflags "-X main.updatePublicKey=..."
+var updatePublicKey string
+
+// release is a GitHub release
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+// releaseAsset is a file attached to a GitHub release
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// selfUpdate replaces the running binary with the one of the latest (or a given) GitHub release,
+// after verifying the signature of the release checksums and the checksum of its archive
+func selfUpdate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	check := fs.Bool("check", false, "Only report whether a newer release is available")
+	target := fs.String("version", "", "Release to install, e.g. 1.4.0 (default: the latest release)")
+	publicKey := fs.String("public-key", "", "PEM file of the ECDSA public key verifying the signature of release checksums (default: the key compiled into release builds)")
+	force := fs.Bool("force", false, "Install the release even if it is the running version or the running version is a development build")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Without a key the release could only be checked against checksums served next to it, which does not
+	// protect from a tampered release
+	keyPEM := []byte(updatePublicKey)
+	if *publicKey != "" {
+		var err error
+		if keyPEM, err = os.ReadFile(*publicKey); err != nil {
+			return fmt.Errorf("failed to read public key: %w", err)
+		}
+	}
+	if len(keyPEM) == 0 && !*check {
+		return errors.New("no public key to verify the release with, pass --public-key")
+	}
+
+	rel, err := fetchRelease(ctx, *target)
+	if err != nil {
+		return err
+	}
+
+	latest := strings.TrimPrefix(rel.TagName, "v")
+	current := strings.TrimPrefix(version, "v")
+	if *check {
+		if latest == current {
+			fmt.Printf("hass2ch %s is up to date\n", current)
+		} else {
+			fmt.Printf("hass2ch %s is available (running %s)\n", latest, current)
+		}
+		return nil
+	}
+	if !*force {
+		if latest == current {
+			fmt.Printf("hass2ch %s is up to date\n", current)
+			return nil
+		}
+		if version == "dev" {
+			return errors.New("refusing to replace a development build, use --force")
+		}
+	}
+
+	binary, err := downloadRelease(ctx, rel, latest, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	path, err := replaceExecutable(binary)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("updated %s from %s to %s\n", path, current, latest)
+	return nil
+}
+
+// downloadRelease downloads the archive of the running platform and returns its binary, once the signature of
+// the release checksums and the checksum of the archive are verified
+func downloadRelease(ctx context.Context, rel *release, version string, keyPEM []byte) ([]byte, error) {
+	archiveName := fmt.Sprintf("hass2ch_%s_%s_%s%s.tar.gz", version, runtime.GOOS, runtime.GOARCH, armVersion())
+	checksumsName := fmt.Sprintf("hass2ch_%s_checksums.txt", version)
+
+	checksums, err := downloadAsset(ctx, rel, checksumsName)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := downloadAsset(ctx, rel, checksumsName+".sig")
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(keyPEM, checksums, signature); err != nil {
+		return nil, fmt.Errorf("invalid signature of %s: %w", checksumsName, err)
+	}
+	log.Info().Str("release", version).Msg("verified signature of release checksums")
+
+	archive, err := downloadAsset(ctx, rel, archiveName)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(checksums, archiveName, archive); err != nil {
+		return nil, err
+	}
+
+	binary, err := extractBinary(archive, "hass2ch")
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract %s: %w", archiveName, err)
+	}
+	return binary, nil
+}
+
+// fetchRelease returns the release of the given version, or the latest one if empty
+func fetchRelease(ctx context.Context, version string) (*release, error) {
+	url := releasesURL + "/latest"
+	if version != "" {
+		url = releasesURL + "/tags/v" + strings.TrimPrefix(version, "v")
+	}
+
+	body, err := httpGet(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch release: %w", err)
+	}
+
+	var rel release
+	if err := json.Unmarshal(body, &rel); err != nil {
+		return nil, fmt.Errorf("failed to parse release: %w", err)
+	}
+	return &rel, nil
+}
+
+// downloadAsset downloads a file attached to the release
+func downloadAsset(ctx context.Context, rel *release, name string) ([]byte, error) {
+	for _, asset := range rel.Assets {
+		if asset.Name == name {
+			body, err := httpGet(ctx, asset.URL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to download %s: %w", name, err)
+			}
+			return body, nil
+		}
+	}
+	return nil, fmt.Errorf("release %s has no asset %s, the platform may not be supported", rel.TagName, name)
+}
+
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "hass2ch/"+version)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxReleaseAssetSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxReleaseAssetSize {
+		return nil, fmt.Errorf("response exceeds %d bytes", maxReleaseAssetSize)
+	}
+	return body, nil
+}
+
+// armVersion returns the suffix of release archives built for a version of 32-bit ARM, e.g. v7
+func armVersion() string {
+	if runtime.GOARCH != "arm" {
+		return ""
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "GOARM" {
+				return "v" + setting.Value
+			}
+		}
+	}
+	return "v7"
+}
+
+// verifySignature verifies a base64-encoded ASN.1 ECDSA signature of the SHA-256 of the data,
+// as made by cosign sign-blob
+func verifySignature(keyPEM, data, signature []byte) error {
+	der, err := decodePublicKey(keyPEM)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("public key is not an ECDSA key")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+
+	digest := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(ecdsaKey, digest[:], sig) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// decodePublicKey returns the DER of a PEM-encoded public key, or of the base64 of its PEM body,
+// as a key passed through -ldflags has to be a single word
+func decodePublicKey(keyPEM []byte) ([]byte, error) {
+	if block, _ := pem.Decode(keyPEM); block != nil {
+		return block.Bytes, nil
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyPEM)))
+	if err != nil {
+		return nil, errors.New("public key is neither PEM nor base64")
+	}
+	return der, nil
+}
+
+// verifyChecksum checks the SHA-256 of a file against its line of a checksums file in the sha256sum format
+func verifyChecksum(checksums []byte, name string, data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[1] != name {
+			continue
+		}
+
+		sum := sha256.Sum256(data)
+		if actual := hex.EncodeToString(sum[:]); actual != fields[0] {
+			return fmt.Errorf("checksum mismatch of %s: expected %s, got %s", name, fields[0], actual)
+		}
+		return nil
+	}
+	return fmt.Errorf("no checksum of %s", name)
+}
+
+// extractBinary returns the content of a file of a gzip-compressed tar archive
+func extractBinary(archive []byte, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("no %s in archive", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg && filepath.Base(header.Name) == name {
+			return io.ReadAll(io.LimitReader(tr, maxReleaseAssetSize))
+		}
+	}
+}
+
+// replaceExecutable atomically replaces the running executable, keeping its permissions, and returns its path
+func replaceExecutable(binary []byte) (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate executable: %w", err)
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	// The new binary is written next to the old one, so it can be renamed over it
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".hass2ch-update-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to write new executable: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(binary); err != nil {
+		_ = tmp.Close()
+		return "", fmt.Errorf("failed to write new executable: %w", err)
+	}
+	// Synced before the rename, so a crash cannot leave a truncated executable in place of the old one
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return "", fmt.Errorf("failed to write new executable: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write new executable: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to replace executable: %w", err)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRelease serves the assets of a release signed with a generated key
+type testRelease struct {
+	key    *ecdsa.PrivateKey
+	keyPEM []byte
+	assets map[string][]byte
+}
+
+func newTestRelease(t *testing.T, version string, binary []byte) *testRelease {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	archiveName := fmt.Sprintf("hass2ch_%s_%s_%s%s.tar.gz", version, runtime.GOOS, runtime.GOARCH, armVersion())
+	checksumsName := fmt.Sprintf("hass2ch_%s_checksums.txt", version)
+
+	archive := tarGz(t, map[string][]byte{"README.md": []byte("# hass2ch"), "hass2ch": binary})
+	sum := sha256.Sum256(archive)
+	checksums := []byte(fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), archiveName))
+
+	r := &testRelease{
+		key:    key,
+		keyPEM: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		assets: map[string][]byte{
+			archiveName:   archive,
+			checksumsName: checksums,
+		},
+	}
+	r.assets[checksumsName+".sig"] = r.sign(t, checksums)
+	return r
+}
+
+func (r *testRelease) sign(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, r.key, digest[:])
+	require.NoError(t, err)
+	return []byte(base64.StdEncoding.EncodeToString(sig))
+}
+
+// serve starts a server of the assets and returns the release listing them
+func (r *testRelease) serve(t *testing.T, version string) *release {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		asset, ok := r.assets[req.URL.Path[1:]]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		_, _ = w.Write(asset)
+	}))
+	t.Cleanup(server.Close)
+
+	rel := &release{TagName: "v" + version}
+	for name := range r.assets {
+		rel.Assets = append(rel.Assets, releaseAsset{Name: name, URL: server.URL + "/" + name})
+	}
+	return rel
+}
+
+func tarGz(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o755, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestDownloadRelease(t *testing.T) {
+	const version = "1.4.0"
+	binary := []byte("#!/bin/hass2ch")
+	checksumsName := "hass2ch_" + version + "_checksums.txt"
+	archiveName := fmt.Sprintf("hass2ch_%s_%s_%s%s.tar.gz", version, runtime.GOOS, runtime.GOARCH, armVersion())
+
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T, r *testRelease)
+		keyPEM  func(r *testRelease) []byte
+		wantErr string
+	}{
+		{
+			name: "verified release",
+		},
+		{
+			name: "key as base64 of the PEM body",
+			keyPEM: func(r *testRelease) []byte {
+				block, _ := pem.Decode(r.keyPEM)
+				return []byte(base64.StdEncoding.EncodeToString(block.Bytes))
+			},
+		},
+		{
+			name: "checksums signed with another key",
+			keyPEM: func(r *testRelease) []byte {
+				other := newTestRelease(t, version, binary)
+				return other.keyPEM
+			},
+			wantErr: "invalid signature of " + checksumsName,
+		},
+		{
+			name: "checksums modified after signing",
+			tamper: func(t *testing.T, r *testRelease) {
+				r.assets[checksumsName] = append(r.assets[checksumsName], []byte("0000  hass2ch_other.tar.gz\n")...)
+			},
+			wantErr: "signature does not match",
+		},
+		{
+			name: "archive modified after signing",
+			tamper: func(t *testing.T, r *testRelease) {
+				r.assets[archiveName] = tarGz(t, map[string][]byte{"hass2ch": []byte("#!/bin/evil")})
+			},
+			wantErr: "checksum mismatch of " + archiveName,
+		},
+		{
+			name: "missing signature",
+			tamper: func(t *testing.T, r *testRelease) {
+				delete(r.assets, checksumsName+".sig")
+			},
+			wantErr: "has no asset " + checksumsName + ".sig",
+		},
+		{
+			name: "missing archive of the platform",
+			tamper: func(t *testing.T, r *testRelease) {
+				delete(r.assets, archiveName)
+			},
+			wantErr: "has no asset " + archiveName,
+		},
+		{
+			name: "archive without the binary",
+			tamper: func(t *testing.T, r *testRelease) {
+				archive := tarGz(t, map[string][]byte{"README.md": []byte("# hass2ch")})
+				sum := sha256.Sum256(archive)
+				checksums := []byte(fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), archiveName))
+				r.assets[archiveName] = archive
+				r.assets[checksumsName] = checksums
+				r.assets[checksumsName+".sig"] = r.sign(t, checksums)
+			},
+			wantErr: "no hass2ch in archive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRelease(t, version, binary)
+			if tt.tamper != nil {
+				tt.tamper(t, r)
+			}
+			keyPEM := r.keyPEM
+			if tt.keyPEM != nil {
+				keyPEM = tt.keyPEM(r)
+			}
+
+			got, err := downloadRelease(context.Background(), r.serve(t, version), version, keyPEM)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, binary, got)
+		})
+	}
+}
+
+func TestSelfUpdate_RequiresPublicKey(t *testing.T) {
+	require.Empty(t, updatePublicKey)
+
+	err := selfUpdate(context.Background(), []string{"--force"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no public key")
+}
+
+func TestExtractBinary(t *testing.T) {
+	archive := tarGz(t, map[string][]byte{
+		"README.md":             []byte("# hass2ch"),
+		"hass2ch_1.4.0/hass2ch": []byte("#!/bin/hass2ch"),
+	})
+
+	binary, err := extractBinary(archive, "hass2ch")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("#!/bin/hass2ch"), binary)
+
+	_, err = extractBinary([]byte("not gzip"), "hass2ch")
+	assert.Error(t, err)
+}
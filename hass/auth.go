@@ -0,0 +1,161 @@
+package hass
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// tokenExpiryMargin is how long before its expiry an access token is refreshed
+const tokenExpiryMargin = time.Minute
+
+// TokenSource provides access tokens used to authenticate with Home Assistant
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a long-lived access token
+type StaticToken string
+
+func (t StaticToken) Token(context.Context) (string, error) {
+	return string(t), nil
+}
+
+// Tokens is a response of the Home Assistant OAuth2 token endpoint
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+}
+
+// RefreshTokenSource provides short-lived access tokens obtained with an OAuth2 refresh token.
+// Access tokens are cached until shortly before they expire.
+type RefreshTokenSource struct {
+	baseURL      string
+	clientID     string
+	refreshToken string
+	httpClient   *http.Client
+
+	mtx         sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+// NewRefreshTokenSource creates a token source refreshing access tokens at the Home Assistant
+// instance at baseURL (e.g. http://homeassistant.local:8123). The client ID must be the one
+// the refresh token has been issued to.
+func NewRefreshTokenSource(baseURL, clientID, refreshToken string, opts ...func(*RefreshTokenSource)) *RefreshTokenSource {
+	s := &RefreshTokenSource{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		clientID:     clientID,
+		refreshToken: refreshToken,
+		httpClient:   http.DefaultClient,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// WithTokenHTTPClient sets the HTTP client access tokens are requested with, e.g. one trusting
+// the self-signed certificate of Home Assistant
+func WithTokenHTTPClient(httpClient *http.Client) func(*RefreshTokenSource) {
+	return func(s *RefreshTokenSource) {
+		s.httpClient = httpClient
+	}
+}
+
+func (s *RefreshTokenSource) Token(ctx context.Context) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.accessToken != "" && time.Now().Before(s.expiresAt.Add(-tokenExpiryMargin)) {
+		return s.accessToken, nil
+	}
+
+	tokens, err := requestTokens(ctx, s.httpClient, s.baseURL, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.refreshToken},
+		"client_id":     {s.clientID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh access token: %w", err)
+	}
+
+	s.accessToken = tokens.AccessToken
+	s.expiresAt = time.Now().Add(time.Duration(tokens.ExpiresIn) * time.Second)
+
+	return s.accessToken, nil
+}
+
+// AuthorizeURL returns the URL of the Home Assistant login page issuing an authorization code
+// to the given client. After logging in, the code is passed to redirectURI as the code parameter.
+func AuthorizeURL(baseURL, clientID, redirectURI string) string {
+	return fmt.Sprintf("%s/auth/authorize?%s", strings.TrimSuffix(baseURL, "/"), url.Values{
+		"client_id":    {clientID},
+		"redirect_uri": {redirectURI},
+	}.Encode())
+}
+
+// ExchangeAuthCode exchanges an authorization code for an access token and a refresh token
+func ExchangeAuthCode(ctx context.Context, baseURL, clientID, code string) (*Tokens, error) {
+	return requestTokens(ctx, http.DefaultClient, strings.TrimSuffix(baseURL, "/"), url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {code},
+		"client_id":  {clientID},
+	})
+}
+
+func requestTokens(ctx context.Context, httpClient *http.Client, baseURL string, form url.Values) (*Tokens, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/auth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "hass2ch")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var tokens Tokens
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %w", err)
+	}
+
+	return &tokens, nil
+}
+
+// HTTPURL converts a websocket URL of a Home Assistant instance to its HTTP URL
+func HTTPURL(websocketURL string) string {
+	switch {
+	case strings.HasPrefix(websocketURL, "wss://"):
+		return "https://" + strings.TrimPrefix(websocketURL, "wss://")
+	case strings.HasPrefix(websocketURL, "ws://"):
+		return "http://" + strings.TrimPrefix(websocketURL, "ws://")
+	default:
+		return websocketURL
+	}
+}
@@ -0,0 +1,193 @@
+package hass
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tokenServer serves the token endpoint of Home Assistant, replying with the responses in order
+type tokenServer struct {
+	*httptest.Server
+
+	mtx       sync.Mutex
+	responses []tokenResponse
+	requests  []url.Values
+}
+
+type tokenResponse struct {
+	status int
+	body   string
+}
+
+func newTokenServer(t *testing.T, responses ...tokenResponse) *tokenServer {
+	t.Helper()
+
+	s := &tokenServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/auth/token" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.requests = append(s.requests, r.PostForm)
+		if len(s.responses) == 0 {
+			http.Error(w, "unexpected token request", http.StatusInternalServerError)
+			return
+		}
+		response := s.responses[0]
+		s.responses = s.responses[1:]
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.status)
+		_, _ = w.Write([]byte(response.body))
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *tokenServer) requested() []url.Values {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests
+}
+
+func TestRefreshTokenSource(t *testing.T) {
+	refreshForm := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {"refresh"},
+		"client_id":     {"https://hass2ch.example"},
+	}
+
+	tests := []struct {
+		name      string
+		responses []tokenResponse
+		calls     int
+		want      []string
+		wantErr   string
+		requests  int
+	}{
+		{
+			name:      "access token is refreshed",
+			responses: []tokenResponse{{http.StatusOK, `{"access_token": "access-1", "expires_in": 1800, "token_type": "Bearer"}`}},
+			calls:     1,
+			want:      []string{"access-1"},
+			requests:  1,
+		},
+		{
+			name:      "access token is cached until it expires",
+			responses: []tokenResponse{{http.StatusOK, `{"access_token": "access-1", "expires_in": 1800, "token_type": "Bearer"}`}},
+			calls:     3,
+			want:      []string{"access-1", "access-1", "access-1"},
+			requests:  1,
+		},
+		{
+			name: "access token expiring within the margin is refreshed again",
+			responses: []tokenResponse{
+				{http.StatusOK, `{"access_token": "access-1", "expires_in": 30, "token_type": "Bearer"}`},
+				{http.StatusOK, `{"access_token": "access-2", "expires_in": 1800, "token_type": "Bearer"}`},
+			},
+			calls:    3,
+			want:     []string{"access-1", "access-2", "access-2"},
+			requests: 2,
+		},
+		{
+			name:      "revoked refresh token",
+			responses: []tokenResponse{{http.StatusBadRequest, `{"error": "invalid_grant"}`}},
+			calls:     1,
+			wantErr:   `token request failed with status 400: {"error": "invalid_grant"}`,
+			requests:  1,
+		},
+		{
+			name:      "invalid token response",
+			responses: []tokenResponse{{http.StatusOK, `<html>`}},
+			calls:     1,
+			wantErr:   "failed to parse token response",
+			requests:  1,
+		},
+		{
+			name: "failed refresh is retried on the next call",
+			responses: []tokenResponse{
+				{http.StatusServiceUnavailable, `starting`},
+				{http.StatusOK, `{"access_token": "access-1", "expires_in": 1800, "token_type": "Bearer"}`},
+			},
+			calls:    2,
+			want:     []string{"", "access-1"},
+			wantErr:  "token request failed with status 503: starting",
+			requests: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTokenServer(t, tt.responses...)
+			source := NewRefreshTokenSource(server.URL+"/", "https://hass2ch.example", "refresh",
+				WithTokenHTTPClient(server.Client()))
+
+			var got []string
+			var errs []error
+			for i := 0; i < tt.calls; i++ {
+				token, err := source.Token(context.Background())
+				got = append(got, token)
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+
+			if tt.wantErr != "" {
+				require.NotEmpty(t, errs)
+				assert.ErrorContains(t, errs[0], "failed to refresh access token")
+				assert.ErrorContains(t, errs[0], tt.wantErr)
+			} else {
+				assert.Empty(t, errs)
+			}
+			if tt.want != nil {
+				assert.Equal(t, tt.want, got)
+			}
+
+			require.Len(t, server.requested(), tt.requests)
+			for _, form := range server.requested() {
+				assert.Equal(t, refreshForm, form)
+			}
+		})
+	}
+}
+
+func TestExchangeAuthCode(t *testing.T) {
+	server := newTokenServer(t,
+		tokenResponse{http.StatusOK, `{"access_token": "access", "refresh_token": "refresh", "expires_in": 1800, "token_type": "Bearer"}`},
+		tokenResponse{http.StatusBadRequest, `{"error": "invalid_request"}`},
+	)
+
+	tokens, err := ExchangeAuthCode(context.Background(), server.URL, "https://hass2ch.example", "code")
+	require.NoError(t, err)
+	assert.Equal(t, &Tokens{AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 1800, TokenType: "Bearer"}, tokens)
+	assert.Equal(t, url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {"code"},
+		"client_id":  {"https://hass2ch.example"},
+	}, server.requested()[0])
+
+	// An authorization code is only valid once
+	_, err = ExchangeAuthCode(context.Background(), server.URL, "https://hass2ch.example", "code")
+	assert.ErrorContains(t, err, "token request failed with status 400")
+}
+
+func TestAuthorizeURL(t *testing.T) {
+	assert.Equal(t,
+		"http://homeassistant.local:8123/auth/authorize?client_id=https%3A%2F%2Fhass2ch.example&redirect_uri=https%3A%2F%2Fhass2ch.example%2Fcallback",
+		AuthorizeURL("http://homeassistant.local:8123/", "https://hass2ch.example", "https://hass2ch.example/callback"))
+}
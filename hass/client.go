@@ -2,14 +2,22 @@ package hass
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/goccy/go-json"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+	"github.com/jkaflik/hass2ch/pkg/singleflight"
 )
 
 // Client is a websocket API client for Home Assistant
@@ -17,14 +25,29 @@ type Client struct {
 	Host  string
 	Token string
 
+	// tokenSource overrides Token, e.g. to use short-lived OAuth2 access tokens
+	tokenSource TokenSource
+
+	// dialer opens websocket connections, websocket.DefaultDialer if nil
+	dialer *websocket.Dialer
+
+	// getStatesGroup deduplicates concurrent get_states requests
+	getStatesGroup singleflight.Group[[]State]
+
+	// stateCache is kept up to date by subscriptions, nil if disabled
+	stateCache *stateCache
+
 	receiveCtx         context.Context
 	receiveCancel      context.CancelFunc
+	receiveDone        chan struct{}
+	closing            atomic.Bool
 	activeReceiversNum int
 	activeReceivers    map[int]chan interface{}
 	activeReceiversMtx sync.Mutex
 
 	conn                         *websocket.Conn
-	isAuthenticated              bool
+	isAuthenticated              atomic.Bool
+	authInvalid                  atomic.Bool
 	receiverBufferSize           int
 	subscribeEventsResultTimeout time.Duration
 
@@ -35,16 +58,43 @@ type Client struct {
 	reconnectInterval      time.Duration
 	maxReconnectInterval   time.Duration
 	reconnectBackoffFactor float64
+	reconnectBudget        int
+	reconnectCooldown      time.Duration
+	reconnectProbeInterval time.Duration
+	lastReconnectAttempt   time.Time
+
+	// fallbackEventTypes are subscribed to individually when subscribing to all events is rejected
+	fallbackEventTypes []EventType
+
+	// clock times the reconnect backoff and cooldown
+	clock clock.Clock
+
+	// heartbeatInterval is the time between pings detecting stale connections, 0 disables them
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	// paused is closed while subscriptions are paused, events received meanwhile are dropped
+	paused   chan struct{}
+	pausedAt time.Time
 }
 
 type subscriptionInfo struct {
 	ctx        context.Context
+	id         int // ID of the subscribe_events message, used to unsubscribe
 	eventType  EventType
 	outputChan chan *EventMessage // The channel returned to the caller
+	onError    func(error)
 }
 
+// ErrAuthInvalid is returned when Home Assistant rejects the access token
+var ErrAuthInvalid = errors.New("invalid Home Assistant access token")
+
 func (c *Client) WaitAuthenticated(ctx context.Context) error {
-	for !c.isAuthenticated {
+	for !c.isAuthenticated.Load() {
+		if c.authInvalid.Load() {
+			return ErrAuthInvalid
+		}
+
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
@@ -65,6 +115,62 @@ func WithReconnectConfig(initialInterval, maxInterval time.Duration, backoffFact
 	}
 }
 
+// WithReconnectBudget protects Home Assistant from reconnect storms, e.g. caused by a revoked token.
+// Connection attempts are at least cooldown apart, and after the given number of consecutive failed
+// attempts the client only probes Home Assistant every probeInterval until a connection succeeds.
+// A budget of 0 disables the probe mode.
+func WithReconnectBudget(attempts int, cooldown, probeInterval time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.reconnectBudget = attempts
+		c.reconnectCooldown = cooldown
+		c.reconnectProbeInterval = probeInterval
+	}
+}
+
+// WithFallbackEventTypes sets the event types subscribed to individually, with their events merged into
+// a single channel, when Home Assistant (or a proxy in front of it) rejects subscribing to all events
+func WithFallbackEventTypes(eventTypes ...EventType) func(*Client) {
+	return func(c *Client) {
+		c.fallbackEventTypes = eventTypes
+	}
+}
+
+// WithClock sets the clock timing the reconnect backoff and cooldown, e.g. a fake clock in tests
+func WithClock(clk clock.Clock) func(*Client) {
+	return func(c *Client) {
+		c.clock = clk
+	}
+}
+
+// WithTokenSource sets a source of access tokens used instead of a long-lived token.
+// A token is requested on every (re)authentication.
+func WithTokenSource(ts TokenSource) func(*Client) {
+	return func(c *Client) {
+		c.tokenSource = ts
+	}
+}
+
+// WithDialer sets the dialer of websocket connections, e.g. to connect through a proxy
+func WithDialer(dialer *websocket.Dialer) func(*Client) {
+	return func(c *Client) {
+		c.dialer = dialer
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of wss:// connections, e.g. to trust the self-signed
+// certificate of a Home Assistant instance. It replaces the TLS configuration of a dialer set with WithDialer.
+func WithTLSConfig(tlsConfig *tls.Config) func(*Client) {
+	return func(c *Client) {
+		dialer := websocket.DefaultDialer
+		if c.dialer != nil {
+			dialer = c.dialer
+		}
+		d := *dialer
+		d.TLSClientConfig = tlsConfig
+		c.dialer = &d
+	}
+}
+
 // NewClient creates a new Home Assistant client with the given host and token.
 // The client supports automatic reconnection with configurable backoff.
 //
@@ -77,6 +183,13 @@ func NewClient(host, token string, opts ...func(*Client)) *Client {
 		reconnectInterval:      1 * time.Second,
 		maxReconnectInterval:   30 * time.Second,
 		reconnectBackoffFactor: 1.5,
+		reconnectBudget:        20,
+		reconnectCooldown:      5 * time.Second,
+		reconnectProbeInterval: 5 * time.Minute,
+		heartbeatInterval:      defaultHeartbeatInterval,
+		heartbeatTimeout:       defaultHeartbeatTimeout,
+		clock:                  clock.Real,
+		paused:                 make(chan struct{}),
 	}
 
 	for _, opt := range opts {
@@ -92,7 +205,12 @@ func (c *Client) Connect(ctx context.Context) error {
 
 	log.Info().Str("url", url).Msg("Connecting to Home Assistant")
 
-	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, http.Header{ //nolint:bodyclose
+	dialer := c.dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	conn, _, err := dialer.DialContext(ctx, url, http.Header{ //nolint:bodyclose
 		"User-Agent": []string{"hass2ch"},
 	})
 
@@ -102,16 +220,31 @@ func (c *Client) Connect(ctx context.Context) error {
 	}
 
 	c.conn = conn
-	c.isAuthenticated = false
+	c.isAuthenticated.Store(false)
+	c.authInvalid.Store(false)
 	c.receiveCtx, c.receiveCancel = context.WithCancel(context.Background())
-
-	go c.receive()
+	c.receiveDone = make(chan struct{})
+
+	go func(done chan struct{}) {
+		defer close(done)
+		recovery.Run("hass_receive", c.receive)
+	}(c.receiveDone)
+
+	if c.heartbeatInterval > 0 {
+		done := c.receiveDone
+		go recovery.Run("hass_heartbeat", func() {
+			c.heartbeat(conn, done)
+		})
+	}
 
 	return nil
 }
 
 const (
 	subscribeEventsResultDefaultTimeout = time.Second * 5
+	accessTokenTimeout                  = time.Second * 10
+	closeHandshakeTimeout               = time.Second * 2
+	reconnectAuthTimeout                = time.Second * 30
 )
 
 type SubscribeEventsOption func(message *SubscribeEventsMessage)
@@ -122,6 +255,27 @@ func SubscribeEventsWithEventType(eventType EventType) SubscribeEventsOption {
 	}
 }
 
+// SubscribeEventsWithErrorHandler sets a handler of errors of the subscription after it has been started:
+// a *MissedEventsError when it was restored after a reconnection, and the error of a failed restore, after
+// which no events are received until the next reconnection. The handler must not block.
+func SubscribeEventsWithErrorHandler(onError func(error)) SubscribeEventsOption {
+	return func(message *SubscribeEventsMessage) {
+		message.onError = onError
+	}
+}
+
+// MissedEventsError is reported to the error handler of a subscription restored after a reconnection.
+// Events fired while the connection was lost are not delivered by Home Assistant.
+type MissedEventsError struct {
+	EventType EventType
+	// From is when the connection was lost, To when the subscription was restored
+	From, To time.Time
+}
+
+func (e *MissedEventsError) Error() string {
+	return fmt.Sprintf("events may have been missed for %s while the connection was lost", e.To.Sub(e.From).Round(time.Millisecond))
+}
+
 // SubscribeEvents subscribes to Home Assistant events and returns a channel that will receive the events.
 // The returned channel remains valid across connection failures and reconnections, ensuring uninterrupted
 // event delivery. The subscription is automatically restored if the connection is lost and re-established.
@@ -149,34 +303,98 @@ func (c *Client) SubscribeEvents(ctx context.Context, opts ...SubscribeEventsOpt
 		ctx:        ctx,
 		eventType:  cmd.EventType,
 		outputChan: outputChan,
+		onError:    cmd.onError,
 	}
 	c.subscriptions = append(c.subscriptions, subscription)
 	c.reconnectMu.Unlock()
 
 	// Start the initial subscription
-	if err := c.startSubscription(ctx, cmd.EventType, outputChan); err != nil {
+	subscriptions, err := c.subscribe(subscription)
+	if len(subscriptions) == 0 {
 		// Remove this subscription from our list since it failed
-		c.reconnectMu.Lock()
-		for i, sub := range c.subscriptions {
-			if sub.outputChan == outputChan {
-				c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
-				break
-			}
-		}
-		c.reconnectMu.Unlock()
+		c.replaceSubscription(subscription, nil)
 
 		close(outputChan)
 		return nil, err
 	}
 
+	if err != nil {
+		log.Error().Err(err).Msg("Subscribed to a part of the fallback event types only")
+	}
+
+	c.replaceSubscription(subscription, subscriptions)
+
 	return outputChan, nil
 }
 
+// reportError passes an error to the error handler of the subscription, if any
+func (s subscriptionInfo) reportError(err error) {
+	if s.onError != nil && s.ctx.Err() == nil {
+		s.onError(err)
+	}
+}
+
+// ErrSubscriptionRejected is returned when Home Assistant responds to a subscription with an error
+var ErrSubscriptionRejected = errors.New("subscription failed")
+
+// subscribe starts the subscription and returns the subscriptions actually started.
+// When Home Assistant rejects a subscription to all events, each of the fallback event types
+// is subscribed to instead, with events merged into the same output channel.
+func (c *Client) subscribe(sub subscriptionInfo) ([]subscriptionInfo, error) {
+	id, err := c.startSubscription(sub.ctx, sub.eventType, sub.outputChan)
+	if err == nil {
+		sub.id = id
+		return []subscriptionInfo{sub}, nil
+	}
+
+	if sub.eventType != "" || len(c.fallbackEventTypes) == 0 || !errors.Is(err, ErrSubscriptionRejected) {
+		return nil, err
+	}
+
+	log.Warn().
+		Err(err).
+		Interface("event_types", c.fallbackEventTypes).
+		Msg("Home Assistant rejected subscribing to all events, subscribing to each event type instead")
+	metrics.HassSubscriptionFallbacks.Inc()
+
+	subscriptions := make([]subscriptionInfo, 0, len(c.fallbackEventTypes))
+	for _, eventType := range c.fallbackEventTypes {
+		id, err := c.startSubscription(sub.ctx, eventType, sub.outputChan)
+		if err != nil {
+			return subscriptions, fmt.Errorf("failed to subscribe to %s events: %w", eventType, err)
+		}
+
+		subscriptions = append(subscriptions, subscriptionInfo{
+			ctx:        sub.ctx,
+			id:         id,
+			eventType:  eventType,
+			outputChan: sub.outputChan,
+			onError:    sub.onError,
+		})
+	}
+
+	return subscriptions, nil
+}
+
+// replaceSubscription replaces a subscription restored on reconnection with the given ones
+func (c *Client) replaceSubscription(old subscriptionInfo, subscriptions []subscriptionInfo) {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+
+	for i, sub := range c.subscriptions {
+		if sub.outputChan == old.outputChan && sub.eventType == old.eventType {
+			rest := append(subscriptions, c.subscriptions[i+1:]...)
+			c.subscriptions = append(c.subscriptions[:i:i], rest...)
+			return
+		}
+	}
+}
+
 // startSubscription initiates a subscription to Home Assistant events
-// and forwards events to the provided output channel
+// and forwards events to the provided output channel. It returns the ID of the subscription.
 //
 //nolint:gocyclo
-func (c *Client) startSubscription(ctx context.Context, eventType EventType, outputChan chan *EventMessage) error {
+func (c *Client) startSubscription(ctx context.Context, eventType EventType, outputChan chan *EventMessage) (int, error) {
 	c.activeReceiversMtx.Lock()
 	c.activeReceiversNum++
 	receiverNum := c.activeReceiversNum
@@ -193,12 +411,12 @@ func (c *Client) startSubscription(ctx context.Context, eventType EventType, out
 	payload, err := json.Marshal(cmd)
 	if err != nil {
 		c.activeReceiversMtx.Unlock()
-		return fmt.Errorf("failed to marshal subscribe events message: %w", err)
+		return 0, fmt.Errorf("failed to marshal subscribe events message: %w", err)
 	}
 
 	if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
 		c.activeReceiversMtx.Unlock()
-		return fmt.Errorf("failed to send message to Home Assistant: %w", err)
+		return 0, fmt.Errorf("failed to send message to Home Assistant: %w", err)
 	}
 
 	if c.activeReceivers == nil {
@@ -226,14 +444,14 @@ func (c *Client) startSubscription(ctx context.Context, eventType EventType, out
 	select {
 	case <-timeoutCtx.Done():
 		c.closeReceiver(receiverNum)
-		return fmt.Errorf("timeout waiting for Home Assistant to acknowledge subscription")
+		return 0, fmt.Errorf("timeout waiting for Home Assistant to acknowledge subscription")
 	case msg := <-resultChan:
 		// Check if the message is a result message
 		result, ok := msg.(ResultMessage)
 		if !ok {
 			c.closeReceiver(receiverNum)
 			log.Error().Interface("message", msg).Msg("Unexpected message type received waiting for a result")
-			return fmt.Errorf("unexpected message type received waiting for a result")
+			return 0, fmt.Errorf("unexpected message type received waiting for a result")
 		}
 
 		// Check if the subscription was successful
@@ -244,7 +462,7 @@ func (c *Client) startSubscription(ctx context.Context, eventType EventType, out
 				Str("message", result.Error.Message).
 				Msg("Subscription failed")
 
-			return fmt.Errorf("subscription failed: %s: %s", result.Error.Code, result.Error.Message)
+			return 0, fmt.Errorf("%w: %s: %s", ErrSubscriptionRejected, result.Error.Code, result.Error.Message)
 		}
 
 		log.Info().
@@ -254,7 +472,7 @@ func (c *Client) startSubscription(ctx context.Context, eventType EventType, out
 	}
 
 	// Start a goroutine to forward events to the output channel
-	go func() {
+	go recovery.Run("hass_subscription", func() {
 		for {
 			select {
 			case <-ctx.Done():
@@ -262,6 +480,14 @@ func (c *Client) startSubscription(ctx context.Context, eventType EventType, out
 				return
 			case msg, ok := <-resultChan:
 				if !ok {
+					if c.isPaused() {
+						log.Debug().
+							Int("id", receiverNum).
+							Str("event_type", string(cmd.EventType)).
+							Msg("Event channel closed, subscription paused")
+						return
+					}
+
 					log.Warn().
 						Int("id", receiverNum).
 						Str("event_type", string(cmd.EventType)).
@@ -271,6 +497,10 @@ func (c *Client) startSubscription(ctx context.Context, eventType EventType, out
 
 				// Only forward event messages to the output channel
 				if eventMsg, ok := msg.(*EventMessage); ok {
+					if c.stateCache != nil {
+						c.stateCache.update(eventMsg)
+					}
+
 					log.Debug().
 						Str("event_type", string(eventMsg.Event.EventType)).
 						Str("entity_id", eventMsg.Event.Data.EntityID).
@@ -279,38 +509,94 @@ func (c *Client) startSubscription(ctx context.Context, eventType EventType, out
 					select {
 					case outputChan <- eventMsg:
 						// Successfully sent the event
+					case <-c.pausedChan():
+						// Events are missed while paused, the receive loop must not wait for the consumer
 					case <-ctx.Done():
 						return
 					}
 				}
 			}
 		}
-	}()
+	})
 
-	return nil
+	return receiverNum, nil
 }
 
-// GetStates gets all states from Home Assistant
+// GetStates gets all states from Home Assistant.
+// Concurrent calls share a single get_states request.
 func (c *Client) GetStates(ctx context.Context) ([]State, error) {
+	states, shared, err := c.getStatesGroup.Do(ctx, "get_states", func() ([]State, error) {
+		// The request is shared, it must not be canceled by the caller that happened to start it
+		return c.getStates(context.WithoutCancel(ctx))
+	})
+	if shared {
+		metrics.HassRequestsDeduplicated.WithLabelValues("get_states").Inc()
+	}
+
+	return states, err
+}
+
+func (c *Client) getStates(ctx context.Context) ([]State, error) {
+	result, err := c.request(ctx, "get states", func(id int) any {
+		return BaseMessage{
+			ID:   id,
+			Type: "get_states",
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Int("id", result.ID).Msg("Received states")
+
+	// Parse the result as a list of states
+	var states []State
+	if err := json.Unmarshal(result.Result, &states); err != nil {
+		return nil, fmt.Errorf("failed to parse states: %w", err)
+	}
+
+	return states, nil
+}
+
+// CallService calls a service of Home Assistant, e.g. notify.notify, and returns its result message.
+// Target selects the entities, devices or areas the service is called for and can be nil, like data.
+func (c *Client) CallService(ctx context.Context, domain, service string, target *ServiceTarget, data map[string]any) (*ResultMessage, error) {
+	result, err := c.request(ctx, "call service", func(id int) any {
+		return CallServiceMessage{
+			BaseMessage: BaseMessage{
+				ID:   id,
+				Type: "call_service",
+			},
+			Domain:      domain,
+			Service:     service,
+			Target:      target,
+			ServiceData: data,
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to call service %s.%s: %w", domain, service, err)
+	}
+
+	log.Debug().Int("id", result.ID).Str("domain", domain).Str("service", service).Msg("Called service")
+	return &result, nil
+}
+
+// request sends a command with a new message ID and waits for the successful result message of that ID.
+// The name of the command is used in errors and logs.
+func (c *Client) request(ctx context.Context, name string, newCommand func(id int) any) (ResultMessage, error) {
 	c.activeReceiversMtx.Lock()
 	c.activeReceiversNum++
 	receiverNum := c.activeReceiversNum
 
-	// Create get states command
-	cmd := BaseMessage{
-		ID:   receiverNum,
-		Type: "get_states",
-	}
-
-	payload, err := json.Marshal(cmd)
+	payload, err := json.Marshal(newCommand(receiverNum))
 	if err != nil {
 		c.activeReceiversMtx.Unlock()
-		return nil, fmt.Errorf("failed to marshal get states message: %w", err)
+		return ResultMessage{}, fmt.Errorf("failed to marshal %s message: %w", name, err)
 	}
 
 	if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
 		c.activeReceiversMtx.Unlock()
-		return nil, fmt.Errorf("failed to send message to Home Assistant: %w", err)
+		return ResultMessage{}, fmt.Errorf("failed to send message to Home Assistant: %w", err)
 	}
 
 	if c.activeReceivers == nil {
@@ -326,7 +612,7 @@ func (c *Client) GetStates(ctx context.Context) ([]State, error) {
 	c.activeReceivers[receiverNum] = resultChan
 	c.activeReceiversMtx.Unlock()
 
-	// Create a timeout context for waiting for the get states result
+	// Create a timeout context for waiting for the result
 	resultTimeout := subscribeEventsResultDefaultTimeout
 	if c.subscribeEventsResultTimeout > 0 {
 		resultTimeout = c.subscribeEventsResultTimeout
@@ -334,40 +620,34 @@ func (c *Client) GetStates(ctx context.Context) ([]State, error) {
 	timeoutCtx, cancel := context.WithTimeout(ctx, resultTimeout)
 	defer cancel()
 
-	// Wait for the get states result
+	// Wait for the result
 	select {
 	case <-timeoutCtx.Done():
 		c.closeReceiver(receiverNum)
-		return nil, fmt.Errorf("timeout waiting for Home Assistant to acknowledge get states")
+		return ResultMessage{}, fmt.Errorf("timeout waiting for Home Assistant to acknowledge %s", name)
 	case msg := <-resultChan:
+		// The ID is not reused, only a single result is expected
+		c.closeReceiver(receiverNum)
+
 		// Check if the message is a result message
 		result, ok := msg.(ResultMessage)
 		if !ok {
-			c.closeReceiver(receiverNum)
 			log.Error().Interface("message", msg).Msg("Unexpected message type received waiting for a result")
-			return nil, fmt.Errorf("unexpected message type received waiting for a result")
+			return ResultMessage{}, fmt.Errorf("unexpected message type received waiting for a result")
 		}
 
-		// Check if the get states was successful
+		// Check if the command was successful
 		if !result.Success {
-			c.closeReceiver(receiverNum)
 			log.Error().
 				Str("code", result.Error.Code).
 				Str("message", result.Error.Message).
-				Msg("Get states failed")
-
-			return nil, fmt.Errorf("get states failed: %s: %s", result.Error.Code, result.Error.Message)
-		}
+				Str("command", name).
+				Msg("Home Assistant command failed")
 
-		log.Info().Int("id", receiverNum).Msg("Received states")
-
-		// Parse the result as a list of states
-		var states []State
-		if err := json.Unmarshal(result.Result, &states); err != nil {
-			return nil, fmt.Errorf("failed to parse states: %w", err)
+			return ResultMessage{}, fmt.Errorf("%s failed: %s: %s", name, result.Error.Code, result.Error.Message)
 		}
 
-		return states, nil
+		return result, nil
 	}
 }
 
@@ -390,7 +670,7 @@ func (c *Client) reconnect(ctx context.Context) {
 	c.isReconnecting = true
 	c.reconnectMu.Unlock()
 
-	go func() {
+	go recovery.Run("hass_reconnect", func() {
 		defer func() {
 			c.reconnectMu.Lock()
 			c.isReconnecting = false
@@ -402,6 +682,12 @@ func (c *Client) reconnect(ctx context.Context) {
 			_ = c.conn.Close()
 		}
 
+		// Events are missed until subscriptions are restored
+		disconnectedAt := c.clock.Now()
+		if c.stateCache != nil {
+			c.stateCache.invalidate()
+		}
+
 		// Make a copy of subscriptions to restore after reconnection
 		c.reconnectMu.Lock()
 		subscriptions := make([]subscriptionInfo, len(c.subscriptions))
@@ -410,56 +696,215 @@ func (c *Client) reconnect(ctx context.Context) {
 
 		// Attempt to reconnect with exponential backoff
 		interval := c.reconnectInterval
+		failures := 0
 		for {
 			select {
 			case <-ctx.Done():
 				log.Info().Msg("Context canceled, stopping reconnection attempts")
 				return
 			default:
+				c.waitReconnectCooldown(ctx)
+
 				log.Info().Dur("interval", interval).Msg("Attempting to reconnect to Home Assistant")
+				metrics.HassReconnectTotal.Inc()
 
-				if err := c.Connect(ctx); err != nil {
-					log.Error().Err(err).Dur("interval", interval).Msg("Failed to reconnect to Home Assistant")
+				if err := c.connectAndAuthenticate(ctx); err != nil {
+					failures++
 
 					// Wait and increase backoff interval
-					time.Sleep(interval)
-					interval = time.Duration(float64(interval) * c.reconnectBackoffFactor)
-					if interval > c.maxReconnectInterval {
-						interval = c.maxReconnectInterval
+					wait := interval
+					if c.reconnectBudget > 0 && failures >= c.reconnectBudget {
+						if failures == c.reconnectBudget {
+							metrics.HassReconnectProbeMode.Set(1)
+							log.Error().
+								Int("attempts", failures).
+								Dur("probe_interval", c.reconnectProbeInterval).
+								Msg("Reconnect attempt budget exhausted, probing Home Assistant slowly until it accepts the connection")
+						}
+						wait = c.reconnectProbeInterval
+					} else {
+						interval = time.Duration(float64(interval) * c.reconnectBackoffFactor)
+						if interval > c.maxReconnectInterval {
+							interval = c.maxReconnectInterval
+						}
 					}
-					continue
-				}
 
-				// Wait for authentication
-				if err := c.WaitAuthenticated(ctx); err != nil {
-					log.Error().Err(err).Msg("Failed to authenticate after reconnection")
+					log.Error().Err(err).Int("failures", failures).Dur("next_attempt", wait).Msg("Failed to reconnect to Home Assistant")
+					<-c.clock.After(wait)
 					continue
 				}
 
+				metrics.HassReconnectProbeMode.Set(0)
 				log.Info().Msg("Successfully reconnected to Home Assistant")
 
-				// Restore subscriptions using the same output channels
-				for _, sub := range subscriptions {
-					log.Info().
-						Str("event_type", string(sub.eventType)).
-						Msg("Restoring subscription after reconnection")
-
-					if err := c.startSubscription(sub.ctx, sub.eventType, sub.outputChan); err != nil {
-						log.Error().
-							Err(err).
-							Str("event_type", string(sub.eventType)).
-							Msg("Failed to restore subscription after reconnection")
-					} else {
-						log.Info().
-							Str("event_type", string(sub.eventType)).
-							Msg("Successfully restored subscription after reconnection")
-					}
+				// Paused subscriptions are restored on resume, events were missed since the connection was lost
+				c.reconnectMu.Lock()
+				paused := c.isPausedLocked()
+				if paused && disconnectedAt.Before(c.pausedAt) {
+					c.pausedAt = disconnectedAt
+				}
+				c.reconnectMu.Unlock()
+
+				if !paused {
+					c.restoreSubscriptions(subscriptions, disconnectedAt)
 				}
 
 				return
 			}
 		}
-	}()
+	})
+}
+
+// restoreSubscriptions subscribes again using the same output channels, reporting events missed since the given time
+func (c *Client) restoreSubscriptions(subscriptions []subscriptionInfo, missedFrom time.Time) {
+	for _, sub := range subscriptions {
+		log.Info().
+			Str("event_type", string(sub.eventType)).
+			Msg("Restoring subscription")
+
+		restored, err := c.subscribe(sub)
+		if len(restored) > 0 {
+			c.replaceSubscription(sub, restored)
+		}
+
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("event_type", string(sub.eventType)).
+				Msg("Failed to restore subscription")
+			metrics.HassSubscriptionRestoreFailures.Inc()
+			sub.reportError(fmt.Errorf("failed to restore subscription: %w", err))
+		} else {
+			log.Info().
+				Str("event_type", string(sub.eventType)).
+				Msg("Successfully restored subscription")
+		}
+
+		if len(restored) > 0 {
+			sub.reportError(&MissedEventsError{EventType: sub.eventType, From: missedFrom, To: c.clock.Now()})
+		}
+	}
+}
+
+// PauseSubscriptions unsubscribes from events until ResumeSubscriptions, e.g. while the consumer cannot keep up,
+// so Home Assistant does not buffer events for a connection that is not read until it drops it.
+// The output channels stay open, events fired while paused are not delivered.
+func (c *Client) PauseSubscriptions(ctx context.Context) error {
+	c.reconnectMu.Lock()
+	if c.isPausedLocked() {
+		c.reconnectMu.Unlock()
+		return nil
+	}
+	close(c.paused)
+	c.pausedAt = c.clock.Now()
+	subscriptions := make([]subscriptionInfo, len(c.subscriptions))
+	copy(subscriptions, c.subscriptions)
+	c.reconnectMu.Unlock()
+
+	metrics.HassSubscriptionsPaused.Set(1)
+	log.Warn().Int("subscriptions", len(subscriptions)).Msg("Pausing subscriptions to Home Assistant")
+
+	var errs []error
+	for _, sub := range subscriptions {
+		_, err := c.request(ctx, "unsubscribe events", func(id int) any {
+			return UnsubscribeEventsMessage{
+				BaseMessage: BaseMessage{
+					ID:   id,
+					Type: MessageTypeUnsubscribeEvents,
+				},
+				Subscription: sub.id,
+			}
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to unsubscribe from %q events: %w", sub.eventType, err))
+		}
+		c.closeReceiver(sub.id)
+	}
+
+	return errors.Join(errs...)
+}
+
+// ResumeSubscriptions subscribes again to the events paused by PauseSubscriptions, using the same output channels.
+// Error handlers of the subscriptions receive a *MissedEventsError of the paused window.
+func (c *Client) ResumeSubscriptions(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.reconnectMu.Lock()
+	if !c.isPausedLocked() {
+		c.reconnectMu.Unlock()
+		return nil
+	}
+	c.paused = make(chan struct{})
+	pausedAt := c.pausedAt
+	subscriptions := make([]subscriptionInfo, len(c.subscriptions))
+	copy(subscriptions, c.subscriptions)
+	c.reconnectMu.Unlock()
+
+	metrics.HassSubscriptionsPaused.Set(0)
+	log.Info().Dur("paused", c.clock.Since(pausedAt)).Msg("Resuming subscriptions to Home Assistant")
+	c.restoreSubscriptions(subscriptions, pausedAt)
+	return nil
+}
+
+// pausedChan returns a channel closed while subscriptions are paused
+func (c *Client) pausedChan() <-chan struct{} {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+	return c.paused
+}
+
+func (c *Client) isPaused() bool {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+	return c.isPausedLocked()
+}
+
+// isPausedLocked reports whether subscriptions are paused. The caller holds reconnectMu.
+func (c *Client) isPausedLocked() bool {
+	select {
+	case <-c.paused:
+		return true
+	default:
+		return false
+	}
+}
+
+// connectAndAuthenticate opens a new connection and waits until it is authenticated
+func (c *Client) connectAndAuthenticate(ctx context.Context) error {
+	if err := c.Connect(ctx); err != nil {
+		return err
+	}
+
+	authCtx, cancel := context.WithTimeout(ctx, reconnectAuthTimeout)
+	defer cancel()
+
+	if err := c.WaitAuthenticated(authCtx); err != nil {
+		_ = c.conn.Close()
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	return nil
+}
+
+// waitReconnectCooldown spaces connection attempts by the reconnect cooldown, also across
+// connections dropped right after they have been established
+func (c *Client) waitReconnectCooldown(ctx context.Context) {
+	c.reconnectMu.Lock()
+	wait := c.clock.Until(c.lastReconnectAttempt.Add(c.reconnectCooldown))
+	c.reconnectMu.Unlock()
+
+	if wait > 0 {
+		select {
+		case <-ctx.Done():
+		case <-c.clock.After(wait):
+		}
+	}
+
+	c.reconnectMu.Lock()
+	c.lastReconnectAttempt = c.clock.Now()
+	c.reconnectMu.Unlock()
 }
 
 func (c *Client) receive() {
@@ -471,6 +916,12 @@ func (c *Client) receive() {
 		default:
 			_, payload, err := c.conn.ReadMessage()
 			if err != nil {
+				// The close handshake has completed or timed out
+				if c.closing.Load() {
+					log.Debug().Err(err).Msg("Home Assistant websocket connection closed on shutdown")
+					return
+				}
+
 				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 					log.Info().Msg("Home Assistant websocket connection closed")
 					// Try to reconnect when connection is closed
@@ -495,11 +946,12 @@ func (c *Client) receive() {
 			case AuthRequiredMessage:
 				c.authenticate()
 			case AuthOKMessage:
-				c.isAuthenticated = true
+				c.isAuthenticated.Store(true)
 				log.Info().Str("version", m.Version).Msg("Authenticated with Home Assistant")
 			case AuthInvalidMessage:
+				c.authInvalid.Store(true)
 				log.Error().Str("message", m.Message).Msg("Failed to authenticate with Home Assistant")
-			case *EventMessage, ResultMessage:
+			case *EventMessage, ResultMessage, PongMessage:
 				c.handleMessage(m)
 			default:
 				log.Debug().Interface("message", msg).Msg("Received unhandled message type from Home Assistant")
@@ -516,6 +968,8 @@ func (c *Client) handleMessage(msg interface{}) {
 		id = m.ID
 	case ResultMessage:
 		id = m.ID
+	case PongMessage:
+		id = m.ID
 	default:
 		log.Warn().Interface("message", msg).Msg("Cannot determine ID of message")
 		return
@@ -540,6 +994,10 @@ func (c *Client) handleMessage(msg interface{}) {
 func (c *Client) Close() error {
 	log.Info().Msg("Closing Home Assistant websocket connection")
 
+	// Don't reconnect when Home Assistant closes the connection in response
+	c.closing.Store(true)
+	c.closeHandshake()
+
 	// Cancel the receive context to stop the message loop
 	if c.receiveCancel != nil {
 		c.receiveCancel()
@@ -561,19 +1019,45 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// closeHandshake sends a close frame and waits briefly for Home Assistant to acknowledge it,
+// so the connection is not logged as abnormally disconnected
+func (c *Client) closeHandshake() {
+	if c.conn == nil || c.receiveDone == nil {
+		return
+	}
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "hass2ch shutting down")
+	if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeHandshakeTimeout)); err != nil {
+		log.Debug().Err(err).Msg("Failed to send close frame to Home Assistant")
+		return
+	}
+
+	select {
+	case <-c.receiveDone:
+	case <-time.After(closeHandshakeTimeout):
+		log.Warn().Msg("Home Assistant did not acknowledge closing the connection in time")
+	}
+}
+
 func (c *Client) authenticate() {
-	if c.isAuthenticated {
+	if c.isAuthenticated.Load() {
 		log.Warn().Msg("Received auth_required message from Home Assistant while already authenticated")
 	}
 
 	log.Info().Msg("Authenticating with Home Assistant")
 
+	token, err := c.accessToken()
+	if err != nil {
+		log.Err(err).Msg("Failed to obtain Home Assistant access token")
+		return
+	}
+
 	// Create authentication message
 	authMsg := AuthMessage{
 		BaseMessage: BaseMessage{
 			Type: MessageTypeAuth,
 		},
-		AccessToken: c.Token,
+		AccessToken: token,
 	}
 
 	payload, err := json.Marshal(authMsg)
@@ -587,3 +1071,15 @@ func (c *Client) authenticate() {
 		return
 	}
 }
+
+// accessToken returns the token used to authenticate the connection
+func (c *Client) accessToken() (string, error) {
+	if c.tokenSource == nil {
+		return c.Token, nil
+	}
+
+	ctx, cancel := context.WithTimeout(c.receiveCtx, accessTokenTimeout)
+	defer cancel()
+
+	return c.tokenSource.Token(ctx)
+}
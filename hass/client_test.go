@@ -0,0 +1,189 @@
+package hass
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+// fakeHass is a websocket server speaking the authentication and ping/pong of the Home Assistant API
+type fakeHass struct {
+	*httptest.Server
+
+	mtx         sync.Mutex
+	rejectAuth  bool
+	ignorePings bool
+	connections int
+	pings       int
+}
+
+func newFakeHass(t *testing.T) *fakeHass {
+	t.Helper()
+
+	h := &fakeHass{}
+	upgrader := websocket.Upgrader{}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		h.mtx.Lock()
+		h.connections++
+		h.mtx.Unlock()
+
+		h.serve(conn)
+	}))
+	t.Cleanup(h.Close)
+
+	return h
+}
+
+func (h *fakeHass) serve(conn *websocket.Conn) {
+	if err := conn.WriteJSON(BaseMessage{Type: MessageTypeAuthRequired}); err != nil {
+		return
+	}
+
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg BaseMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return
+		}
+
+		h.mtx.Lock()
+		rejectAuth, ignorePings := h.rejectAuth, h.ignorePings
+		if msg.Type == MessageTypePing {
+			h.pings++
+		}
+		h.mtx.Unlock()
+
+		switch {
+		case msg.Type == MessageTypeAuth && rejectAuth:
+			_ = conn.WriteJSON(map[string]string{"type": MessageTypeAuthInvalid, "message": "Invalid access token"})
+			return
+		case msg.Type == MessageTypeAuth:
+			_ = conn.WriteJSON(map[string]string{"type": MessageTypeAuthOK, "ha_version": "2024.1.0"})
+		case msg.Type == MessageTypePing && !ignorePings:
+			_ = conn.WriteJSON(BaseMessage{ID: msg.ID, Type: MessageTypePong})
+		}
+	}
+}
+
+func (h *fakeHass) url() string {
+	return "ws" + strings.TrimPrefix(h.URL, "http")
+}
+
+func (h *fakeHass) set(fn func(h *fakeHass)) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	fn(h)
+}
+
+func (h *fakeHass) counts() (connections, pings int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.connections, h.pings
+}
+
+func (h *fakeHass) waitConnections(t *testing.T, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		connections, _ := h.counts()
+		return connections == n
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClient_ReconnectBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := newFakeHass(t)
+	server.set(func(h *fakeHass) { h.rejectAuth = true })
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := NewClient(server.url(), "revoked", WithClock(clk), WithHeartbeat(0, 0),
+		WithReconnectConfig(time.Second, 30*time.Second, 2),
+		WithReconnectBudget(3, 0, time.Minute))
+
+	// Failed attempts back off until the budget of attempts is exhausted
+	c.reconnect(ctx)
+	server.waitConnections(t, 1)
+	for attempt, backoff := range []time.Duration{time.Second, 2 * time.Second} {
+		clk.BlockUntil(1)
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.HassReconnectProbeMode))
+		clk.Advance(backoff)
+		server.waitConnections(t, attempt+2)
+	}
+
+	// The client then gives up reconnecting with a backoff and only probes Home Assistant every probe interval
+	clk.BlockUntil(1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.HassReconnectProbeMode))
+	clk.Advance(59 * time.Second)
+	require.Never(t, func() bool {
+		connections, _ := server.counts()
+		return connections != 3
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	clk.Advance(time.Second)
+	server.waitConnections(t, 4)
+
+	// A probe accepted by Home Assistant leaves the probe mode
+	server.set(func(h *fakeHass) { h.rejectAuth = false })
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	server.waitConnections(t, 5)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.HassReconnectProbeMode) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, c.Close())
+}
+
+func TestClient_HeartbeatMissedPong(t *testing.T) {
+	server := newFakeHass(t)
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := NewClient(server.url(), "token", WithClock(clk), WithHeartbeat(30*time.Second, 10*time.Second),
+		WithReconnectBudget(0, 0, 0))
+	defer c.Close()
+
+	ctx := context.Background()
+	require.NoError(t, c.Connect(ctx))
+	require.NoError(t, c.WaitAuthenticated(ctx))
+
+	// Answered pings keep the connection
+	clk.BlockUntil(1)
+	clk.Advance(30 * time.Second)
+	require.Eventually(t, func() bool {
+		_, pings := server.counts()
+		return pings == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	clk.Advance(10 * time.Second)
+	connections, _ := server.counts()
+	assert.Equal(t, 1, connections)
+	failures := testutil.ToFloat64(metrics.HassHeartbeatFailures)
+
+	// A ping without a pong within the timeout drops the stale connection, which is reconnected
+	server.set(func(h *fakeHass) { h.ignorePings = true })
+	require.Eventually(t, func() bool {
+		clk.Advance(10 * time.Second)
+		connections, _ := server.counts()
+		return connections == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, failures+1, testutil.ToFloat64(metrics.HassHeartbeatFailures))
+}
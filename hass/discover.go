@@ -0,0 +1,299 @@
+package hass
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// discoveryService is the zeroconf service type announced by Home Assistant
+	discoveryService = "_home-assistant._tcp.local."
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+)
+
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// ErrNotDiscovered is returned when no Home Assistant instance answered the discovery query
+var ErrNotDiscovered = errors.New("no Home Assistant instance discovered")
+
+// DiscoveredInstance is a Home Assistant instance found on the local network
+type DiscoveredInstance struct {
+	Name string
+	// URL is the HTTP base URL of the instance, e.g. http://192.168.1.10:8123
+	URL string
+}
+
+// Discover locates Home Assistant instances on the local network via mDNS (zeroconf).
+// It waits for answers until the context is done and returns all instances found.
+func Discover(ctx context.Context) ([]DiscoveredInstance, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %w", err)
+	}
+	defer conn.Close()
+
+	// Queries sent from a port other than 5353 are answered directly to the sender
+	if _, err := conn.WriteToUDP(mdnsQuery(discoveryService, dnsTypePTR), mdnsAddr); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %w", err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(3 * time.Second)
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("failed to set mDNS read deadline: %w", err)
+	}
+
+	records := newMDNSRecords()
+	buf := make([]byte, 9000)
+	for ctx.Err() == nil {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("failed to read mDNS response: %w", err)
+		}
+
+		// Ignore malformed responses of unrelated devices
+		_ = records.parse(buf[:n])
+	}
+
+	instances := records.instances()
+	if len(instances) == 0 {
+		return nil, ErrNotDiscovered
+	}
+
+	return instances, nil
+}
+
+// mdnsQuery builds a DNS query message with a single question
+func mdnsQuery(name string, qtype uint16) []byte {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[4:], 1) // QDCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, dnsClassIN)
+}
+
+type srvRecord struct {
+	target string
+	port   uint16
+}
+
+// mdnsRecords collects records of mDNS responses relevant to discovery
+type mdnsRecords struct {
+	services []string
+	srv      map[string]srvRecord
+	txt      map[string]map[string]string
+	a        map[string]net.IP
+}
+
+func newMDNSRecords() *mdnsRecords {
+	return &mdnsRecords{
+		srv: make(map[string]srvRecord),
+		txt: make(map[string]map[string]string),
+		a:   make(map[string]net.IP),
+	}
+}
+
+// instances resolves the base URLs of the discovered services
+func (r *mdnsRecords) instances() []DiscoveredInstance {
+	var instances []DiscoveredInstance
+	seen := make(map[string]bool)
+
+	for _, service := range r.services {
+		if seen[service] {
+			continue
+		}
+		seen[service] = true
+
+		instance := DiscoveredInstance{Name: strings.TrimSuffix(strings.TrimSuffix(service, discoveryService), ".")}
+
+		var srv *srvRecord
+		var addr net.IP
+		if record, ok := r.srv[service]; ok {
+			srv = &record
+			addr = r.a[record.target]
+		}
+
+		if instance.URL = instanceURL(r.txt[service], srv, addr); instance.URL != "" {
+			instances = append(instances, instance)
+		}
+	}
+
+	return instances
+}
+
+// instanceURL returns the base URL of a service. The URL announced in its TXT record is preferred over
+// the target of its SRV record, which is replaced by its address if known. Empty if neither is announced.
+func instanceURL(txt map[string]string, srv *srvRecord, addr net.IP) string {
+	for _, key := range []string{"internal_url", "base_url"} {
+		if txt[key] != "" {
+			return strings.TrimSuffix(txt[key], "/")
+		}
+	}
+
+	if srv == nil {
+		return ""
+	}
+	host := strings.TrimSuffix(srv.target, ".")
+	if addr != nil {
+		host = addr.String()
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, strconv.Itoa(int(srv.port))))
+}
+
+var errMalformedDNSMessage = errors.New("malformed DNS message")
+
+// parse reads the resource records of a DNS response
+func (r *mdnsRecords) parse(msg []byte) error {
+	if len(msg) < 12 {
+		return errMalformedDNSMessage
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return err
+		}
+		offset = next + 4 // QTYPE, QCLASS
+	}
+
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return err
+		}
+		if next+10 > len(msg) {
+			return errMalformedDNSMessage
+		}
+
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		end := start + length
+		if end > len(msg) {
+			return errMalformedDNSMessage
+		}
+		offset = end
+
+		switch rtype {
+		case dnsTypePTR:
+			if name != discoveryService {
+				continue
+			}
+			service, _, err := readDNSName(msg, start)
+			if err != nil {
+				return err
+			}
+			r.services = append(r.services, service)
+		case dnsTypeSRV:
+			if length < 7 {
+				return errMalformedDNSMessage
+			}
+			target, _, err := readDNSName(msg, start+6)
+			if err != nil {
+				return err
+			}
+			r.srv[name] = srvRecord{target: target, port: binary.BigEndian.Uint16(msg[start+4:])}
+		case dnsTypeTXT:
+			r.txt[name] = parseTXT(msg[start:end])
+		case dnsTypeA:
+			if addr := parseA(msg[start:end]); addr != nil {
+				r.a[name] = addr
+			}
+		}
+	}
+
+	return nil
+}
+
+// readDNSName reads a possibly compressed domain name and returns it with a trailing dot
+// together with the offset following the name
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+
+	// Bound the number of pointers followed to protect against loops
+	for jumps := 0; jumps < 32; {
+		if offset >= len(msg) {
+			return "", 0, errMalformedDNSMessage
+		}
+
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(msg) {
+				return "", 0, errMalformedDNSMessage
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errMalformedDNSMessage
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+
+	return "", 0, errMalformedDNSMessage
+}
+
+// parseA returns the IPv4 address of an A record, nil if malformed
+func parseA(data []byte) net.IP {
+	if len(data) != net.IPv4len {
+		return nil
+	}
+	return net.IP(append([]byte(nil), data...))
+}
+
+// parseTXT parses key=value strings of a TXT record
+func parseTXT(data []byte) map[string]string {
+	values := make(map[string]string)
+
+	for len(data) > 0 {
+		length := int(data[0])
+		if 1+length > len(data) {
+			break
+		}
+
+		key, value, _ := strings.Cut(string(data[1:1+length]), "=")
+		values[key] = value
+		data = data[1+length:]
+	}
+
+	return values
+}
@@ -0,0 +1,216 @@
+package hass
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dnsResponse builds a DNS response message of resource records
+type dnsResponse struct {
+	records [][]byte
+}
+
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func (m *dnsResponse) add(name string, rtype uint16, data []byte) *dnsResponse {
+	record := dnsName(name)
+	record = binary.BigEndian.AppendUint16(record, rtype)
+	record = binary.BigEndian.AppendUint16(record, dnsClassIN)
+	record = binary.BigEndian.AppendUint32(record, 120)
+	record = binary.BigEndian.AppendUint16(record, uint16(len(data)))
+	m.records = append(m.records, append(record, data...))
+	return m
+}
+
+func (m *dnsResponse) bytes() []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(m.records)))
+	for _, record := range m.records {
+		msg = append(msg, record...)
+	}
+	return msg
+}
+
+func txtData(values ...string) []byte {
+	var b []byte
+	for _, value := range values {
+		b = append(b, byte(len(value)))
+		b = append(b, value...)
+	}
+	return b
+}
+
+func srvData(port uint16, target string) []byte {
+	b := make([]byte, 6)
+	binary.BigEndian.PutUint16(b[4:], port)
+	return append(b, dnsName(target)...)
+}
+
+func TestParseTXT(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want map[string]string
+	}{
+		{
+			name: "announced URLs",
+			data: txtData("location_name=Home", "internal_url=http://192.168.1.10:8123/", "base_url=http://homeassistant.local:8123", "requires_api_password=True"),
+			want: map[string]string{
+				"location_name":         "Home",
+				"internal_url":          "http://192.168.1.10:8123/",
+				"base_url":              "http://homeassistant.local:8123",
+				"requires_api_password": "True",
+			},
+		},
+		{
+			name: "values containing an equals sign",
+			data: txtData("external_url=https://example.com/?a=b"),
+			want: map[string]string{"external_url": "https://example.com/?a=b"},
+		},
+		{
+			name: "key without a value",
+			data: txtData("flag"),
+			want: map[string]string{"flag": ""},
+		},
+		{
+			name: "truncated string",
+			data: append(txtData("version=2024.1.0"), 20, 'b'),
+			want: map[string]string{"version": "2024.1.0"},
+		},
+		{
+			name: "empty record",
+			want: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseTXT(tt.data))
+		})
+	}
+}
+
+func TestParseA(t *testing.T) {
+	assert.Equal(t, net.IPv4(192, 168, 1, 10).To4(), parseA([]byte{192, 168, 1, 10}))
+	assert.Nil(t, parseA([]byte{192, 168, 1}))
+	assert.Nil(t, parseA(net.ParseIP("fe80::1")))
+}
+
+func TestInstanceURL(t *testing.T) {
+	srv := &srvRecord{target: "homeassistant.local.", port: 8123}
+
+	tests := []struct {
+		name string
+		txt  map[string]string
+		srv  *srvRecord
+		addr net.IP
+		want string
+	}{
+		{
+			name: "internal URL is preferred",
+			txt:  map[string]string{"internal_url": "http://192.168.1.10:8123/", "base_url": "http://homeassistant.local:8123"},
+			srv:  srv,
+			want: "http://192.168.1.10:8123",
+		},
+		{
+			name: "base URL of older versions",
+			txt:  map[string]string{"base_url": "http://homeassistant.local:8123"},
+			want: "http://homeassistant.local:8123",
+		},
+		{
+			name: "SRV target resolved to its address",
+			txt:  map[string]string{"internal_url": ""},
+			srv:  srv,
+			addr: net.IPv4(192, 168, 1, 10),
+			want: "http://192.168.1.10:8123",
+		},
+		{
+			name: "unresolved SRV target",
+			srv:  srv,
+			want: "http://homeassistant.local:8123",
+		},
+		{
+			name: "IPv6 address",
+			srv:  srv,
+			addr: net.ParseIP("fe80::1"),
+			want: "http://[fe80::1]:8123",
+		},
+		{
+			name: "nothing announced",
+			txt:  map[string]string{"location_name": "Home"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, instanceURL(tt.txt, tt.srv, tt.addr))
+		})
+	}
+}
+
+func TestMDNSRecords(t *testing.T) {
+	records := newMDNSRecords()
+
+	// Home announces its internal URL, Garage only its SRV record and address
+	response := (&dnsResponse{}).
+		add(discoveryService, dnsTypePTR, dnsName("Home."+discoveryService)).
+		add("Home."+discoveryService, dnsTypeTXT, txtData("internal_url=http://192.168.1.10:8123")).
+		add(discoveryService, dnsTypePTR, dnsName("Garage."+discoveryService)).
+		add("Garage."+discoveryService, dnsTypeSRV, srvData(8123, "garage.local.")).
+		add("garage.local.", dnsTypeA, []byte{192, 168, 1, 20}).
+		add("_printer._tcp.local.", dnsTypePTR, dnsName("Printer._printer._tcp.local."))
+	require.NoError(t, records.parse(response.bytes()))
+
+	// Repeated answers do not duplicate instances
+	require.NoError(t, records.parse((&dnsResponse{}).add(discoveryService, dnsTypePTR, dnsName("Home."+discoveryService)).bytes()))
+
+	assert.Equal(t, []DiscoveredInstance{
+		{Name: "Home", URL: "http://192.168.1.10:8123"},
+		{Name: "Garage", URL: "http://192.168.1.20:8123"},
+	}, records.instances())
+}
+
+func TestMDNSRecords_Malformed(t *testing.T) {
+	valid := (&dnsResponse{}).add(discoveryService, dnsTypePTR, dnsName("Home."+discoveryService)).bytes()
+
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{name: "short header", msg: valid[:8]},
+		{name: "truncated record", msg: valid[:len(valid)-4]},
+		{name: "short SRV record", msg: (&dnsResponse{}).add("Home."+discoveryService, dnsTypeSRV, []byte{0, 0, 0}).bytes()},
+		// A record whose name points to itself
+		{name: "pointer loop", msg: []byte{0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0xC0, 12}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, newMDNSRecords().parse(tt.msg), errMalformedDNSMessage)
+		})
+	}
+}
+
+func TestMDNSQuery(t *testing.T) {
+	query := mdnsQuery(discoveryService, dnsTypePTR)
+
+	assert.Equal(t, uint16(1), binary.BigEndian.Uint16(query[4:]))
+	name, next, err := readDNSName(query, 12)
+	require.NoError(t, err)
+	assert.Equal(t, discoveryService, name)
+	assert.Equal(t, uint16(dnsTypePTR), binary.BigEndian.Uint16(query[next:]))
+	assert.Equal(t, uint16(dnsClassIN), binary.BigEndian.Uint16(query[next+2:]))
+}
@@ -23,6 +23,9 @@ const (
 	EntityInputDateTime = "input_datetime"
 	EntityTimer         = "timer"
 	EntityImage         = "image"
+
+	EntityMediaPlayer       = "media_player"
+	EntityAlarmControlPanel = "alarm_control_panel"
 )
 
 const (
@@ -0,0 +1,90 @@
+package hass
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+const (
+	defaultHeartbeatInterval = 30 * time.Second
+	defaultHeartbeatTimeout  = 10 * time.Second
+)
+
+// WithHeartbeat sets how often the connection is checked with a ping message and how long the pong is waited for.
+// A connection not answering in time is considered stale, e.g. half-open after a router reboot, and is reconnected.
+// An interval of 0 disables the heartbeat.
+func WithHeartbeat(interval, timeout time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.heartbeatInterval = interval
+		c.heartbeatTimeout = timeout
+	}
+}
+
+// heartbeat pings Home Assistant every interval until the receive loop of the connection is done.
+// A stale connection is closed, so its receive loop fails and reconnects.
+func (c *Client) heartbeat(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := c.clock.NewTicker(c.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+
+		// Home Assistant closes connections sending anything but the auth message before authentication
+		if !c.isAuthenticated.Load() || c.closing.Load() {
+			continue
+		}
+
+		started := c.clock.Now()
+		if err := c.ping(conn); err != nil {
+			metrics.HassHeartbeatFailures.Inc()
+			log.Warn().Err(err).Msg("Home Assistant connection is stale, reconnecting")
+			_ = conn.Close()
+			return
+		}
+		metrics.HassHeartbeatLatency.Observe(c.clock.Since(started).Seconds())
+	}
+}
+
+// ping sends a ping message over the connection and waits for the pong of the same ID
+func (c *Client) ping(conn *websocket.Conn) error {
+	c.activeReceiversMtx.Lock()
+	c.activeReceiversNum++
+	id := c.activeReceiversNum
+
+	payload, err := json.Marshal(BaseMessage{ID: id, Type: MessageTypePing})
+	if err != nil {
+		c.activeReceiversMtx.Unlock()
+		return fmt.Errorf("failed to marshal ping message: %w", err)
+	}
+
+	if c.activeReceivers == nil {
+		c.activeReceivers = make(map[int]chan interface{})
+	}
+	// The pong is buffered, so a late one does not block the receive loop
+	pongChan := make(chan interface{}, 1)
+	c.activeReceivers[id] = pongChan
+
+	err = conn.WriteMessage(websocket.TextMessage, payload)
+	c.activeReceiversMtx.Unlock()
+	defer c.closeReceiver(id)
+	if err != nil {
+		return fmt.Errorf("failed to send ping to Home Assistant: %w", err)
+	}
+
+	select {
+	case <-pongChan:
+		return nil
+	case <-c.clock.After(c.heartbeatTimeout):
+		return fmt.Errorf("no pong from Home Assistant within %s", c.heartbeatTimeout)
+	}
+}
@@ -0,0 +1,88 @@
+package hass
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// HistoryDuringPeriodMessage is a message sent to Home Assistant to read the recorded states of entities.
+// Type is "history/history_during_period".
+type HistoryDuringPeriodMessage struct {
+	BaseMessage
+	StartTime              time.Time `json:"start_time"`
+	EndTime                time.Time `json:"end_time"`
+	EntityIDs              []string  `json:"entity_ids"`
+	IncludeStartTimeState  bool      `json:"include_start_time_state"`
+	SignificantChangesOnly bool      `json:"significant_changes_only"`
+	MinimalResponse        bool      `json:"minimal_response"`
+	NoAttributes           bool      `json:"no_attributes"`
+}
+
+// compressedState is a state in the compressed format of the history websocket API.
+// Last changed is omitted if it equals last updated.
+type compressedState struct {
+	State       string          `json:"s"`
+	Attributes  json.RawMessage `json:"a"`
+	LastChanged float64         `json:"lc"`
+	LastUpdated float64         `json:"lu"`
+}
+
+// HistoryDuringPeriod reads the states of entities recorded between start and end, keyed by entity ID and
+// ordered by last updated. The first state of every entity is its state at start, so it is known what the
+// first recorded state changed from. Home Assistant does not record the context of historical states.
+func (c *Client) HistoryDuringPeriod(ctx context.Context, start, end time.Time, entityIDs []string) (map[string][]State, error) {
+	result, err := c.request(ctx, "history during period", func(id int) any {
+		return HistoryDuringPeriodMessage{
+			BaseMessage: BaseMessage{
+				ID:   id,
+				Type: "history/history_during_period",
+			},
+			StartTime:             start.UTC(),
+			EndTime:               end.UTC(),
+			EntityIDs:             entityIDs,
+			IncludeStartTimeState: true,
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var compressed map[string][]compressedState
+	if err := json.Unmarshal(result.Result, &compressed); err != nil {
+		return nil, fmt.Errorf("failed to parse history: %w", err)
+	}
+
+	history := make(map[string][]State, len(compressed))
+	for entityID, states := range compressed {
+		for _, s := range states {
+			lastChanged := s.LastChanged
+			if lastChanged == 0 {
+				lastChanged = s.LastUpdated
+			}
+			history[entityID] = append(history[entityID], State{
+				EntityID:    entityID,
+				State:       s.State,
+				Attributes:  s.Attributes,
+				LastChanged: unixTime(lastChanged),
+				LastUpdated: unixTime(s.LastUpdated),
+			})
+		}
+		sort.SliceStable(history[entityID], func(i, j int) bool {
+			return history[entityID][i].LastUpdated.Before(history[entityID][j].LastUpdated)
+		})
+	}
+
+	log.Debug().Int("id", result.ID).Int("entities", len(history)).Time("start", start).Time("end", end).Msg("Received history")
+	return history, nil
+}
+
+// unixTime converts a Unix timestamp in seconds with a fraction to a time, keeping microsecond precision
+func unixTime(seconds float64) time.Time {
+	return time.UnixMicro(int64(math.Round(seconds * 1e6))).UTC()
+}
@@ -13,9 +13,13 @@ const (
 	MessageTypeAuthOK       = "auth_ok"
 	MessageTypeAuthInvalid  = "auth_invalid"
 	MessageTypeEvent        = "event"
+	MessageTypePong         = "pong"
 
 	MessageTypeAuth            = "auth"
 	MessageTypeSubscribeEvents = "subscribe_events"
+
+	MessageTypeUnsubscribeEvents = "unsubscribe_events"
+	MessageTypePing              = "ping"
 )
 
 type BaseMessage struct {
@@ -59,9 +63,42 @@ type AuthInvalidMessage struct {
 	Message string `json:"message"`
 }
 
+// PongMessage is a message sent by Home Assistant in response to a ping message of the same ID.
+// Type is "pong".
+type PongMessage struct {
+	BaseMessage
+}
+
 type SubscribeEventsMessage struct {
 	BaseMessage
 	EventType EventType `json:"event_type,omitempty"`
+
+	// onError is the error handler of the subscription, it is not sent to Home Assistant
+	onError func(error)
+}
+
+// UnsubscribeEventsMessage is a message sent to Home Assistant to end the subscription of the given ID.
+// Type is "unsubscribe_events".
+type UnsubscribeEventsMessage struct {
+	BaseMessage
+	Subscription int `json:"subscription"`
+}
+
+// CallServiceMessage is a message sent to Home Assistant to call a service.
+// Type is "call_service".
+type CallServiceMessage struct {
+	BaseMessage
+	Domain      string         `json:"domain"`
+	Service     string         `json:"service"`
+	Target      *ServiceTarget `json:"target,omitempty"`
+	ServiceData map[string]any `json:"service_data,omitempty"`
+}
+
+// ServiceTarget selects the entities, devices and areas a service is called for
+type ServiceTarget struct {
+	EntityID []string `json:"entity_id,omitempty"`
+	DeviceID []string `json:"device_id,omitempty"`
+	AreaID   []string `json:"area_id,omitempty"`
 }
 
 type EventMessage struct {
@@ -72,7 +109,11 @@ type EventMessage struct {
 type EventType string
 
 const (
-	EventTypeStateChanged EventType = "state_changed"
+	EventTypeStateChanged         EventType = "state_changed"
+	EventTypeHomeAssistantStart   EventType = "homeassistant_start"
+	EventTypeHomeAssistantStarted EventType = "homeassistant_started"
+	EventTypeHomeAssistantStop    EventType = "homeassistant_stop"
+	EventTypeCoreConfigUpdated    EventType = "core_config_updated"
 )
 
 type State struct {
@@ -103,6 +144,9 @@ type Event struct {
 	Origin    string       `json:"origin"`
 	Context   EventContext `json:"context"`
 	Data      EventData    `json:"data"`
+
+	// RawData is the data of events other than state_changed, whose schema depends on the event type
+	RawData json.RawMessage `json:"-"`
 }
 
 func UnmarshalMessage(raw []byte) (interface{}, error) {
@@ -136,11 +180,28 @@ func UnmarshalMessage(raw []byte) (interface{}, error) {
 			return nil, fmt.Errorf("failed to unmarshal auth invalid message: %w", err)
 		}
 		return m, nil
+	case MessageTypePong:
+		var m PongMessage
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal pong message: %w", err)
+		}
+		return m, nil
 	case MessageTypeEvent:
 		var m EventMessage
 		if err := json.Unmarshal(raw, &m); err != nil {
 			return nil, fmt.Errorf("failed to unmarshal event message: %w", err)
 		}
+		if m.Event.EventType != EventTypeStateChanged {
+			var data struct {
+				Event struct {
+					Data json.RawMessage `json:"data"`
+				} `json:"event"`
+			}
+			if err := json.Unmarshal(raw, &data); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal event data: %w", err)
+			}
+			m.Event.RawData = data.Event.Data
+		}
 		return &m, nil // Return pointer to allow interface type checking
 	default:
 		return nil, fmt.Errorf("unknown message type: %s", m.Type)
@@ -0,0 +1,77 @@
+package hass
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	EventTypeEntityRegistryUpdated EventType = "entity_registry_updated"
+	EventTypeDeviceRegistryUpdated EventType = "device_registry_updated"
+	EventTypeAreaRegistryUpdated   EventType = "area_registry_updated"
+)
+
+// EntityRegistryEntry is an entity of the entity registry. Name and DeviceClass are set if overridden by the user.
+type EntityRegistryEntry struct {
+	EntityID            string  `json:"entity_id"`
+	Name                *string `json:"name"`
+	OriginalName        *string `json:"original_name"`
+	Platform            string  `json:"platform"`
+	DeviceID            *string `json:"device_id"`
+	AreaID              *string `json:"area_id"`
+	DeviceClass         *string `json:"device_class"`
+	OriginalDeviceClass *string `json:"original_device_class"`
+}
+
+// DeviceRegistryEntry is a device of the device registry. NameByUser is set if the device was renamed by the user.
+type DeviceRegistryEntry struct {
+	ID         string  `json:"id"`
+	Name       *string `json:"name"`
+	NameByUser *string `json:"name_by_user"`
+	AreaID     *string `json:"area_id"`
+}
+
+// AreaRegistryEntry is an area of the area registry
+type AreaRegistryEntry struct {
+	AreaID string `json:"area_id"`
+	Name   string `json:"name"`
+}
+
+// EntityRegistry lists the entities of the entity registry
+func (c *Client) EntityRegistry(ctx context.Context) ([]EntityRegistryEntry, error) {
+	return listRegistry[EntityRegistryEntry](ctx, c, "entity")
+}
+
+// DeviceRegistry lists the devices of the device registry
+func (c *Client) DeviceRegistry(ctx context.Context) ([]DeviceRegistryEntry, error) {
+	return listRegistry[DeviceRegistryEntry](ctx, c, "device")
+}
+
+// AreaRegistry lists the areas of the area registry
+func (c *Client) AreaRegistry(ctx context.Context) ([]AreaRegistryEntry, error) {
+	return listRegistry[AreaRegistryEntry](ctx, c, "area")
+}
+
+// listRegistry lists the entries of a registry with the config/<registry>_registry/list command
+func listRegistry[T any](ctx context.Context, c *Client, registry string) ([]T, error) {
+	result, err := c.request(ctx, registry+" registry", func(id int) any {
+		return BaseMessage{
+			ID:   id,
+			Type: "config/" + registry + "_registry/list",
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []T
+	if err := json.Unmarshal(result.Result, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse %s registry: %w", registry, err)
+	}
+
+	log.Debug().Int("id", result.ID).Int("entries", len(entries)).Msgf("Received %s registry", registry)
+	return entries, nil
+}
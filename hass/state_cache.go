@@ -0,0 +1,109 @@
+package hass
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrUnknownEntity is returned when Home Assistant has no state of the requested entity
+var ErrUnknownEntity = errors.New("unknown entity")
+
+// WithStateCache enables caching of states returned by StateOf. The cache is kept up to date
+// by state_changed events of active subscriptions and fully refreshed when older than ttl,
+// which bounds drift caused by events missed e.g. while reconnecting.
+func WithStateCache(ttl time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.stateCache = &stateCache{ttl: ttl}
+	}
+}
+
+// stateCache holds the latest known state of every entity
+type stateCache struct {
+	ttl time.Duration
+
+	mtx         sync.RWMutex
+	states      map[string]State
+	refreshedAt time.Time
+}
+
+func (s *stateCache) get(entityID string) (State, bool, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.states == nil || time.Since(s.refreshedAt) > s.ttl {
+		return State{}, false, false
+	}
+
+	state, ok := s.states[entityID]
+	return state, ok, true
+}
+
+func (s *stateCache) replace(states []State) {
+	byEntity := make(map[string]State, len(states))
+	for _, state := range states {
+		byEntity[state.EntityID] = state
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.states = byEntity
+	s.refreshedAt = time.Now()
+}
+
+// update applies a state_changed event to the cache
+func (s *stateCache) update(event *EventMessage) {
+	if event.Event.EventType != EventTypeStateChanged {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.states == nil {
+		return
+	}
+
+	if event.Event.Data.NewState == nil {
+		delete(s.states, event.Event.Data.EntityID)
+		return
+	}
+	s.states[event.Event.Data.EntityID] = *event.Event.Data.NewState
+}
+
+func (s *stateCache) invalidate() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.states = nil
+}
+
+// StateOf returns the current state of an entity. Without a state cache (see WithStateCache)
+// every call fetches all states from Home Assistant.
+func (c *Client) StateOf(ctx context.Context, entityID string) (*State, error) {
+	if c.stateCache != nil {
+		if state, ok, fresh := c.stateCache.get(entityID); fresh {
+			if !ok {
+				return nil, ErrUnknownEntity
+			}
+			return &state, nil
+		}
+	}
+
+	states, err := c.GetStates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.stateCache != nil {
+		c.stateCache.replace(states)
+	}
+
+	for i := range states {
+		if states[i].EntityID == entityID {
+			return &states[i], nil
+		}
+	}
+
+	return nil, ErrUnknownEntity
+}
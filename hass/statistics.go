@@ -0,0 +1,95 @@
+package hass
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// StatisticsDuringPeriodMessage is a message sent to Home Assistant to read the long-term statistics of the recorder.
+// Type is "recorder/statistics_during_period".
+type StatisticsDuringPeriodMessage struct {
+	BaseMessage
+	StartTime    time.Time `json:"start_time"`
+	EndTime      time.Time `json:"end_time"`
+	StatisticIDs []string  `json:"statistic_ids,omitempty"`
+	Period       string    `json:"period"`
+	Types        []string  `json:"types"`
+}
+
+// Statistic is a long-term statistic of an entity, e.g. a sensor, aggregated over a period.
+// Measurements have a mean, min and max; meters have a state and a sum. Missing values are nil.
+type Statistic struct {
+	Start     time.Time
+	End       time.Time
+	Mean      *float64
+	Min       *float64
+	Max       *float64
+	State     *float64
+	Sum       *float64
+	LastReset *time.Time
+}
+
+// statisticMessage is a statistic as sent by Home Assistant, with timestamps in milliseconds
+type statisticMessage struct {
+	Start     float64  `json:"start"`
+	End       float64  `json:"end"`
+	Mean      *float64 `json:"mean"`
+	Min       *float64 `json:"min"`
+	Max       *float64 `json:"max"`
+	State     *float64 `json:"state"`
+	Sum       *float64 `json:"sum"`
+	LastReset *float64 `json:"last_reset"`
+}
+
+// StatisticsDuringPeriod reads the hourly long-term statistics starting between start and end, keyed by statistic ID
+// and ordered by start. Statistics of all entities are read if statisticIDs is empty.
+func (c *Client) StatisticsDuringPeriod(ctx context.Context, start, end time.Time, statisticIDs []string) (map[string][]Statistic, error) {
+	result, err := c.request(ctx, "statistics during period", func(id int) any {
+		return StatisticsDuringPeriodMessage{
+			BaseMessage: BaseMessage{
+				ID:   id,
+				Type: "recorder/statistics_during_period",
+			},
+			StartTime:    start.UTC(),
+			EndTime:      end.UTC(),
+			StatisticIDs: statisticIDs,
+			Period:       "hour",
+			Types:        []string{"mean", "min", "max", "state", "sum", "last_reset"},
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var messages map[string][]statisticMessage
+	if err := json.Unmarshal(result.Result, &messages); err != nil {
+		return nil, fmt.Errorf("failed to parse statistics: %w", err)
+	}
+
+	statistics := make(map[string][]Statistic, len(messages))
+	for statisticID, rows := range messages {
+		for _, s := range rows {
+			statistic := Statistic{
+				Start: unixTime(s.Start / 1e3),
+				End:   unixTime(s.End / 1e3),
+				Mean:  s.Mean,
+				Min:   s.Min,
+				Max:   s.Max,
+				State: s.State,
+				Sum:   s.Sum,
+			}
+			if s.LastReset != nil {
+				lastReset := unixTime(*s.LastReset / 1e3)
+				statistic.LastReset = &lastReset
+			}
+			statistics[statisticID] = append(statistics[statisticID], statistic)
+		}
+	}
+
+	log.Debug().Int("id", result.ID).Int("statistics", len(statistics)).Time("start", start).Time("end", end).Msg("Received statistics")
+	return statistics, nil
+}
@@ -0,0 +1,49 @@
+package hass
+
+import (
+	"sort"
+	"time"
+)
+
+// ClientStatus is a snapshot of the connection and subscriptions of a client, e.g. for diagnostics
+type ClientStatus struct {
+	Authenticated bool      `json:"authenticated"`
+	Reconnecting  bool      `json:"reconnecting"`
+	Paused        bool      `json:"paused"`
+	PausedAt      time.Time `json:"paused_at,omitempty"`
+	// PendingRequests is the number of commands waiting for their result, including subscriptions
+	PendingRequests int                  `json:"pending_requests"`
+	Subscriptions   []SubscriptionStatus `json:"subscriptions"`
+}
+
+// SubscriptionStatus is an active subscription to events
+type SubscriptionStatus struct {
+	ID        int       `json:"id"`
+	EventType EventType `json:"event_type,omitempty"`
+}
+
+// Status returns a snapshot of the connection and subscriptions of the client
+func (c *Client) Status() ClientStatus {
+	c.reconnectMu.Lock()
+	status := ClientStatus{
+		Authenticated: c.isAuthenticated.Load(),
+		Reconnecting:  c.isReconnecting,
+		Paused:        c.isPausedLocked(),
+	}
+	if status.Paused {
+		status.PausedAt = c.pausedAt
+	}
+	for _, sub := range c.subscriptions {
+		status.Subscriptions = append(status.Subscriptions, SubscriptionStatus{ID: sub.id, EventType: sub.eventType})
+	}
+	c.reconnectMu.Unlock()
+
+	c.activeReceiversMtx.Lock()
+	status.PendingRequests = len(c.activeReceivers)
+	c.activeReceiversMtx.Unlock()
+
+	sort.Slice(status.Subscriptions, func(i, j int) bool {
+		return status.Subscriptions[i].ID < status.Subscriptions[j].ID
+	})
+	return status
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// logLevelHandler serves the global log level, restoring the previous one after a temporary change
+type logLevelHandler struct {
+	token string
+
+	mtx sync.Mutex
+	// reset restores restoreLevel once a temporary change expires, nil without one
+	reset        *time.Timer
+	restoreLevel zerolog.Level
+	// changes counts the changes, so a restore replaced by a later change is skipped
+	changes int
+}
+
+// EnableLogLevelEndpoint serves /admin/loglevel, authenticated by the bearer token. GET returns the global
+// log level and PUT or POST sets it from the level parameter, e.g. level=debug. With the for parameter,
+// e.g. for=15m, the previous level is restored after the duration. The endpoint is not served without a token.
+func (s *Server) EnableLogLevelEndpoint(token string) {
+	if token == "" {
+		return
+	}
+	s.mux.Handle("/admin/loglevel", &logLevelHandler{token: token})
+}
+
+func (h *logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="hass2ch"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level, err := zerolog.ParseLevel(r.FormValue("level"))
+		if err != nil || level == zerolog.NoLevel {
+			http.Error(w, fmt.Sprintf("invalid log level %q", r.FormValue("level")), http.StatusBadRequest)
+			return
+		}
+
+		var duration time.Duration
+		if value := r.FormValue("for"); value != "" {
+			if duration, err = time.ParseDuration(value); err != nil || duration <= 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		h.setLevel(level, duration)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, _ = fmt.Fprintln(w, zerolog.GlobalLevel().String())
+}
+
+// setLevel sets the global log level, for the duration if positive. A change replaces a pending restore,
+// keeping the level before the first temporary change as the one to restore.
+func (h *logLevelHandler) setLevel(level zerolog.Level, duration time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	previous := zerolog.GlobalLevel()
+	if h.reset != nil {
+		h.reset.Stop()
+		h.reset = nil
+		previous = h.restoreLevel
+	}
+
+	h.changes++
+	zerolog.SetGlobalLevel(level)
+	event := log.Log().Str("level", level.String())
+	if duration > 0 {
+		h.restoreLevel = previous
+		change := h.changes
+		h.reset = time.AfterFunc(duration, func() { h.restore(change) })
+		event = event.Dur("for", duration).Str("restore_level", previous.String())
+	}
+	event.Msg("Changed log level")
+}
+
+func (h *logLevelHandler) restore(change int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if change != h.changes {
+		return
+	}
+	h.reset = nil
+	zerolog.SetGlobalLevel(h.restoreLevel)
+	log.Log().Str("level", h.restoreLevel.String()).Msg("Restored log level")
+}
@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func logLevelRequest(t *testing.T, server *httptest.Server, method, authorization string, form url.Values) (int, http.Header, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+"/admin/loglevel", strings.NewReader(form.Encode()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, resp.Header, strings.TrimSpace(string(body))
+}
+
+func TestLogLevelEndpoint(t *testing.T) {
+	previous := zerolog.GlobalLevel()
+	t.Cleanup(func() { zerolog.SetGlobalLevel(previous) })
+
+	s := NewServer(":0")
+	s.EnableLogLevelEndpoint("secret")
+	server := httptest.NewServer(s.mux)
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		form          url.Values
+		wantStatus    int
+		wantBody      string
+		wantLevel     zerolog.Level
+	}{
+		{
+			name:       "missing token",
+			method:     http.MethodGet,
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "unauthorized",
+			wantLevel:  zerolog.InfoLevel,
+		},
+		{
+			name:          "rejected token",
+			method:        http.MethodPut,
+			authorization: "Bearer guess",
+			form:          url.Values{"level": {"debug"}},
+			wantStatus:    http.StatusUnauthorized,
+			wantBody:      "unauthorized",
+			wantLevel:     zerolog.InfoLevel,
+		},
+		{
+			name:          "token of another scheme",
+			method:        http.MethodPut,
+			authorization: "Basic secret",
+			form:          url.Values{"level": {"debug"}},
+			wantStatus:    http.StatusUnauthorized,
+			wantBody:      "unauthorized",
+			wantLevel:     zerolog.InfoLevel,
+		},
+		{
+			name:          "prefix of the token",
+			method:        http.MethodGet,
+			authorization: "Bearer secre",
+			wantStatus:    http.StatusUnauthorized,
+			wantBody:      "unauthorized",
+			wantLevel:     zerolog.InfoLevel,
+		},
+		{
+			name:          "current level",
+			method:        http.MethodGet,
+			authorization: "Bearer secret",
+			wantStatus:    http.StatusOK,
+			wantBody:      "info",
+			wantLevel:     zerolog.InfoLevel,
+		},
+		{
+			name:          "level changed",
+			method:        http.MethodPut,
+			authorization: "Bearer secret",
+			form:          url.Values{"level": {"debug"}},
+			wantStatus:    http.StatusOK,
+			wantBody:      "debug",
+			wantLevel:     zerolog.DebugLevel,
+		},
+		{
+			name:          "invalid level",
+			method:        http.MethodPost,
+			authorization: "Bearer secret",
+			form:          url.Values{"level": {"verbose"}},
+			wantStatus:    http.StatusBadRequest,
+			wantBody:      `invalid log level "verbose"`,
+			wantLevel:     zerolog.InfoLevel,
+		},
+		{
+			name:          "invalid duration",
+			method:        http.MethodPost,
+			authorization: "Bearer secret",
+			form:          url.Values{"level": {"debug"}, "for": {"-1m"}},
+			wantStatus:    http.StatusBadRequest,
+			wantBody:      `invalid duration "-1m"`,
+			wantLevel:     zerolog.InfoLevel,
+		},
+		{
+			name:          "unsupported method",
+			method:        http.MethodDelete,
+			authorization: "Bearer secret",
+			wantStatus:    http.StatusMethodNotAllowed,
+			wantBody:      "method not allowed",
+			wantLevel:     zerolog.InfoLevel,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+			status, header, body := logLevelRequest(t, server, tt.method, tt.authorization, tt.form)
+			assert.Equal(t, tt.wantStatus, status)
+			assert.Equal(t, tt.wantBody, body)
+			assert.Equal(t, tt.wantLevel, zerolog.GlobalLevel())
+			if tt.wantStatus == http.StatusUnauthorized {
+				assert.Equal(t, `Bearer realm="hass2ch"`, header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestLogLevelEndpoint_Temporary(t *testing.T) {
+	previous := zerolog.GlobalLevel()
+	t.Cleanup(func() { zerolog.SetGlobalLevel(previous) })
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	s := NewServer(":0")
+	s.EnableLogLevelEndpoint("secret")
+	server := httptest.NewServer(s.mux)
+	defer server.Close()
+
+	// A later temporary change keeps the level before the first one to restore
+	status, _, _ := logLevelRequest(t, server, http.MethodPut, "Bearer secret", url.Values{"level": {"debug"}, "for": {"1h"}})
+	require.Equal(t, http.StatusOK, status)
+	status, _, body := logLevelRequest(t, server, http.MethodPut, "Bearer secret", url.Values{"level": {"trace"}, "for": {"50ms"}})
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "trace", body)
+
+	require.Eventually(t, func() bool {
+		return zerolog.GlobalLevel() == zerolog.InfoLevel
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLogLevelEndpoint_DisabledWithoutToken(t *testing.T) {
+	s := NewServer(":0")
+	s.EnableLogLevelEndpoint("")
+	server := httptest.NewServer(s.mux)
+	defer server.Close()
+
+	status, _, _ := logLevelRequest(t, server, http.MethodGet, "Bearer ", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+}
@@ -38,12 +38,140 @@ var (
 		Help: "The total number of database operations by type and status",
 	}, []string{"operation", "status"})
 
+	ContextGroupSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "hass2ch_context_group_size",
+		Help:    "Number of state changes of groups sharing a context released by context grouping",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+	})
+
 	BatchProcessingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
 		Name:    "hass2ch_batch_processing_duration_seconds",
 		Help:    "Duration of processing a batch of events",
 		Buckets: prometheus.DefBuckets,
 	})
 
+	InsertWrittenRowsMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_insert_written_rows_mismatches_total",
+		Help: "The total number of inserts where ClickHouse reported a different number of written rows than sent",
+	})
+
+	InsertRowsNotWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_insert_rows_not_written_total",
+		Help: "The total number of sent rows that ClickHouse reported as not written",
+	})
+
+	LateEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_late_events_total",
+		Help: "The total number of state changes flagged as late by table",
+	}, []string{"table"})
+
+	OverflowRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_overflow_rows_total",
+		Help: "The total number of rows stored in overflow tables because their state does not fit the table type, by table",
+	}, []string{"table"})
+
+	TableQueuedRows = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hass2ch_table_queued_rows",
+		Help: "The number of events passed by filters and not inserted yet, by destination table",
+	}, []string{"table"})
+
+	TableOldestPendingAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hass2ch_table_oldest_pending_event_age_seconds",
+		Help: "The time since the oldest event not inserted yet was received, by destination table (0 if none is pending)",
+	}, []string{"table"})
+
+	HassLifecycleEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_hass_lifecycle_events_total",
+		Help: "The total number of Home Assistant start, stop and core configuration change events recorded in the restarts table",
+	}, []string{"event_type"})
+
+	AttributeDiffRows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_attribute_diff_rows_total",
+		Help: "The total number of state change rows storing only the attributes changed since the old state",
+	})
+
+	HeartbeatsEmitted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_heartbeats_emitted_total",
+		Help: "The total number of heartbeat rows emitted for entities without state changes",
+	})
+
+	CHInsertUncompressedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_clickhouse_insert_uncompressed_bytes_total",
+		Help: "The total size of insert payloads before compression, by table",
+	}, []string{"table"})
+
+	CHInsertSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_clickhouse_insert_sent_bytes_total",
+		Help: "The total size of insert payloads sent over the wire, by table",
+	}, []string{"table"})
+
+	CHInsertRowsPerSecond = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hass2ch_clickhouse_insert_rows_per_second",
+		Help:    "Rows per second of successful inserts, by table",
+		Buckets: prometheus.ExponentialBuckets(10, 4, 8),
+	}, []string{"table"})
+
+	EventsOriginFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_events_origin_filtered_total",
+		Help: "The total number of state changes dropped by the origin filter, by reason (origin or actor)",
+	}, []string{"reason"})
+
+	EventsRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_events_rate_limited_total",
+		Help: "The total number of state changes dropped by the rate limit of their entity, by entity",
+	}, []string{"entity_id"})
+
+	FlapsDetected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_flaps_detected_total",
+		Help: "The total number of times an entity started flapping, by entity",
+	}, []string{"entity_id"})
+
+	FlapStateChangesCollapsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_flap_state_changes_collapsed_total",
+		Help: "The total number of state changes of flapping entities collapsed into a single row, by entity",
+	}, []string{"entity_id"})
+
+	ShardEventsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_shard_events_skipped_total",
+		Help: "The total number of events of entities ingested by other shards",
+	})
+
+	DeadLetterRows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_dead_letter_rows_total",
+		Help: "The total number of rows inserted into the dead-letter table",
+	})
+
+	PanicsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_panics_total",
+		Help: "The total number of recovered panics by component",
+	}, []string{"component"})
+
+	// Worker pool metrics
+	PoolTasksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_pool_tasks_total",
+		Help: "The total number of tasks processed by worker pools by pool and status",
+	}, []string{"pool", "status"})
+
+	PoolBusyWorkers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hass2ch_pool_busy_workers",
+		Help: "The number of workers processing a task by pool",
+	}, []string{"pool"})
+
+	PoolWorkerTasksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_pool_worker_tasks_total",
+		Help: "The total number of tasks processed by pool and worker",
+	}, []string{"pool", "worker"})
+
+	PoolWorkerBusySeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_pool_worker_busy_seconds_total",
+		Help: "The total time spent processing tasks by pool and worker",
+	}, []string{"pool", "worker"})
+
+	ConfigInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hass2ch_config_info",
+		Help: "Always 1, labeled with the checksum of the effective configuration and the version",
+	}, []string{"checksum", "version"})
+
 	// Home Assistant client metrics
 	HassConnectionStatus = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "hass2ch_hass_connection_status",
@@ -55,6 +183,122 @@ var (
 		Help: "Total number of reconnection attempts to Home Assistant",
 	})
 
+	HassReconnectProbeMode = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "hass2ch_hass_reconnect_probe_mode",
+		Help: "Whether the reconnect attempt budget is exhausted and Home Assistant is only probed slowly (1) or not (0)",
+	})
+
+	HassHeartbeatFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_hass_heartbeat_failures_total",
+		Help: "Total number of Home Assistant connections reconnected because a ping was not answered in time",
+	})
+
+	HassHeartbeatLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "hass2ch_hass_heartbeat_latency_seconds",
+		Help:    "Round-trip time of pings to Home Assistant",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	HassSubscriptionFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_hass_subscription_fallbacks_total",
+		Help: "Total number of rejected subscriptions to all events replaced by subscriptions to each fallback event type",
+	})
+
+	HassSubscriptionsPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "hass2ch_hass_subscriptions_paused",
+		Help: "Whether subscriptions to Home Assistant are paused because of backpressure (1) or not (0)",
+	})
+
+	EventTypeEventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_event_type_events_received_total",
+		Help: "The total number of events of additional event types received from Home Assistant",
+	}, []string{"event_type"})
+
+	DeadLettersRecovered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_dead_letters_recovered_total",
+		Help: "Total number of dead letters inserted into their destination table again and deleted by the dlq retry command",
+	})
+
+	MemoryPressureFlushes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_memory_pressure_flushes_total",
+		Help: "Total number of early flushes of pending batches because the heap exceeded the soft memory limit",
+	})
+
+	BackpressurePauses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_backpressure_pauses_total",
+		Help: "Total number of times subscriptions were paused because events in flight exceeded the high-water mark",
+	})
+
+	BackpressureSnapshotEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_backpressure_snapshot_events_total",
+		Help: "Total number of state changes synthesized from the states fetched after subscriptions were resumed",
+	})
+
+	InitialSnapshotEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_initial_snapshot_events_total",
+		Help: "Total number of states inserted by the initial snapshot on startup",
+	})
+
+	WALSegments = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "hass2ch_wal_segments",
+		Help: "Number of write-ahead log segments waiting for replay",
+	})
+
+	WALBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "hass2ch_wal_bytes",
+		Help: "Size of write-ahead log segments waiting for replay in bytes",
+	})
+
+	WALSpilledRows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_wal_spilled_rows_total",
+		Help: "Total number of rows spilled to the write-ahead log because ClickHouse was unavailable",
+	})
+
+	WALReplayedRows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_wal_replayed_rows_total",
+		Help: "Total number of rows of the write-ahead log inserted into ClickHouse",
+	})
+
+	WALRejectedSegments = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_wal_rejected_segments_total",
+		Help: "Total number of write-ahead log segments rejected by ClickHouse and set aside",
+	})
+
+	EventsAcknowledged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_events_acknowledged_total",
+		Help: "Total number of events acknowledged to a source buffering them until they are stored",
+	})
+
+	SubscriptionGaps = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_subscription_gaps_total",
+		Help: "Total number of windows in which state_changed events may have been missed because the connection was lost",
+	})
+
+	EventsMissedEstimate = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_events_missed_estimate_total",
+		Help: "Estimated number of state changes missed while the connection was lost: entities updated within a gap but not received, a lower bound",
+	})
+
+	GapBackfillEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_gap_backfill_events_total",
+		Help: "Total number of state changes missed in gaps and inserted from the history of Home Assistant",
+	})
+
+	GapResyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_gap_resyncs_total",
+		Help: "Total number of gaps re-synced from the history of Home Assistant, by status (resynced, failed)",
+	}, []string{"status"})
+
+	HassSubscriptionRestoreFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hass2ch_hass_subscription_restore_failures_total",
+		Help: "Total number of subscriptions that failed to be restored after a reconnection",
+	})
+
+	HassRequestsDeduplicated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_hass_requests_deduplicated_total",
+		Help: "Total number of Home Assistant requests served by an identical request already in flight",
+	}, []string{"request"})
+
 	// ClickHouse client metrics
 	CHConnectionStatus = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "hass2ch_clickhouse_connection_status",
@@ -67,6 +311,26 @@ var (
 		Buckets: prometheus.DefBuckets,
 	}, []string{"query_type"})
 
+	CHAsyncInserts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_clickhouse_async_inserts_total",
+		Help: "Total number of asynchronous inserts into the tables of hass2ch flushed by ClickHouse, by database, table and status (Ok, ParsingError, FlushError), read from system.asynchronous_insert_log",
+	}, []string{"database", "table", "status"})
+
+	CHAsyncInsertRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_clickhouse_async_insert_rows_total",
+		Help: "Total number of rows of asynchronous inserts into the tables of hass2ch, by database, table and status, read from system.asynchronous_insert_log",
+	}, []string{"database", "table", "status"})
+
+	CHPartsCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hass2ch_clickhouse_parts_created_total",
+		Help: "Total number of parts created in the tables of hass2ch by inserts, by database and table, read from system.part_log",
+	}, []string{"database", "table"})
+
+	OrphanedTables = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "hass2ch_orphaned_tables",
+		Help: "Number of tables in the databases of hass2ch not produced by the current configuration, found on startup",
+	})
+
 	CHRetryAttempts = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "hass2ch_clickhouse_retry_attempts_total",
 		Help: "Total number of retry attempts for ClickHouse operations",
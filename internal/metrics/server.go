@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -13,6 +14,10 @@ import (
 // Server represents an HTTP server for exposing Prometheus metrics
 type Server struct {
 	httpServer *http.Server
+	mux        *http.ServeMux
+
+	readinessMtx sync.RWMutex
+	readiness    func() error
 }
 
 // NewServer creates a new metrics server that will listen on the given address
@@ -26,13 +31,44 @@ func NewServer(addr string) *Server {
 		_, _ = w.Write([]byte("OK"))
 	})
 
-	return &Server{
+	s := &Server{
+		mux: mux,
 		httpServer: &http.Server{
 			Addr:              addr,
 			Handler:           mux,
 			ReadHeaderTimeout: 5 * time.Second,
 		},
 	}
+
+	// Readiness endpoint, ready unless a readiness check fails
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.checkReadiness(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	return s
+}
+
+// SetReadinessCheck sets the check backing the /ready endpoint, e.g. the readiness of a pipeline
+func (s *Server) SetReadinessCheck(check func() error) {
+	s.readinessMtx.Lock()
+	defer s.readinessMtx.Unlock()
+
+	s.readiness = check
+}
+
+func (s *Server) checkReadiness() error {
+	s.readinessMtx.RLock()
+	defer s.readinessMtx.RUnlock()
+
+	if s.readiness == nil {
+		return nil
+	}
+	return s.readiness()
 }
 
 // Start starts the HTTP server for metrics
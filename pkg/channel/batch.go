@@ -3,6 +3,9 @@ package channel
 import (
 	"sync"
 	"time"
+
+	"github.com/jkaflik/hass2ch/pkg/clock"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
 )
 
 type Partitioner[T any] func(T) (string, error)
@@ -18,6 +21,35 @@ type BatchOptions[T any] struct {
 	// It can be used to batch items together that share a common key.
 	// If PartitionBy is nil, all items are batched together.
 	PartitionBy Partitioner[T]
+
+	// GroupBy returns the group of an item, empty for none. A batch reaching MaxSize is not sent while
+	// consecutive items of the group of its last item arrive, but before the first item of another group,
+	// so MaxSize does not split groups. If GroupBy is nil, batches are sent as soon as they reach MaxSize.
+	GroupBy func(T) string
+
+	// SizeOf estimates the size of an item in bytes, e.g. of its encoded form. It is required by MaxBytes
+	// and MaxPendingBytes.
+	SizeOf func(T) int
+
+	// MaxBytes is the maximum estimated size of a batch in bytes, see SizeOf. A batch reaching it is sent like
+	// one reaching MaxSize. If MaxBytes is 0, batches are limited by MaxSize only.
+	MaxBytes int
+
+	// MaxPendingBytes is the budget of the estimated size of the items pending in all batches. While it is
+	// exceeded, the largest batches are sent early regardless of their size, age and group, so many partitions
+	// filling up at once cannot hold more items in memory. If MaxPendingBytes is 0, there is no budget.
+	MaxPendingBytes int
+
+	// Flush sends all pending batches regardless of their size and age when it receives a value.
+	// If Flush is nil, batches are only sent by MaxSize and MaxWait.
+	Flush <-chan struct{}
+
+	// Align sends all pending batches at every multiple of Align of the wall clock, e.g. at :00 of every minute,
+	// instead of MaxWait after their first item. Batches are still sent early by MaxSize and Flush.
+	Align time.Duration
+
+	// Clock times MaxWait and Align. If Clock is nil, the real clock is used.
+	Clock clock.Clock
 }
 
 func (o *BatchOptions[T]) defaults() {
@@ -28,6 +60,8 @@ func (o *BatchOptions[T]) defaults() {
 	if o.MaxWait == 0 {
 		o.MaxWait = 60 * time.Second
 	}
+
+	o.Clock = clock.OrReal(o.Clock)
 }
 
 func Batch[T any](in chan T, opts BatchOptions[T]) (chan []T, chan error) {
@@ -40,55 +74,145 @@ func Batch[T any](in chan T, opts BatchOptions[T]) (chan []T, chan error) {
 		defer close(errc)
 		var batches map[string][]T
 		var batchesMtx sync.Mutex
-		var timers map[string]*time.Timer
-		for {
-			select {
-			case item, ok := <-in:
-				if !ok {
+		var timers map[string]clock.Timer
+
+		// sizes are the estimated sizes of the batches, tracked with SizeOf only
+		sizes := make(map[string]int)
+		pending := 0
+		sizeOf := opts.SizeOf
+		if sizeOf == nil {
+			sizeOf = func(T) int { return 0 }
+		}
+
+		// send sends a pending batch, batchesMtx must be held
+		send := func(key string) {
+			stopTimer(timers, key)
+			out <- batches[key]
+			delete(batches, key)
+			pending -= sizes[key]
+			delete(sizes, key)
+		}
+		full := func(key string) bool {
+			return len(batches[key]) >= opts.MaxSize || (opts.MaxBytes > 0 && sizes[key] >= opts.MaxBytes)
+		}
+
+		var aligned clock.Timer
+		var alignedC <-chan time.Time
+		if opts.Align > 0 {
+			aligned = opts.Clock.NewTimer(untilAligned(opts.Clock.Now(), opts.Align))
+			defer aligned.Stop()
+			alignedC = aligned.C()
+		}
+
+		// Items that make PartitionBy panic are dropped
+		recovery.Run("channel_batch", func() {
+			for {
+				select {
+				case item, ok := <-in:
+					if !ok {
+						batchesMtx.Lock()
+						for _, batch := range batches {
+							out <- batch
+						}
+						return
+					}
+
+					key := ""
+					if opts.PartitionBy != nil {
+						var err error
+						key, err = opts.PartitionBy(item)
+						if err != nil {
+							errc <- err
+							continue
+						}
+					}
+
 					batchesMtx.Lock()
-					for _, batch := range batches {
-						out <- batch
+
+					if batches == nil {
+						batches = make(map[string][]T)
+						timers = make(map[string]clock.Timer)
 					}
-					return
-				}
 
-				key := ""
-				if opts.PartitionBy != nil {
-					var err error
-					key, err = opts.PartitionBy(item)
-					if err != nil {
-						errc <- err
-						continue
+					// A full batch held back for the group of its last item is sent before an item of another group
+					if batch, ok := batches[key]; ok && full(key) && !sameGroup(opts.GroupBy, batch[len(batch)-1], item) {
+						send(key)
 					}
-				}
 
-				batchesMtx.Lock()
+					size := sizeOf(item)
+					sizes[key] += size
+					pending += size
 
-				if batches == nil {
-					batches = make(map[string][]T)
-					timers = make(map[string]*time.Timer)
-				}
+					if _, ok := batches[key]; !ok {
+						batches[key] = []T{item}
+						// Aligned batches are sent together on the next boundary
+						if aligned == nil {
+							timers[key] = opts.Clock.AfterFunc(opts.MaxWait, func() {
+								batchesMtx.Lock()
+								defer batchesMtx.Unlock()
+								// The batch might have been sent by MaxSize or Flush meanwhile
+								if _, ok := batches[key]; ok {
+									send(key)
+								}
+							})
+						}
+					} else {
+						batches[key] = append(batches[key], item)
+					}
+					if full(key) && (opts.GroupBy == nil || opts.GroupBy(item) == "") {
+						send(key)
+					}
 
-				if _, ok := batches[key]; !ok {
-					batches[key] = []T{item}
-					timers[key] = time.AfterFunc(opts.MaxWait, func() {
-						batchesMtx.Lock()
-						defer batchesMtx.Unlock()
-						out <- batches[key]
-						delete(batches, key)
-					})
-				} else {
-					batches[key] = append(batches[key], item)
-					if len(batches[key]) == opts.MaxSize {
-						timers[key].Stop()
-						out <- batches[key]
-						delete(batches, key)
+					// The largest batches are sent until the pending items fit the budget
+					for opts.MaxPendingBytes > 0 && pending > opts.MaxPendingBytes && len(batches) > 0 {
+						largest := ""
+						for key := range batches {
+							if _, ok := batches[largest]; !ok || sizes[key] > sizes[largest] {
+								largest = key
+							}
+						}
+						send(largest)
 					}
-				}
 
-				batchesMtx.Unlock()
+					batchesMtx.Unlock()
+				case <-opts.Flush:
+					batchesMtx.Lock()
+					for key := range batches {
+						send(key)
+					}
+					batchesMtx.Unlock()
+				case <-alignedC:
+					batchesMtx.Lock()
+					for key := range batches {
+						send(key)
+					}
+					batchesMtx.Unlock()
+					aligned.Reset(untilAligned(opts.Clock.Now(), opts.Align))
+				}
 			}
-		}
+		})
 	}()
 	return out, errc
 }
+
+// sameGroup reports whether two items belong to the same non-empty group
+func sameGroup[T any](groupBy func(T) string, a, b T) bool {
+	if groupBy == nil {
+		return false
+	}
+	group := groupBy(a)
+	return group != "" && group == groupBy(b)
+}
+
+// stopTimer stops the MaxWait timer of a batch, if any
+func stopTimer(timers map[string]clock.Timer, key string) {
+	if timer, ok := timers[key]; ok {
+		timer.Stop()
+		delete(timers, key)
+	}
+}
+
+// untilAligned returns the time from now until the next multiple of align of the wall clock
+func untilAligned(now time.Time, align time.Duration) time.Duration {
+	return now.Truncate(align).Add(align).Sub(now)
+}
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/jkaflik/hass2ch/pkg/clock"
 )
 
 var partitionByFirstLetter = func(s string) (string, error) {
@@ -64,8 +66,8 @@ func TestBatch(t *testing.T) {
 		{
 			name:           "multiple batches with pause",
 			in:             []string{"a", "b", "c", "d", "e", "f"},
-			opts:           BatchOptions[string]{MaxSize: 6, MaxWait: 30 * time.Millisecond},
-			pauseEveryItem: 10 * time.Millisecond,
+			opts:           BatchOptions[string]{MaxSize: 6, MaxWait: 50 * time.Millisecond},
+			pauseEveryItem: 20 * time.Millisecond,
 			expected: [][]string{
 				{"a", "b", "c"},
 				{"d", "e", "f"},
@@ -74,8 +76,8 @@ func TestBatch(t *testing.T) {
 		{
 			name:           "multiple batches with pause and partition",
 			in:             []string{"aa", "ab", "ba", "bb", "ca", "cb"},
-			opts:           BatchOptions[string]{MaxSize: 6, MaxWait: 30 * time.Millisecond, PartitionBy: partitionByFirstLetter},
-			pauseEveryItem: 10 * time.Millisecond,
+			opts:           BatchOptions[string]{MaxSize: 6, MaxWait: 50 * time.Millisecond, PartitionBy: partitionByFirstLetter},
+			pauseEveryItem: 20 * time.Millisecond,
 			expected: [][]string{
 				{"aa", "ab"},
 				{"ba", "bb"},
@@ -140,3 +142,149 @@ func TestBatch(t *testing.T) {
 		})
 	}
 }
+
+func TestBatch_Flush(t *testing.T) {
+	in := make(chan string)
+	flush := make(chan struct{})
+	out, _ := Batch(in, BatchOptions[string]{MaxSize: 10, MaxWait: time.Hour, PartitionBy: partitionByFirstLetter, Flush: flush})
+
+	in <- "aa"
+	in <- "ba"
+	in <- "ab"
+	flush <- struct{}{}
+
+	assert.ElementsMatch(t, [][]string{{"aa", "ab"}, {"ba"}}, [][]string{<-out, <-out})
+
+	in <- "ac"
+	close(in)
+	assert.Equal(t, []string{"ac"}, <-out)
+}
+
+func TestBatch_MaxWait(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	in := make(chan string)
+	out, _ := Batch(in, BatchOptions[string]{MaxSize: 10, MaxWait: time.Minute, PartitionBy: partitionByFirstLetter, Clock: clk})
+
+	in <- "aa"
+	clk.BlockUntil(1)
+	clk.Advance(30 * time.Second)
+	in <- "ab"
+	in <- "ba"
+	clk.BlockUntil(2)
+
+	// Only the batch started first has been waiting for MaxWait
+	clk.Advance(30 * time.Second)
+	assert.Equal(t, []string{"aa", "ab"}, <-out)
+
+	clk.Advance(30 * time.Second)
+	assert.Equal(t, []string{"ba"}, <-out)
+
+	close(in)
+	_, ok := <-out
+	assert.False(t, ok)
+}
+
+func TestBatch_Align(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 40, 0, time.UTC))
+	in := make(chan string)
+	out, _ := Batch(in, BatchOptions[string]{MaxSize: 10, MaxWait: time.Hour, Align: time.Minute, PartitionBy: partitionByFirstLetter, Clock: clk})
+
+	clk.BlockUntil(1)
+	in <- "aa"
+	in <- "ba"
+
+	// All batches are sent on the minute, however long they have been pending
+	clk.Advance(20 * time.Second)
+	assert.ElementsMatch(t, [][]string{{"aa"}, {"ba"}}, [][]string{<-out, <-out})
+
+	clk.BlockUntil(1)
+	in <- "ab"
+	clk.Advance(59 * time.Second)
+	select {
+	case batch := <-out:
+		t.Fatalf("unexpected batch %v before the minute", batch)
+	default:
+	}
+
+	clk.Advance(time.Second)
+	assert.Equal(t, []string{"ab"}, <-out)
+
+	close(in)
+	_, ok := <-out
+	assert.False(t, ok)
+}
+
+func TestBatch_GroupBy(t *testing.T) {
+	in := make(chan string)
+	// Items are grouped by their second letter, x is no group
+	groupBy := func(s string) string {
+		if s[1] == 'x' {
+			return ""
+		}
+		return s[1:]
+	}
+	out, _ := Batch(in, BatchOptions[string]{MaxSize: 2, MaxWait: time.Hour, PartitionBy: partitionByFirstLetter, GroupBy: groupBy})
+
+	// A full batch is held back while items of the group of its last item arrive
+	in <- "ax"
+	in <- "ab"
+	in <- "ab"
+	in <- "ab"
+	in <- "ac"
+	assert.Equal(t, []string{"ax", "ab", "ab", "ab"}, <-out)
+
+	// Items without a group send a full batch at once
+	in <- "ax"
+	assert.Equal(t, []string{"ac", "ax"}, <-out)
+
+	close(in)
+	_, ok := <-out
+	assert.False(t, ok)
+}
+
+func TestBatch_MaxBytes(t *testing.T) {
+	in := make(chan string)
+	out, _ := Batch(in, BatchOptions[string]{
+		MaxSize:     100,
+		MaxWait:     time.Hour,
+		PartitionBy: partitionByFirstLetter,
+		SizeOf:      func(s string) int { return len(s) },
+		MaxBytes:    6,
+	})
+
+	// A batch reaching MaxBytes is sent regardless of MaxSize
+	in <- "abc"
+	in <- "abcd"
+	assert.Equal(t, []string{"abc", "abcd"}, <-out)
+
+	// A single item larger than MaxBytes is sent at once
+	in <- "bcdefgh"
+	assert.Equal(t, []string{"bcdefgh"}, <-out)
+
+	close(in)
+	_, ok := <-out
+	assert.False(t, ok)
+}
+
+func TestBatch_MaxPendingBytes(t *testing.T) {
+	in := make(chan string)
+	out, _ := Batch(in, BatchOptions[string]{
+		MaxSize:         100,
+		MaxWait:         time.Hour,
+		PartitionBy:     partitionByFirstLetter,
+		SizeOf:          func(s string) int { return len(s) },
+		MaxPendingBytes: 10,
+	})
+
+	in <- "a1"
+	in <- "b123"
+	in <- "b456"
+	// The largest batch is sent once the pending items exceed the budget
+	in <- "a2"
+	assert.Equal(t, []string{"b123", "b456"}, <-out)
+
+	close(in)
+	assert.Equal(t, []string{"a1", "a2"}, <-out)
+	_, ok := <-out
+	assert.False(t, ok)
+}
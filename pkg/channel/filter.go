@@ -1,14 +1,21 @@
 package channel
 
+import (
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+)
+
+// Filter passes items for which fn returns true. Items that make fn panic are dropped.
 func Filter[T any](in chan T, fn func(T) bool) chan T {
 	out := make(chan T)
 	go func() {
 		defer close(out)
-		for item := range in {
-			if fn(item) {
-				out <- item
+		recovery.Run("channel_filter", func() {
+			for item := range in {
+				if fn(item) {
+					out <- item
+				}
 			}
-		}
+		})
 	}()
 	return out
 }
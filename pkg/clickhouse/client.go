@@ -1,21 +1,30 @@
 package clickhouse
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/goccy/go-json"
 	"github.com/rs/zerolog/log"
 
 	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/clock"
 	"github.com/jkaflik/hass2ch/pkg/retry"
 )
 
+const defaultUserAgent = "hass2ch"
+
+// killQueryTimeout is how long to wait for ClickHouse to accept a KILL QUERY of an abandoned query
+const killQueryTimeout = 5 * time.Second
+
 // RetryConfig defines the retry configuration for ClickHouse operations
 type RetryConfig struct {
 	MaxRetries          int
@@ -23,6 +32,8 @@ type RetryConfig struct {
 	MaxInterval         time.Duration
 	Multiplier          float64
 	RandomizationFactor float64
+	// Clock times the backoff, the real clock if nil
+	Clock clock.Clock
 }
 
 // DefaultRetryConfig returns the default retry configuration for ClickHouse operations
@@ -39,10 +50,23 @@ func DefaultRetryConfig() RetryConfig {
 // Client is an HTTP client for ClickHouse
 type Client struct {
 	url        url.URL
+	readURL    *url.URL
+	readURLRaw string
 	username   string
 	password   string
 	httpClient *http.Client
 	retryConf  RetryConfig
+	userAgent  string
+	headers    http.Header
+	quotaKey   string
+	logComment map[string]string
+
+	// sessionID is the session of requests other than read queries, sent one at a time under sessionMtx
+	sessionID  string
+	sessionMtx sync.Mutex
+	tlsConfig  *tls.Config
+
+	compression Compression
 }
 
 // ClientOption is a function that configures a Client
@@ -62,7 +86,116 @@ func WithRetryConfig(retryConf RetryConfig) ClientOption {
 	}
 }
 
+// WithUserAgent sets the User-Agent header of all requests, e.g. to tell apart hass2ch instances
+// in system.query_log (http_user_agent column)
+func WithUserAgent(userAgent string) ClientOption {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithHeaders sets extra headers of all requests, e.g. X-ClickHouse-Quota-Key or the credentials of an
+// authenticating proxy in front of ClickHouse. They override the headers set by the client, e.g. Authorization.
+func WithHeaders(headers http.Header) ClientOption {
+	return func(c *Client) {
+		c.headers = headers
+	}
+}
+
+// WithDefaultQuotaKey sets the quota key of all queries without one set by WithQuotaKey, e.g. to account
+// the queries of an instance separately in a shared cluster
+func WithDefaultQuotaKey(quotaKey string) ClientOption {
+	return func(c *Client) {
+		c.quotaKey = quotaKey
+	}
+}
+
+// WithSessionID sends requests other than read queries, e.g. inserts and DDL, in the ClickHouse session of the ID,
+// so load balancers and chproxy route them to the same host. ClickHouse runs one query of a session at a time,
+// so these requests are sent one at a time. Read queries sent with Query are not part of the session.
+func WithSessionID(sessionID string) ClientOption {
+	return func(c *Client) {
+		c.sessionID = sessionID
+	}
+}
+
+// headerNamePattern matches valid names of HTTP headers
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+
+// ParseHeaders parses headers in the form of "Name=value,Name=value", e.g. "X-ClickHouse-Quota-Key=home"
+func ParseHeaders(s string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !headerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid header %q: expected Name=value with a valid header name", part)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// WithLogComment sets fields of the log_comment of all queries, stored as a JSON object
+// in system.query_log. Fields set per query with WithLogCommentField are merged in.
+func WithLogComment(fields map[string]string) ClientOption {
+	return func(c *Client) {
+		c.logComment = fields
+	}
+}
+
+// WithReadURL sets a separate URL, e.g. of a replica, for read-only queries sent with Query,
+// so they don't interfere with inserts on the write node
+func WithReadURL(readURL string) ClientOption {
+	return func(c *Client) {
+		c.readURLRaw = readURL
+	}
+}
+
 func NewClient(serverURL, username, password string, options ...ClientOption) (*Client, error) {
+	u, err := parseURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		url:        *u,
+		username:   username,
+		password:   password,
+		httpClient: http.DefaultClient,
+		retryConf:  DefaultRetryConfig(),
+		userAgent:  defaultUserAgent,
+
+		compression: defaultCompression,
+	}
+
+	// Apply options
+	for _, option := range options {
+		option(client)
+	}
+
+	if client.tlsConfig != nil {
+		if client.httpClient, err = withTLSTransport(client.httpClient, client.tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if client.readURLRaw != "" {
+		if client.readURL, err = parseURL(client.readURLRaw); err != nil {
+			return nil, fmt.Errorf("invalid read URL: %w", err)
+		}
+	}
+
+	return client, nil
+}
+
+// parseURL parses a ClickHouse HTTP URL and sets the default settings of the client
+func parseURL(serverURL string) (*url.URL, error) {
 	u, err := url.Parse(serverURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse ClickHouse URL: %w", err)
@@ -81,20 +214,7 @@ func NewClient(serverURL, username, password string, options ...ClientOption) (*
 	queryParams.Set("input_format_json_read_arrays_as_strings", "1")
 	u.RawQuery = queryParams.Encode()
 
-	client := &Client{
-		url:        *u,
-		username:   username,
-		password:   password,
-		httpClient: http.DefaultClient,
-		retryConf:  DefaultRetryConfig(),
-	}
-
-	// Apply options
-	for _, option := range options {
-		option(client)
-	}
-
-	return client, nil
+	return u, nil
 }
 
 // isRetryableError determines if an error from ClickHouse should be retried
@@ -103,6 +223,11 @@ func isRetryableError(err error) bool {
 		return false
 	}
 
+	// Malformed data is rejected again no matter how many times it is sent
+	if IsDataError(err) {
+		return false
+	}
+
 	// Check for network errors
 	if retry.IsNetworkError(err) {
 		return true
@@ -138,33 +263,38 @@ func isRetryableError(err error) bool {
 	return false
 }
 
-// Execute runs a query on ClickHouse with retries for transient failures
-func (c *Client) Execute(ctx context.Context, query string, r io.Reader) error {
-	// If the reader is of a reusable type (like bytes.Buffer), we can retry with it
-	// For non-reusable readers, we need to buffer it first if we want to retry
-	var buf []byte
-	var err error
-
-	if r != nil {
-		// Check if reader is a bytes.Buffer which we can reuse
-		if _, ok := r.(*bytes.Buffer); !ok {
-			// Not a bytes.Buffer, need to read it fully once
-			buf, err = io.ReadAll(r)
-			if err != nil {
-				return fmt.Errorf("failed to read request body: %w", err)
-			}
-			// Replace reader with a new one for each retry
-			r = nil // This ensures we use the buffer instead
-		}
+// Execute runs a query on ClickHouse with retries for transient failures.
+// The body is rewound to the start before every attempt, so it is never buffered as a whole.
+func (c *Client) Execute(ctx context.Context, query string, body io.ReadSeeker, opts ...QueryOption) error {
+	queryOpts := newQueryOptions(opts)
+
+	err := c.retry(ctx, func() error {
+		return c.do(ctx, query, body, queryOpts)
+	}, isRetryableError)
+
+	// Don't let the query linger on the server if it has been abandoned
+	if err != nil && ctx.Err() != nil && queryOpts.queryID != "" {
+		c.killQuery(queryOpts)
 	}
 
+	return err
+}
+
+// retry executes fn with retries according to the client retry configuration
+func (c *Client) retry(ctx context.Context, fn retry.RetryableFunc, isRetryable retry.IsRetryable) error {
+	return retryWithConfig(ctx, c.retryConf, fn, isRetryable)
+}
+
+// retryWithConfig executes fn with retries according to retryConf, recording retry metrics
+func retryWithConfig(ctx context.Context, retryConf RetryConfig, fn retry.RetryableFunc, isRetryable retry.IsRetryable) error {
 	// Convert retry config to generic retry config
 	retryConfig := retry.Config{
-		MaxRetries:          c.retryConf.MaxRetries,
-		InitialInterval:     c.retryConf.InitialInterval,
-		MaxInterval:         c.retryConf.MaxInterval,
-		Multiplier:          c.retryConf.Multiplier,
-		RandomizationFactor: c.retryConf.RandomizationFactor,
+		MaxRetries:          retryConf.MaxRetries,
+		InitialInterval:     retryConf.InitialInterval,
+		MaxInterval:         retryConf.MaxInterval,
+		Multiplier:          retryConf.Multiplier,
+		RandomizationFactor: retryConf.RandomizationFactor,
+		Clock:               retryConf.Clock,
 	}
 
 	// Define retry callbacks for metrics
@@ -191,42 +321,171 @@ func (c *Client) Execute(ctx context.Context, query string, r io.Reader) error {
 		},
 	}
 
-	return retry.DoWithCallbacks(ctx, func() error {
-		var bodyReader = r
+	return retry.DoWithCallbacks(ctx, fn, isRetryable, retryConfig, callbacks)
+}
+
+// do executes a single attempt of a query
+func (c *Client) do(ctx context.Context, query string, body io.ReadSeeker, queryOpts queryOptions) error {
+	if c.inSession(queryOpts) {
+		c.sessionMtx.Lock()
+		defer c.sessionMtx.Unlock()
+	}
+
+	resp, err := c.send(ctx, query, body, queryOpts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body to allow reusing the connection
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return nil
+}
 
-		// If we have a buffer, create a new reader for each retry
-		if buf != nil {
-			bodyReader = bytes.NewReader(buf)
+// send sends a query and returns the response of a successful query. The caller must close the response body.
+func (c *Client) send(ctx context.Context, query string, body io.ReadSeeker, queryOpts queryOptions) (*http.Response, error) {
+	var bodyReader io.Reader
+
+	// Rewind the body, it might have been partially read by a previous attempt
+	if body != nil {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind request body: %w", err)
 		}
+		bodyReader = body
 
-		// Build the URL with the query parameter
-		uri := c.url
-		queryParams := uri.Query()
-		queryParams.Set("query", query)
-		uri.RawQuery = queryParams.Encode()
+		if stats := queryOpts.requestStats; stats != nil {
+			*stats = RequestStats{}
+			bodyReader = countingReader{r: bodyReader, n: &stats.UncompressedBytes}
+		}
+	}
 
-		// Create a new request for each retry
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri.String(), bodyReader)
+	// Compressed bodies are streamed, compressed anew by every attempt
+	var contentEncoding string
+	var compressed *compressedBody
+	if bodyReader != nil && c.compression != CompressionNone && c.compression != "" {
+		var err error
+		compressed, err = compressBody(c.compression, bodyReader)
 		if err != nil {
-			return fmt.Errorf("failed to create request: %w", err)
+			return nil, fmt.Errorf("failed to compress request body: %w", err)
 		}
+		defer compressed.Close()
+		bodyReader = compressed
+		contentEncoding = string(c.compression)
+	}
 
-		req.Header.Set("User-Agent", "hass2ch")
-		req.SetBasicAuth(c.username, c.password)
+	// Build the URL with the query parameter
+	uri := c.url
+	if queryOpts.read && c.readURL != nil {
+		uri = *c.readURL
+	}
+	queryParams := uri.Query()
+	queryParams.Set("query", query)
+	if logComment := buildLogComment(c.logComment, queryOpts); logComment != "" {
+		queryParams.Set("log_comment", logComment)
+	}
+	if queryOpts.quotaKey == "" {
+		queryOpts.quotaKey = c.quotaKey
+	}
+	if c.inSession(queryOpts) {
+		queryParams.Set("session_id", c.sessionID)
+	}
+	queryOpts.apply(queryParams)
+	uri.RawQuery = queryParams.Encode()
 
-		// Execute the query
-		resp, err := c.httpClient.Do(req)
-		if err != nil {
-			return fmt.Errorf("failed to execute query: %w", err)
+	// Create a new request for each retry
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri.String(), bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("User-Agent", c.userAgent)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	req.SetBasicAuth(c.username, c.password)
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+
+	// Execute the query
+	resp, err := c.httpClient.Do(req)
+	if compressed != nil {
+		// The body has been sent or abandoned, the compression must be done before the body is rewound
+		_ = compressed.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	if stats := queryOpts.requestStats; stats != nil {
+		stats.SentBytes = stats.UncompressedBytes
+		if compressed != nil {
+			stats.SentBytes = compressed.n
 		}
+	}
+
+	// Check for HTTP errors
+	if resp.StatusCode != http.StatusOK {
 		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, newException(resp.StatusCode, resp.Header.Get(exceptionCodeHeader), strings.TrimSpace(string(body)))
+	}
 
-		// Check for HTTP errors
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			return fmt.Errorf("query execution failed with status %d: %s", resp.StatusCode, string(body))
+	if queryOpts.summary != nil {
+		if err := parseSummary(resp.Header, queryOpts.summary); err != nil {
+			log.Warn().Err(err).Msg("Failed to parse ClickHouse query summary")
 		}
+	}
+
+	return resp, nil
+}
+
+// inSession reports whether a query is sent in the session of the client, see WithSessionID
+func (c *Client) inSession(queryOpts queryOptions) bool {
+	return c.sessionID != "" && !queryOpts.read && !queryOpts.noSession
+}
+
+// buildLogComment merges the client and query log comment fields into a JSON object
+func buildLogComment(clientFields map[string]string, queryOpts queryOptions) string {
+	if len(clientFields) == 0 && len(queryOpts.logComment) == 0 {
+		return ""
+	}
+
+	fields := make(map[string]string, len(clientFields)+len(queryOpts.logComment))
+	for key, value := range clientFields {
+		fields[key] = value
+	}
+	for key, value := range queryOpts.logComment {
+		fields[key] = value
+	}
+
+	comment, err := json.Marshal(fields)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to marshal ClickHouse log comment")
+		return ""
+	}
+
+	return string(comment)
+}
+
+// killQuery makes a best-effort attempt to cancel a query on the server it has been sent to.
+// It is sent outside of the session of the client, which the abandoned query may still hold.
+func (c *Client) killQuery(queryOpts queryOptions) {
+	ctx, cancel := context.WithTimeout(context.Background(), killQueryTimeout)
+	defer cancel()
+
+	queryID := queryOpts.queryID
+	query := fmt.Sprintf("KILL QUERY WHERE query_id = %s ASYNC", QuoteString(queryID))
+	if err := c.do(ctx, query, nil, queryOptions{read: queryOpts.read, noSession: true}); err != nil {
+		log.Warn().Err(err).Str("query_id", queryID).Msg("Failed to kill abandoned ClickHouse query")
+		return
+	}
+
+	log.Info().Str("query_id", queryID).Msg("Killed abandoned ClickHouse query")
+}
 
-		return nil
-	}, isRetryableError, retryConfig, callbacks)
+// QuoteString quotes a string literal for use in a ClickHouse query
+func QuoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
 }
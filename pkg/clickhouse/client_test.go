@@ -0,0 +1,369 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse/format"
+)
+
+func testRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxRetries:      3,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+		Multiplier:      1,
+	}
+}
+
+func TestClient_Execute_RetryRewindsBody(t *testing.T) {
+	var mtx sync.Mutex
+	var bodies []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		bodies = append(bodies, string(body))
+
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()), WithCompression(CompressionNone))
+	require.NoError(t, err)
+
+	r := format.NewJSONEachRowReader([]any{
+		map[string]string{"key1": "value1"},
+		map[string]string{"key2": "value2"},
+	})
+
+	err = client.Execute(context.Background(), "INSERT INTO t FORMAT JSONEachRow", r)
+	require.NoError(t, err)
+
+	expected := `{"key1":"value1"}
+{"key2":"value2"}`
+	assert.Equal(t, []string{expected, expected}, bodies)
+}
+
+func TestClient_Execute_QueryOptions(t *testing.T) {
+	var params url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params = r.URL.Query()
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+
+	err = client.Execute(context.Background(), "SELECT 1", nil,
+		WithQueryID("hass2ch-1"),
+		WithRole("writer"),
+		WithQuotaKey("hass"),
+		WithSetting("async_insert", "0"),
+		WithSetting("max_threads", "2"),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, "SELECT 1", params.Get("query"))
+	assert.Equal(t, "hass2ch-1", params.Get("query_id"))
+	assert.Equal(t, "writer", params.Get("role"))
+	assert.Equal(t, "hass", params.Get("quota_key"))
+	assert.Equal(t, "0", params.Get("async_insert"), "per-query settings override client defaults")
+	assert.Equal(t, "2", params.Get("max_threads"))
+}
+
+func TestClient_Execute_KillsAbandonedQuery(t *testing.T) {
+	killed := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if strings.HasPrefix(query, "KILL QUERY") {
+			killed <- query
+			return
+		}
+
+		// Simulate a long-running insert
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = client.Execute(ctx, "INSERT INTO t FORMAT JSONEachRow", nil, WithQueryID("hass2ch-insert-'1'"))
+	require.Error(t, err)
+
+	select {
+	case query := <-killed:
+		assert.Equal(t, `KILL QUERY WHERE query_id = 'hass2ch-insert-\'1\'' ASYNC`, query)
+	default:
+		t.Fatal("abandoned query has not been killed")
+	}
+}
+
+func TestClient_Execute_Summary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-ClickHouse-Summary",
+			`{"read_rows":"0","read_bytes":"0","written_rows":"2","written_bytes":"34","total_rows_to_read":"0","result_rows":"2","result_bytes":"34","elapsed_ns":"1234"}`)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+
+	var summary Summary
+	err = client.Execute(context.Background(), "INSERT INTO t FORMAT JSONEachRow", nil, WithSummary(&summary))
+	require.NoError(t, err)
+
+	assert.Equal(t, Summary{
+		WrittenRows:        2,
+		WrittenBytes:       34,
+		ResultRows:         2,
+		ResultBytes:        34,
+		ElapsedNanoseconds: 1234,
+	}, summary)
+}
+
+func TestClient_Execute_DataErrorIsNotRetried(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("X-ClickHouse-Exception-Code", "117")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Code: 117. DB::Exception: Unknown field found while parsing JSONEachRow format: cost: (at row 2)"))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+
+	err = client.Execute(context.Background(), "INSERT INTO t FORMAT JSONEachRow", strings.NewReader(`{"cost":1}`))
+	require.Error(t, err)
+	assert.True(t, IsDataError(err))
+	assert.Equal(t, 1, attempts)
+}
+
+func TestQueryRows(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "JSONEachRow", r.URL.Query().Get("default_format"))
+		for i := 0; i < 3; i++ {
+			_, _ = fmt.Fprintf(w, "{\"entity_id\":\"sensor.%d\",\"rows\":\"%d\"}\n", i, i*10)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+
+	type row struct {
+		EntityID string `json:"entity_id"`
+		Rows     uint64 `json:"rows,string"`
+	}
+
+	var rows []row
+	err = QueryRows(context.Background(), client, "SELECT entity_id, count() AS rows FROM t GROUP BY entity_id", func(r row) error {
+		rows = append(rows, r)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []row{{"sensor.0", 0}, {"sensor.1", 10}, {"sensor.2", 20}}, rows)
+
+	// Errors returned by the callback stop reading and are not retried
+	calls := 0
+	err = QueryRows(context.Background(), client, "SELECT 1", func(r row) error {
+		calls++
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, 1, calls)
+}
+
+func TestClient_ReadURL(t *testing.T) {
+	var writes, reads atomic.Int32
+	writer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writes.Add(1)
+	}))
+	defer writer.Close()
+
+	reader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads.Add(1)
+		_, _ = fmt.Fprintln(w, `{"n":"1"}`)
+	}))
+	defer reader.Close()
+
+	client, err := NewClient(writer.URL, "default", "", WithReadURL(reader.URL), WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+
+	require.NoError(t, client.Execute(context.Background(), "INSERT INTO t FORMAT JSONEachRow", strings.NewReader(`{}`)))
+	require.NoError(t, client.Query(context.Background(), "SELECT 1 AS n", func(json.RawMessage) error { return nil }))
+
+	assert.Equal(t, int32(1), writes.Load())
+	assert.Equal(t, int32(1), reads.Load())
+
+	_, err = NewClient(writer.URL, "default", "", WithReadURL("ftp://replica"))
+	assert.Error(t, err)
+}
+
+func TestClient_Tagging(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "hass2ch/1.0 (pipeline)", r.UserAgent())
+		assert.JSONEq(t, `{"command":"pipeline","batch_id":"42"}`, r.URL.Query().Get("log_comment"))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "",
+		WithUserAgent("hass2ch/1.0 (pipeline)"),
+		WithLogComment(map[string]string{"command": "pipeline"}),
+		WithRetryConfig(testRetryConfig()),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, client.Execute(context.Background(), "SELECT 1", nil, WithLogCommentField("batch_id", "42")))
+}
+
+func TestClient_Headers(t *testing.T) {
+	headers, err := ParseHeaders("X-ClickHouse-Quota-Key=home, authorization=Bearer proxy-token")
+	require.NoError(t, err)
+	assert.Equal(t, "home", headers.Get("X-ClickHouse-Quota-Key"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "home", r.Header.Get("X-ClickHouse-Quota-Key"))
+		// Headers override the ones set by the client
+		assert.Equal(t, "Bearer proxy-token", r.Header.Get("Authorization"))
+		assert.Equal(t, defaultUserAgent, r.UserAgent())
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithHeaders(headers), WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+	require.NoError(t, client.Execute(context.Background(), "SELECT 1", nil))
+
+	_, err = ParseHeaders("X Quota=home")
+	assert.Error(t, err)
+	_, err = ParseHeaders("X-ClickHouse-Quota-Key")
+	assert.Error(t, err)
+}
+
+func TestClient_Session_KillsAbandonedQuery(t *testing.T) {
+	killed := make(chan url.Values, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		if strings.HasPrefix(params.Get("query"), "KILL QUERY") {
+			killed <- params
+			return
+		}
+
+		// Simulate a long-running insert holding the session
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithSessionID("hass2ch-a"), WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Error(t, client.Execute(ctx, "INSERT INTO t FORMAT JSONEachRow", nil, WithQueryID("hass2ch-insert-1")))
+
+	select {
+	case params := <-killed:
+		assert.False(t, params.Has("session_id"))
+	default:
+		t.Fatal("abandoned query has not been killed")
+	}
+
+	// The kill is not queued behind queries of the session
+	client.sessionMtx.Lock()
+	defer client.sessionMtx.Unlock()
+	done := make(chan struct{})
+	go func() {
+		client.killQuery(queryOptions{queryID: "hass2ch-insert-2"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("kill waited for the session")
+	}
+	params := <-killed
+	assert.False(t, params.Has("session_id"))
+}
+
+func TestClient_Session(t *testing.T) {
+	var active, maxActive atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		if strings.HasPrefix(params.Get("query"), "SELECT") {
+			// Read queries are not part of the session
+			assert.Empty(t, params.Get("session_id"))
+			assert.Equal(t, "reports", params.Get("quota_key"))
+			return
+		}
+
+		assert.Equal(t, "hass2ch-a", params.Get("session_id"))
+		assert.Equal(t, "instance-a", params.Get("quota_key"))
+		n := active.Add(1)
+		defer active.Add(-1)
+		if n > maxActive.Load() {
+			maxActive.Store(n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "",
+		WithSessionID("hass2ch-a"),
+		WithDefaultQuotaKey("instance-a"),
+		WithRetryConfig(testRetryConfig()),
+	)
+	require.NoError(t, err)
+
+	// Queries of a session are sent one at a time
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, client.Execute(context.Background(), "INSERT INTO hass.light FORMAT JSONEachRow", strings.NewReader("{}")))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), maxActive.Load())
+
+	require.NoError(t, client.Query(context.Background(), "SELECT 1", func(json.RawMessage) error { return nil }, WithQuotaKey("reports")))
+}
+
+func TestClient_RequestStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()), WithCompression(CompressionNone))
+	require.NoError(t, err)
+
+	var stats RequestStats
+	body := strings.NewReader(`{"entity_id":"light.kitchen"}`)
+	require.NoError(t, client.Execute(context.Background(), "INSERT INTO t FORMAT JSONEachRow", body, WithRequestStats(&stats)))
+	assert.Equal(t, RequestStats{UncompressedBytes: 29, SentBytes: 29}, stats)
+}
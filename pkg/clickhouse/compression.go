@@ -0,0 +1,100 @@
+package clickhouse
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression is a codec request bodies are compressed with, sent as their Content-Encoding
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionZSTD Compression = "zstd"
+	CompressionLZ4  Compression = "lz4"
+	CompressionGzip Compression = "gzip"
+)
+
+// defaultCompression is the codec of request bodies unless set with WithCompression
+const defaultCompression = CompressionZSTD
+
+// ParseCompression parses the name of a codec
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case CompressionNone, CompressionZSTD, CompressionLZ4, CompressionGzip:
+		return c, nil
+	case "":
+		return CompressionNone, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q, expected none, zstd, lz4 or gzip", s)
+	}
+}
+
+// WithCompression sets the codec request bodies, e.g. of inserts, are compressed with. Bodies are compressed
+// with zstd by default. Queries without a body are not compressed.
+//
+// Bodies are compressed while they are sent, so neither the body nor its compressed form is copied into memory.
+// The cost is the state of an encoder per request in flight, up to a few MB for zstd, and the CPU of compressing
+// the body again on every retry.
+func WithCompression(codec Compression) ClientOption {
+	return func(c *Client) {
+		c.compression = codec
+	}
+}
+
+// compressedBody is a request body compressed as it is read. It is compressed by a goroutine writing into a pipe,
+// counting the compressed bytes.
+type compressedBody struct {
+	*io.PipeReader
+	done chan struct{}
+	n    uint64
+}
+
+// compressBody starts compressing a request body with the codec. The body must not be read by others until
+// the compressed body is closed.
+func compressBody(codec Compression, body io.Reader) (*compressedBody, error) {
+	pr, pw := io.Pipe()
+	compressed := &compressedBody{PipeReader: pr, done: make(chan struct{})}
+
+	w, err := newEncoder(codec, countingWriter{w: pw, n: &compressed.n})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(compressed.done)
+
+		_, err := io.Copy(w, body)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	return compressed, nil
+}
+
+// Close stops compressing the body and waits until the body is no longer read, so it can be rewound
+func (b *compressedBody) Close() error {
+	_ = b.PipeReader.Close()
+	<-b.done
+	return nil
+}
+
+// newEncoder creates an encoder of the codec writing into w
+func newEncoder(codec Compression, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CompressionZSTD:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	case CompressionLZ4:
+		return lz4.NewWriter(w), nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", codec)
+	}
+}
@@ -0,0 +1,123 @@
+package clickhouse
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeBody decompresses a request body by its Content-Encoding
+func decodeBody(t *testing.T, r *http.Request) string {
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "zstd":
+		decoder, err := zstd.NewReader(r.Body)
+		require.NoError(t, err)
+		defer decoder.Close()
+		body = decoder
+	case "lz4":
+		body = lz4.NewReader(r.Body)
+	case "gzip":
+		reader, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body = reader
+	}
+
+	decoded, err := io.ReadAll(body)
+	require.NoError(t, err)
+	return string(decoded)
+}
+
+func TestClient_Compression(t *testing.T) {
+	payload := strings.Repeat(`{"entity_id":"sensor.power","state":"12.5"}`+"\n", 100)
+
+	for _, codec := range []Compression{CompressionZSTD, CompressionLZ4, CompressionGzip, CompressionNone} {
+		t.Run(string(codec), func(t *testing.T) {
+			var encoding, body string
+			var received uint64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				encoding = r.Header.Get("Content-Encoding")
+				r.Body = io.NopCloser(countingReader{r: r.Body, n: &received})
+				body = decodeBody(t, r)
+				_, _ = io.Copy(io.Discard, r.Body)
+			}))
+			defer server.Close()
+
+			client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()), WithCompression(codec))
+			require.NoError(t, err)
+
+			var stats RequestStats
+			require.NoError(t, client.Execute(context.Background(), "INSERT INTO t FORMAT JSONEachRow", strings.NewReader(payload), WithRequestStats(&stats)))
+			assert.Equal(t, payload, body)
+			assert.Equal(t, uint64(len(payload)), stats.UncompressedBytes)
+			if codec == CompressionNone {
+				assert.Empty(t, encoding)
+				assert.Equal(t, stats.UncompressedBytes, stats.SentBytes)
+			} else {
+				assert.Equal(t, string(codec), encoding)
+				assert.Equal(t, received, stats.SentBytes)
+			}
+		})
+	}
+}
+
+func TestClient_CompressionRetry(t *testing.T) {
+	payload := strings.Repeat(`{"entity_id":"sensor.power","state":"12.5"}`+"\n", 100000)
+
+	var attempts int
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			// Reject the first attempt without reading its body
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body = decodeBody(t, r)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+
+	// The body is rewound and compressed again by the retry
+	require.NoError(t, client.Execute(context.Background(), "INSERT INTO t FORMAT JSONEachRow", strings.NewReader(payload)))
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, payload, body)
+}
+
+func TestClient_CompressionDefault(t *testing.T) {
+	var encoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(testRetryConfig()))
+	require.NoError(t, err)
+
+	require.NoError(t, client.Execute(context.Background(), "INSERT INTO t FORMAT JSONEachRow", strings.NewReader(`{}`)))
+	assert.Equal(t, "zstd", encoding)
+
+	// Queries without a body are not compressed
+	require.NoError(t, client.Execute(context.Background(), "SELECT 1", nil))
+	assert.Empty(t, encoding)
+}
+
+func TestParseCompression(t *testing.T) {
+	codec, err := ParseCompression("lz4")
+	require.NoError(t, err)
+	assert.Equal(t, CompressionLZ4, codec)
+
+	_, err = ParseCompression("brotli")
+	assert.Error(t, err)
+}
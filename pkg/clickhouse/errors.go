@@ -0,0 +1,95 @@
+package clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+const exceptionCodeHeader = "X-ClickHouse-Exception-Code"
+
+var exceptionCodeRegexp = regexp.MustCompile(`^Code: (\d+)\.`)
+
+// Error codes of exceptions caused by the data sent to ClickHouse rather than by the server
+const (
+	errCodeCannotParseText                 = 6
+	errCodeNoSuchColumnInTable             = 16
+	errCodeCannotParseEscapeSequence       = 25
+	errCodeCannotParseQuotedString         = 26
+	errCodeCannotParseInputAssertionFailed = 27
+	errCodeCannotReadAllData               = 33
+	errCodeCannotParseDate                 = 38
+	errCodeCannotParseDateTime             = 41
+	errCodeTypeMismatch                    = 53
+	errCodeCannotConvertType               = 70
+	errCodeCannotParseNumber               = 72
+	errCodeIncorrectData                   = 117
+	errCodeValueIsOutOfRangeOfDataType     = 321
+	errCodeCannotInsertNullInOrdinary      = 349
+	errCodeCannotParseUUID                 = 376
+	errCodeCannotParseDomainValue          = 441
+	errCodeCannotParseBool                 = 467
+)
+
+// Exception is an error returned by ClickHouse for a failed query
+type Exception struct {
+	StatusCode int
+	Code       int
+	Message    string
+}
+
+func (e *Exception) Error() string {
+	// Exceptions of the native protocol have no HTTP status
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("query execution failed: %s", e.Message)
+	}
+	return fmt.Sprintf("query execution failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+func newException(statusCode int, codeHeader, message string) *Exception {
+	e := &Exception{
+		StatusCode: statusCode,
+		Message:    message,
+	}
+
+	if code, err := strconv.Atoi(codeHeader); err == nil {
+		e.Code = code
+	} else if m := exceptionCodeRegexp.FindStringSubmatch(message); m != nil {
+		e.Code, _ = strconv.Atoi(m[1])
+	}
+
+	return e
+}
+
+// IsDataError reports whether the error is a ClickHouse exception caused by malformed data,
+// e.g. a row that could not be parsed. Retrying such a query does not help.
+func IsDataError(err error) bool {
+	var e *Exception
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.Code {
+	case errCodeCannotParseText,
+		errCodeNoSuchColumnInTable,
+		errCodeCannotParseEscapeSequence,
+		errCodeCannotParseQuotedString,
+		errCodeCannotParseInputAssertionFailed,
+		errCodeCannotReadAllData,
+		errCodeCannotParseDate,
+		errCodeCannotParseDateTime,
+		errCodeTypeMismatch,
+		errCodeCannotConvertType,
+		errCodeCannotParseNumber,
+		errCodeIncorrectData,
+		errCodeValueIsOutOfRangeOfDataType,
+		errCodeCannotInsertNullInOrdinary,
+		errCodeCannotParseUUID,
+		errCodeCannotParseDomainValue,
+		errCodeCannotParseBool:
+		return true
+	default:
+		return false
+	}
+}
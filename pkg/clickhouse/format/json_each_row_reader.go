@@ -2,6 +2,7 @@ package format
 
 import (
 	"bytes"
+	"errors"
 	"io"
 
 	"github.com/goccy/go-json"
@@ -9,10 +10,14 @@ import (
 
 // JSONEachRowReader is a reader that allows to read JSON objects one by one
 // in a format that is compatible with ClickHouse's JSONEachRow format.
+//
+// Values are marshaled lazily while reading, so the whole body is never buffered.
+// The reader can be rewound with Seek to read the same rows again, e.g. when a request is retried.
 type JSONEachRowReader struct {
-	values []any        // Values to be marshaled to JSON
-	buffer bytes.Buffer // Buffer for the marshaled data
-	ready  bool         // Whether the buffer has been prepared
+	values  []any        // Values to be marshaled to JSON
+	buffer  bytes.Buffer // Buffer for the marshaled data of the current value
+	next    int          // Index of the next value to marshal
+	started bool         // Whether reading has started
 }
 
 // NewJSONEachRowReader creates a new JSONEachRowReader from a slice of values
@@ -28,52 +33,60 @@ func (r *JSONEachRowReader) Len() int {
 
 // Add adds a value to the reader
 func (r *JSONEachRowReader) Add(value any) {
-	// If we've already prepared the buffer, we can't add more values
-	if r.ready {
+	// If we've already started reading, we can't add more values
+	if r.started {
 		return
 	}
 	r.values = append(r.values, value)
 }
 
-// prepareBuffer marshals all values to JSON and writes them to the buffer
-func (r *JSONEachRowReader) prepareBuffer() error {
-	if r.ready {
-		return nil
+// fillBuffer marshals the next value to JSON and writes it to the buffer
+func (r *JSONEachRowReader) fillBuffer() error {
+	// Add newline separator between values
+	if r.next > 0 {
+		r.buffer.WriteByte('\n')
 	}
 
-	for i, v := range r.values {
-		// Add newline separator between values
-		if i > 0 {
-			r.buffer.WriteByte('\n')
-		}
-
-		// Marshal the value to JSON
-		jsonBytes, err := json.Marshal(v)
-		if err != nil {
-			return err
-		}
-
-		// Write the JSON to the buffer
-		r.buffer.Write(jsonBytes)
+	// Marshal the value to JSON
+	jsonBytes, err := json.Marshal(r.values[r.next])
+	if err != nil {
+		return err
 	}
 
-	r.ready = true
+	// Write the JSON to the buffer
+	r.buffer.Write(jsonBytes)
+	r.next++
+
 	return nil
 }
 
 func (r *JSONEachRowReader) Read(p []byte) (n int, err error) {
-	// Prepare the buffer if it hasn't been prepared yet
-	if !r.ready {
-		if err := r.prepareBuffer(); err != nil {
-			return 0, err
-		}
-	}
+	r.started = true
 
-	// If the buffer is empty, return EOF
+	// Marshal the next value once the previous one has been fully read
 	if r.buffer.Len() == 0 {
-		return 0, io.EOF
+		// If there are no more values, return EOF
+		if r.next == len(r.values) {
+			return 0, io.EOF
+		}
+
+		if err := r.fillBuffer(); err != nil {
+			return 0, err
+		}
 	}
 
 	// Read from the buffer
 	return r.buffer.Read(p)
 }
+
+// Seek rewinds the reader. Only seeking to the start is supported.
+func (r *JSONEachRowReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("JSONEachRowReader only supports seeking to the start")
+	}
+
+	r.buffer.Reset()
+	r.next = 0
+
+	return 0, nil
+}
@@ -214,3 +214,39 @@ func TestJSONEachRowReader_Read_NewlineHandling(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.Equal(t, io.EOF, err)
 }
+
+func TestJSONEachRowReader_Seek(t *testing.T) {
+	r := NewJSONEachRowReader([]any{
+		map[string]string{"key1": "value1"},
+		map[string]string{"key2": "value2"},
+	})
+
+	// Partially read the first value
+	_, err := r.Read(make([]byte, 5))
+	assert.NoError(t, err)
+
+	// Rewind and read everything
+	_, err = r.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+
+	expected := `{"key1":"value1"}
+{"key2":"value2"}`
+	assert.Equal(t, expected, string(data))
+
+	// Rewinding a fully read reader allows to read the same rows again
+	_, err = r.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+
+	data, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(data))
+
+	// Only seeking to the start is supported
+	_, err = r.Seek(1, io.SeekStart)
+	assert.Error(t, err)
+	_, err = r.Seek(0, io.SeekEnd)
+	assert.Error(t, err)
+}
@@ -0,0 +1,354 @@
+package clickhouse
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/ch-go/proto"
+	"github.com/goccy/go-json"
+)
+
+// nativeColumn is a column of a native protocol block, appending row values converted to its type
+type nativeColumn interface {
+	proto.ColInput
+	AppendValue(v any) error
+}
+
+// valueColumn is a column of a scalar type
+type valueColumn[T any] struct {
+	proto.ColumnOf[T]
+	convert func(v any) (T, error)
+}
+
+func (c *valueColumn[T]) AppendValue(v any) error {
+	value, err := c.convert(v)
+	if err != nil {
+		return err
+	}
+	c.Append(value)
+	return nil
+}
+
+// Prepare propagates the preparation of columns encoded with a state, e.g. LowCardinality
+func (c *valueColumn[T]) Prepare() error {
+	if p, ok := c.ColumnOf.(proto.Preparable); ok {
+		return p.Prepare()
+	}
+	return nil
+}
+
+// EncodeState propagates the state of columns encoded with a state, e.g. LowCardinality
+func (c *valueColumn[T]) EncodeState(b *proto.Buffer) {
+	if s, ok := c.ColumnOf.(proto.StateEncoder); ok {
+		s.EncodeState(b)
+	}
+}
+
+// nullableColumn is a Nullable(T) column, storing nil values as NULL
+type nullableColumn[T any] struct {
+	*proto.ColNullable[T]
+	convert func(v any) (T, error)
+}
+
+func (c *nullableColumn[T]) AppendValue(v any) error {
+	if v == nil {
+		c.Append(proto.Null[T]())
+		return nil
+	}
+
+	value, err := c.convert(v)
+	if err != nil {
+		return err
+	}
+	c.Append(proto.NewNullable(value))
+	return nil
+}
+
+// arrayColumn is an Array(T) column, storing nil values as empty arrays
+type arrayColumn[T any] struct {
+	*proto.ColArr[T]
+	convert func(v any) (T, error)
+}
+
+func (c *arrayColumn[T]) AppendValue(v any) error {
+	var elems []T
+	if v != nil {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return newConversionError(c.Type(), v)
+		}
+
+		elems = make([]T, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			elem, err := c.convert(rv.Index(i).Interface())
+			if err != nil {
+				return err
+			}
+			elems = append(elems, elem)
+		}
+	}
+	c.Append(elems)
+	return nil
+}
+
+// columnKind is how a scalar column is wrapped
+type columnKind int
+
+const (
+	columnScalar columnKind = iota
+	columnNullable
+	columnArray
+)
+
+func wrapColumn[T any](kind columnKind, col proto.ColumnOf[T], convert func(v any) (T, error)) nativeColumn {
+	switch kind {
+	case columnNullable:
+		return &nullableColumn[T]{ColNullable: proto.NewColNullable[T](col), convert: convert}
+	case columnArray:
+		return &arrayColumn[T]{ColArr: proto.NewArray[T](col), convert: convert}
+	default:
+		return &valueColumn[T]{ColumnOf: col, convert: convert}
+	}
+}
+
+// newNativeColumn returns a column of a ClickHouse type. Scalar types, their Nullable and Array variants
+// are supported, which covers all tables created by hass2ch.
+func newNativeColumn(t proto.ColumnType) (nativeColumn, error) {
+	kind := columnScalar
+	elem := t
+	switch t.Base() {
+	case proto.ColumnTypeNullable:
+		kind, elem = columnNullable, t.Elem()
+	case proto.ColumnTypeArray:
+		kind, elem = columnArray, t.Elem()
+	}
+
+	switch elem.Base() {
+	case proto.ColumnTypeString:
+		return wrapColumn[string](kind, new(proto.ColStr), toString), nil
+	case proto.ColumnTypeLowCardinality:
+		if elem.Elem() != proto.ColumnTypeString {
+			break
+		}
+		return wrapColumn[string](kind, proto.NewLowCardinality[string](new(proto.ColStr)), toString), nil
+	case proto.ColumnTypeJSON:
+		return wrapColumn[string](kind, new(proto.ColJSONStr), toJSONString), nil
+	case proto.ColumnTypeBool:
+		return wrapColumn[bool](kind, new(proto.ColBool), toBool), nil
+	case proto.ColumnTypeFloat64:
+		return wrapColumn[float64](kind, new(proto.ColFloat64), toFloat[float64]), nil
+	case proto.ColumnTypeFloat32:
+		return wrapColumn[float32](kind, new(proto.ColFloat32), toFloat[float32]), nil
+	case proto.ColumnTypeInt8:
+		return wrapColumn[int8](kind, new(proto.ColInt8), toInt[int8]), nil
+	case proto.ColumnTypeInt16:
+		return wrapColumn[int16](kind, new(proto.ColInt16), toInt[int16]), nil
+	case proto.ColumnTypeInt32:
+		return wrapColumn[int32](kind, new(proto.ColInt32), toInt[int32]), nil
+	case proto.ColumnTypeInt64:
+		return wrapColumn[int64](kind, new(proto.ColInt64), toInt[int64]), nil
+	case proto.ColumnTypeUInt8:
+		return wrapColumn[uint8](kind, new(proto.ColUInt8), toUint[uint8]), nil
+	case proto.ColumnTypeUInt16:
+		return wrapColumn[uint16](kind, new(proto.ColUInt16), toUint[uint16]), nil
+	case proto.ColumnTypeUInt32:
+		return wrapColumn[uint32](kind, new(proto.ColUInt32), toUint[uint32]), nil
+	case proto.ColumnTypeUInt64:
+		return wrapColumn[uint64](kind, new(proto.ColUInt64), toUint[uint64]), nil
+	case proto.ColumnTypeDateTime64:
+		col := new(proto.ColDateTime64)
+		if err := col.Infer(elem); err != nil {
+			return nil, fmt.Errorf("unsupported column type %s: %w", t, err)
+		}
+		return wrapColumn[time.Time](kind, col, toTime), nil
+	case proto.ColumnTypeDateTime:
+		col := new(proto.ColDateTime)
+		if err := col.Infer(elem); err != nil {
+			return nil, fmt.Errorf("unsupported column type %s: %w", t, err)
+		}
+		return wrapColumn[time.Time](kind, col, toTime), nil
+	}
+
+	return nil, fmt.Errorf("unsupported column type %s", t)
+}
+
+// newConversionError returns a data error for a value that cannot be stored in a column,
+// the same ClickHouse rejects such a row sent over HTTP
+func newConversionError(t proto.ColumnType, v any) error {
+	return &Exception{
+		Code:    errCodeCannotConvertType,
+		Message: fmt.Sprintf("cannot convert %T value %v to %s", v, v, t),
+	}
+}
+
+// toString stores strings as is and other values as JSON, like input_format_json_read_*_as_strings
+func toString(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case json.RawMessage:
+		return string(v), nil
+	case json.Number:
+		return v.String(), nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", newConversionError(proto.ColumnTypeString, v)
+	}
+	return string(b), nil
+}
+
+// toJSONString returns the JSON of a value, strings are taken as JSON already
+func toJSONString(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "{}", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case json.RawMessage:
+		return string(v), nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", newConversionError(proto.ColumnTypeJSON, v)
+	}
+	return string(b), nil
+}
+
+func toBool(v any) (bool, error) {
+	switch v := v.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b, nil
+		}
+	default:
+		if f, ok := numberOf(v); ok {
+			return f != 0, nil
+		}
+	}
+	return false, newConversionError(proto.ColumnTypeBool, v)
+}
+
+func toFloat[T float32 | float64](v any) (T, error) {
+	f, ok := numberOf(v)
+	if !ok {
+		var zero T
+		return zero, newConversionError(proto.ColumnTypeFloat64, v)
+	}
+	return T(f), nil
+}
+
+func toInt[T int8 | int16 | int32 | int64](v any) (T, error) {
+	var zero T
+	if i, ok := v.(int64); ok {
+		return T(i), nil
+	}
+	if s, ok := v.(string); ok {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return T(i), nil
+		}
+	}
+	f, ok := numberOf(v)
+	if !ok || f != math.Trunc(f) {
+		return zero, newConversionError(proto.ColumnTypeInt64, v)
+	}
+	return T(f), nil
+}
+
+func toUint[T uint8 | uint16 | uint32 | uint64](v any) (T, error) {
+	var zero T
+	if u, ok := v.(uint64); ok {
+		return T(u), nil
+	}
+	if s, ok := v.(string); ok {
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return T(u), nil
+		}
+	}
+	f, ok := numberOf(v)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return zero, newConversionError(proto.ColumnTypeUInt64, v)
+	}
+	return T(f), nil
+}
+
+// numberOf returns the value of a number, a numeric string or a bool, nil is 0
+func numberOf(v any) (float64, bool) {
+	switch v := v.(type) {
+	case nil:
+		return 0, true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// timeLayouts are the layouts of timestamps parsed like date_time_input_format=best_effort does for hass2ch rows
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+func toTime(v any) (time.Time, error) {
+	switch v := v.(type) {
+	case nil:
+		return time.Unix(0, 0).UTC(), nil
+	case time.Time:
+		return v, nil
+	case string:
+		if v == "" {
+			return time.Unix(0, 0).UTC(), nil
+		}
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+		// Unix timestamps with an optional fraction
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			sec, frac := math.Modf(f)
+			return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+		}
+	}
+	return time.Time{}, newConversionError(proto.ColumnTypeDateTime64, v)
+}
@@ -0,0 +1,110 @@
+package clickhouse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/ch-go/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testRow struct {
+	EntityID    string   `json:"entity_id"`
+	State       any      `json:"state"`
+	Attributes  any      `json:"attributes"`
+	LastUpdated string   `json:"last_updated"`
+	Value       *float64 `json:"value"`
+	FlapCount   int      `json:"flap_count,omitempty"`
+	Keys        []string `json:"keys,omitempty"`
+	Ignored     string   `json:"-"`
+}
+
+func TestRowValues(t *testing.T) {
+	value := 21.5
+	values, err := RowValues(&testRow{
+		EntityID:    "sensor.temperature",
+		State:       "21.5",
+		LastUpdated: "2024-01-01T00:00:00Z",
+		Value:       &value,
+		Ignored:     "x",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]any{
+		"entity_id":    "sensor.temperature",
+		"state":        "21.5",
+		"attributes":   nil,
+		"last_updated": "2024-01-01T00:00:00Z",
+		"value":        21.5,
+	}, values)
+}
+
+func TestBuildInput(t *testing.T) {
+	columns := []tableColumn{
+		{name: "entity_id", typ: "LowCardinality(String)"},
+		{name: "state", typ: "String"},
+		{name: "attributes", typ: "JSON"},
+		{name: "last_updated", typ: "DateTime64(3, 'UTC')"},
+		{name: "value", typ: "Nullable(Float64)"},
+		{name: "flap_count", typ: "UInt32"},
+		{name: "keys", typ: "Array(LowCardinality(String))"},
+		{name: "ingested_at", typ: "DateTime64(3, 'UTC')"},
+	}
+
+	value := 21.5
+	rows := []map[string]any{}
+	for _, row := range []*testRow{
+		{EntityID: "sensor.temperature", State: 21.5, Attributes: map[string]any{"unit": "°C"}, LastUpdated: "2024-01-01T00:00:00.123Z", Value: &value},
+		{EntityID: "binary_sensor.door", State: "on", LastUpdated: "2024-01-01T00:00:01Z", FlapCount: 3, Keys: []string{"a", "b"}},
+	} {
+		values, err := RowValues(row)
+		require.NoError(t, err)
+		rows = append(rows, values)
+	}
+
+	input, names, err := buildInput(columns, rows)
+	require.NoError(t, err)
+
+	// Columns missing from all rows are left to their defaults
+	assert.Equal(t, "`entity_id`, `state`, `attributes`, `last_updated`, `value`, `flap_count`, `keys`", names)
+	require.Len(t, input, 7)
+	for _, col := range input {
+		assert.Equal(t, 2, col.Data.Rows(), col.Name)
+	}
+
+	state := input[1].Data.(*valueColumn[string])
+	assert.Equal(t, "21.5", state.Row(0))
+	assert.Equal(t, "on", state.Row(1))
+
+	attributes := input[2].Data.(*valueColumn[string])
+	assert.JSONEq(t, `{"unit":"°C"}`, attributes.Row(0))
+	assert.Equal(t, "{}", attributes.Row(1))
+
+	lastUpdated := input[3].Data.(*valueColumn[time.Time])
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 123_000_000, time.UTC), lastUpdated.Row(0))
+
+	nullable := input[4].Data.(*nullableColumn[float64])
+	assert.Equal(t, proto.NewNullable(21.5), nullable.Row(0))
+	assert.False(t, nullable.Row(1).Set)
+
+	keys := input[6].Data.(*arrayColumn[string])
+	assert.Empty(t, keys.Row(0))
+	assert.Equal(t, []string{"a", "b"}, keys.Row(1))
+
+	assert.NotZero(t, inputSize(input))
+}
+
+func TestBuildInput_ConversionIsDataError(t *testing.T) {
+	columns := []tableColumn{{name: "flap_count", typ: "UInt32"}}
+
+	_, _, err := buildInput(columns, []map[string]any{{"flap_count": "many"}})
+	require.Error(t, err)
+	assert.True(t, IsDataError(err))
+	assert.Contains(t, err.Error(), "flap_count")
+}
+
+func TestNewNativeColumn_Unsupported(t *testing.T) {
+	_, err := newNativeColumn("Map(String, String)")
+	assert.Error(t, err)
+}
@@ -0,0 +1,86 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/goccy/go-json"
+)
+
+// Query runs a query and streams its result row by row to fn, so the result set is never
+// loaded into memory as a whole. Rows are passed as raw JSON objects of the JSONEachRow format.
+//
+// The query is sent to the read URL if the client has one (see WithReadURL).
+// It is retried on transient failures until the first row has been passed to fn.
+// Returning an error from fn stops reading the result and the error is returned by Query.
+func (c *Client) Query(ctx context.Context, query string, fn func(row json.RawMessage) error, opts ...QueryOption) error {
+	queryOpts := newQueryOptions(append(opts, WithSetting("default_format", "JSONEachRow")))
+	queryOpts.read = true
+
+	streaming := false
+	err := c.retry(ctx, func() error {
+		resp, err := c.send(ctx, query, nil, queryOpts)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var row json.RawMessage
+			if err := decoder.Decode(&row); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return fmt.Errorf("failed to decode row: %w", err)
+			}
+
+			streaming = true
+			if err := fn(row); err != nil {
+				return &stopError{err: err}
+			}
+		}
+	}, func(err error) bool {
+		// Rows that have been passed to fn cannot be taken back
+		return !streaming && isRetryableError(err)
+	})
+
+	// Don't let the query linger on the server if it has been abandoned
+	if err != nil && ctx.Err() != nil && queryOpts.queryID != "" {
+		c.killQuery(queryOpts)
+	}
+
+	var stopErr *stopError
+	if errors.As(err, &stopErr) {
+		return stopErr.err
+	}
+
+	return err
+}
+
+// QueryRows runs a query and streams its result row by row to fn, decoding every row into T.
+// See Client.Query for details.
+func QueryRows[T any](ctx context.Context, c *Client, query string, fn func(row T) error, opts ...QueryOption) error {
+	return c.Query(ctx, query, func(raw json.RawMessage) error {
+		var row T
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return fmt.Errorf("failed to unmarshal row: %w", err)
+		}
+		return fn(row)
+	}, opts...)
+}
+
+// stopError wraps an error returned by a row callback to tell it apart from query errors
+type stopError struct {
+	err error
+}
+
+func (e *stopError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stopError) Unwrap() error {
+	return e.err
+}
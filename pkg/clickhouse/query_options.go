@@ -0,0 +1,91 @@
+package clickhouse
+
+import (
+	"net/url"
+)
+
+// QueryOption is a function that configures a single query
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	queryID  string
+	role     string
+	quotaKey string
+	settings map[string]string
+	summary  *Summary
+
+	requestStats *RequestStats
+
+	logComment map[string]string
+
+	// read routes the query to the read URL of the client, if configured
+	read bool
+	// noSession sends the query outside of the session of the client, e.g. to kill a query of the session
+	noSession bool
+}
+
+// WithQueryID sets the query_id of the query. It can be used to find the query
+// in system.query_log or to cancel it with KILL QUERY.
+func WithQueryID(queryID string) QueryOption {
+	return func(o *queryOptions) {
+		o.queryID = queryID
+	}
+}
+
+// WithRole sets the role the query is executed with
+func WithRole(role string) QueryOption {
+	return func(o *queryOptions) {
+		o.role = role
+	}
+}
+
+// WithQuotaKey sets the quota key the query is accounted to
+func WithQuotaKey(quotaKey string) QueryOption {
+	return func(o *queryOptions) {
+		o.quotaKey = quotaKey
+	}
+}
+
+// WithSetting sets a ClickHouse setting for the query, overriding the client defaults
+func WithSetting(name, value string) QueryOption {
+	return func(o *queryOptions) {
+		if o.settings == nil {
+			o.settings = make(map[string]string)
+		}
+		o.settings[name] = value
+	}
+}
+
+// WithLogCommentField sets a field of the log_comment of the query, see WithLogComment
+func WithLogCommentField(key, value string) QueryOption {
+	return func(o *queryOptions) {
+		if o.logComment == nil {
+			o.logComment = make(map[string]string)
+		}
+		o.logComment[key] = value
+	}
+}
+
+func newQueryOptions(opts []QueryOption) queryOptions {
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// apply sets the query options as URL parameters
+func (o *queryOptions) apply(params url.Values) {
+	if o.queryID != "" {
+		params.Set("query_id", o.queryID)
+	}
+	if o.role != "" {
+		params.Set("role", o.role)
+	}
+	if o.quotaKey != "" {
+		params.Set("quota_key", o.quotaKey)
+	}
+	for name, value := range o.settings {
+		params.Set(name, value)
+	}
+}
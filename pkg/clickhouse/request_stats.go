@@ -0,0 +1,45 @@
+package clickhouse
+
+import (
+	"io"
+)
+
+// RequestStats are client-side statistics of the request body of a query
+type RequestStats struct {
+	// UncompressedBytes is the size of the request body as produced by the caller
+	UncompressedBytes uint64
+	// SentBytes is the size of the request body sent over the wire, equal to UncompressedBytes
+	// unless the body is compressed
+	SentBytes uint64
+}
+
+// WithRequestStats stores statistics of the request body of the last attempt of a query in the given stats
+func WithRequestStats(stats *RequestStats) QueryOption {
+	return func(o *queryOptions) {
+		o.requestStats = stats
+	}
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += uint64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += uint64(n)
+	return n, err
+}
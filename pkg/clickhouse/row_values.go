@@ -0,0 +1,162 @@
+package clickhouse
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// RowValuer is implemented by rows providing their column values themselves, e.g. to add columns
+// to the ones of a wrapped row
+type RowValuer interface {
+	RowValues() (map[string]any, error)
+}
+
+// RowValues returns the column values of a row inserted with NativeClient.Insert, keyed by column name.
+// A row is a RowValuer, a map with string keys or a struct with fields tagged like for JSONEachRow:
+// fields are named by their json tag, fields tagged with omitempty are left out if empty and
+// embedded structs are flattened.
+func RowValues(row any) (map[string]any, error) {
+	switch row := row.(type) {
+	case RowValuer:
+		return row.RowValues()
+	case map[string]any:
+		return row, nil
+	case *map[string]any:
+		return *row, nil
+	}
+
+	v := reflect.ValueOf(row)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, fmt.Errorf("row is nil")
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		values := make(map[string]any)
+		appendStructValues(values, v)
+		return values, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("row map of type %s has no string keys", v.Type())
+		}
+		values := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			values[iter.Key().String()] = iter.Value().Interface()
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("row of type %s is not a struct or map", v.Type())
+	}
+}
+
+// rowField is a field of a row struct stored in a column
+type rowField struct {
+	index     []int
+	name      string
+	omitEmpty bool
+}
+
+// rowFields caches the fields of row struct types
+var rowFields sync.Map
+
+func appendStructValues(values map[string]any, v reflect.Value) {
+	for _, field := range fieldsOf(v.Type()) {
+		fv, ok := fieldByIndex(v, field.index)
+		if !ok || field.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+
+		// Pointers are stored as the value they point to or NULL
+		for fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				break
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Pointer {
+			values[field.name] = nil
+			continue
+		}
+		values[field.name] = fv.Interface()
+	}
+}
+
+// fieldsOf returns the fields of a struct type stored in columns
+func fieldsOf(t reflect.Type) []rowField {
+	if fields, ok := rowFields.Load(t); ok {
+		return fields.([]rowField)
+	}
+
+	var fields []rowField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		// Embedded structs without a name are flattened
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for _, embedded := range fieldsOf(ft) {
+					embedded.index = append([]int{i}, embedded.index...)
+					fields = append(fields, embedded)
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, rowField{
+			index:     []int{i},
+			name:      name,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+
+	rowFields.Store(t, fields)
+	return fields
+}
+
+// fieldByIndex returns a nested field, it is missing if an embedded pointer on the way is nil
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isEmptyValue reports whether a value is left out by omitempty, as by encoding/json
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package clickhouse
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/goccy/go-json"
+)
+
+const summaryHeader = "X-ClickHouse-Summary"
+
+// Summary is the query summary reported by ClickHouse in the X-ClickHouse-Summary response header
+type Summary struct {
+	ReadRows           uint64 `json:"read_rows,string"`
+	ReadBytes          uint64 `json:"read_bytes,string"`
+	WrittenRows        uint64 `json:"written_rows,string"`
+	WrittenBytes       uint64 `json:"written_bytes,string"`
+	TotalRowsToRead    uint64 `json:"total_rows_to_read,string"`
+	ResultRows         uint64 `json:"result_rows,string"`
+	ResultBytes        uint64 `json:"result_bytes,string"`
+	ElapsedNanoseconds uint64 `json:"elapsed_ns,string"`
+}
+
+// WithSummary stores the summary of a successful query in the given summary.
+// The summary is left untouched if ClickHouse does not report it.
+func WithSummary(summary *Summary) QueryOption {
+	return func(o *queryOptions) {
+		o.summary = summary
+	}
+}
+
+// parseSummary parses the summary header of a response
+func parseSummary(header http.Header, summary *Summary) error {
+	value := header.Get(summaryHeader)
+	if value == "" {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(value), summary); err != nil {
+		return fmt.Errorf("failed to parse %s header: %w", summaryHeader, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package clickhouse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// WithTLSConfig sets the TLS configuration of connections to ClickHouse, e.g. to trust a private CA or to
+// authenticate with a client certificate. It applies to https URLs and to the native protocol, which
+// connects over TLS if it is set. See NewTLSConfig.
+func WithTLSConfig(tlsConfig *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = tlsConfig
+	}
+}
+
+// NewTLSConfig creates a TLS configuration trusting the CA certificates of the PEM bundle at caFile in addition
+// to the system ones, presenting the client certificate and key of certFile and keyFile for mutual TLS, and
+// optionally skipping the verification of the server certificate. Empty files are not used.
+func NewTLSConfig(caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify, //nolint:gosec
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+// withTLSTransport returns a copy of the HTTP client using the TLS configuration,
+// leaving the client passed with WithHTTPClient untouched
+func withTLSTransport(httpClient *http.Client, tlsConfig *tls.Config) (*http.Client, error) {
+	var transport *http.Transport
+	switch t := httpClient.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("cannot set the TLS configuration of an HTTP client with a %T transport", t)
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	client := *httpClient
+	client.Transport = transport
+	return &client, nil
+}
@@ -0,0 +1,102 @@
+package clickhouse
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePEM writes PEM blocks of the given type to a file of the test's temporary directory
+func writePEM(t *testing.T, name, blockType string, blocks ...[]byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	for _, block := range blocks {
+		require.NoError(t, pem.Encode(f, &pem.Block{Type: blockType, Bytes: block}))
+	}
+	return path
+}
+
+// writeClientCertificate writes a self-signed client certificate and its key
+func writeClientCertificate(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hass2ch"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return writePEM(t, "client.pem", "CERTIFICATE", cert), writePEM(t, "client-key.pem", "EC PRIVATE KEY", der)
+}
+
+func TestClient_TLS(t *testing.T) {
+	var clientCerts int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCerts = len(r.TLS.PeerCertificates)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	certFile, keyFile := writeClientCertificate(t)
+
+	// The certificate of the server is not trusted without the CA
+	client, err := NewClient(server.URL, "default", "", WithRetryConfig(RetryConfig{}))
+	require.NoError(t, err)
+	assert.Error(t, client.Execute(context.Background(), "SELECT 1", nil))
+
+	tlsConfig, err := NewTLSConfig(caFile, certFile, keyFile, false)
+	require.NoError(t, err)
+	client, err = NewClient(server.URL, "default", "", WithRetryConfig(RetryConfig{}), WithTLSConfig(tlsConfig))
+	require.NoError(t, err)
+	require.NoError(t, client.Execute(context.Background(), "SELECT 1", nil))
+	assert.Equal(t, 1, clientCerts)
+
+	tlsConfig, err = NewTLSConfig("", "", "", true)
+	require.NoError(t, err)
+	httpClient := &http.Client{Timeout: time.Second}
+	client, err = NewClient(server.URL, "default", "", WithRetryConfig(RetryConfig{}), WithHTTPClient(httpClient), WithTLSConfig(tlsConfig))
+	require.NoError(t, err)
+	require.NoError(t, client.Execute(context.Background(), "SELECT 1", nil))
+	assert.Equal(t, 0, clientCerts)
+	// The HTTP client passed in is not modified
+	assert.Nil(t, httpClient.Transport)
+}
+
+func TestNewTLSConfig_Invalid(t *testing.T) {
+	certFile, keyFile := writeClientCertificate(t)
+
+	_, err := NewTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), "", "", false)
+	assert.Error(t, err)
+	_, err = NewTLSConfig(keyFile, "", "", false)
+	assert.Error(t, err, "no certificates in the CA bundle")
+	_, err = NewTLSConfig("", certFile, "", false)
+	assert.Error(t, err, "key missing")
+	_, err = NewTLSConfig("", keyFile, certFile, false)
+	assert.Error(t, err, "certificate and key swapped")
+}
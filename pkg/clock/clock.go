@@ -0,0 +1,80 @@
+package clock
+
+import (
+	"time"
+)
+
+// Clock provides the current time, timers and tickers. Timing-heavy code takes a Clock instead of calling
+// the time package directly, so tests and embedders can control time with a Fake.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Until(t time.Time) time.Duration
+
+	// After waits for the duration to elapse and then sends the current time on the returned channel
+	After(d time.Duration) <-chan time.Time
+
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+
+	// AfterFunc calls f in its own goroutine after the duration elapsed. The channel of the returned timer is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single event, as time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker delivers ticks at intervals, as time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the clock of the time package
+var Real Clock = realClock{}
+
+// OrReal returns c, or Real if c is nil
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Until(t time.Time) time.Duration        { return time.Until(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{timer: time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{ticker: time.NewTicker(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{timer: time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time        { return t.timer.C }
+func (t realTimer) Stop() bool                 { return t.timer.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.timer.Reset(d) }
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t realTicker) Stop()               { t.ticker.Stop() }
@@ -0,0 +1,159 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a clock whose time only moves with Advance. Timers and tickers fire synchronously
+// within Advance, callbacks of AfterFunc run in their own goroutine as with the real clock.
+type Fake struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending timer, ticker or AfterFunc
+type fakeWaiter struct {
+	fake   *Fake
+	at     time.Time
+	period time.Duration
+	fn     func()
+	c      chan time.Time
+}
+
+// NewFake creates a fake clock starting at now
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration { return f.Now().Sub(t) }
+func (f *Fake) Until(t time.Time) time.Duration { return t.Sub(f.Now()) }
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.add(&fakeWaiter{c: make(chan time.Time, 1)}, d)
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.add(&fakeWaiter{c: make(chan time.Time, 1), period: d}, d)}
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	return f.add(&fakeWaiter{fn: fn}, d)
+}
+
+// Advance moves the time forward by d, firing all timers and tickers due until then in order
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	end := f.now.Add(d)
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool {
+			return f.waiters[i].at.Before(f.waiters[j].at)
+		})
+		if len(f.waiters) == 0 || f.waiters[0].at.After(end) {
+			break
+		}
+
+		w := f.waiters[0]
+		f.now = w.at
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+		w.fire(f.now)
+	}
+	f.now = end
+	f.cond.Broadcast()
+}
+
+// BlockUntil waits until at least n timers, tickers or AfterFuncs are pending, e.g. to wait for
+// a goroutine under test to start its timer before advancing the clock
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+func (f *Fake) add(w *fakeWaiter, d time.Duration) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.fake = f
+	w.at = f.now.Add(d)
+	if d <= 0 && w.period == 0 {
+		w.fire(f.now)
+		return w
+	}
+	f.waiters = append(f.waiters, w)
+	f.cond.Broadcast()
+	return w
+}
+
+// remove removes the waiter, reporting whether it was pending. The caller holds the lock.
+func (f *Fake) remove(w *fakeWaiter) bool {
+	for i := range f.waiters {
+		if f.waiters[i] == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			f.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// fire delivers a tick, dropped as by the time package if the previous one has not been received yet
+func (w *fakeWaiter) fire(now time.Time) {
+	if w.fn != nil {
+		go w.fn()
+		return
+	}
+	select {
+	case w.c <- now:
+	default:
+	}
+}
+
+func (w *fakeWaiter) C() <-chan time.Time { return w.c }
+
+func (w *fakeWaiter) Stop() bool {
+	w.fake.mu.Lock()
+	defer w.fake.mu.Unlock()
+	return w.fake.remove(w)
+}
+
+func (w *fakeWaiter) Reset(d time.Duration) bool {
+	w.fake.mu.Lock()
+	pending := w.fake.remove(w)
+	w.fake.mu.Unlock()
+
+	w.fake.add(w, d)
+	return pending
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() { t.fakeWaiter.Stop() }
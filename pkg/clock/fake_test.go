@@ -0,0 +1,38 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewFake(start)
+
+	timer := clk.NewTimer(time.Minute)
+	ticker := clk.NewTicker(20 * time.Second)
+	called := make(chan struct{})
+	clk.AfterFunc(30*time.Second, func() { close(called) })
+
+	clk.Advance(20 * time.Second)
+	assert.Equal(t, start.Add(20*time.Second), <-ticker.C())
+	assert.Empty(t, timer.C())
+
+	// Ticks not received are dropped, as with the real clock
+	clk.Advance(time.Minute)
+	assert.Equal(t, start.Add(40*time.Second), <-ticker.C())
+	assert.Empty(t, ticker.C())
+	assert.Equal(t, start.Add(time.Minute), <-timer.C())
+	<-called
+
+	assert.False(t, timer.Stop(), "fired timers are not pending")
+	assert.False(t, timer.Reset(time.Second))
+	assert.True(t, timer.Stop())
+
+	ticker.Stop()
+	clk.Advance(time.Hour)
+	assert.Empty(t, ticker.C())
+	assert.Equal(t, start.Add(80*time.Second+time.Hour), clk.Now())
+}
@@ -0,0 +1,29 @@
+package ingestion
+
+import (
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// Acknowledger is optionally implemented by a Source that keeps events in an upstream buffer, e.g. on disk,
+// until the pipeline is done with them. The pipeline guarantees at-least-once delivery to such a source:
+//   - events are acknowledged once all rows of their batch were accepted by ClickHouse,
+//     including rows of the overflow and dead-letter tables
+//   - events dropped on purpose, e.g. by filters or the shard check, are acknowledged when dropped
+//   - state changes held back by flap collapsing are acknowledged once the row they are collapsed into is stored
+//   - events of batches failing to be stored are never acknowledged, the source decides when to redeliver them
+//
+// An event redelivered by the source may be acknowledged more than once, so Ack must be idempotent.
+type Acknowledger interface {
+	Ack(events []*hass.EventMessage)
+}
+
+// ack acknowledges events to the source if it buffers them
+func (p *Pipeline) ack(events []*hass.EventMessage) {
+	if p.acker == nil || len(events) == 0 {
+		return
+	}
+
+	p.acker.Ack(events)
+	metrics.EventsAcknowledged.Add(float64(len(events)))
+}
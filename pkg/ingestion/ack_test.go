@@ -0,0 +1,128 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+type ackSource struct {
+	Source
+	acked []*hass.EventMessage
+}
+
+func (s *ackSource) Ack(events []*hass.EventMessage) {
+	s.acked = append(s.acked, events...)
+}
+
+type sinkFunc func(query string) error
+
+func (f sinkFunc) Execute(_ context.Context, query string, _ io.ReadSeeker, _ ...clickhouse.QueryOption) error {
+	return f(query)
+}
+
+func TestPipeline_InsertPreparedBatchAck(t *testing.T) {
+	event := &hass.EventMessage{Event: hass.Event{EventType: hass.EventTypeStateChanged, Data: hass.EventData{
+		EntityID: "light.kitchen",
+		OldState: &hass.State{EntityID: "light.kitchen", State: "off"},
+		NewState: &hass.State{EntityID: "light.kitchen", State: "on", LastUpdated: time.Now()},
+	}}}
+
+	var insertErr error
+	source := &ackSource{}
+	p := NewPipeline(source, sinkFunc(func(string) error { return insertErr }), "hass", WithoutDDL())
+	require.Equal(t, source, p.acker)
+
+	insertErr = errors.New("connection refused")
+	assert.Error(t, p.insertPreparedBatch(context.Background(), p.prepareBatch([]*hass.EventMessage{event})))
+
+	insertErr = nil
+	batch := p.prepareBatch([]*hass.EventMessage{event})
+	require.NoError(t, p.insertPreparedBatch(context.Background(), batch))
+	p.ack(batch.events)
+	assert.Equal(t, []*hass.EventMessage{event}, source.acked)
+}
+
+// streamAckSource streams state change events and records the acknowledged ones
+type streamAckSource struct {
+	streamSource
+	mtx   sync.Mutex
+	acked []*hass.EventMessage
+}
+
+func (s *streamAckSource) Ack(events []*hass.EventMessage) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.acked = append(s.acked, events...)
+}
+
+func (s *streamAckSource) acknowledged() []*hass.EventMessage {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]*hass.EventMessage(nil), s.acked...)
+}
+
+func TestPipeline_RunAckFlapCollapse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	source := &streamAckSource{streamSource: streamSource{events: make(chan *hass.EventMessage)}}
+	sink := &rowSink{down: true}
+	p := NewPipeline(source, sink.sink(), "hass", WithoutDDL(), WithBatchSize(1), WithClock(clk),
+		WithFlapDetection(FlapConfig{
+			Domains:  map[string]FlapLimit{"binary_sensor": {Window: 10 * time.Second, Threshold: 3}},
+			Collapse: true,
+		}),
+	)
+	go func() {
+		_ = p.Run(ctx)
+	}()
+
+	flap := func(entityID string) []*hass.EventMessage {
+		states := []string{"off", "on"}
+		var events []*hass.EventMessage
+		for i := 0; i < 5; i++ {
+			event := stateChangeAt(entityID, states[i%2], states[(i+1)%2], clk.Now())
+			source.events <- event
+			events = append(events, event)
+		}
+		return events
+	}
+	settle := func(attempts int) {
+		require.Eventually(t, func() bool {
+			clk.Advance(time.Second)
+			return sink.insertAttempts() == attempts
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// While ClickHouse is down, neither the stored nor the held back state changes are acknowledged,
+	// not even once the collapsed row fails to be inserted
+	flap("binary_sensor.door")
+	source.events <- stateChangeAt("light.kitchen", "off", "on", clk.Now())
+	require.Eventually(t, func() bool { return sink.insertAttempts() == 3 }, 5*time.Second, 10*time.Millisecond)
+	settle(4)
+	assert.Empty(t, source.acknowledged())
+
+	// Once the collapsed row is stored, every state change collapsed into it is acknowledged
+	sink.setDown(false)
+	events := flap("binary_sensor.window")
+	light := stateChangeAt("light.kitchen", "on", "off", clk.Now())
+	source.events <- light
+	require.Eventually(t, func() bool { return len(source.acknowledged()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []*hass.EventMessage{events[0], events[1], light}, source.acknowledged())
+
+	settle(8)
+	require.Eventually(t, func() bool { return len(source.acknowledged()) == 6 }, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, append(events, light), source.acknowledged())
+}
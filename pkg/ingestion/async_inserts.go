@@ -0,0 +1,130 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// asyncInsertStatusOk is the status of successfully flushed asynchronous inserts
+const asyncInsertStatusOk = "Ok"
+
+// WithAsyncInsertFeedback reads system.asynchronous_insert_log and system.part_log every interval and exposes
+// the asynchronous inserts into the tables of the pipeline by status and the parts they created as metrics.
+// Inserts are acknowledged by ClickHouse before they are flushed, so flush failures are not seen otherwise.
+// The logs must be enabled on the server.
+func WithAsyncInsertFeedback(interval time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.asyncInsertFeedback = interval
+	}
+}
+
+// asyncInsertFeedback reads the logs of the server since the previous read
+type asyncInsertFeedback struct {
+	q         querier
+	databases []string
+
+	// inserts and parts are the times of the last entries read from the logs, in microseconds
+	inserts int64
+	parts   int64
+}
+
+// watchAsyncInserts reads the feedback of the server every interval until the context is done
+func (p *Pipeline) watchAsyncInserts(ctx context.Context, q querier) {
+	ticker := p.clock.NewTicker(p.asyncInsertFeedback)
+	defer ticker.Stop()
+
+	// Entries logged before the start are not counted
+	now := p.clock.Now().UnixMicro()
+	feedback := &asyncInsertFeedback{q: q, databases: p.databases(), inserts: now, parts: now}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		if err := feedback.read(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to read asynchronous insert feedback")
+		}
+	}
+}
+
+// read updates the metrics with the entries of the logs since the previous read
+func (f *asyncInsertFeedback) read(ctx context.Context) error {
+	databases := make([]string, 0, len(f.databases))
+	for _, database := range f.databases {
+		databases = append(databases, clickhouse.QuoteString(database))
+	}
+	inDatabases := strings.Join(databases, ", ")
+
+	query := fmt.Sprintf(`SELECT database, table, toString(status) AS status, count() AS inserts, sum(rows) AS rows,
+    anyIf(exception, exception != '') AS exception, toUnixTimestamp64Micro(max(event_time_microseconds)) AS last
+FROM system.asynchronous_insert_log
+WHERE event_time_microseconds > fromUnixTimestamp64Micro(toInt64(%d)) AND database IN (%s)
+GROUP BY database, table, status`, f.inserts, inDatabases)
+	err := f.q.Query(ctx, query, func(raw json.RawMessage) error {
+		var row struct {
+			Database  string `json:"database"`
+			Table     string `json:"table"`
+			Status    string `json:"status"`
+			Inserts   uint64 `json:"inserts,string"`
+			Rows      uint64 `json:"rows,string"`
+			Exception string `json:"exception"`
+			Last      int64  `json:"last,string"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return err
+		}
+
+		metrics.CHAsyncInserts.WithLabelValues(row.Database, row.Table, row.Status).Add(float64(row.Inserts))
+		metrics.CHAsyncInsertRows.WithLabelValues(row.Database, row.Table, row.Status).Add(float64(row.Rows))
+		if row.Status != asyncInsertStatusOk {
+			log.Warn().
+				Str("table", row.Database+"."+row.Table).
+				Str("status", row.Status).
+				Uint64("inserts", row.Inserts).
+				Uint64("rows", row.Rows).
+				Str("exception", row.Exception).
+				Msg("asynchronous inserts failed to be flushed")
+		}
+		f.inserts = max(f.inserts, row.Last)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query system.asynchronous_insert_log: %w", err)
+	}
+
+	query = fmt.Sprintf(`SELECT database, table, count() AS parts, toUnixTimestamp64Micro(max(event_time_microseconds)) AS last
+FROM system.part_log
+WHERE event_type = 'NewPart' AND event_time_microseconds > fromUnixTimestamp64Micro(toInt64(%d)) AND database IN (%s)
+GROUP BY database, table`, f.parts, inDatabases)
+	err = f.q.Query(ctx, query, func(raw json.RawMessage) error {
+		var row struct {
+			Database string `json:"database"`
+			Table    string `json:"table"`
+			Parts    uint64 `json:"parts,string"`
+			Last     int64  `json:"last,string"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return err
+		}
+
+		metrics.CHPartsCreated.WithLabelValues(row.Database, row.Table).Add(float64(row.Parts))
+		f.parts = max(f.parts, row.Last)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query system.part_log: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package ingestion
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// logSink serves rows of system.asynchronous_insert_log and system.part_log and records the queries
+type logSink struct {
+	inserts []string
+	parts   []string
+	queries []string
+}
+
+func (s *logSink) Execute(context.Context, string, io.ReadSeeker, ...clickhouse.QueryOption) error {
+	return nil
+}
+
+func (s *logSink) Query(_ context.Context, query string, fn func(row json.RawMessage) error, _ ...clickhouse.QueryOption) error {
+	s.queries = append(s.queries, query)
+	rows := s.parts
+	if strings.Contains(query, "system.asynchronous_insert_log") {
+		rows = s.inserts
+	}
+	for _, row := range rows {
+		if err := fn(json.RawMessage(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAsyncInsertFeedback(t *testing.T) {
+	sink := &logSink{
+		inserts: []string{
+			`{"database":"hass","table":"light","status":"Ok","inserts":"3","rows":"120","exception":"","last":"1700000002000000"}`,
+			`{"database":"hass","table":"light","status":"FlushError","inserts":"1","rows":"40","exception":"Code: 53. Type mismatch","last":"1700000001000000"}`,
+		},
+		parts: []string{`{"database":"hass","table":"light","parts":"4","last":"1700000003000000"}`},
+	}
+	p := NewPipeline(nil, sink, "hass", WithTableDatabases(map[string]string{"light": "lights"}))
+	feedback := &asyncInsertFeedback{q: sink, databases: p.databases(), inserts: 1700000000000000, parts: 1700000000000000}
+
+	require.NoError(t, feedback.read(context.Background()))
+	require.Len(t, sink.queries, 2)
+	assert.Contains(t, sink.queries[0], "fromUnixTimestamp64Micro(toInt64(1700000000000000)) AND database IN ('hass', 'lights')")
+	assert.Contains(t, sink.queries[1], "event_type = 'NewPart'")
+
+	// The next read continues after the last entries read
+	assert.Equal(t, int64(1700000002000000), feedback.inserts)
+	assert.Equal(t, int64(1700000003000000), feedback.parts)
+
+	sink.inserts, sink.parts = nil, nil
+	require.NoError(t, feedback.read(context.Background()))
+	assert.Contains(t, sink.queries[2], "toInt64(1700000002000000)")
+	assert.Equal(t, int64(1700000002000000), feedback.inserts)
+}
@@ -0,0 +1,128 @@
+package ingestion
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+const attributeChangesTableName = "attribute_changes"
+
+// AttributeChange represents a state change event where only the attributes have changed
+type AttributeChange struct {
+	EntityID    string                     `json:"entity_id"`
+	ChangedKeys []string                   `json:"changed_keys"`
+	OldValues   map[string]json.RawMessage `json:"old_values"`
+	NewValues   map[string]json.RawMessage `json:"new_values"`
+	Context     any                        `json:"context"`
+	LastUpdated string                     `json:"last_updated"`
+}
+
+// WithAttributeChanges enables recording state changes with an unchanged state
+// in the attribute_changes table instead of the entity domain table
+func WithAttributeChanges() PipelineOption {
+	return func(p *Pipeline) {
+		p.attributeChanges = true
+	}
+}
+
+// isAttributeChange reports whether the event changes attributes only
+func isAttributeChange(event *hass.EventMessage) bool {
+	data := event.Event.Data
+	if data.OldState == nil || data.NewState == nil {
+		return false
+	}
+
+	return data.OldState.State == data.NewState.State &&
+		!bytes.Equal(data.OldState.Attributes, data.NewState.Attributes)
+}
+
+func resolveAttributeChangeDestination(event *hass.EventMessage, database string) (*insert, error) {
+	data := event.Event.Data
+
+	if data.EntityID == "" {
+		return nil, fmt.Errorf("event.data.entity_id is missing")
+	}
+
+	input, err := resolveAttributeChangeInput(data.OldState, data.NewState)
+	if err != nil {
+		return nil, err
+	}
+
+	return &insert{
+		Database:  database,
+		TableName: attributeChangesTableName,
+		Input:     input,
+	}, nil
+}
+
+// resolveAttributeChangeInput compares the top-level attributes of the states by their JSON. Without an old state,
+// e.g. for the first state of an entity, all attributes are added.
+func resolveAttributeChangeInput(oldState, newState *hass.State) (*AttributeChange, error) {
+	var oldAttrs, newAttrs map[string]json.RawMessage
+	if oldState != nil {
+		if err := unmarshalAttributes(oldState.Attributes, &oldAttrs); err != nil {
+			return nil, fmt.Errorf("failed to parse old attributes: %w", err)
+		}
+	}
+	if err := unmarshalAttributes(newState.Attributes, &newAttrs); err != nil {
+		return nil, fmt.Errorf("failed to parse new attributes: %w", err)
+	}
+
+	change := &AttributeChange{
+		EntityID:    newState.EntityID,
+		ChangedKeys: []string{},
+		OldValues:   make(map[string]json.RawMessage),
+		NewValues:   make(map[string]json.RawMessage),
+		Context:     newState.Context,
+		LastUpdated: newState.LastUpdated.Format(time.RFC3339Nano),
+	}
+
+	for key, oldValue := range oldAttrs {
+		newValue, ok := newAttrs[key]
+		if ok && bytes.Equal(oldValue, newValue) {
+			continue
+		}
+
+		change.ChangedKeys = append(change.ChangedKeys, key)
+		change.OldValues[key] = oldValue
+		if ok {
+			change.NewValues[key] = newValue
+		}
+	}
+
+	for key, newValue := range newAttrs {
+		if _, ok := oldAttrs[key]; ok {
+			continue
+		}
+
+		change.ChangedKeys = append(change.ChangedKeys, key)
+		change.NewValues[key] = newValue
+	}
+
+	sort.Strings(change.ChangedKeys)
+
+	return change, nil
+}
+
+func unmarshalAttributes(raw json.RawMessage, attrs *map[string]json.RawMessage) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, attrs)
+}
+
+// createAttributeChangesTable creates the attribute changes table in ClickHouse
+func createAttributeChangesTable(ctx context.Context, sink Sink, database string, extraColumns []string) error {
+	query := fmt.Sprintf(attributeChangesDDL, database, attributeChangesTableName)
+	if err := sink.Execute(ctx, query, nil); err != nil {
+		return err
+	}
+	return addColumns(ctx, sink, database, attributeChangesTableName, extraColumns)
+}
@@ -0,0 +1,70 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestResolveAttributeChangeInput(t *testing.T) {
+	lastUpdated := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	state := func(attributes string) *hass.State {
+		return &hass.State{EntityID: "climate.living_room", State: "heat", Attributes: json.RawMessage(attributes), LastUpdated: lastUpdated}
+	}
+
+	// Added, removed and changed attributes
+	change, err := resolveAttributeChangeInput(
+		state(`{"temperature":21,"hvac_action":"idle","preset_mode":"eco"}`),
+		state(`{"temperature":22,"hvac_action":"idle","fan_mode":"auto"}`),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, &AttributeChange{
+		EntityID:    "climate.living_room",
+		ChangedKeys: []string{"fan_mode", "preset_mode", "temperature"},
+		OldValues:   map[string]json.RawMessage{"preset_mode": json.RawMessage(`"eco"`), "temperature": json.RawMessage(`21`)},
+		NewValues:   map[string]json.RawMessage{"fan_mode": json.RawMessage(`"auto"`), "temperature": json.RawMessage(`22`)},
+		Context:     hass.EventContext{},
+		LastUpdated: "2026-01-02T03:04:05Z",
+	}, change)
+
+	// Without an old state, all attributes are added
+	change, err = resolveAttributeChangeInput(nil, state(`{"temperature":21}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"temperature"}, change.ChangedKeys)
+	assert.Empty(t, change.OldValues)
+	assert.Equal(t, map[string]json.RawMessage{"temperature": json.RawMessage(`21`)}, change.NewValues)
+
+	// Nested values are compared as a whole, the changed top-level attribute holds them
+	change, err = resolveAttributeChangeInput(
+		state(`{"forecast":[{"temperature":20,"condition":"sunny"}],"target":{"low":18,"high":24}}`),
+		state(`{"forecast":[{"temperature":19,"condition":"sunny"}],"target":{"low":18,"high":24}}`),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"forecast"}, change.ChangedKeys)
+	assert.JSONEq(t, `[{"temperature":20,"condition":"sunny"}]`, string(change.OldValues["forecast"]))
+	assert.JSONEq(t, `[{"temperature":19,"condition":"sunny"}]`, string(change.NewValues["forecast"]))
+
+	// Malformed attributes are an error
+	_, err = resolveAttributeChangeInput(state(`{"temperature":`), state(`{}`))
+	assert.Error(t, err)
+}
+
+func TestIsAttributeChange(t *testing.T) {
+	event := func(oldState, newState *hass.State) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{Data: hass.EventData{OldState: oldState, NewState: newState}}}
+	}
+
+	on := &hass.State{State: "on", Attributes: json.RawMessage(`{"brightness":100}`)}
+	dimmed := &hass.State{State: "on", Attributes: json.RawMessage(`{"brightness":50}`)}
+	off := &hass.State{State: "off", Attributes: json.RawMessage(`{"brightness":50}`)}
+
+	assert.True(t, isAttributeChange(event(on, dimmed)))
+	assert.False(t, isAttributeChange(event(on, on)))
+	assert.False(t, isAttributeChange(event(dimmed, off)))
+	assert.False(t, isAttributeChange(event(nil, on)))
+}
@@ -0,0 +1,84 @@
+package ingestion
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// attributeTypePattern matches the ClickHouse types attributes can be promoted to: types without parameters or
+// with a single one, e.g. Float64 or DateTime64(3)
+var attributeTypePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(\([^(),]*\))?$`)
+
+// AttributeColumn promotes an attribute of the entities of a domain to a typed column of the state change
+// tables of the domain
+type AttributeColumn struct {
+	Domain    string
+	Attribute string
+	// Type is the ClickHouse type of the column. The column is Nullable, as entities may lack the attribute.
+	Type string
+}
+
+// definition returns the definition of the column, extracted from the attributes column by ClickHouse on insert
+func (c AttributeColumn) definition() string {
+	return fmt.Sprintf("`%s` Nullable(%s) DEFAULT accurateCastOrNull(toString(attributes.`%s`), '%s')",
+		c.Attribute, c.Type, c.Attribute, c.Type)
+}
+
+// ParseAttributeColumns parses the attributes promoted to typed columns in the form of
+// "domain.attribute=Type,...", e.g. "climate.current_temperature=Float64,sensor.battery_level=UInt8".
+// An attribute promoted in more than one domain must have the same type in all of them, as override
+// tables get the columns of all domains.
+func ParseAttributeColumns(s string) ([]AttributeColumn, error) {
+	var columns []AttributeColumn
+	seen := make(map[string]bool)
+	types := make(map[string]string)
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, columnType, ok := strings.Cut(part, "=")
+		domain, attribute, hasDomain := strings.Cut(strings.TrimSpace(key), ".")
+		columnType = strings.TrimSpace(columnType)
+		if !ok || !hasDomain || !tableNamePattern.MatchString(domain) || !labelNameRegexp.MatchString(attribute) {
+			return nil, fmt.Errorf("invalid attribute column %q: expected domain.attribute=Type", part)
+		}
+		if !attributeTypePattern.MatchString(columnType) {
+			return nil, fmt.Errorf("invalid type %q of attribute %s", columnType, attribute)
+		}
+		if strings.HasPrefix(columnType, "Nullable") || strings.HasPrefix(columnType, "LowCardinality") {
+			return nil, fmt.Errorf("invalid type %q of attribute %s: attribute columns are Nullable already", columnType, attribute)
+		}
+		if _, ok := columnDescriptions[attribute]; ok {
+			return nil, fmt.Errorf("attribute %s cannot be promoted, a generated column has its name", attribute)
+		}
+		if seen[domain+"."+attribute] {
+			return nil, fmt.Errorf("attribute %s of domain %s is promoted more than once", attribute, domain)
+		}
+		if other, ok := types[attribute]; ok && other != columnType {
+			return nil, fmt.Errorf("attribute %s is promoted with types %s and %s", attribute, other, columnType)
+		}
+		seen[domain+"."+attribute] = true
+		types[attribute] = columnType
+
+		columns = append(columns, AttributeColumn{Domain: domain, Attribute: attribute, Type: columnType})
+	}
+
+	return columns, nil
+}
+
+// WithAttributeColumns adds typed columns holding attributes of the entities of a domain to its state change
+// tables, e.g. current_temperature of climate entities, so they can be queried without reading the attributes
+// column. The values are extracted from the attributes by ClickHouse on insert, and attributes that are
+// missing or do not fit the type are NULL.
+func WithAttributeColumns(columns ...AttributeColumn) PipelineOption {
+	return func(p *Pipeline) {
+		p.attributeColumns = make(map[string][]string)
+		for _, column := range columns {
+			p.attributeColumns[column.Domain] = append(p.attributeColumns[column.Domain], column.definition())
+		}
+	}
+}
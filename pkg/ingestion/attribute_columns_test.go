@@ -0,0 +1,54 @@
+package ingestion
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAttributeColumns(t *testing.T) {
+	columns, err := ParseAttributeColumns("climate.current_temperature=Float64, sensor.battery_level=UInt8,media_player.volume_level=Float64")
+	require.NoError(t, err)
+	assert.Equal(t, []AttributeColumn{
+		{Domain: "climate", Attribute: "current_temperature", Type: "Float64"},
+		{Domain: "sensor", Attribute: "battery_level", Type: "UInt8"},
+		{Domain: "media_player", Attribute: "volume_level", Type: "Float64"},
+	}, columns)
+
+	for _, invalid := range []string{
+		"current_temperature=Float64",
+		"climate.current_temperature",
+		"climate.current-temperature=Float64",
+		"climate.current_temperature=Nullable(Float64)",
+		"climate.current_temperature=Decimal(10, 2)",
+		"climate.state=String",
+		"climate.current_temperature=Float64,climate.current_temperature=Float32",
+		"climate.battery_level=UInt8,sensor.battery_level=Float64",
+	} {
+		_, err := ParseAttributeColumns(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPipeline_AttributeColumns(t *testing.T) {
+	columns, err := ParseAttributeColumns("climate.current_temperature=Float64,media_player.volume_level=Float64")
+	require.NoError(t, err)
+	p := NewPipeline(nil, nil, "hass", WithAttributeColumns(columns...))
+
+	assert.Contains(t, p.tableColumns("climate"), "`current_temperature` Nullable(Float64) DEFAULT accurateCastOrNull(toString(attributes.`current_temperature`), 'Float64')")
+	assert.NotContains(t, p.tableColumns("light"), columns[0].definition())
+
+	// Domains without a dedicated state type are listed once they have attribute columns
+	catalog, err := p.Catalog(context.Background())
+	require.NoError(t, err)
+	var mediaPlayer *CatalogTable
+	for _, table := range catalog.Tables {
+		if table.Name == "media_player" {
+			mediaPlayer = table
+		}
+	}
+	require.NotNil(t, mediaPlayer)
+	assert.Contains(t, mediaPlayer.Columns, CatalogColumn{Name: "volume_level", Type: "Nullable(Float64)"})
+}
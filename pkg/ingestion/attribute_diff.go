@@ -0,0 +1,79 @@
+package ingestion
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+const (
+	attributesDiffColumn    = "attributes_diff Bool DEFAULT false"
+	attributesRemovedColumn = "attributes_removed Array(LowCardinality(String)) DEFAULT []"
+)
+
+// WithAttributeDiff stores, instead of the full attributes on every row, only the attributes added or changed
+// since the old state, with removed attribute keys in the attributes_removed column. Rows storing a diff are
+// marked with the attributes_diff column. The first row of an entity, and the first one after snapshotInterval
+// since the last full row, store the full attributes, so attributes can be rebuilt from the preceding snapshot
+// even if some rows were dropped in between, e.g. by a rate limit.
+func WithAttributeDiff(snapshotInterval time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.transformers = append(p.transformers, &attributeDiffer{
+			snapshotInterval: snapshotInterval,
+			snapshots:        make(map[string]time.Time),
+		})
+	}
+}
+
+// attributeDiffer keeps the last_updated of the last full attributes row of every entity
+type attributeDiffer struct {
+	snapshotInterval time.Duration
+
+	snapshotsMtx sync.Mutex
+	snapshots    map[string]time.Time
+}
+
+func (d *attributeDiffer) Columns(string) []string {
+	return []string{attributesDiffColumn, attributesRemovedColumn}
+}
+
+func (d *attributeDiffer) Transform(event *hass.EventMessage, change *StateChange) {
+	oldState, newState := event.Event.Data.OldState, event.Event.Data.NewState
+	if oldState == nil || newState == nil || d.snapshotDue(newState.EntityID, newState.LastUpdated) {
+		return
+	}
+
+	diff, err := resolveAttributeChangeInput(oldState, newState)
+	if err != nil {
+		// Unparsable attributes are stored in full
+		return
+	}
+
+	removed := []string{}
+	for _, key := range diff.ChangedKeys {
+		if _, ok := diff.NewValues[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	change.Attributes = diff.NewValues
+	change.AttributesDiff = true
+	change.AttributesRemoved = removed
+	metrics.AttributeDiffRows.Inc()
+}
+
+// snapshotDue reports whether the row of the entity updated at lastUpdated stores the full attributes
+func (d *attributeDiffer) snapshotDue(entityID string, lastUpdated time.Time) bool {
+	d.snapshotsMtx.Lock()
+	defer d.snapshotsMtx.Unlock()
+
+	last, ok := d.snapshots[entityID]
+	if ok && lastUpdated.Sub(last) < d.snapshotInterval {
+		return false
+	}
+
+	d.snapshots[entityID] = lastUpdated
+	return true
+}
@@ -0,0 +1,39 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestAttributeDiffer(t *testing.T) {
+	differ := &attributeDiffer{snapshotInterval: time.Hour, snapshots: make(map[string]time.Time)}
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	transform := func(lastUpdated time.Time, oldAttrs, newAttrs string) *StateChange {
+		event := &hass.EventMessage{Event: hass.Event{Data: hass.EventData{
+			EntityID: "light.kitchen",
+			OldState: &hass.State{EntityID: "light.kitchen", Attributes: json.RawMessage(oldAttrs)},
+			NewState: &hass.State{EntityID: "light.kitchen", Attributes: json.RawMessage(newAttrs), LastUpdated: lastUpdated},
+		}}}
+		change := &StateChange{Attributes: event.Event.Data.NewState.Attributes}
+		differ.Transform(event, change)
+		return change
+	}
+
+	snapshot := transform(start, `{"brightness":1,"color":"red"}`, `{"brightness":2,"color":"red"}`)
+	assert.False(t, snapshot.AttributesDiff, "first row of an entity is a snapshot")
+	assert.JSONEq(t, `{"brightness":2,"color":"red"}`, string(snapshot.Attributes.(json.RawMessage)))
+
+	diff := transform(start.Add(time.Minute), `{"brightness":2,"color":"red"}`, `{"brightness":3,"effect":"none"}`)
+	assert.True(t, diff.AttributesDiff)
+	assert.Equal(t, map[string]json.RawMessage{"brightness": json.RawMessage("3"), "effect": json.RawMessage(`"none"`)}, diff.Attributes)
+	assert.Equal(t, []string{"color"}, diff.AttributesRemoved)
+
+	snapshot = transform(start.Add(time.Hour), `{"brightness":3}`, `{"brightness":4}`)
+	assert.False(t, snapshot.AttributesDiff, "snapshot after the interval")
+}
@@ -0,0 +1,81 @@
+package ingestion
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+const availabilityTableName = "availability"
+
+// Events of the availability table
+const (
+	AvailabilityBecameUnavailable = "became_unavailable"
+	AvailabilityBecameUnknown     = "became_unknown"
+	AvailabilityBecameAvailable   = "became_available"
+)
+
+// errSkippedState is the error of state changes to an unknown or unavailable state, which are not stored
+// in state change tables
+var errSkippedState = errors.New("skipping event with unknown state")
+
+// AvailabilityChange is a row of the availability table recording that an entity became unavailable or unknown,
+// or available again
+type AvailabilityChange struct {
+	EntityID    string `json:"entity_id"`
+	Domain      string `json:"domain"`
+	Event       string `json:"event"`
+	State       string `json:"state"`
+	OldState    string `json:"old_state"`
+	LastChanged string `json:"last_changed"`
+}
+
+// WithAvailability records the transitions of entities to and from the unavailable and unknown states in the
+// availability table. State changes to these states are not stored in state change tables, so without it
+// the windows in which an entity was unavailable cannot be told apart from ones without state changes.
+func WithAvailability() PipelineOption {
+	return func(p *Pipeline) {
+		p.availability = true
+	}
+}
+
+// availabilityChange returns the availability row of a state change event, nil if recording availability is
+// disabled or the event does not change the availability of its entity
+func (p *Pipeline) availabilityChange(event *hass.EventMessage) *AvailabilityChange {
+	data := event.Event.Data
+	if !p.availability || event.Event.EventType != hass.EventTypeStateChanged || data.NewState == nil {
+		return nil
+	}
+
+	oldState := ""
+	if data.OldState != nil {
+		oldState = data.OldState.State
+	}
+
+	var name string
+	switch newState := data.NewState.State; {
+	case newState == oldState:
+		return nil
+	case newState == hass.UnavailableValue:
+		name = AvailabilityBecameUnavailable
+	case newState == hass.UnknownValue:
+		name = AvailabilityBecameUnknown
+	case oldState == hass.UnavailableValue || oldState == hass.UnknownValue:
+		name = AvailabilityBecameAvailable
+	default:
+		return nil
+	}
+
+	// The domain of the entity ID, as the table domain of a sensor depends on its state
+	domain, _, _ := strings.Cut(data.NewState.EntityID, ".")
+	return &AvailabilityChange{
+		EntityID:    data.NewState.EntityID,
+		Domain:      domain,
+		Event:       name,
+		State:       data.NewState.State,
+		OldState:    oldState,
+		LastChanged: data.NewState.LastChanged.UTC().Format(time.RFC3339Nano),
+	}
+}
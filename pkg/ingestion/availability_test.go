@@ -0,0 +1,59 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestPipeline_AvailabilityChange(t *testing.T) {
+	transition := func(entityID, oldState, newState string) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{EventType: hass.EventTypeStateChanged, Data: hass.EventData{
+			EntityID: entityID,
+			OldState: &hass.State{EntityID: entityID, State: oldState},
+			NewState: &hass.State{EntityID: entityID, State: newState, LastChanged: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+		}}}
+	}
+
+	assert.Nil(t, NewPipeline(nil, nil, "hass").availabilityChange(transition("light.kitchen", "on", hass.UnavailableValue)))
+
+	p := NewPipeline(nil, nil, "hass", WithAvailability())
+	for _, tc := range []struct {
+		oldState, newState string
+		expected           string
+	}{
+		{"21.5", hass.UnavailableValue, AvailabilityBecameUnavailable},
+		{hass.UnavailableValue, hass.UnknownValue, AvailabilityBecameUnknown},
+		{hass.UnknownValue, "22", AvailabilityBecameAvailable},
+		{"21.5", "22", ""},
+		{hass.UnavailableValue, hass.UnavailableValue, ""},
+	} {
+		change := p.availabilityChange(transition("sensor.temperature", tc.oldState, tc.newState))
+		if tc.expected == "" {
+			assert.Nil(t, change, "%s -> %s", tc.oldState, tc.newState)
+			continue
+		}
+		require.NotNil(t, change, "%s -> %s", tc.oldState, tc.newState)
+		assert.Equal(t, tc.expected, change.Event)
+		// The domain of the entity ID, not the numeric_sensor table
+		assert.Equal(t, hass.EntitySensor, change.Domain)
+		assert.Equal(t, "2026-01-02T03:04:05Z", change.LastChanged)
+	}
+
+	// Unavailable states are stored in the availability table only, available ones in both tables
+	batch := p.prepareBatch([]*hass.EventMessage{
+		transition("light.kitchen", "on", hass.UnavailableValue),
+		transition("light.kitchen", hass.UnavailableValue, "off"),
+	})
+	assert.Zero(t, batch.errorCount)
+	require.Len(t, batch.tables, 2)
+	assert.Equal(t, availabilityTableName, batch.tables[0].tableName)
+	assert.Len(t, batch.tables[0].values, 2)
+	assert.Equal(t, 1, batch.tables[0].processedCount)
+	assert.Equal(t, hass.EntityLight, batch.tables[1].tableName)
+	assert.Len(t, batch.tables[1].values, 1)
+}
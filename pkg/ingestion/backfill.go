@@ -0,0 +1,322 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+	"github.com/jkaflik/hass2ch/pkg/pool"
+)
+
+// HistorySource is optionally implemented by a Source able to read the recorded history of entities,
+// e.g. *hass.Client. It is required by Backfill.
+type HistorySource interface {
+	HistoryDuringPeriod(ctx context.Context, start, end time.Time, entityIDs []string) (map[string][]hass.State, error)
+}
+
+// defaultBackfillWindow is the period of history read at once by default
+const defaultBackfillWindow = time.Hour
+
+// BackfillOptions select the history inserted by Backfill
+type BackfillOptions struct {
+	// From and To bound the period of the history, To defaults to now
+	From, To time.Time
+	// Window is the period of history read from Home Assistant at once, an hour if 0
+	Window time.Duration
+	// Entities are glob patterns of the entity IDs backfilled, all entities if empty
+	Entities []string
+	// Concurrency is the number of windows of history read from Home Assistant at the same time, 1 if 0.
+	// Windows are inserted in order regardless.
+	Concurrency int
+	// RequestRate limits the requests of history sent to Home Assistant per second, unlimited if 0
+	RequestRate float64
+	// Checkpoint is the path of a file storing the end of the last inserted window, so that an interrupted
+	// backfill of the same period and entities resumes after it. No checkpoint is kept if empty.
+	// The pipeline has no state store yet, so the checkpoint is kept in a local file.
+	Checkpoint string
+}
+
+// BackfillReport is the outcome of Backfill
+type BackfillReport struct {
+	Entities int `json:"entities"`
+	Windows  int `json:"windows"`
+	// StateChanges is the number of recorded state changes read from Home Assistant
+	StateChanges int `json:"state_changes"`
+	// FailedBatches is the number of batches that failed to be inserted
+	FailedBatches int `json:"failed_batches"`
+	// ResumedFrom is the end of the last window inserted by an interrupted backfill, if resumed from its checkpoint
+	ResumedFrom *time.Time `json:"resumed_from,omitempty"`
+}
+
+// Backfill reads the history recorded by Home Assistant between From and To and inserts its state changes
+// into the same tables as the pipeline, with the same transformers, e.g. to seed ClickHouse with existing
+// recorder data. Filters of live events, e.g. rate limits, are not applied; the shard of the pipeline is.
+// State changes are inserted in order, one window of history at a time, and a window with batches that failed
+// to be inserted stops the backfill. With a checkpoint, the end of every inserted window is stored, and
+// a backfill of the same period and entities resumes after it.
+func (p *Pipeline) Backfill(ctx context.Context, opts BackfillOptions) (*BackfillReport, error) {
+	history, ok := p.source.(HistorySource)
+	if !ok {
+		return nil, errors.New("source does not support reading history")
+	}
+
+	if opts.To.IsZero() {
+		opts.To = p.clock.Now()
+	}
+	if !opts.From.Before(opts.To) {
+		return nil, fmt.Errorf("invalid period: %s is not before %s", opts.From.Format(time.RFC3339), opts.To.Format(time.RFC3339))
+	}
+	if opts.Window <= 0 {
+		opts.Window = defaultBackfillWindow
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+
+	checkpoint, err := loadBackfillCheckpoint(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.CheckGrants(ctx); err != nil {
+		return nil, err
+	}
+	if err := p.createDatabases(ctx); err != nil {
+		return nil, err
+	}
+	if err := p.discoverTopology(ctx); err != nil {
+		return nil, err
+	}
+	p.tableExists = make(map[string]bool)
+
+	entityIDs, err := p.backfillEntities(ctx, opts.Entities)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &BackfillReport{Entities: len(entityIDs)}
+	if len(entityIDs) == 0 {
+		return report, nil
+	}
+
+	start := opts.From
+	if checkpoint != nil {
+		start = checkpoint.Done
+		report.ResumedFrom = &checkpoint.Done
+		log.Info().Time("from", start).Str("checkpoint", opts.Checkpoint).Msg("resuming backfill from checkpoint")
+	}
+
+	var windows [][2]time.Time
+	for ; start.Before(opts.To); start = start.Add(opts.Window) {
+		windows = append(windows, [2]time.Time{start, minTime(start.Add(opts.Window), opts.To)})
+	}
+
+	limiter := newRequestLimiter(p.clock, opts.RequestRate)
+	for len(windows) > 0 {
+		group := windows[:min(len(windows), opts.Concurrency)]
+		windows = windows[len(group):]
+
+		// The windows of a group are read at the same time by a pool of workers, and inserted in order
+		histories := make([]map[string][]hass.State, len(group))
+		errs := make([]error, len(group))
+		for i := range errs {
+			errs[i] = errWindowNotRead
+		}
+		readers := pool.New(ctx, "backfill", len(group), func(ctx context.Context, i int) error {
+			if errs[i] = limiter.wait(ctx); errs[i] == nil {
+				histories[i], errs[i] = history.HistoryDuringPeriod(ctx, group[i][0], group[i][1], entityIDs)
+			}
+			return errs[i]
+		})
+		for i := range group {
+			if err := readers.Submit(ctx, i); err != nil {
+				break
+			}
+		}
+		readers.Close()
+
+		for i, window := range group {
+			if errs[i] != nil {
+				return report, fmt.Errorf("failed to read history from %s: %w", window[0].Format(time.RFC3339), errs[i])
+			}
+
+			events := historyStateChanges(histories[i])
+			failed := p.insertHistory(ctx, events)
+			report.Windows++
+			report.StateChanges += len(events)
+			report.FailedBatches += failed
+
+			// The checkpoint is not moved past a window with rows that were not stored, so a resumed backfill
+			// inserts it again
+			if failed > 0 {
+				return report, fmt.Errorf("failed to insert %d batches of history from %s", failed, window[0].Format(time.RFC3339))
+			}
+			if err := saveBackfillCheckpoint(opts, window[1]); err != nil {
+				return report, err
+			}
+
+			log.Info().
+				Time("from", window[0]).
+				Time("to", window[1]).
+				Int("state_changes", len(events)).
+				Msg("backfilled history")
+		}
+	}
+
+	return report, nil
+}
+
+// errWindowNotRead is the error of windows of history whose read was canceled or panicked
+var errWindowNotRead = errors.New("window of history was not read")
+
+// minTime returns the earlier of two times
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// requestLimiter spaces requests evenly at a rate per second. A nil limiter does not limit requests.
+type requestLimiter struct {
+	clock    clock.Clock
+	interval time.Duration
+
+	mtx  sync.Mutex
+	next time.Time
+}
+
+// newRequestLimiter creates a limiter of requests per second, nil if the rate is 0
+func newRequestLimiter(clk clock.Clock, rate float64) *requestLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &requestLimiter{clock: clk, interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait waits until the next request is allowed
+func (l *requestLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mtx.Lock()
+	now := l.clock.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mtx.Unlock()
+
+	if !at.After(now) {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.clock.After(at.Sub(now)):
+		return nil
+	}
+}
+
+// backfillEntities returns the IDs of the current entities matching any of the patterns and owned by the shard
+func (p *Pipeline) backfillEntities(ctx context.Context, patterns []string) ([]string, error) {
+	states, err := p.source.GetStates(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get entities: %w", err)
+	}
+
+	var entityIDs []string
+	for _, state := range states {
+		if !p.owns(state.EntityID) || !matchesAny(patterns, state.EntityID) {
+			continue
+		}
+		entityIDs = append(entityIDs, state.EntityID)
+	}
+	sort.Strings(entityIDs)
+
+	return entityIDs, nil
+}
+
+// matchesAny reports whether a name matches any of the glob patterns, or whether there are no patterns
+func matchesAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// historyStateChanges returns a state change event of every recorded state but the first one of each entity,
+// which is its state at the start of the period and the old state of the next one
+func historyStateChanges(history map[string][]hass.State) []*hass.EventMessage {
+	var events []*hass.EventMessage
+	for _, states := range history {
+		for i := 1; i < len(states); i++ {
+			oldState, newState := states[i-1], states[i]
+			events = append(events, &hass.EventMessage{
+				BaseMessage: hass.BaseMessage{Type: hass.MessageTypeEvent},
+				Event: hass.Event{
+					EventType: hass.EventTypeStateChanged,
+					TimeFired: newState.LastUpdated,
+					Origin:    OriginLocal,
+					Data: hass.EventData{
+						EntityID: newState.EntityID,
+						OldState: &oldState,
+						NewState: &newState,
+					},
+				},
+			})
+		}
+	}
+
+	sortByLastUpdated(events)
+	return events
+}
+
+// insertHistory inserts state changes in batches per table and returns the number of batches that failed
+func (p *Pipeline) insertHistory(ctx context.Context, events []*hass.EventMessage) int {
+	batches := make(map[string][]*hass.EventMessage)
+	var partitions []string
+	for _, event := range events {
+		// Transformers see events in the order they happened, e.g. to compute value deltas
+		p.observe(event)
+
+		partition, err := p.partition(event)
+		if err != nil {
+			log.Warn().Err(err).Str("entity_id", event.Event.Data.EntityID).Msg("failed to route historical state change")
+			continue
+		}
+		if _, ok := batches[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+		batches[partition] = append(batches[partition], event)
+	}
+
+	failed := 0
+	for _, partition := range partitions {
+		batch := batches[partition]
+		for len(batch) > 0 {
+			n := min(len(batch), p.batchSize)
+			if err := p.insertPreparedBatch(ctx, p.prepareBatch(batch[:n])); err != nil {
+				failed++
+			}
+			batch = batch[n:]
+		}
+	}
+
+	return failed
+}
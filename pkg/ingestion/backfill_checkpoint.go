@@ -0,0 +1,65 @@
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// backfillCheckpoint is the progress of a backfill stored in its checkpoint file
+type backfillCheckpoint struct {
+	From     time.Time `json:"from"`
+	Entities []string  `json:"entities"`
+	// Done is the end of the last inserted window
+	Done time.Time `json:"done"`
+}
+
+// loadBackfillCheckpoint reads the checkpoint of a backfill, nil if it has none yet. The checkpoint of a backfill
+// of another period or other entities is an error, so a wrong file does not skip history. The end of the period
+// is not compared, as it defaults to the time the backfill is started.
+func loadBackfillCheckpoint(opts BackfillOptions) (*backfillCheckpoint, error) {
+	if opts.Checkpoint == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(opts.Checkpoint)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backfill checkpoint: %w", err)
+	}
+
+	var checkpoint backfillCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse backfill checkpoint %s: %w", opts.Checkpoint, err)
+	}
+	if !checkpoint.From.Equal(opts.From) || !slices.Equal(checkpoint.Entities, opts.Entities) {
+		return nil, fmt.Errorf("backfill checkpoint %s is of a backfill from %s of entities %v, remove it to start over",
+			opts.Checkpoint, checkpoint.From.Format(time.RFC3339), checkpoint.Entities)
+	}
+
+	return &checkpoint, nil
+}
+
+// saveBackfillCheckpoint stores the end of the last inserted window of a backfill. The file is replaced atomically
+// and synced, so a crash leaves either the previous checkpoint or the new one.
+func saveBackfillCheckpoint(opts BackfillOptions, done time.Time) error {
+	if opts.Checkpoint == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(backfillCheckpoint{From: opts.From, Entities: opts.Entities, Done: done})
+	if err != nil {
+		return err
+	}
+
+	if err := replaceFileSync(opts.Checkpoint, data); err != nil {
+		return fmt.Errorf("failed to write backfill checkpoint: %w", err)
+	}
+	return nil
+}
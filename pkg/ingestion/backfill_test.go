@@ -0,0 +1,235 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+// historySource serves the current states and the history of entities in the window their last state is in,
+// failing to read windows starting at or after failFrom if it is set
+type historySource struct {
+	Source
+	states   []hass.State
+	history  map[string][]hass.State
+	failFrom time.Time
+
+	mtx     sync.Mutex
+	windows [][2]time.Time
+}
+
+func (s *historySource) GetStates(context.Context) ([]hass.State, error) {
+	return s.states, nil
+}
+
+func (s *historySource) HistoryDuringPeriod(_ context.Context, start, end time.Time, _ []string) (map[string][]hass.State, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.windows = append(s.windows, [2]time.Time{start, end})
+	if !s.failFrom.IsZero() && !start.Before(s.failFrom) {
+		return nil, errors.New("connection lost")
+	}
+
+	history := make(map[string][]hass.State)
+	for entityID, states := range s.history {
+		if last := states[len(states)-1].LastUpdated; !last.Before(start) && last.Before(end) {
+			history[entityID] = states
+		}
+	}
+	return history, nil
+}
+
+func TestPipeline_Backfill(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	source := &historySource{
+		states: []hass.State{{EntityID: "light.kitchen"}, {EntityID: "switch.fan"}},
+		history: map[string][]hass.State{
+			"light.kitchen": {
+				{EntityID: "light.kitchen", State: "off", LastUpdated: from},
+				{EntityID: "light.kitchen", State: "on", LastUpdated: from.Add(10 * time.Minute)},
+				{EntityID: "light.kitchen", State: "off", LastUpdated: from.Add(20 * time.Minute)},
+			},
+		},
+	}
+	sink := &outageSink{}
+
+	p := NewPipeline(source, sink, "hass", WithoutDDL())
+	report, err := p.Backfill(context.Background(), BackfillOptions{
+		From:     from,
+		To:       from.Add(90 * time.Minute),
+		Entities: []string{"light.*"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, &BackfillReport{Entities: 1, Windows: 2, StateChanges: 2}, report)
+	assert.Equal(t, [][2]time.Time{
+		{from, from.Add(time.Hour)},
+		{from.Add(time.Hour), from.Add(90 * time.Minute)},
+	}, source.windows)
+
+	// The first state of the period is only the old state of the next one
+	require.Len(t, sink.inserted, 1)
+	rows := strings.Split(sink.inserted[0], "\n")
+	require.Len(t, rows, 2)
+	assert.Contains(t, rows[0], `"state":"on","old_state":"off"`)
+	assert.Contains(t, rows[1], `"state":"off","old_state":"on"`)
+}
+
+func TestPipeline_BackfillInvalidPeriod(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewPipeline(&historySource{}, nil, "hass")
+
+	_, err := p.Backfill(context.Background(), BackfillOptions{From: from, To: from})
+	assert.Error(t, err)
+}
+
+func TestPipeline_BackfillConcurrency(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	toggle := func(entityID string, at time.Time) []hass.State {
+		return []hass.State{
+			{EntityID: entityID, State: "off", LastUpdated: at},
+			{EntityID: entityID, State: "on", LastUpdated: at.Add(time.Minute)},
+		}
+	}
+	source := &historySource{
+		states: []hass.State{{EntityID: "light.kitchen"}, {EntityID: "light.hall"}},
+		history: map[string][]hass.State{
+			"light.kitchen": toggle("light.kitchen", from),
+			"light.hall":    toggle("light.hall", from.Add(2*time.Hour)),
+		},
+	}
+	sink := &outageSink{}
+
+	p := NewPipeline(source, sink, "hass", WithoutDDL())
+	report, err := p.Backfill(context.Background(), BackfillOptions{From: from, To: from.Add(4 * time.Hour), Concurrency: 3})
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Windows)
+
+	sort.Slice(source.windows, func(i, j int) bool { return source.windows[i][0].Before(source.windows[j][0]) })
+	assert.Equal(t, [][2]time.Time{
+		{from, from.Add(time.Hour)},
+		{from.Add(time.Hour), from.Add(2 * time.Hour)},
+		{from.Add(2 * time.Hour), from.Add(3 * time.Hour)},
+		{from.Add(3 * time.Hour), from.Add(4 * time.Hour)},
+	}, source.windows)
+
+	// Windows read at the same time are inserted in order
+	require.Len(t, sink.inserted, 2)
+	assert.Contains(t, sink.inserted[0], "light.kitchen")
+	assert.Contains(t, sink.inserted[1], "light.hall")
+}
+
+func TestPipeline_BackfillCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	checkpoint := filepath.Join(t.TempDir(), "backfill.json")
+	opts := BackfillOptions{From: from, To: from.Add(3 * time.Hour), Entities: []string{"light.*"}, Checkpoint: checkpoint}
+
+	// The backfill is interrupted after the first window
+	source := &historySource{states: []hass.State{{EntityID: "light.kitchen"}}, failFrom: from.Add(time.Hour)}
+	report, err := NewPipeline(source, &outageSink{}, "hass", WithoutDDL()).Backfill(ctx, opts)
+	require.Error(t, err)
+	assert.Equal(t, 1, report.Windows)
+
+	// It resumes after the last inserted window
+	source = &historySource{states: []hass.State{{EntityID: "light.kitchen"}}}
+	report, err = NewPipeline(source, &outageSink{}, "hass", WithoutDDL()).Backfill(ctx, opts)
+	require.NoError(t, err)
+	require.NotNil(t, report.ResumedFrom)
+	assert.Equal(t, from.Add(time.Hour), *report.ResumedFrom)
+	assert.Equal(t, [][2]time.Time{
+		{from.Add(time.Hour), from.Add(2 * time.Hour)},
+		{from.Add(2 * time.Hour), from.Add(3 * time.Hour)},
+	}, source.windows)
+
+	// The checkpoint of another backfill is not resumed from
+	opts.Entities = []string{"switch.*"}
+	_, err = NewPipeline(source, &outageSink{}, "hass", WithoutDDL()).Backfill(ctx, opts)
+	assert.ErrorContains(t, err, "remove it to start over")
+}
+
+// outageAfterSink goes down after a number of inserts, unless it is negative
+type outageAfterSink struct {
+	outageSink
+	inserts int
+}
+
+func (s *outageAfterSink) Execute(ctx context.Context, query string, body io.ReadSeeker, opts ...clickhouse.QueryOption) error {
+	s.down = s.inserts >= 0 && body != nil && len(s.inserted) >= s.inserts
+	return s.outageSink.Execute(ctx, query, body, opts...)
+}
+
+func TestPipeline_BackfillCheckpointFailedInsert(t *testing.T) {
+	ctx := context.Background()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	checkpoint := filepath.Join(t.TempDir(), "backfill.json")
+	opts := BackfillOptions{From: from, To: from.Add(3 * time.Hour), Checkpoint: checkpoint}
+	source := &historySource{
+		states: []hass.State{{EntityID: "light.kitchen"}, {EntityID: "switch.fan"}},
+		history: map[string][]hass.State{
+			"light.kitchen": {
+				{EntityID: "light.kitchen", State: "off", LastUpdated: from},
+				{EntityID: "light.kitchen", State: "on", LastUpdated: from.Add(10 * time.Minute)},
+			},
+			"switch.fan": {
+				{EntityID: "switch.fan", State: "off", LastUpdated: from.Add(time.Hour)},
+				{EntityID: "switch.fan", State: "on", LastUpdated: from.Add(70 * time.Minute)},
+			},
+		},
+	}
+
+	// ClickHouse goes down after the first window is inserted, which stops the backfill at the second one
+	sink := &outageAfterSink{inserts: 1}
+	report, err := NewPipeline(source, sink, "hass", WithoutDDL()).Backfill(ctx, opts)
+	require.ErrorContains(t, err, "failed to insert 1 batches of history")
+	assert.Equal(t, 2, report.Windows)
+	assert.Equal(t, 1, report.FailedBatches)
+
+	// The resumed backfill inserts the failed window again
+	sink.inserts = -1
+	source.windows = nil
+	report, err = NewPipeline(source, sink, "hass", WithoutDDL()).Backfill(ctx, opts)
+	require.NoError(t, err)
+	require.NotNil(t, report.ResumedFrom)
+	assert.Equal(t, from.Add(time.Hour), *report.ResumedFrom)
+	assert.Len(t, source.windows, 2)
+	assert.Equal(t, 1, report.StateChanges)
+}
+
+func TestRequestLimiter(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	limiter := newRequestLimiter(clk, 2)
+
+	// The first request is not delayed, the next one waits for the interval of the rate
+	require.NoError(t, limiter.wait(ctx))
+	done := make(chan error)
+	go func() {
+		done <- limiter.wait(ctx)
+	}()
+	clk.BlockUntil(1)
+	select {
+	case <-done:
+		t.Fatal("request has not been delayed")
+	default:
+	}
+	clk.Advance(500 * time.Millisecond)
+	require.NoError(t, <-done)
+
+	// Without a rate, requests are not limited
+	assert.Nil(t, newRequestLimiter(clk, 0))
+	assert.NoError(t, (*requestLimiter)(nil).wait(ctx))
+}
@@ -0,0 +1,144 @@
+package ingestion
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// Pauser is optionally implemented by a Source able to stop delivering events for a while, e.g. *hass.Client.
+// Events fired while paused are not delivered.
+type Pauser interface {
+	PauseSubscriptions(ctx context.Context) error
+	ResumeSubscriptions(ctx context.Context) error
+}
+
+// backpressureCheckInterval is how often the events in flight are compared to the water marks
+const backpressureCheckInterval = time.Second
+
+// WithBackpressure pauses the subscriptions of the source while more than highWater events are in flight,
+// e.g. during a long ClickHouse outage, so Home Assistant does not drop a connection that is not read anymore.
+// Once no more than lowWater events are in flight, subscriptions are resumed and state changes during the pause
+// are inserted from a snapshot of the states, one per entity. The source must implement Pauser.
+func WithBackpressure(highWater, lowWater int) PipelineOption {
+	return func(p *Pipeline) {
+		p.backpressure = &backpressure{highWater: highWater, lowWater: lowWater}
+	}
+}
+
+type backpressure struct {
+	highWater int
+	lowWater  int
+
+	paused bool
+	// states are the states of entities when subscriptions were paused, nil if they failed to be fetched
+	states map[string]hass.State
+}
+
+// watchBackpressure pauses and resumes the subscriptions of the source until the context is done.
+// State changes of the snapshot taken on resume are sent to the snapshots channel.
+func (p *Pipeline) watchBackpressure(ctx context.Context, pauser Pauser, snapshots chan<- *hass.EventMessage) {
+	ticker := p.clock.NewTicker(backpressureCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			for _, event := range p.checkBackpressure(ctx, pauser) {
+				select {
+				case snapshots <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// checkBackpressure pauses or resumes the subscriptions of the source depending on the events in flight.
+// It returns the state changes missed while paused after a resume.
+func (p *Pipeline) checkBackpressure(ctx context.Context, pauser Pauser) []*hass.EventMessage {
+	bp := p.backpressure
+	inFlight := p.Stats().EventsInFlight
+
+	switch {
+	case !bp.paused && inFlight > int64(bp.highWater):
+		log.Warn().Int64("events_in_flight", inFlight).Int("high_water", bp.highWater).Msg("too many events in flight, pausing subscriptions")
+		if err := pauser.PauseSubscriptions(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to pause subscriptions")
+		}
+		bp.paused = true
+		metrics.BackpressurePauses.Inc()
+
+		// The states are fetched once paused, the connection is not read while events are not consumed
+		bp.states = nil
+		states, err := p.source.GetStates(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get states on pause, state changes during the pause are not inserted")
+			return nil
+		}
+		bp.states = make(map[string]hass.State, len(states))
+		for _, state := range states {
+			bp.states[state.EntityID] = state
+		}
+		return nil
+	case bp.paused && inFlight <= int64(bp.lowWater):
+		log.Info().Int64("events_in_flight", inFlight).Int("low_water", bp.lowWater).Msg("events in flight dropped below the low-water mark, resuming subscriptions")
+		if err := pauser.ResumeSubscriptions(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to resume subscriptions")
+			return nil
+		}
+		bp.paused = false
+
+		if bp.states == nil {
+			return nil
+		}
+		states, err := p.source.GetStates(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to get states on resume, state changes during the pause are not inserted")
+			return nil
+		}
+		events := stateChangesSince(bp.states, states)
+		bp.states = nil
+		metrics.BackpressureSnapshotEvents.Add(float64(len(events)))
+		return events
+	}
+
+	return nil
+}
+
+// stateChangesSince returns a state change event of every entity updated since the old states.
+// Entities without an old state are skipped, their state changes cannot be stored without one.
+func stateChangesSince(old map[string]hass.State, states []hass.State) []*hass.EventMessage {
+	var events []*hass.EventMessage
+	for _, state := range states {
+		oldState, ok := old[state.EntityID]
+		if !ok || !state.LastUpdated.After(oldState.LastUpdated) {
+			continue
+		}
+
+		newState := state
+		events = append(events, &hass.EventMessage{
+			BaseMessage: hass.BaseMessage{Type: hass.MessageTypeEvent},
+			Event: hass.Event{
+				EventType: hass.EventTypeStateChanged,
+				TimeFired: newState.LastUpdated,
+				Origin:    OriginLocal,
+				Context:   newState.Context,
+				Data: hass.EventData{
+					EntityID: newState.EntityID,
+					OldState: &oldState,
+					NewState: &newState,
+				},
+			},
+		})
+	}
+
+	return events
+}
@@ -0,0 +1,76 @@
+package ingestion
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+type pauseSource struct {
+	Source
+	states []hass.State
+	paused bool
+}
+
+func (s *pauseSource) GetStates(context.Context) ([]hass.State, error) {
+	return s.states, nil
+}
+
+func (s *pauseSource) PauseSubscriptions(context.Context) error {
+	s.paused = true
+	return nil
+}
+
+func (s *pauseSource) ResumeSubscriptions(context.Context) error {
+	s.paused = false
+	return nil
+}
+
+func TestPipeline_CheckBackpressure(t *testing.T) {
+	ctx := context.Background()
+	pausedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	source := &pauseSource{states: []hass.State{
+		{EntityID: "light.kitchen", State: "off", LastUpdated: pausedAt},
+		{EntityID: "sensor.power", State: "100", LastUpdated: pausedAt},
+	}}
+	p := NewPipeline(source, nil, "hass", WithBackpressure(10, 5))
+
+	p.stats.eventsInFlight(10)
+	assert.Empty(t, p.checkBackpressure(ctx, source))
+	assert.False(t, source.paused, "the high-water mark is not exceeded")
+
+	p.stats.eventsInFlight(1)
+	assert.Empty(t, p.checkBackpressure(ctx, source))
+	assert.True(t, source.paused)
+
+	source.states = []hass.State{
+		{EntityID: "light.kitchen", State: "on", LastUpdated: pausedAt.Add(time.Minute)},
+		{EntityID: "sensor.power", State: "100", LastUpdated: pausedAt},
+		{EntityID: "switch.new", State: "on", LastUpdated: pausedAt.Add(time.Minute)},
+	}
+
+	p.stats.eventsInFlight(-5)
+	assert.Empty(t, p.checkBackpressure(ctx, source))
+	assert.True(t, source.paused, "the low-water mark is not reached")
+
+	p.stats.eventsInFlight(-1)
+	events := p.checkBackpressure(ctx, source)
+	assert.False(t, source.paused)
+
+	// Only entities updated during the pause and known before it get a state change
+	require.Len(t, events, 1)
+	assert.Equal(t, hass.EventTypeStateChanged, events[0].Event.EventType)
+	assert.Equal(t, "light.kitchen", events[0].Event.Data.EntityID)
+	assert.Equal(t, "off", events[0].Event.Data.OldState.State)
+	assert.Equal(t, "on", events[0].Event.Data.NewState.State)
+	assert.Equal(t, pausedAt.Add(time.Minute), events[0].Event.TimeFired)
+
+	insert, err := p.resolveInput(events[0])
+	require.NoError(t, err)
+	assert.Equal(t, "light", insert.TableName)
+}
@@ -0,0 +1,350 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// Kinds of tables in the catalog
+const (
+	TableKindStateChanges     = "state_changes"
+	TableKindOverflow         = "overflow"
+	TableKindAttributeChanges = "attribute_changes"
+	TableKindDeadLetter       = "dead_letter"
+	TableKindHeartbeats       = "heartbeats"
+	TableKindInsertStats      = "insert_stats"
+	TableKindRestarts         = "restarts"
+	TableKindEvents           = "events"
+	TableKindStatistics       = "statistics"
+	TableKindEntities         = "entities"
+	TableKindGaps             = "gaps"
+	TableKindStateLabels      = "state_labels"
+	TableKindAvailability     = "availability"
+)
+
+// stateChangeDomains are the domains with a dedicated state type, see resolveStateChangeType.
+// Entities of other domains are stored in tables of the same schema with a String state.
+var stateChangeDomains = []string{
+	hass.EntitySwitch, hass.EntityLight, hass.EntitySensor, hass.EntityBinarySensor, hass.EntityInputBoolean,
+	hass.EntityBooleanSensor, hass.EntityAutomation, hass.EntityScene, hass.EntityScript, hass.EntitySun,
+	hass.EntityDeviceTracker, hass.EntityPerson, hass.EntityZone, hass.EntityWeather, hass.EntityClimate,
+	hass.EntityNumericSensor, hass.EntityNumber, hass.EntityInputNumber, hass.EntityCounter,
+	hass.EntityInputDateTime, hass.EntityTimer, hass.EntityImage,
+}
+
+// catalogDomains returns the domains whose state change tables are listed in the catalog: the domains with
+// a dedicated state type, the ones with enumerated states, see WithStateEnums, and the ones with attribute
+// columns, see WithAttributeColumns
+func (p *Pipeline) catalogDomains() []string {
+	domains := slices.Clip(stateChangeDomains)
+	for _, domain := range EnumDomains() {
+		if _, ok := p.stateEnums[domain]; ok && !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	attributeDomains := make([]string, 0, len(p.attributeColumns))
+	for domain := range p.attributeColumns {
+		if !slices.Contains(domains, domain) {
+			attributeDomains = append(attributeDomains, domain)
+		}
+	}
+	slices.Sort(attributeDomains)
+	return append(domains, attributeDomains...)
+}
+
+// columnSources are the fields of Home Assistant state_changed events the columns are populated from
+var columnSources = map[string]string{
+	"entity_id":         "new_state.entity_id",
+	"domain":            "new_state.entity_id",
+	"state":             "new_state.state",
+	"old_state":         "old_state.state",
+	"attributes":        "new_state.attributes",
+	"context":           "new_state.context",
+	"context_id":        "new_state.context.id",
+	"context_parent_id": "new_state.context.parent_id",
+	"context_user_id":   "new_state.context.user_id",
+	"last_changed":      "new_state.last_changed",
+	"last_updated":      "new_state.last_updated",
+	"last_reported":     "new_state.last_reported",
+	"changed_keys":      "new_state.attributes",
+	"old_values":        "old_state.attributes",
+	"new_values":        "new_state.attributes",
+}
+
+// Catalog describes the tables written by the pipeline
+type Catalog struct {
+	Tables []*CatalogTable `json:"tables"`
+}
+
+// CatalogTable is a table the pipeline would generate, or one that exists in ClickHouse already
+type CatalogTable struct {
+	Database string `json:"database"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Domain   string `json:"domain,omitempty"`
+	RowModel string `json:"row_model,omitempty"`
+
+	// Generated is set for tables the pipeline creates, Exists for tables found in ClickHouse
+	Generated bool `json:"generated"`
+	Exists    bool `json:"exists"`
+
+	Columns []CatalogColumn `json:"columns"`
+	// Attributes are the attribute keys found in a sample of the rows, see Pipeline.SampleAttributes
+	Attributes []string `json:"attributes,omitempty"`
+
+	// definitions are the definitions of the generated columns by name
+	definitions map[string]string
+}
+
+// CatalogColumn is a column of a catalog table
+type CatalogColumn struct {
+	Name string `json:"name"`
+	// Type is the type the pipeline creates the column with
+	Type string `json:"type,omitempty"`
+	// ExistingType is the type of the column in ClickHouse, empty if the column does not exist
+	ExistingType string `json:"existing_type,omitempty"`
+	// Source is the field of the Home Assistant event the column is populated from, empty for derived columns
+	Source string `json:"source,omitempty"`
+}
+
+// Catalog returns the tables and columns the pipeline would generate, merged with the ones existing
+// in ClickHouse if the sink can run queries
+func (p *Pipeline) Catalog(ctx context.Context) (*Catalog, error) {
+	catalog := &Catalog{}
+	tables := make(map[string]*CatalogTable)
+	add := func(table *CatalogTable, ddl string, extraColumns []string) {
+		columns := append(parseDDLColumns(ddl), extraColumns...)
+		table.definitions = make(map[string]string, len(columns))
+		for _, column := range columns {
+			name, columnType := parseColumnDefinition(column)
+			table.Columns = append(table.Columns, CatalogColumn{Name: name, Type: columnType, Source: columnSources[name]})
+			table.definitions[name] = column
+		}
+		table.Generated = true
+		catalog.Tables = append(catalog.Tables, table)
+		tables[table.Database+"."+table.Name] = table
+	}
+
+	for _, domain := range p.catalogDomains() {
+		database := p.databaseFor(domain)
+		for _, model := range p.rowModels {
+			tableName := model.tableName(domain)
+			ddl, err := p.stateChangeDDL(model, database, tableName, domain, p.stateTypeOf(domain))
+			if err != nil {
+				return nil, err
+			}
+			add(&CatalogTable{
+				Database: database,
+				Name:     tableName,
+				Kind:     TableKindStateChanges,
+				Domain:   domain,
+				RowModel: string(model),
+			}, ddl, p.columns(domain))
+		}
+	}
+
+	overrideTables := make([]string, 0, len(p.tableOverrides))
+	for table := range p.tableOverrides {
+		overrideTables = append(overrideTables, table)
+	}
+	sort.Strings(overrideTables)
+	for _, table := range overrideTables {
+		database := p.databaseFor(table)
+		for _, model := range p.rowModels {
+			tableName := model.tableName(table)
+			ddl, err := p.stateChangeDDL(model, database, tableName, table, p.stateTypeOf(table))
+			if err != nil {
+				return nil, err
+			}
+			add(&CatalogTable{
+				Database: database,
+				Name:     tableName,
+				Kind:     TableKindStateChanges,
+				RowModel: string(model),
+			}, ddl, p.tableColumns(table))
+		}
+	}
+
+	if p.attributeChanges {
+		database := p.databaseFor(attributeChangesTableName)
+		add(&CatalogTable{Database: database, Name: attributeChangesTableName, Kind: TableKindAttributeChanges},
+			fmt.Sprintf(attributeChangesDDL, database, attributeChangesTableName), p.labelColumns())
+	}
+	if p.availability {
+		database := p.databaseFor(availabilityTableName)
+		add(&CatalogTable{Database: database, Name: availabilityTableName, Kind: TableKindAvailability},
+			fmt.Sprintf(availabilityDDL, database, availabilityTableName), p.labelColumns())
+	}
+	if p.strict && p.deadLetterDir == "" {
+		database := p.databaseFor(deadLetterTableName)
+		add(&CatalogTable{Database: database, Name: deadLetterTableName, Kind: TableKindDeadLetter},
+			fmt.Sprintf(deadLetterDDL, database, deadLetterTableName), p.labelColumns())
+	}
+	if p.heartbeats != nil {
+		database := p.databaseFor(heartbeatsTableName)
+		add(&CatalogTable{Database: database, Name: heartbeatsTableName, Kind: TableKindHeartbeats},
+			fmt.Sprintf(heartbeatsDDL, database, heartbeatsTableName), p.labelColumns())
+	}
+	if p.insertStats != nil {
+		database := p.databaseFor(insertStatsTableName)
+		add(&CatalogTable{Database: database, Name: insertStatsTableName, Kind: TableKindInsertStats},
+			fmt.Sprintf(insertStatsDDL, database, insertStatsTableName), p.labelColumns())
+	}
+	if p.restartLog {
+		database := p.databaseFor(restartsTableName)
+		add(&CatalogTable{Database: database, Name: restartsTableName, Kind: TableKindRestarts},
+			fmt.Sprintf(restartsDDL, database, restartsTableName), p.labelColumns())
+	}
+	if p.statistics != nil {
+		database := p.databaseFor(statisticsTableName)
+		add(&CatalogTable{Database: database, Name: statisticsTableName, Kind: TableKindStatistics},
+			fmt.Sprintf(statisticsDDL, database, statisticsTableName), p.labelColumns())
+	}
+	if p.entityMetadata != nil {
+		database := p.databaseFor(entitiesTableName)
+		add(&CatalogTable{Database: database, Name: entitiesTableName, Kind: TableKindEntities},
+			fmt.Sprintf(entitiesDDL, database, entitiesTableName), p.labelColumns())
+	}
+	if len(p.stateEnums) > 0 {
+		database := p.databaseFor(stateLabelsTableName)
+		add(&CatalogTable{Database: database, Name: stateLabelsTableName, Kind: TableKindStateLabels},
+			fmt.Sprintf(stateLabelsDDL, database, stateLabelsTableName), p.labelColumns())
+	}
+	if p.gapBackfill {
+		database := p.databaseFor(gapsTableName)
+		add(&CatalogTable{Database: database, Name: gapsTableName, Kind: TableKindGaps},
+			fmt.Sprintf(gapsDDL, database, gapsTableName), p.labelColumns())
+	}
+	for _, eventType := range p.eventTypes {
+		tableName := eventTableName(eventType)
+		database := p.databaseFor(tableName)
+		add(&CatalogTable{Database: database, Name: tableName, Kind: TableKindEvents},
+			fmt.Sprintf(eventDDL(eventType), database, tableName), p.labelColumns())
+	}
+
+	q, ok := p.sink.(querier)
+	if !ok {
+		return catalog, nil
+	}
+
+	// Overflow tables are only created on demand, so they are listed if they exist
+	for _, database := range p.databases() {
+		query := fmt.Sprintf("SELECT table, name, type FROM system.columns WHERE database = %s ORDER BY table, position",
+			clickhouse.QuoteString(database))
+		err := q.Query(ctx, query, func(raw json.RawMessage) error {
+			var row struct {
+				Table string `json:"table"`
+				Name  string `json:"name"`
+				Type  string `json:"type"`
+			}
+			if err := json.Unmarshal(raw, &row); err != nil {
+				return err
+			}
+
+			key := database + "." + row.Table
+			table, ok := tables[key]
+			if !ok {
+				if !strings.HasSuffix(row.Table, overflowTableSuffix) {
+					return nil
+				}
+				parent, ok := tables[database+"."+strings.TrimSuffix(row.Table, overflowTableSuffix)]
+				if !ok {
+					return nil
+				}
+				table = &CatalogTable{Database: database, Name: row.Table, Kind: TableKindOverflow, Domain: parent.Domain, RowModel: parent.RowModel}
+				catalog.Tables = append(catalog.Tables, table)
+				tables[key] = table
+			}
+
+			table.Exists = true
+			for i := range table.Columns {
+				if table.Columns[i].Name == row.Name {
+					table.Columns[i].ExistingType = row.Type
+					return nil
+				}
+			}
+			table.Columns = append(table.Columns, CatalogColumn{Name: row.Name, ExistingType: row.Type, Source: columnSources[row.Name]})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query columns of database %s: %w", database, err)
+		}
+	}
+
+	return catalog, nil
+}
+
+// parseDDLColumns returns the column definitions of a CREATE TABLE statement
+func parseDDLColumns(ddl string) []string {
+	start := strings.Index(ddl, "(")
+	if start < 0 {
+		return nil
+	}
+
+	var columns []string
+	appendColumn := func(definition string) {
+		definition = strings.TrimSpace(definition)
+		keyword, _, _ := strings.Cut(definition, " ")
+		switch strings.ToUpper(keyword) {
+		case "", "INDEX", "PROJECTION", "CONSTRAINT", "PRIMARY":
+		default:
+			columns = append(columns, definition)
+		}
+	}
+
+	depth, from := 0, start+1
+	for i := start + 1; i < len(ddl); i++ {
+		switch ddl[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				appendColumn(ddl[from:i])
+				return columns
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				appendColumn(ddl[from:i])
+				from = i + 1
+			}
+		}
+	}
+
+	return columns
+}
+
+// parseColumnDefinition splits a column definition, e.g. "is_late Bool DEFAULT false", into its name and type
+func parseColumnDefinition(definition string) (string, string) {
+	name, rest, _ := strings.Cut(strings.TrimSpace(definition), " ")
+	name = strings.Trim(name, "`")
+
+	depth := 0
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ' ':
+			if depth > 0 {
+				continue
+			}
+			keyword, _, _ := strings.Cut(rest[i+1:], " ")
+			switch strings.ToUpper(strings.SplitN(keyword, "(", 2)[0]) {
+			case "DEFAULT", "MATERIALIZED", "ALIAS", "EPHEMERAL", "CODEC", "COMMENT", "TTL", "NULL", "NOT":
+				return name, strings.TrimSpace(rest[:i])
+			}
+		}
+	}
+
+	return name, strings.TrimSpace(rest)
+}
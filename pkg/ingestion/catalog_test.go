@@ -0,0 +1,48 @@
+package ingestion
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDDLColumns(t *testing.T) {
+	ddl, err := NewPipeline(nil, nil, "hass").stateChangeDDL(RowModelV1, "hass", "light", "light", "Bool")
+	require.NoError(t, err)
+
+	columns := parseDDLColumns(ddl)
+	require.Len(t, columns, 9)
+	assert.Equal(t, "entity_id LowCardinality(String)", columns[0])
+	assert.Equal(t, "received_at DateTime64(3, 'UTC') DEFAULT now64(3)", columns[8])
+
+	name, columnType := parseColumnDefinition(columns[8])
+	assert.Equal(t, "received_at", name)
+	assert.Equal(t, "DateTime64(3, 'UTC')", columnType)
+
+	name, columnType = parseColumnDefinition("`site` LowCardinality(String)")
+	assert.Equal(t, "site", name)
+	assert.Equal(t, "LowCardinality(String)", columnType)
+}
+
+func TestPipeline_Catalog(t *testing.T) {
+	p := NewPipeline(nil, nil, "hass", WithLabels([]Label{{Name: "site", Value: "cabin"}}), WithStrictMode())
+
+	catalog, err := p.Catalog(context.Background())
+	require.NoError(t, err)
+
+	tables := make(map[string]*CatalogTable)
+	for _, table := range catalog.Tables {
+		tables[table.Name] = table
+	}
+
+	light := tables["light"]
+	require.NotNil(t, light)
+	assert.Equal(t, TableKindStateChanges, light.Kind)
+	assert.Contains(t, light.Columns, CatalogColumn{Name: "state", Type: "LowCardinality(String)", Source: "new_state.state"})
+	assert.Contains(t, light.Columns, CatalogColumn{Name: "site", Type: "LowCardinality(String)"})
+
+	require.NotNil(t, tables["dead_letter"])
+	assert.Nil(t, tables["heartbeats"], "disabled")
+}
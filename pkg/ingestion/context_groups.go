@@ -0,0 +1,167 @@
+package ingestion
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+)
+
+const contextBatchIDColumn = "context_batch_id String DEFAULT ''"
+
+// WithContextGrouping holds the state changes sharing a context, e.g. the entities touched by one run of an
+// automation, for window after the first of them and releases them together, so they are inserted in the same
+// batch of every table. Their rows get the same context_batch_id, so the effects of a run can be reconstructed
+// across tables. State changes without a context are not held.
+func WithContextGrouping(window time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		if window <= 0 {
+			return
+		}
+		p.contextGroups = newContextGrouper(window)
+		p.transformers = append(p.transformers, p.contextGroups)
+	}
+}
+
+// contextGroup is a group of state changes sharing a context, held until its deadline
+type contextGroup struct {
+	id       string
+	deadline time.Time
+	events   []*hass.EventMessage
+}
+
+// contextGrouper holds state changes by context and stamps released ones with the ID of their group
+type contextGrouper struct {
+	window time.Duration
+
+	mtx sync.Mutex
+	// groups are the held groups by context ID, pending the same groups in the order they started
+	groups  map[string]*contextGroup
+	pending []*contextGroup
+	stamped map[*hass.EventMessage]string
+}
+
+func newContextGrouper(window time.Duration) *contextGrouper {
+	return &contextGrouper{
+		window:  window,
+		groups:  make(map[string]*contextGroup),
+		stamped: make(map[*hass.EventMessage]string),
+	}
+}
+
+// hold adds a state change to the group of its context and reports whether it is held
+func (g *contextGrouper) hold(event *hass.EventMessage, now time.Time) bool {
+	contextID := contextIDOf(event)
+	if contextID == "" {
+		return false
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	group, ok := g.groups[contextID]
+	if !ok {
+		group = &contextGroup{id: newBatchID(), deadline: now.Add(g.window)}
+		g.groups[contextID] = group
+		g.pending = append(g.pending, group)
+	}
+	group.events = append(group.events, event)
+	return true
+}
+
+// release returns the state changes of the groups whose deadline has passed, group by group in the order
+// the groups started. A state change of a context arriving after its group was released starts a new group.
+func (g *contextGrouper) release(now time.Time) []*hass.EventMessage {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	var events []*hass.EventMessage
+	released := 0
+	for _, group := range g.pending {
+		if now.Before(group.deadline) {
+			break
+		}
+		released++
+
+		delete(g.groups, contextIDOf(group.events[0]))
+		for _, event := range group.events {
+			g.stamped[event] = group.id
+		}
+		events = append(events, group.events...)
+		metrics.ContextGroupSize.Observe(float64(len(group.events)))
+	}
+	g.pending = g.pending[released:]
+
+	return events
+}
+
+func (g *contextGrouper) Columns(string) []string {
+	return []string{contextBatchIDColumn}
+}
+
+func (g *contextGrouper) Transform(event *hass.EventMessage, change *StateChange) {
+	g.mtx.Lock()
+	id, ok := g.stamped[event]
+	delete(g.stamped, event)
+	g.mtx.Unlock()
+
+	if ok {
+		change.ContextBatchID = id
+	}
+}
+
+// groupContexts holds the state changes of in by context and sends them to the returned channel group by group.
+// Groups still held when in is closed are released at once.
+func (p *Pipeline) groupContexts(ctx context.Context, in chan *hass.EventMessage) chan *hass.EventMessage {
+	out := make(chan *hass.EventMessage)
+	go func() {
+		defer close(out)
+		recovery.Run("pipeline_context_groups", func() {
+			// Groups are released at most a quarter of the window late
+			ticker := p.clock.NewTicker(max(p.contextGroups.window/4, time.Millisecond))
+			defer ticker.Stop()
+
+			send := func(events []*hass.EventMessage) bool {
+				for _, event := range events {
+					select {
+					case out <- event:
+					case <-ctx.Done():
+						return false
+					}
+				}
+				return true
+			}
+
+			for {
+				select {
+				case event, ok := <-in:
+					if !ok {
+						send(p.contextGroups.release(time.Unix(1<<62, 0)))
+						return
+					}
+					if !p.contextGroups.hold(event, p.clock.Now()) && !send([]*hass.EventMessage{event}) {
+						return
+					}
+				case now := <-ticker.C():
+					if !send(p.contextGroups.release(now)) {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}()
+	return out
+}
+
+// contextIDOf returns the ID of the context of a state change, empty if it has none
+func contextIDOf(event *hass.EventMessage) string {
+	if event.Event.Data.NewState == nil {
+		return ""
+	}
+	return event.Event.Data.NewState.Context.ID
+}
@@ -0,0 +1,61 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestContextGrouper(t *testing.T) {
+	grouper := newContextGrouper(time.Second)
+	now := time.Now()
+
+	stateChange := func(entityID, contextID string) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{Data: hass.EventData{
+			EntityID: entityID,
+			NewState: &hass.State{EntityID: entityID, State: "on", Context: hass.EventContext{ID: contextID}},
+		}}}
+	}
+
+	kitchen, hall, door := stateChange("light.kitchen", "run1"), stateChange("light.hall", "run1"), stateChange("lock.door", "run2")
+	assert.True(t, grouper.hold(kitchen, now))
+	assert.True(t, grouper.hold(door, now.Add(500*time.Millisecond)))
+	assert.True(t, grouper.hold(hall, now.Add(600*time.Millisecond)))
+	// State changes without a context are not held
+	assert.False(t, grouper.hold(stateChange("sensor.power", ""), now))
+
+	assert.Empty(t, grouper.release(now.Add(900*time.Millisecond)))
+	// Groups are released with all their state changes once their window has passed
+	require.Equal(t, []*hass.EventMessage{kitchen, hall}, grouper.release(now.Add(time.Second)))
+	require.Equal(t, []*hass.EventMessage{door}, grouper.release(now.Add(2*time.Second)))
+
+	kitchenChange, hallChange, doorChange := &StateChange{}, &StateChange{}, &StateChange{}
+	grouper.Transform(kitchen, kitchenChange)
+	grouper.Transform(hall, hallChange)
+	grouper.Transform(door, doorChange)
+	assert.NotEmpty(t, kitchenChange.ContextBatchID)
+	assert.Equal(t, kitchenChange.ContextBatchID, hallChange.ContextBatchID)
+	assert.NotEqual(t, kitchenChange.ContextBatchID, doorChange.ContextBatchID)
+	assert.Empty(t, grouper.stamped)
+
+	// A late state change of a released context starts a new group
+	late := stateChange("light.porch", "run1")
+	assert.True(t, grouper.hold(late, now.Add(3*time.Second)))
+	require.Equal(t, []*hass.EventMessage{late}, grouper.release(now.Add(4*time.Second)))
+	lateChange := &StateChange{}
+	grouper.Transform(late, lateChange)
+	assert.NotEqual(t, kitchenChange.ContextBatchID, lateChange.ContextBatchID)
+}
+
+func TestPipeline_ContextGroupingColumn(t *testing.T) {
+	p := NewPipeline(nil, nil, "hass", WithContextGrouping(time.Second))
+	assert.Contains(t, p.tableColumns("light"), contextBatchIDColumn)
+
+	// A zero window disables grouping
+	p = NewPipeline(nil, nil, "hass", WithContextGrouping(0))
+	assert.Nil(t, p.contextGroups)
+}
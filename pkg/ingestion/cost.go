@@ -0,0 +1,278 @@
+package ingestion
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+const (
+	deviceClassEnergy = "energy"
+
+	costColumn = "cost Nullable(Float64)"
+
+	// priceHistoryRetention is how long price entity changes are kept to price late energy events
+	priceHistoryRetention = 24 * time.Hour
+)
+
+// CostConfig configures enrichment of energy consumption rows with a computed cost.
+// The price source is resolved in order: PriceEntityID, Schedule, Price.
+type CostConfig struct {
+	// Price is a static price per kWh.
+	Price float64
+
+	// Schedule is a time-of-day price schedule. Each entry is effective from its start time
+	// until the start time of the next entry.
+	Schedule []PriceScheduleEntry
+
+	// Location is the time zone the schedule is evaluated in. Defaults to time.Local.
+	Location *time.Location
+
+	// PriceEntityID is an entity whose state is the current price per kWh.
+	PriceEntityID string
+
+	// EntityIDs is a list of energy entities to enrich.
+	// If empty, all sensors with the energy device class are enriched.
+	EntityIDs []string
+}
+
+// PriceScheduleEntry is a price effective from a given time of day.
+type PriceScheduleEntry struct {
+	Start time.Duration // Offset from midnight
+	Price float64
+}
+
+// ParsePriceSchedule parses a price schedule in the form of "HH:MM=price,HH:MM=price".
+func ParsePriceSchedule(s string) ([]PriceScheduleEntry, error) {
+	var schedule []PriceScheduleEntry
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		start, price, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid price schedule entry %q: expected HH:MM=price", part)
+		}
+
+		t, err := time.Parse("15:04", strings.TrimSpace(start))
+		if err != nil {
+			return nil, fmt.Errorf("invalid price schedule start time %q: %w", start, err)
+		}
+
+		p, err := strconv.ParseFloat(strings.TrimSpace(price), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid price schedule price %q: %w", price, err)
+		}
+
+		schedule = append(schedule, PriceScheduleEntry{
+			Start: time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute,
+			Price: p,
+		})
+	}
+
+	sort.Slice(schedule, func(i, j int) bool {
+		return schedule[i].Start < schedule[j].Start
+	})
+
+	return schedule, nil
+}
+
+// WithCostEnrichment enables computing the cost column for energy consumption rows
+func WithCostEnrichment(conf CostConfig) PipelineOption {
+	return func(p *Pipeline) {
+		if conf.Location == nil {
+			conf.Location = time.Local
+		}
+		p.transformers = append(p.transformers, &costTransformer{conf: conf})
+	}
+}
+
+type pricePoint struct {
+	since time.Time
+	price float64
+}
+
+// costTransformer computes the cost of the energy consumed between the old and the new state
+type costTransformer struct {
+	conf CostConfig
+
+	historyMtx sync.Mutex
+	history    []pricePoint
+}
+
+// stateAttributes are the well-known attributes used to classify entities
+type stateAttributes struct {
+	FriendlyName      string `json:"friendly_name"`
+	DeviceClass       string `json:"device_class"`
+	UnitOfMeasurement string `json:"unit_of_measurement"`
+}
+
+func parseStateAttributes(state *hass.State) stateAttributes {
+	var attrs stateAttributes
+	if len(state.Attributes) > 0 {
+		_ = json.Unmarshal(state.Attributes, &attrs)
+	}
+	return attrs
+}
+
+func (t *costTransformer) stageName() string {
+	return StageCost
+}
+
+func (t *costTransformer) Columns(domain string) []string {
+	if domain != hass.EntityNumericSensor {
+		return nil
+	}
+	return []string{costColumn}
+}
+
+func (t *costTransformer) Seed(states []hass.State) {
+	if t.conf.PriceEntityID == "" {
+		return
+	}
+
+	for i := range states {
+		if states[i].EntityID == t.conf.PriceEntityID {
+			t.observePrice(&states[i])
+			return
+		}
+	}
+
+	log.Warn().Str("entity_id", t.conf.PriceEntityID).Msg("price entity not found, cost will be computed once its state changes")
+}
+
+func (t *costTransformer) Observe(event *hass.EventMessage) {
+	if t.conf.PriceEntityID == "" || event.Event.Data.EntityID != t.conf.PriceEntityID {
+		return
+	}
+
+	if event.Event.Data.NewState != nil {
+		t.observePrice(event.Event.Data.NewState)
+	}
+}
+
+// observePrice records a price entity state in the price history
+func (t *costTransformer) observePrice(state *hass.State) {
+	price, err := strconv.ParseFloat(state.State, 64)
+	if err != nil {
+		log.Debug().Str("entity_id", state.EntityID).Str("state", state.State).Msg("ignoring non-numeric price")
+		return
+	}
+
+	t.historyMtx.Lock()
+	defer t.historyMtx.Unlock()
+
+	point := pricePoint{since: state.LastChanged, price: price}
+	i := sort.Search(len(t.history), func(i int) bool {
+		return t.history[i].since.After(point.since)
+	})
+	t.history = slices.Insert(t.history, i, point)
+
+	// Drop expired points, keeping the last one effective at the retention cutoff
+	cutoff := time.Now().Add(-priceHistoryRetention)
+	expired := sort.Search(len(t.history), func(i int) bool {
+		return t.history[i].since.After(cutoff)
+	})
+	if expired > 1 {
+		t.history = t.history[expired-1:]
+	}
+}
+
+// priceAt returns the price effective at the given time
+func (t *costTransformer) priceAt(at time.Time) (float64, bool) {
+	switch {
+	case t.conf.PriceEntityID != "":
+		t.historyMtx.Lock()
+		defer t.historyMtx.Unlock()
+
+		i := sort.Search(len(t.history), func(i int) bool {
+			return t.history[i].since.After(at)
+		})
+		if i == 0 {
+			return 0, false
+		}
+		return t.history[i-1].price, true
+	case len(t.conf.Schedule) > 0:
+		local := at.In(t.conf.Location)
+		offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+
+		// Before the first entry, the last entry of the previous day is effective
+		price := t.conf.Schedule[len(t.conf.Schedule)-1].Price
+		for _, entry := range t.conf.Schedule {
+			if entry.Start > offset {
+				break
+			}
+			price = entry.Price
+		}
+		return price, true
+	default:
+		return t.conf.Price, true
+	}
+}
+
+func (t *costTransformer) isEnergyEntity(state *hass.State, attrs stateAttributes) bool {
+	if len(t.conf.EntityIDs) > 0 {
+		return slices.Contains(t.conf.EntityIDs, state.EntityID)
+	}
+	return attrs.DeviceClass == deviceClassEnergy
+}
+
+func (t *costTransformer) Transform(event *hass.EventMessage, change *StateChange) {
+	oldState, newState := event.Event.Data.OldState, event.Event.Data.NewState
+	if extractDomainFromState(newState) != hass.EntityNumericSensor {
+		return
+	}
+
+	attrs := parseStateAttributes(newState)
+	if !t.isEnergyEntity(newState, attrs) {
+		return
+	}
+
+	newValue, err := strconv.ParseFloat(newState.State, 64)
+	if err != nil {
+		return
+	}
+	oldValue, err := strconv.ParseFloat(oldState.State, 64)
+	if err != nil {
+		return
+	}
+
+	consumed := newValue - oldValue
+	if consumed < 0 {
+		// Meter has been reset, everything since the reset has been consumed
+		consumed = newValue
+	}
+
+	price, ok := t.priceAt(newState.LastUpdated)
+	if !ok {
+		return
+	}
+
+	cost := consumed * energyUnitToKWh(attrs.UnitOfMeasurement) * price
+	change.Cost = &cost
+}
+
+// energyUnitToKWh returns a factor converting the given energy unit to kWh
+func energyUnitToKWh(unit string) float64 {
+	switch unit {
+	case "Wh":
+		return 1e-3
+	case "MWh":
+		return 1e3
+	case "GWh":
+		return 1e6
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,100 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestParsePriceSchedule(t *testing.T) {
+	schedule, err := ParsePriceSchedule("22:00=0.20, 07:00=0.35")
+	require.NoError(t, err)
+	assert.Equal(t, []PriceScheduleEntry{
+		{Start: 7 * time.Hour, Price: 0.35},
+		{Start: 22 * time.Hour, Price: 0.20},
+	}, schedule)
+
+	_, err = ParsePriceSchedule("07:00")
+	assert.Error(t, err)
+
+	_, err = ParsePriceSchedule("7am=0.1")
+	assert.Error(t, err)
+}
+
+func TestCostTransformer_PriceAt(t *testing.T) {
+	day := time.Date(2024, 8, 20, 0, 0, 0, 0, time.UTC)
+
+	scheduled := &costTransformer{conf: CostConfig{
+		Location: time.UTC,
+		Schedule: []PriceScheduleEntry{
+			{Start: 7 * time.Hour, Price: 0.35},
+			{Start: 22 * time.Hour, Price: 0.20},
+		},
+	}}
+
+	price, ok := scheduled.priceAt(day.Add(3 * time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, 0.20, price)
+
+	price, _ = scheduled.priceAt(day.Add(12 * time.Hour))
+	assert.Equal(t, 0.35, price)
+
+	tracked := &costTransformer{conf: CostConfig{PriceEntityID: "sensor.price"}}
+	_, ok = tracked.priceAt(time.Now())
+	assert.False(t, ok, "no price is known before the price entity is observed")
+
+	now := time.Now()
+	tracked.observePrice(&hass.State{EntityID: "sensor.price", State: "0.5", LastChanged: now.Add(-time.Hour)})
+	tracked.observePrice(&hass.State{EntityID: "sensor.price", State: "0.3", LastChanged: now.Add(-2 * time.Hour)})
+
+	price, _ = tracked.priceAt(now.Add(-90 * time.Minute))
+	assert.Equal(t, 0.3, price)
+
+	price, _ = tracked.priceAt(now)
+	assert.Equal(t, 0.5, price)
+}
+
+func TestCostTransformer_Transform(t *testing.T) {
+	transformer := &costTransformer{conf: CostConfig{Price: 0.5}}
+
+	event := func(oldState, newState, unit string) *hass.EventMessage {
+		attrs := []byte(`{"device_class":"energy","unit_of_measurement":"` + unit + `"}`)
+		return &hass.EventMessage{Event: hass.Event{Data: hass.EventData{
+			EntityID: "sensor.energy",
+			OldState: &hass.State{EntityID: "sensor.energy", State: oldState, Attributes: attrs},
+			NewState: &hass.State{EntityID: "sensor.energy", State: newState, Attributes: attrs},
+		}}}
+	}
+
+	tests := []struct {
+		name     string
+		event    *hass.EventMessage
+		expected *float64
+	}{
+		{name: "consumption in kWh", event: event("10", "12", "kWh"), expected: ptr(1.0)},
+		{name: "consumption in Wh", event: event("1000", "3000", "Wh"), expected: ptr(1.0)},
+		{name: "meter reset", event: event("100", "4", "kWh"), expected: ptr(2.0)},
+		{name: "unknown old state", event: event("unknown", "4", "kWh")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change := &StateChange{}
+			transformer.Transform(tt.event, change)
+			if tt.expected == nil {
+				assert.Nil(t, change.Cost)
+				return
+			}
+			require.NotNil(t, change.Cost)
+			assert.InDelta(t, *tt.expected, *change.Cost, 1e-9)
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
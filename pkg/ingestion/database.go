@@ -0,0 +1,59 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// DatabaseConfig configures the databases created by the pipeline
+type DatabaseConfig struct {
+	// Engine is the engine of created databases, e.g. Atomic or Replicated('/clickhouse/databases/hass', '{shard}', '{replica}'),
+	// the server default if empty
+	Engine string
+	// Comment is the comment of created databases, may be empty
+	Comment string
+}
+
+// WithDatabaseCreation creates the databases the pipeline writes to on startup if they do not exist,
+// with the configured engine and comment. Existing databases are left as they are.
+func WithDatabaseCreation(conf DatabaseConfig) PipelineOption {
+	return func(p *Pipeline) {
+		p.databaseConf = &conf
+	}
+}
+
+// createDatabases creates all databases the pipeline writes to, unless automatic DDL is disabled
+func (p *Pipeline) createDatabases(ctx context.Context) error {
+	if p.databaseConf == nil || p.noDDL {
+		return nil
+	}
+
+	for _, database := range p.databases() {
+		if err := createDatabaseIfNotExists(ctx, p.sink, database, *p.databaseConf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDatabaseIfNotExists creates a database with the configured engine and comment
+func createDatabaseIfNotExists(ctx context.Context, sink Sink, database string, conf DatabaseConfig) error {
+	query := "CREATE DATABASE IF NOT EXISTS " + database
+	if conf.Engine != "" {
+		query += " ENGINE = " + conf.Engine
+	}
+	if conf.Comment != "" {
+		query += " COMMENT " + clickhouse.QuoteString(conf.Comment)
+	}
+
+	if err := sink.Execute(ctx, query, nil); err != nil {
+		return fmt.Errorf("failed to create database %s: %w", database, err)
+	}
+
+	log.Info().Str("database", database).Str("engine", conf.Engine).Msg("created database if it did not exist")
+	return nil
+}
@@ -0,0 +1,37 @@
+package ingestion
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline_CreateDatabases(t *testing.T) {
+	var queries []string
+	sink := sinkFunc(func(query string) error {
+		queries = append(queries, query)
+		return nil
+	})
+
+	p := NewPipeline(nil, sink, "hass", WithDatabaseCreation(DatabaseConfig{
+		Engine:  "Replicated('/clickhouse/databases/hass', '{shard}', '{replica}')",
+		Comment: "Home Assistant's state changes",
+	}))
+	require.NoError(t, p.createDatabases(context.Background()))
+	assert.Equal(t, []string{
+		`CREATE DATABASE IF NOT EXISTS hass ENGINE = Replicated('/clickhouse/databases/hass', '{shard}', '{replica}') COMMENT 'Home Assistant\'s state changes'`,
+	}, queries)
+	assert.Contains(t, p.requiredGrants(), "CREATE DATABASE")
+
+	queries = nil
+	p = NewPipeline(nil, sink, "hass", WithDatabaseCreation(DatabaseConfig{}))
+	require.NoError(t, p.createDatabases(context.Background()))
+	assert.Equal(t, []string{"CREATE DATABASE IF NOT EXISTS hass"}, queries)
+
+	queries = nil
+	p = NewPipeline(nil, sink, "hass", WithDatabaseCreation(DatabaseConfig{}), WithoutDDL())
+	require.NoError(t, p.createDatabases(context.Background()))
+	assert.Empty(t, queries)
+}
@@ -0,0 +1,118 @@
+package ingestion
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// DDLTemplateData is passed to a custom state change DDL template
+type DDLTemplateData struct {
+	Database string
+	Table    string
+	// Domain is the entity domain of the table, e.g. numeric_sensor, or the table of a TableOverride
+	Domain string
+	// RowModel is the row model the table is created for, see RowModel
+	RowModel RowModel
+	// StateType is the ClickHouse type of the state and old_state columns
+	StateType string
+	// Codec is the compression codec configured with DDLTemplateConfig, may be empty
+	Codec string
+	// TTL is the TTL expression configured with DDLTemplateConfig, may be empty
+	TTL string
+	// StorageTTL is the TTL expression moving parts to the storage tiers of WithStorageTiering, may be empty
+	StorageTTL string
+	// StoragePolicy is the storage policy of WithStorageTiering, may be empty
+	StoragePolicy string
+	// Engine is the table engine of the built-in DDL, e.g. ReplacingMergeTree()
+	Engine string
+	// OrderBy is the sorting key of the built-in DDL, e.g. (entity_id, last_updated)
+	OrderBy string
+	// PartitionBy is the partition key of the built-in DDL, e.g. toYYYYMM(last_updated)
+	PartitionBy string
+	// Columns are the definitions of columns the engine or sorting key requires, e.g. the sign of a CollapsingMergeTree
+	Columns []string
+	// Cluster, Shard, Replica and Macros are set with WithClusterTopology, empty otherwise
+	Cluster string
+	Shard   string
+	Replica string
+	Macros  map[string]string
+}
+
+// DDLTemplateConfig configures a custom DDL of state change tables
+type DDLTemplateConfig struct {
+	Template *template.Template
+	Codec    string
+	TTL      string
+}
+
+// LoadDDLTemplate loads a state change DDL from a Go template file
+func LoadDDLTemplate(path string) (*template.Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DDL template: %w", err)
+	}
+
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DDL template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// WithDDLTemplate creates state change tables with a custom DDL template instead of the built-in DDL
+// of the row model. Columns required by enabled transformations are still added to the created tables.
+func WithDDLTemplate(conf DDLTemplateConfig) PipelineOption {
+	return func(p *Pipeline) {
+		p.ddlTemplate = &conf
+	}
+}
+
+// stateChangeDDL returns the DDL of a state change table of the given domain
+func (p *Pipeline) stateChangeDDL(model RowModel, database, tableName, domain, stateType string) (string, error) {
+	engine := p.stateChangeEngine(domain)
+	if p.ddlTemplate == nil {
+		var columns string
+		for _, column := range engine.columns {
+			columns += ",\n    " + column
+		}
+		var ttl, settings string
+		if storageTTL := p.storageTTL(domain); storageTTL != "" {
+			ttl = "\nTTL " + storageTTL
+		}
+		if policy := p.storagePolicy(); policy != "" {
+			settings = ", storage_policy = " + clickhouse.QuoteString(policy)
+		}
+		return fmt.Sprintf(model.ddl(), database, tableName, stateType, stateType, columns, engine.engine, engine.partitionBy, engine.orderBy(), ttl, settings), nil
+	}
+
+	data := DDLTemplateData{
+		Database:      database,
+		Table:         tableName,
+		Domain:        domain,
+		RowModel:      model,
+		StateType:     stateType,
+		Codec:         p.ddlTemplate.Codec,
+		TTL:           p.ddlTemplate.TTL,
+		StorageTTL:    p.storageTTL(domain),
+		StoragePolicy: p.storagePolicy(),
+		Engine:        engine.engine,
+		OrderBy:       engine.orderBy(),
+		PartitionBy:   engine.partitionBy,
+		Columns:       engine.columns,
+	}
+	if t := p.topology; t != nil {
+		data.Cluster, data.Shard, data.Replica, data.Macros = t.Cluster, t.Shard, t.Replica, t.Macros
+	}
+
+	var ddl strings.Builder
+	if err := p.ddlTemplate.Template.Execute(&ddl, data); err != nil {
+		return "", fmt.Errorf("failed to execute DDL template: %w", err)
+	}
+
+	return ddl.String(), nil
+}
@@ -0,0 +1,33 @@
+package ingestion
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline_StateChangeDDL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ddl.sql.tmpl")
+	require.NoError(t, os.WriteFile(path, []byte(
+		"CREATE TABLE {{.Database}}.{{.Table}} (state {{.StateType}} CODEC({{.Codec}})) TTL {{.TTL}}",
+	), 0o600))
+
+	tmpl, err := LoadDDLTemplate(path)
+	require.NoError(t, err)
+
+	p := NewPipeline(nil, nil, "hass", WithDDLTemplate(DDLTemplateConfig{
+		Template: tmpl,
+		Codec:    "ZSTD(3)",
+		TTL:      "toDateTime(last_updated) + INTERVAL 1 YEAR",
+	}))
+
+	ddl, err := p.stateChangeDDL(RowModelV1, "hass", "numeric_sensor", "numeric_sensor", "Float64")
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE hass.numeric_sensor (state Float64 CODEC(ZSTD(3))) TTL toDateTime(last_updated) + INTERVAL 1 YEAR", ddl)
+
+	_, err = LoadDDLTemplate(filepath.Join(t.TempDir(), "missing.tmpl"))
+	assert.Error(t, err)
+}
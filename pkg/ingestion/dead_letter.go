@@ -0,0 +1,77 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+const deadLetterTableName = "dead_letter"
+
+// DeadLetter is a row that could not be inserted into its destination table
+type DeadLetter struct {
+	DestinationTable string `json:"destination_table"`
+	Row              string `json:"row"`
+	Error            string `json:"error"`
+}
+
+func newDeadLetter(tableName string, value any, err error) DeadLetter {
+	row, marshalErr := json.Marshal(value)
+	if marshalErr != nil {
+		row = []byte(fmt.Sprintf("%+v", value))
+	}
+
+	return DeadLetter{
+		DestinationTable: tableName,
+		Row:              string(row),
+		Error:            err.Error(),
+	}
+}
+
+// createDeadLetterTable creates the dead-letter table in ClickHouse
+func createDeadLetterTable(ctx context.Context, sink Sink, database string, extraColumns []string) error {
+	query := fmt.Sprintf(deadLetterDDL, database, deadLetterTableName)
+	if err := sink.Execute(ctx, query, nil); err != nil {
+		return err
+	}
+	return addColumns(ctx, sink, database, deadLetterTableName, extraColumns)
+}
+
+// writeDeadLetters inserts rows that could not be inserted into their destination table into the dead-letter table,
+// or writes them to the dead-letter file with WithDeadLetterDir
+func (p *Pipeline) writeDeadLetters(ctx context.Context, database string, deadLetters []DeadLetter) error {
+	if len(deadLetters) == 0 {
+		return nil
+	}
+	if p.deadLetterDir != "" {
+		return p.writeDeadLetterFile(database, deadLetters)
+	}
+
+	tableKey := fmt.Sprintf("%s.%s", database, deadLetterTableName)
+	if !p.hasTable(tableKey) {
+		if err := createDeadLetterTable(ctx, p.sink, database, p.labelColumns()); err != nil {
+			log.Error().Err(err).Str("table", tableKey).Int("rows", len(deadLetters)).Msg("failed to create dead-letter table, rows are lost")
+			return fmt.Errorf("failed to create dead-letter table %s: %w", tableKey, err)
+		}
+		p.markTable(tableKey)
+	}
+
+	values := make([]any, 0, len(deadLetters))
+	for _, deadLetter := range deadLetters {
+		values = append(values, deadLetter)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", tableKey)
+	if err := p.sink.Execute(ctx, query, p.newRowReader(values)); err != nil {
+		log.Error().Err(err).Str("table", tableKey).Int("rows", len(deadLetters)).Msg("failed to insert dead letters, rows are lost")
+		return fmt.Errorf("failed to insert dead letters into %s: %w", tableKey, err)
+	}
+
+	metrics.DeadLetterRows.Add(float64(len(deadLetters)))
+	log.Warn().Str("table", tableKey).Int("rows", len(deadLetters)).Msg("inserted rows into the dead-letter table")
+	return nil
+}
@@ -0,0 +1,192 @@
+package ingestion
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// deadLetterFileSuffix is the suffix of dead-letter files, named after their database
+const deadLetterFileSuffix = ".dead_letter.ndjson"
+
+// deadLetterReplaySuffix marks a dead-letter file taken over by a retry, so the pipeline appends to a new one
+const deadLetterReplaySuffix = ".retrying"
+
+// WithDeadLetterDir writes dead letters of strict mode to NDJSON files in dir, one per database, instead of
+// the dead_letter table, e.g. if the ClickHouse user must not create tables. RetryDeadLetters reads them from there.
+func WithDeadLetterDir(dir string) PipelineOption {
+	return func(p *Pipeline) {
+		p.deadLetterDir = dir
+	}
+}
+
+// fileDeadLetter is a line of a dead-letter file
+type fileDeadLetter struct {
+	DeadLetter
+	FailedAt time.Time `json:"failed_at"`
+}
+
+func (p *Pipeline) deadLetterFile(database string) string {
+	return filepath.Join(p.deadLetterDir, database+deadLetterFileSuffix)
+}
+
+// writeDeadLetterFile appends dead letters to the dead-letter file of a database, synced to disk
+func (p *Pipeline) writeDeadLetterFile(database string, deadLetters []DeadLetter) error {
+	if err := os.MkdirAll(p.deadLetterDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create dead-letter directory: %w", err)
+	}
+
+	var lines []byte
+	failedAt := p.clock.Now().UTC()
+	for _, deadLetter := range deadLetters {
+		line, err := json.Marshal(fileDeadLetter{DeadLetter: deadLetter, FailedAt: failedAt})
+		if err != nil {
+			return fmt.Errorf("failed to marshal dead letter: %w", err)
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	p.deadLetterMtx.Lock()
+	defer p.deadLetterMtx.Unlock()
+
+	path := p.deadLetterFile(database)
+	if err := appendFileSync(path, lines); err != nil {
+		log.Error().Err(err).Str("path", path).Int("rows", len(deadLetters)).Msg("failed to write dead letters, rows are lost")
+		return fmt.Errorf("failed to write dead letters to %s: %w", path, err)
+	}
+
+	metrics.DeadLetterRows.Add(float64(len(deadLetters)))
+	log.Warn().Str("path", path).Int("rows", len(deadLetters)).Msg("wrote rows to the dead-letter file")
+	return nil
+}
+
+func appendFileSync(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(content); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// retryDeadLetterFile retries the dead letters of the dead-letter file of a database. The file is taken over
+// first, so a running pipeline appends new dead letters to a new file, and the dead letters not recovered are
+// appended back to it afterwards. With progress, the dead letters not recovered are appended back before
+// the offset of every recovered one is recorded, so a resumed retry continues after it.
+func (p *Pipeline) retryDeadLetterFile(ctx context.Context, database string, opts DeadLetterRetryOptions, progress *deadLetterProgress, report *DeadLetterRetryReport) error {
+	path := p.deadLetterFile(database)
+	replayPath := path + deadLetterReplaySuffix
+	resumed := progress.database(database)
+
+	// A file left by an interrupted retry is retried first, after the dead letters it recovered
+	var offset int64
+	if _, err := os.Stat(replayPath); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(path, replayPath); errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to take over dead-letter file %s: %w", path, err)
+		}
+	} else if resumed != nil {
+		offset = resumed.Offset
+	}
+
+	f, err := os.Open(replayPath)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to resume dead-letter file: %w", err)
+	}
+
+	var kept []byte
+	keep := func() error {
+		if len(kept) == 0 {
+			return nil
+		}
+		p.deadLetterMtx.Lock()
+		err := appendFileSync(path, kept)
+		p.deadLetterMtx.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to keep dead letters in %s, they are still in %s: %w", path, replayPath, err)
+		}
+		kept = nil
+		return nil
+	}
+
+	retried := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		offset += int64(len(line)) + 1
+		if len(line) == 0 {
+			continue
+		}
+
+		var deadLetter fileDeadLetter
+		if err := json.Unmarshal(line, &deadLetter); err != nil {
+			log.Warn().Err(err).Str("path", replayPath).Msg("failed to decode dead letter, keeping it")
+			kept = append(append(kept, line...), '\n')
+			continue
+		}
+
+		selected := (len(opts.Tables) == 0 || slices.Contains(opts.Tables, deadLetter.DestinationTable)) &&
+			opts.selectsTime(deadLetter.FailedAt) && opts.selectsEntity(deadLetter.Row)
+		if !selected || opts.Limit > 0 && retried >= opts.Limit {
+			kept = append(append(kept, line...), '\n')
+			continue
+		}
+		retried++
+
+		stored := storedDeadLetter{DestinationTable: deadLetter.DestinationTable, Row: deadLetter.Row}
+		if !p.retryReported(ctx, database, stored, opts.DryRun, report) || opts.DryRun {
+			kept = append(append(kept, line...), '\n')
+			continue
+		}
+		metrics.DeadLettersRecovered.Inc()
+
+		if resumed != nil {
+			if err := keep(); err != nil {
+				return err
+			}
+			resumed.Offset = offset
+			if err := progress.save(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read dead-letter file: %w", err)
+	}
+
+	if err := keep(); err != nil {
+		return err
+	}
+	if err := os.Remove(replayPath); err != nil {
+		return fmt.Errorf("failed to remove retried dead-letter file: %w", err)
+	}
+	if resumed != nil {
+		resumed.Offset = 0
+		return progress.save()
+	}
+	return nil
+}
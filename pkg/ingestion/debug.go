@@ -0,0 +1,59 @@
+package ingestion
+
+import (
+	"runtime"
+	"sort"
+	"time"
+)
+
+// DebugReport is a snapshot of the internal state of a pipeline, e.g. to diagnose a deployment that looks hung
+type DebugReport struct {
+	Stats PipelineStats `json:"stats"`
+	// Ready is empty if the pipeline is ready, otherwise what it is waiting for
+	Ready string `json:"ready,omitempty"`
+	// Partitions are the destination tables with events passed by filters and not inserted yet
+	Partitions []PartitionReport `json:"partitions"`
+	// WALPending tells whether batches are spilled to the write-ahead log and wait for their replay
+	WALPending bool `json:"wal_pending"`
+	Goroutines int  `json:"goroutines"`
+}
+
+// PartitionReport describes the pending events of a destination table
+type PartitionReport struct {
+	Table  string        `json:"table"`
+	Queued int           `json:"queued"`
+	Oldest time.Time     `json:"oldest"`
+	Age    time.Duration `json:"age"`
+}
+
+// DebugReport returns a snapshot of the internal state of the pipeline. It is safe to call concurrently with Run.
+func (p *Pipeline) DebugReport() DebugReport {
+	report := DebugReport{
+		Stats:      p.Stats(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	if err := p.Ready(); err != nil {
+		report.Ready = err.Error()
+	}
+	// The write-ahead log is opened while starting
+	if state := report.Stats.State; state != PipelineStateIdle && state != PipelineStateStarting && p.wal != nil {
+		report.WALPending = p.wal.pending()
+	}
+
+	now := p.clock.Now()
+	p.queues.mtx.Lock()
+	for table, queued := range p.queues.queued {
+		report.Partitions = append(report.Partitions, PartitionReport{
+			Table:  table,
+			Queued: len(queued),
+			Oldest: queued[0],
+			Age:    now.Sub(queued[0]),
+		})
+	}
+	p.queues.mtx.Unlock()
+
+	sort.Slice(report.Partitions, func(i, j int) bool {
+		return report.Partitions[i].Table < report.Partitions[j].Table
+	})
+	return report
+}
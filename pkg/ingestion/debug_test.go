@@ -0,0 +1,29 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+func TestPipeline_DebugReport(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	p := NewPipeline(nil, nil, "hass", WithClock(clk))
+
+	p.queues.push("sensor", start)
+	p.queues.push("light", start.Add(time.Second))
+	p.queues.push("sensor", start.Add(2*time.Second))
+	clk.Advance(time.Minute)
+
+	report := p.DebugReport()
+	assert.Equal(t, PipelineStateIdle, report.Stats.State)
+	assert.Equal(t, "pipeline is idle", report.Ready)
+	require.Len(t, report.Partitions, 2)
+	assert.Equal(t, PartitionReport{Table: "light", Queued: 1, Oldest: start.Add(time.Second), Age: 59 * time.Second}, report.Partitions[0])
+	assert.Equal(t, PartitionReport{Table: "sensor", Queued: 2, Oldest: start, Age: time.Minute}, report.Partitions[1])
+}
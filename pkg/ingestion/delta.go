@@ -0,0 +1,83 @@
+package ingestion
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+const valueDeltaColumn = "value_delta Nullable(Float64)"
+
+// WithValueDelta enables storing the difference from the previously stored value of each numeric entity
+func WithValueDelta() PipelineOption {
+	return func(p *Pipeline) {
+		p.transformers = append(p.transformers, &deltaTransformer{
+			lastValues: make(map[string]float64),
+		})
+	}
+}
+
+// deltaTransformer computes value_delta using a per-entity cache of the last stored value.
+// It falls back to the old state for entities that have not been seen yet.
+type deltaTransformer struct {
+	lastValuesMtx sync.Mutex
+	lastValues    map[string]float64
+}
+
+func isNumericDomain(domain string) bool {
+	switch domain {
+	case hass.EntityNumericSensor, hass.EntityNumber, hass.EntityInputNumber, hass.EntityCounter:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *deltaTransformer) stageName() string {
+	return StageValueDelta
+}
+
+func (t *deltaTransformer) Columns(domain string) []string {
+	if !isNumericDomain(domain) {
+		return nil
+	}
+	return []string{valueDeltaColumn}
+}
+
+func (t *deltaTransformer) Transform(event *hass.EventMessage, change *StateChange) {
+	if !isNumericDomain(extractDomainFromState(event.Event.Data.NewState)) {
+		return
+	}
+
+	value, ok := parseNumericValue(change.State)
+	if !ok {
+		return
+	}
+
+	t.lastValuesMtx.Lock()
+	last, seen := t.lastValues[change.EntityID]
+	t.lastValues[change.EntityID] = value
+	t.lastValuesMtx.Unlock()
+
+	if !seen {
+		if last, seen = parseNumericValue(change.OldState); !seen {
+			return
+		}
+	}
+
+	delta := value - last
+	change.ValueDelta = &delta
+}
+
+func parseNumericValue(value any) (float64, bool) {
+	switch v := value.(type) {
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
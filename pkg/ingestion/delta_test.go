@@ -0,0 +1,56 @@
+package ingestion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestDeltaTransformer(t *testing.T) {
+	transformer := &deltaTransformer{lastValues: make(map[string]float64)}
+	transform := func(entityID string, oldState any, newState string) *float64 {
+		event := &hass.EventMessage{Event: hass.Event{Data: hass.EventData{
+			EntityID: entityID,
+			NewState: &hass.State{EntityID: entityID, State: newState},
+		}}}
+		change := &StateChange{EntityID: entityID, State: newState, OldState: oldState}
+		transformer.Transform(event, change)
+		return change.ValueDelta
+	}
+
+	// The first event of an entity without an old state has no delta
+	assert.Nil(t, transform("sensor.energy", nil, "10.5"))
+	delta := transform("sensor.energy", "10.5", "12")
+	require.NotNil(t, delta)
+	assert.Equal(t, 1.5, *delta)
+
+	// The first event of an entity falls back to its old state
+	delta = transform("counter.visits", "3", "4")
+	require.NotNil(t, delta)
+	assert.Equal(t, 1.0, *delta)
+
+	// A non-numeric previous state has no value to compare with
+	assert.Nil(t, transform("sensor.power", hass.UnavailableValue, "250"))
+
+	// Non-numeric states are skipped, the delta is to the last numeric value
+	assert.Nil(t, transform("sensor.power", "250", hass.UnavailableValue))
+	delta = transform("sensor.power", hass.UnavailableValue, "300")
+	require.NotNil(t, delta)
+	assert.Equal(t, 50.0, *delta)
+
+	// A counter reset is stored as a negative delta, counting resumes from the reset value
+	delta = transform("counter.visits", "4", "0")
+	require.NotNil(t, delta)
+	assert.Equal(t, -4.0, *delta)
+	delta = transform("counter.visits", "0", "2")
+	require.NotNil(t, delta)
+	assert.Equal(t, 2.0, *delta)
+
+	// Domains without numeric states are skipped
+	assert.Nil(t, transform("light.kitchen", "off", "on"))
+	assert.Nil(t, transformer.Columns("light"))
+	assert.Equal(t, []string{valueDeltaColumn}, transformer.Columns("counter"))
+}
@@ -0,0 +1,319 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// DeadLetterRetryOptions select the dead letters reprocessed by RetryDeadLetters
+type DeadLetterRetryOptions struct {
+	// Tables are the destination tables whose dead letters are retried, all if empty
+	Tables []string
+	// Limit is the maximum number of dead letters retried per database, all if 0
+	Limit int
+	// DryRun reprocesses and reports dead letters without inserting or deleting them
+	DryRun bool
+	// Progress is the path of a file recording the dead letters recovered so far, so that an interrupted retry
+	// resumes without inserting them again. No progress is recorded if empty.
+	Progress string
+	// Resume picks up the progress of an interrupted retry. A retry with progress left by another one fails
+	// without it.
+	Resume bool
+	// From and To bound the time the dead letters failed at, e.g. the period a fixed bug rejected rows in,
+	// unbounded if zero
+	From, To time.Time
+	// Entities are glob patterns of the entity IDs of the rows retried, all rows if empty. Rows without
+	// an entity ID, e.g. of heartbeats, are not selected by patterns.
+	Entities []string
+}
+
+// selectsTime reports whether a dead letter failed within the period of the options
+func (opts DeadLetterRetryOptions) selectsTime(failedAt time.Time) bool {
+	return (opts.From.IsZero() || !failedAt.Before(opts.From)) && (opts.To.IsZero() || failedAt.Before(opts.To))
+}
+
+// selectsEntity reports whether the row of a dead letter is of an entity selected by the options
+func (opts DeadLetterRetryOptions) selectsEntity(row string) bool {
+	if len(opts.Entities) == 0 {
+		return true
+	}
+
+	var value struct {
+		EntityID string `json:"entity_id"`
+	}
+	if err := json.Unmarshal([]byte(row), &value); err != nil || value.EntityID == "" {
+		return false
+	}
+	return matchesAny(opts.Entities, value.EntityID)
+}
+
+// DeadLetterRetryReport is the outcome of RetryDeadLetters per destination table, keyed by database.table
+type DeadLetterRetryReport struct {
+	Tables map[string]*DeadLetterRetryTable `json:"tables"`
+}
+
+// DeadLetterRetryTable is the outcome of retrying the dead letters of a single destination table
+type DeadLetterRetryTable struct {
+	Retried   int `json:"retried"`
+	Recovered int `json:"recovered"`
+	Failed    int `json:"failed"`
+	// LastError is the error of the last dead letter that failed again
+	LastError string `json:"last_error,omitempty"`
+}
+
+// storedDeadLetter is a row of the dead-letter table with an ID of its content
+type storedDeadLetter struct {
+	ID               uint64 `json:"id,string"`
+	DestinationTable string `json:"destination_table"`
+	Row              string `json:"row"`
+}
+
+// RetryDeadLetters reads rows of the dead-letter tables, runs them through the current row model and
+// routing of their destination table and inserts them again, e.g. after an upgrade fixed the bug that made
+// ClickHouse reject them. Dead letters inserted successfully are deleted, the others are kept.
+// With a progress file, the recovered dead letters are recorded as they are inserted, and a resumed retry
+// continues after them.
+func (p *Pipeline) RetryDeadLetters(ctx context.Context, opts DeadLetterRetryOptions) (*DeadLetterRetryReport, error) {
+	q, ok := p.sink.(querier)
+	if !ok && p.deadLetterDir == "" {
+		return nil, errors.New("sink does not support queries")
+	}
+
+	progress, err := loadDeadLetterProgress(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DeadLetterRetryReport{Tables: make(map[string]*DeadLetterRetryTable)}
+	for _, database := range p.databases() {
+		if p.deadLetterDir != "" {
+			if err := p.retryDeadLetterFile(ctx, database, opts, progress, report); err != nil {
+				return report, err
+			}
+			continue
+		}
+
+		// Dead letters recovered by the interrupted retry have been inserted already, so they are deleted first
+		if resumed := progress.database(database); resumed != nil && len(resumed.Recovered) > 0 {
+			if err := p.deleteRecoveredDeadLetters(ctx, database, resumed.Recovered, progress); err != nil {
+				return report, err
+			}
+		}
+
+		deadLetters, err := p.readDeadLetters(ctx, q, database, opts)
+		if err != nil {
+			return report, err
+		}
+
+		var recovered []uint64
+		for _, deadLetter := range deadLetters {
+			if !p.retryReported(ctx, database, deadLetter, opts.DryRun, report) || opts.DryRun {
+				continue
+			}
+			recovered = append(recovered, deadLetter.ID)
+			if progress != nil {
+				progress.database(database).Recovered = recovered
+				if err := progress.save(); err != nil {
+					return report, err
+				}
+			}
+
+			if len(recovered) >= deadLetterDeleteBatch {
+				if err := p.deleteRecoveredDeadLetters(ctx, database, recovered, progress); err != nil {
+					return report, err
+				}
+				recovered = nil
+			}
+		}
+
+		if len(recovered) > 0 {
+			if err := p.deleteRecoveredDeadLetters(ctx, database, recovered, progress); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	return report, progress.remove()
+}
+
+// deleteRecoveredDeadLetters deletes recovered dead letters of a database and clears them from the progress
+func (p *Pipeline) deleteRecoveredDeadLetters(ctx context.Context, database string, ids []uint64, progress *deadLetterProgress) error {
+	if err := p.deleteDeadLetters(ctx, database, ids); err != nil {
+		return err
+	}
+	metrics.DeadLettersRecovered.Add(float64(len(ids)))
+	log.Info().Str("database", database).Int("rows", len(ids)).Msg("deleted recovered dead letters")
+
+	if progress == nil {
+		return nil
+	}
+	progress.database(database).Recovered = nil
+	return progress.save()
+}
+
+// retryReported retries a dead letter and records the outcome in the report, reporting whether it has been recovered
+func (p *Pipeline) retryReported(ctx context.Context, database string, deadLetter storedDeadLetter, dryRun bool, report *DeadLetterRetryReport) bool {
+	table := report.Tables[database+"."+deadLetter.DestinationTable]
+	if table == nil {
+		table = &DeadLetterRetryTable{}
+		report.Tables[database+"."+deadLetter.DestinationTable] = table
+	}
+	table.Retried++
+
+	if err := p.retryDeadLetter(ctx, database, deadLetter, dryRun); err != nil {
+		log.Warn().Err(err).Str("database", database).Str("table", deadLetter.DestinationTable).Msg("dead letter failed again")
+		table.Failed++
+		table.LastError = err.Error()
+		return false
+	}
+	table.Recovered++
+	return true
+}
+
+// readDeadLetters reads the dead letters of a database, oldest first
+func (p *Pipeline) readDeadLetters(ctx context.Context, q querier, database string, opts DeadLetterRetryOptions) ([]storedDeadLetter, error) {
+	exists := false
+	query := fmt.Sprintf("SELECT name FROM system.tables WHERE database = %s AND name = %s",
+		clickhouse.QuoteString(database), clickhouse.QuoteString(deadLetterTableName))
+	err := q.Query(ctx, query, func(json.RawMessage) error {
+		exists = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the dead-letter table of %s: %w", database, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	query = fmt.Sprintf("SELECT %s AS id, destination_table, row FROM %s.%s", deadLetterIDExpr, database, deadLetterTableName)
+	var conditions []string
+	if len(opts.Tables) > 0 {
+		tables := make([]string, 0, len(opts.Tables))
+		for _, table := range opts.Tables {
+			tables = append(tables, clickhouse.QuoteString(table))
+		}
+		conditions = append(conditions, fmt.Sprintf("destination_table IN (%s)", strings.Join(tables, ", ")))
+	}
+	if !opts.From.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("failed_at >= fromUnixTimestamp64Milli(%d)", opts.From.UnixMilli()))
+	}
+	if !opts.To.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("failed_at < fromUnixTimestamp64Milli(%d)", opts.To.UnixMilli()))
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY failed_at"
+	// Entity patterns are matched while reading, so the limit is applied there as well
+	if opts.Limit > 0 && len(opts.Entities) == 0 {
+		query += fmt.Sprintf(" LIMIT %d", opts.Limit)
+	}
+
+	var deadLetters []storedDeadLetter
+	err = q.Query(ctx, query, func(raw json.RawMessage) error {
+		var deadLetter storedDeadLetter
+		if err := json.Unmarshal(raw, &deadLetter); err != nil {
+			return err
+		}
+		if !opts.selectsEntity(deadLetter.Row) || opts.Limit > 0 && len(deadLetters) >= opts.Limit {
+			return nil
+		}
+		deadLetters = append(deadLetters, deadLetter)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters of %s: %w", database, err)
+	}
+
+	return deadLetters, nil
+}
+
+// deadLetterIDExpr identifies a dead letter by its content, the dead-letter table has no key
+const deadLetterIDExpr = "cityHash64(destination_table, row, failed_at)"
+
+// retryDeadLetter reprocesses a dead letter with the current row model of its destination table and inserts it
+func (p *Pipeline) retryDeadLetter(ctx context.Context, database string, deadLetter storedDeadLetter, dryRun bool) error {
+	tableName := deadLetter.DestinationTable
+	value, err := p.decodeDeadLetterRow(tableName, deadLetter.Row)
+	if err != nil {
+		return err
+	}
+
+	// States that do not fit the table type anymore are kept in the overflow table
+	if change, ok := value.(*StateChange); ok && !fitsStateType(p.stateTypeOf(tableName), change) {
+		if dryRun {
+			return nil
+		}
+		return p.writeOverflow(ctx, newBatchID(), database, tableName, []any{change})
+	}
+
+	if dryRun {
+		return nil
+	}
+	return p.insertRows(ctx, database, tableName, []any{value})
+}
+
+// decodeDeadLetterRow decodes a row of a destination table into its current row model,
+// dropping fields the row model does not have anymore
+func (p *Pipeline) decodeDeadLetterRow(tableName, row string) (any, error) {
+	var value any
+	switch {
+	case tableName == attributeChangesTableName:
+		value = &AttributeChange{}
+	case strings.HasSuffix(tableName, overflowTableSuffix):
+		// Overflow tables store states of any type
+		value = &map[string]any{}
+	case strings.HasSuffix(tableName, "_"+string(RowModelV2)):
+		value = &StateChangeV2{}
+	case p.isInternalTable(tableName):
+		value = &map[string]any{}
+	default:
+		value = &StateChange{}
+	}
+
+	if err := json.Unmarshal([]byte(row), value); err != nil {
+		return nil, fmt.Errorf("failed to decode dead letter of %s: %w", tableName, err)
+	}
+	return value, nil
+}
+
+// isInternalTable reports whether a table holds other rows than state changes, e.g. heartbeats or events
+func (p *Pipeline) isInternalTable(tableName string) bool {
+	switch tableName {
+	case deadLetterTableName, heartbeatsTableName, insertStatsTableName, restartsTableName, availabilityTableName:
+		return true
+	}
+
+	for _, eventType := range p.eventTypes {
+		if eventTableName(eventType) == tableName {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteDeadLetters deletes dead letters by their IDs, waiting for the mutation so a retry run right
+// afterwards does not insert them twice
+func (p *Pipeline) deleteDeadLetters(ctx context.Context, database string, ids []uint64) error {
+	list := make([]string, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, fmt.Sprint(id))
+	}
+
+	query := fmt.Sprintf("ALTER TABLE %s.%s DELETE WHERE %s IN (%s)",
+		database, deadLetterTableName, deadLetterIDExpr, strings.Join(list, ", "))
+	if err := p.sink.Execute(ctx, query, nil, clickhouse.WithSetting("mutations_sync", "1")); err != nil {
+		return fmt.Errorf("failed to delete recovered dead letters of %s: %w", database, err)
+	}
+	return nil
+}
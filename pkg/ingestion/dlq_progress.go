@@ -0,0 +1,95 @@
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/goccy/go-json"
+)
+
+// deadLetterDeleteBatch is the number of recovered dead letters deleted from the dead-letter table at once
+const deadLetterDeleteBatch = 1000
+
+// deadLetterProgress is the progress of a dead-letter retry stored in its progress file. A nil progress
+// records nothing.
+type deadLetterProgress struct {
+	path      string
+	Databases map[string]*deadLetterDatabaseProgress `json:"databases"`
+}
+
+// deadLetterDatabaseProgress is the progress of the retry of the dead letters of a database
+type deadLetterDatabaseProgress struct {
+	// Recovered are the IDs of dead letters of the dead-letter table inserted, but not deleted yet
+	Recovered []uint64 `json:"recovered,omitempty"`
+	// Offset is the offset of the taken over dead-letter file up to which dead letters have been retried
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// loadDeadLetterProgress reads the progress file of a retry. The progress of an interrupted retry is only
+// picked up if the retry resumes, so it is not mistaken for the progress of another one. Dry runs have no progress.
+func loadDeadLetterProgress(opts DeadLetterRetryOptions) (*deadLetterProgress, error) {
+	if opts.Progress == "" || opts.DryRun {
+		return nil, nil
+	}
+
+	progress := &deadLetterProgress{path: opts.Progress, Databases: make(map[string]*deadLetterDatabaseProgress)}
+	data, err := os.ReadFile(opts.Progress)
+	if errors.Is(err, os.ErrNotExist) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead-letter retry progress: %w", err)
+	}
+	if !opts.Resume {
+		return nil, fmt.Errorf("%s holds the progress of an interrupted dead-letter retry, resume it or remove the file", opts.Progress)
+	}
+
+	if err := json.Unmarshal(data, progress); err != nil {
+		return nil, fmt.Errorf("failed to parse dead-letter retry progress %s: %w", opts.Progress, err)
+	}
+	if progress.Databases == nil {
+		progress.Databases = make(map[string]*deadLetterDatabaseProgress)
+	}
+	return progress, nil
+}
+
+// database returns the progress of a database, nil without progress
+func (p *deadLetterProgress) database(database string) *deadLetterDatabaseProgress {
+	if p == nil {
+		return nil
+	}
+	progress, ok := p.Databases[database]
+	if !ok {
+		progress = &deadLetterDatabaseProgress{}
+		p.Databases[database] = progress
+	}
+	return progress
+}
+
+// save replaces the progress file atomically and syncs it, so an interruption leaves the previous progress or the new one
+func (p *deadLetterProgress) save() error {
+	if p == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := replaceFileSync(p.path, data); err != nil {
+		return fmt.Errorf("failed to write dead-letter retry progress: %w", err)
+	}
+	return nil
+}
+
+// remove removes the progress file of a finished retry
+func (p *deadLetterProgress) remove() error {
+	if p == nil {
+		return nil
+	}
+	if err := os.Remove(p.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove dead-letter retry progress: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+// deadLetterSink serves dead letters and rejects inserts into the rejected tables, calling onInsert before inserts
+type deadLetterSink struct {
+	deadLetters []string
+	rejected    map[string]bool
+	executed    []string
+	queries     []string
+	onInsert    func()
+}
+
+func (s *deadLetterSink) Execute(_ context.Context, query string, _ io.ReadSeeker, _ ...clickhouse.QueryOption) error {
+	s.executed = append(s.executed, query)
+	if s.onInsert != nil && strings.HasPrefix(query, "INSERT INTO ") {
+		s.onInsert()
+	}
+	for table := range s.rejected {
+		if strings.HasPrefix(query, "INSERT INTO hass."+table+" ") {
+			return errors.New("Code: 27. DB::Exception: Cannot parse input")
+		}
+	}
+	return nil
+}
+
+func (s *deadLetterSink) Query(_ context.Context, query string, fn func(row json.RawMessage) error, _ ...clickhouse.QueryOption) error {
+	s.queries = append(s.queries, query)
+	if strings.HasPrefix(query, "SELECT name FROM system.tables") {
+		return fn(json.RawMessage(`{"name":"dead_letter"}`))
+	}
+	for _, row := range s.deadLetters {
+		if err := fn(json.RawMessage(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPipeline_RetryDeadLetters(t *testing.T) {
+	sink := &deadLetterSink{
+		deadLetters: []string{
+			`{"id":"1","destination_table":"light","row":"{\"entity_id\":\"light.kitchen\",\"state\":true,\"removed_field\":1}"}`,
+			`{"id":"2","destination_table":"numeric_sensor","row":"{\"entity_id\":\"sensor.power\",\"state\":\"n/a\"}"}`,
+			`{"id":"18446744073709551615","destination_table":"switch","row":"{\"entity_id\":\"switch.fan\",\"state\":false}"}`,
+		},
+		rejected: map[string]bool{"switch": true},
+	}
+
+	p := NewPipeline(nil, sink, "hass", WithoutDDL())
+	report, err := p.RetryDeadLetters(context.Background(), DeadLetterRetryOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, report.Tables["hass.light"].Recovered)
+	assert.Equal(t, 1, report.Tables["hass.numeric_sensor"].Recovered)
+	assert.Equal(t, 1, report.Tables["hass.switch"].Failed)
+	assert.Contains(t, report.Tables["hass.switch"].LastError, "Cannot parse input")
+
+	assert.Contains(t, sink.executed, "INSERT INTO hass.numeric_sensor_overflow FORMAT JSONEachRow", "states not fitting the table type are kept in the overflow table")
+	assert.Equal(t, "ALTER TABLE hass.dead_letter DELETE WHERE cityHash64(destination_table, row, failed_at) IN (1, 2)", sink.executed[len(sink.executed)-1])
+}
+
+func TestPipeline_RetryDeadLetterFile(t *testing.T) {
+	ctx := context.Background()
+	sink := &deadLetterSink{rejected: map[string]bool{"switch": true}}
+	p := NewPipeline(nil, sink, "hass", WithoutDDL(), WithDeadLetterDir(t.TempDir()))
+
+	require.NoError(t, p.writeDeadLetters(ctx, "hass", []DeadLetter{
+		{DestinationTable: "light", Row: `{"entity_id":"light.kitchen","state":true}`, Error: "rejected"},
+		{DestinationTable: "switch", Row: `{"entity_id":"switch.fan","state":false}`, Error: "rejected"},
+	}))
+	assert.Empty(t, sink.executed, "dead letters are not written to ClickHouse")
+
+	report, err := p.RetryDeadLetters(ctx, DeadLetterRetryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Tables["hass.light"].Recovered)
+	assert.Equal(t, 1, report.Tables["hass.switch"].Failed)
+
+	// Only the dead letter not recovered is kept for a later retry
+	content, err := os.ReadFile(p.deadLetterFile("hass"))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"destination_table":"switch"`)
+	assert.Contains(t, lines[0], `"failed_at"`)
+}
+
+func TestPipeline_RetryDeadLettersProgress(t *testing.T) {
+	ctx := context.Background()
+	progressPath := filepath.Join(t.TempDir(), "dlq-progress.json")
+	require.NoError(t, os.WriteFile(progressPath, []byte(`{"databases":{"hass":{"recovered":[7]}}}`), 0o600))
+
+	sink := &deadLetterSink{deadLetters: []string{
+		`{"id":"1","destination_table":"light","row":"{\"entity_id\":\"light.kitchen\",\"state\":true}"}`,
+		`{"id":"2","destination_table":"light","row":"{\"entity_id\":\"light.hall\",\"state\":false}"}`,
+	}}
+	p := NewPipeline(nil, sink, "hass", WithoutDDL())
+
+	// The progress of an interrupted retry is not picked up unless resumed
+	_, err := p.RetryDeadLetters(ctx, DeadLetterRetryOptions{Progress: progressPath})
+	assert.ErrorContains(t, err, "interrupted dead-letter retry")
+	assert.Empty(t, sink.executed)
+
+	// Recovered dead letters are recorded as they are inserted
+	inserts := 0
+	sink.onInsert = func() {
+		inserts++
+		if inserts == 2 {
+			content, err := os.ReadFile(progressPath)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"databases":{"hass":{"recovered":[1]}}}`, string(content))
+		}
+	}
+	report, err := p.RetryDeadLetters(ctx, DeadLetterRetryOptions{Progress: progressPath, Resume: true})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Tables["hass.light"].Recovered)
+	assert.Equal(t, 2, inserts)
+
+	// The dead letters recovered by the interrupted retry are deleted first
+	assert.Equal(t, "ALTER TABLE hass.dead_letter DELETE WHERE cityHash64(destination_table, row, failed_at) IN (7)", sink.executed[0])
+	assert.Equal(t, "ALTER TABLE hass.dead_letter DELETE WHERE cityHash64(destination_table, row, failed_at) IN (1, 2)", sink.executed[len(sink.executed)-1])
+
+	// The progress of a finished retry is removed
+	assert.NoFileExists(t, progressPath)
+}
+
+func TestPipeline_RetryDeadLetterFileResume(t *testing.T) {
+	ctx := context.Background()
+	sink := &deadLetterSink{rejected: map[string]bool{"switch": true}}
+	p := NewPipeline(nil, sink, "hass", WithoutDDL(), WithDeadLetterDir(t.TempDir()))
+	progressPath := filepath.Join(t.TempDir(), "dlq-progress.json")
+
+	require.NoError(t, p.writeDeadLetters(ctx, "hass", []DeadLetter{
+		{DestinationTable: "light", Row: `{"entity_id":"light.kitchen","state":true}`, Error: "rejected"},
+		{DestinationTable: "switch", Row: `{"entity_id":"switch.fan","state":false}`, Error: "rejected"},
+		{DestinationTable: "light", Row: `{"entity_id":"light.hall","state":true}`, Error: "rejected"},
+	}))
+
+	// A retry was interrupted after recovering the first dead letter
+	path := p.deadLetterFile("hass")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	first := strings.Index(string(content), "\n") + 1
+	require.NoError(t, os.Rename(path, path+deadLetterReplaySuffix))
+	require.NoError(t, os.WriteFile(progressPath, []byte(fmt.Sprintf(`{"databases":{"hass":{"offset":%d}}}`, first)), 0o600))
+
+	report, err := p.RetryDeadLetters(ctx, DeadLetterRetryOptions{Progress: progressPath, Resume: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Tables["hass.light"].Recovered)
+	assert.Equal(t, 1, report.Tables["hass.switch"].Failed)
+	assert.Equal(t, []string{"INSERT INTO hass.switch FORMAT JSONEachRow", "INSERT INTO hass.light FORMAT JSONEachRow"}, sink.executed)
+
+	// Only the dead letter not recovered is kept, the retried file and the progress are removed
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"destination_table":"switch"`)
+	assert.NoFileExists(t, path+deadLetterReplaySuffix)
+	assert.NoFileExists(t, progressPath)
+}
+
+func TestPipeline_RetryDeadLettersFilters(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink := &deadLetterSink{deadLetters: []string{
+		`{"id":"1","destination_table":"light","row":"{\"entity_id\":\"light.kitchen\",\"state\":true}"}`,
+		`{"id":"2","destination_table":"switch","row":"{\"entity_id\":\"switch.fan\",\"state\":false}"}`,
+		`{"id":"3","destination_table":"light","row":"{\"entity_id\":\"light.hall\",\"state\":true}"}`,
+		`{"id":"4","destination_table":"heartbeats","row":"{\"source\":\"hass2ch\"}"}`,
+	}}
+
+	p := NewPipeline(nil, sink, "hass", WithoutDDL())
+	report, err := p.RetryDeadLetters(context.Background(), DeadLetterRetryOptions{
+		From:     from,
+		To:       from.Add(time.Hour),
+		Entities: []string{"light.*", "sensor.*"},
+		Limit:    1,
+	})
+	require.NoError(t, err)
+
+	// The period is filtered by ClickHouse, entities and the limit while reading
+	query := sink.queries[len(sink.queries)-1]
+	assert.Contains(t, query, " WHERE failed_at >= fromUnixTimestamp64Milli(1704067200000) AND failed_at < fromUnixTimestamp64Milli(1704070800000) ORDER BY failed_at")
+	assert.NotContains(t, query, "LIMIT")
+	assert.Equal(t, map[string]*DeadLetterRetryTable{"hass.light": {Retried: 1, Recovered: 1}}, report.Tables)
+	assert.Equal(t, "ALTER TABLE hass.dead_letter DELETE WHERE cityHash64(destination_table, row, failed_at) IN (1)", sink.executed[len(sink.executed)-1])
+}
+
+func TestPipeline_RetryDeadLetterFileFilters(t *testing.T) {
+	ctx := context.Background()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(from.Add(-time.Minute))
+	sink := &deadLetterSink{}
+	p := NewPipeline(nil, sink, "hass", WithoutDDL(), WithDeadLetterDir(t.TempDir()), WithClock(clk))
+
+	// Dead letters failed before, within and after the period
+	for _, entityID := range []string{"light.before", "light.kitchen", "light.after"} {
+		require.NoError(t, p.writeDeadLetters(ctx, "hass", []DeadLetter{
+			{DestinationTable: "light", Row: `{"entity_id":"` + entityID + `","state":true}`, Error: "rejected"},
+		}))
+		require.NoError(t, p.writeDeadLetters(ctx, "hass", []DeadLetter{
+			{DestinationTable: "switch", Row: `{"entity_id":"switch.fan","state":false}`, Error: "rejected"},
+		}))
+		clk.Advance(time.Hour)
+	}
+
+	report, err := p.RetryDeadLetters(ctx, DeadLetterRetryOptions{From: from, To: from.Add(time.Hour), Entities: []string{"light.*"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*DeadLetterRetryTable{"hass.light": {Retried: 1, Recovered: 1}}, report.Tables)
+
+	// The dead letters not selected are kept
+	content, err := os.ReadFile(p.deadLetterFile("hass"))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 5)
+	assert.NotContains(t, string(content), "light.kitchen")
+}
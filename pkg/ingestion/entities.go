@@ -0,0 +1,306 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/pool"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+)
+
+const (
+	entitiesTableName = "entities"
+
+	// registryRetryInterval is the time after which a failed refresh of the entities table is retried
+	registryRetryInterval = 30 * time.Second
+)
+
+// registryEventTypes are the Home Assistant events refreshing the entities table
+var registryEventTypes = []hass.EventType{
+	hass.EventTypeEntityRegistryUpdated,
+	hass.EventTypeDeviceRegistryUpdated,
+	hass.EventTypeAreaRegistryUpdated,
+}
+
+// RegistrySource is optionally implemented by a Source able to list the entity, device and area registries,
+// e.g. *hass.Client. It is required by WithEntityMetadata.
+type RegistrySource interface {
+	EntityRegistry(ctx context.Context) ([]hass.EntityRegistryEntry, error)
+	DeviceRegistry(ctx context.Context) ([]hass.DeviceRegistryEntry, error)
+	AreaRegistry(ctx context.Context) ([]hass.AreaRegistryEntry, error)
+}
+
+// EntityMetadata is a row of the entities dimension table describing an entity
+type EntityMetadata struct {
+	EntityID     string `json:"entity_id"`
+	Domain       string `json:"domain"`
+	FriendlyName string `json:"friendly_name"`
+	Platform     string `json:"platform"`
+	DeviceID     string `json:"device_id"`
+	DeviceName   string `json:"device_name"`
+	Area         string `json:"area"`
+	DeviceClass  string `json:"device_class"`
+	Unit         string `json:"unit"`
+	UpdatedAt    string `json:"updated_at"`
+}
+
+// WithEntityMetadata maintains the entities table with the friendly name, device, area, device class and unit
+// of every entity, read from the entity, device and area registries and the current states. It is refreshed
+// whenever a registry is updated, so state change tables can be joined to the metadata of their entities.
+func WithEntityMetadata() PipelineOption {
+	return func(p *Pipeline) {
+		p.entityMetadata = &entityMetadata{}
+	}
+}
+
+// entityMetadata holds the rows last inserted into the entities table, so only changed ones are inserted again
+type entityMetadata struct {
+	rowsMtx sync.Mutex
+	rows    map[string]EntityMetadata
+}
+
+// changed returns the rows that differ from the ones last inserted
+func (m *entityMetadata) changed(rows []EntityMetadata) []EntityMetadata {
+	m.rowsMtx.Lock()
+	defer m.rowsMtx.Unlock()
+
+	var changed []EntityMetadata
+	for _, row := range rows {
+		if last, ok := m.rows[row.EntityID]; !ok || last != row {
+			changed = append(changed, row)
+		}
+	}
+	return changed
+}
+
+// inserted remembers the rows inserted into the entities table
+func (m *entityMetadata) inserted(rows []EntityMetadata) {
+	m.rowsMtx.Lock()
+	defer m.rowsMtx.Unlock()
+
+	if m.rows == nil {
+		m.rows = make(map[string]EntityMetadata, len(rows))
+	}
+	for _, row := range rows {
+		m.rows[row.EntityID] = row
+	}
+}
+
+// watchRegistries refreshes the entities table on start and whenever a registry is updated until the context is done.
+// Updates received during a refresh are coalesced into a single one, failed refreshes are retried.
+func (p *Pipeline) watchRegistries(ctx context.Context, source RegistrySource) error {
+	updates := make(chan struct{}, 1)
+	updates <- struct{}{}
+
+	for _, eventType := range registryEventTypes {
+		eventsChan, err := p.source.SubscribeEvents(ctx, hass.SubscribeEventsWithEventType(eventType))
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s events: %w", eventType, err)
+		}
+
+		go recovery.Run("pipeline_registry_"+string(eventType), func() {
+			for range eventsChan {
+				select {
+				case updates <- struct{}{}:
+				default:
+				}
+			}
+		})
+	}
+
+	go recovery.Run("pipeline_entities", func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-updates:
+				if err := p.refreshEntities(ctx, source); err != nil {
+					log.Error().Err(err).Msg("failed to refresh entity metadata")
+					p.clock.AfterFunc(registryRetryInterval, func() {
+						select {
+						case updates <- struct{}{}:
+						default:
+						}
+					})
+					continue
+				}
+				p.readiness.synced()
+			}
+		}
+	})
+
+	return nil
+}
+
+// refreshEntities reads the registries and the current states and inserts the changed metadata of entities
+func (p *Pipeline) refreshEntities(ctx context.Context, source RegistrySource) error {
+	// The registries and the states are read at the same time by a pool of workers
+	var (
+		entities []hass.EntityRegistryEntry
+		devices  []hass.DeviceRegistryEntry
+		areas    []hass.AreaRegistryEntry
+		states   []hass.State
+	)
+	reads := []func(ctx context.Context) error{
+		func(ctx context.Context) (err error) {
+			if entities, err = source.EntityRegistry(ctx); err != nil {
+				return fmt.Errorf("failed to list entity registry: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) (err error) {
+			if devices, err = source.DeviceRegistry(ctx); err != nil {
+				return fmt.Errorf("failed to list device registry: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) (err error) {
+			if areas, err = source.AreaRegistry(ctx); err != nil {
+				return fmt.Errorf("failed to list area registry: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) (err error) {
+			if states, err = p.source.GetStates(ctx); err != nil {
+				return fmt.Errorf("failed to get states: %w", err)
+			}
+			return nil
+		},
+	}
+	errs := make([]error, len(reads))
+	for i := range errs {
+		errs[i] = errRegistryNotRead
+	}
+	readers := pool.New(ctx, "registry_sync", len(reads), func(ctx context.Context, i int) error {
+		errs[i] = reads[i](ctx)
+		return errs[i]
+	})
+	for i := range reads {
+		if err := readers.Submit(ctx, i); err != nil {
+			break
+		}
+	}
+	readers.Close()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	// Every instance of a sharded deployment describes the entities it owns
+	var owned []EntityMetadata
+	for _, row := range entityMetadataRows(entities, devices, areas, states) {
+		if p.owns(row.EntityID) {
+			owned = append(owned, row)
+		}
+	}
+
+	changed := p.entityMetadata.changed(owned)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	rows := make([]any, 0, len(changed))
+	updatedAt := p.clock.Now().UTC().Format(time.RFC3339Nano)
+	for _, row := range changed {
+		row.UpdatedAt = updatedAt
+		rows = append(rows, row)
+	}
+
+	database, err := p.ensureTable(ctx, entitiesTableName, entitiesDDL)
+	if err != nil {
+		return fmt.Errorf("failed to create entities table: %w", err)
+	}
+
+	if err := p.insertBatch(ctx, newBatchID(), database, entitiesTableName, rows, 0, 0); err != nil {
+		return err
+	}
+	p.entityMetadata.inserted(changed)
+
+	log.Info().Int("entities", len(rows)).Msg("refreshed entity metadata")
+	return nil
+}
+
+// errRegistryNotRead is the error of registries whose read was canceled or panicked
+var errRegistryNotRead = errors.New("registry was not read")
+
+// entityMetadataRows joins the registries and the states into rows ordered by entity ID, without UpdatedAt.
+// Entities without a registry entry, e.g. ones configured in YAML, are described by their state only,
+// registered entities without a state, e.g. disabled ones, by their registry entry only.
+func entityMetadataRows(
+	entities []hass.EntityRegistryEntry,
+	devices []hass.DeviceRegistryEntry,
+	areas []hass.AreaRegistryEntry,
+	states []hass.State,
+) []EntityMetadata {
+	devicesByID := make(map[string]hass.DeviceRegistryEntry, len(devices))
+	for _, device := range devices {
+		devicesByID[device.ID] = device
+	}
+	areaNames := make(map[string]string, len(areas))
+	for _, area := range areas {
+		areaNames[area.AreaID] = area.Name
+	}
+
+	rows := make(map[string]*EntityMetadata, len(states))
+	row := func(entityID string) *EntityMetadata {
+		if r, ok := rows[entityID]; ok {
+			return r
+		}
+		domain, _, _ := strings.Cut(entityID, ".")
+		r := &EntityMetadata{EntityID: entityID, Domain: domain}
+		rows[entityID] = r
+		return r
+	}
+
+	for _, entity := range entities {
+		r := row(entity.EntityID)
+		r.FriendlyName = firstSet(entity.Name, entity.OriginalName)
+		r.Platform = entity.Platform
+		r.DeviceClass = firstSet(entity.DeviceClass, entity.OriginalDeviceClass)
+
+		areaID := firstSet(entity.AreaID)
+		if entity.DeviceID != nil {
+			device := devicesByID[*entity.DeviceID]
+			r.DeviceID = *entity.DeviceID
+			r.DeviceName = firstSet(device.NameByUser, device.Name)
+			// Entities are in the area of their device unless assigned to another one
+			areaID = firstSet(entity.AreaID, device.AreaID)
+		}
+		r.Area = areaNames[areaID]
+	}
+
+	for i := range states {
+		attrs := parseStateAttributes(&states[i])
+		r := row(states[i].EntityID)
+		// The friendly name of the state includes the name of the device, like the Home Assistant UI shows it
+		r.FriendlyName = firstNonEmpty(attrs.FriendlyName, r.FriendlyName)
+		r.DeviceClass = firstNonEmpty(r.DeviceClass, attrs.DeviceClass)
+		r.Unit = attrs.UnitOfMeasurement
+	}
+
+	result := make([]EntityMetadata, 0, len(rows))
+	for _, r := range rows {
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].EntityID < result[j].EntityID
+	})
+	return result
+}
+
+// firstSet returns the first non-nil and non-empty value
+func firstSet(values ...*string) string {
+	for _, v := range values {
+		if v != nil && *v != "" {
+			return *v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+// registrySource serves fixed registries and states
+type registrySource struct {
+	Source
+	entities []hass.EntityRegistryEntry
+	devices  []hass.DeviceRegistryEntry
+	areas    []hass.AreaRegistryEntry
+	states   []hass.State
+}
+
+func (s *registrySource) EntityRegistry(context.Context) ([]hass.EntityRegistryEntry, error) {
+	return s.entities, nil
+}
+
+func (s *registrySource) DeviceRegistry(context.Context) ([]hass.DeviceRegistryEntry, error) {
+	return s.devices, nil
+}
+
+func (s *registrySource) AreaRegistry(context.Context) ([]hass.AreaRegistryEntry, error) {
+	return s.areas, nil
+}
+
+func (s *registrySource) GetStates(context.Context) ([]hass.State, error) {
+	return s.states, nil
+}
+
+func TestPipeline_RefreshEntities(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+	source := &registrySource{
+		entities: []hass.EntityRegistryEntry{
+			{EntityID: "sensor.kitchen_temperature", Platform: "zha", DeviceID: ptr("dev1"), OriginalDeviceClass: ptr("temperature")},
+			{EntityID: "light.hallway", Platform: "hue", AreaID: ptr("hallway"), Name: ptr("Hallway")},
+		},
+		devices: []hass.DeviceRegistryEntry{{ID: "dev1", Name: ptr("Thermometer"), NameByUser: ptr("Kitchen thermometer"), AreaID: ptr("kitchen")}},
+		areas:   []hass.AreaRegistryEntry{{AreaID: "kitchen", Name: "Kitchen"}, {AreaID: "hallway", Name: "Hallway"}},
+		states: []hass.State{
+			{EntityID: "sensor.kitchen_temperature", Attributes: []byte(`{"friendly_name":"Kitchen thermometer Temperature","unit_of_measurement":"°C"}`)},
+			{EntityID: "sun.sun", Attributes: []byte(`{"friendly_name":"Sun"}`)},
+		},
+	}
+	sink := &outageSink{}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewPipeline(source, sink, "hass", WithoutDDL(), WithClock(clock.NewFake(now)), WithEntityMetadata())
+	require.NoError(t, p.refreshEntities(context.Background(), source))
+
+	require.Len(t, sink.inserted, 1)
+	assert.Equal(t, "hass.entities FORMAT JSONEachRow "+
+		`{"entity_id":"light.hallway","domain":"light","friendly_name":"Hallway","platform":"hue","device_id":"","device_name":"","area":"Hallway","device_class":"","unit":"","updated_at":"2024-01-01T00:00:00Z"}`+"\n"+
+		`{"entity_id":"sensor.kitchen_temperature","domain":"sensor","friendly_name":"Kitchen thermometer Temperature","platform":"zha","device_id":"dev1","device_name":"Kitchen thermometer","area":"Kitchen","device_class":"temperature","unit":"°C","updated_at":"2024-01-01T00:00:00Z"}`+"\n"+
+		`{"entity_id":"sun.sun","domain":"sun","friendly_name":"Sun","platform":"","device_id":"","device_name":"","area":"","device_class":"","unit":"","updated_at":"2024-01-01T00:00:00Z"}`,
+		sink.inserted[0])
+
+	// Only entities whose metadata changed are inserted again
+	source.areas[0].Name = "Kitchen & Dining"
+	require.NoError(t, p.refreshEntities(context.Background(), source))
+	require.Len(t, sink.inserted, 2)
+	assert.Contains(t, sink.inserted[1], `"entity_id":"sensor.kitchen_temperature"`)
+	assert.NotContains(t, sink.inserted[1], `"entity_id":"sun.sun"`)
+}
+
+// failingRegistrySource fails to list the device registry and panics listing the area registry
+type failingRegistrySource struct {
+	registrySource
+}
+
+func (s *failingRegistrySource) DeviceRegistry(context.Context) ([]hass.DeviceRegistryEntry, error) {
+	return nil, errors.New("connection lost")
+}
+
+func (s *failingRegistrySource) AreaRegistry(context.Context) ([]hass.AreaRegistryEntry, error) {
+	panic("unexpected message")
+}
+
+func TestPipeline_RefreshEntitiesFailedRead(t *testing.T) {
+	source := &failingRegistrySource{}
+	p := NewPipeline(source, &outageSink{}, "hass", WithoutDDL(), WithEntityMetadata())
+
+	// Registries are read concurrently, every failed or panicking read fails the refresh
+	err := p.refreshEntities(context.Background(), source)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "failed to list device registry: connection lost")
+	assert.ErrorIs(t, err, errRegistryNotRead)
+}
@@ -0,0 +1,57 @@
+package ingestion
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+const (
+	eventHashColumnName = "event_hash"
+	eventHashColumn     = "event_hash UInt64 DEFAULT 0"
+)
+
+// EventHashConfig configures the event_hash column
+type EventHashConfig struct {
+	// Deduplicate creates new state change tables with the ReplacingMergeTree engine and event_hash
+	// in the sorting key, so rows ingested repeatedly are collapsed in background merges
+	Deduplicate bool
+}
+
+// WithEventHash adds the event_hash column to state change tables: a hash of the entity ID, state,
+// last_updated and context ID of the state change. A state change ingested again, e.g. by a replay
+// or a backfill, has the same hash, so duplicates can be told apart or deduplicated by the table engine.
+func WithEventHash(conf EventHashConfig) PipelineOption {
+	return func(p *Pipeline) {
+		p.eventHash = &conf
+		p.transformers = append(p.transformers, eventHasher{})
+	}
+}
+
+type eventHasher struct{}
+
+func (eventHasher) Transform(event *hass.EventMessage, change *StateChange) {
+	change.EventHash = eventHash(event.Event.Data.NewState)
+}
+
+func (eventHasher) Columns(string) []string {
+	return []string{eventHashColumn}
+}
+
+// eventHash hashes the fields identifying a state change, independent of how it was ingested
+func eventHash(state *hass.State) uint64 {
+	if state == nil {
+		return 0
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(strings.Join([]string{
+		state.EntityID,
+		state.State,
+		state.LastUpdated.UTC().Format(time.RFC3339Nano),
+		state.Context.ID,
+	}, "\x00")))
+	return h.Sum64()
+}
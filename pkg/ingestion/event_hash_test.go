@@ -0,0 +1,36 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestEventHash(t *testing.T) {
+	lastUpdated := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	state := &hass.State{EntityID: "light.kitchen", State: "on", LastUpdated: lastUpdated, Context: hass.EventContext{ID: "ctx"}}
+
+	same := *state
+	same.LastUpdated = lastUpdated.In(time.FixedZone("CET", 3600))
+	assert.Equal(t, eventHash(state), eventHash(&same))
+
+	other := *state
+	other.State = "off"
+	assert.NotEqual(t, eventHash(state), eventHash(&other))
+	assert.Zero(t, eventHash(nil))
+}
+
+func TestPipeline_StateChangeDDLEventHash(t *testing.T) {
+	p := NewPipeline(nil, nil, "hass", WithEventHash(EventHashConfig{Deduplicate: true}))
+
+	ddl, err := p.stateChangeDDL(RowModelV2, "hass", "light_v2", "light", "Bool")
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "event_hash UInt64 DEFAULT 0\n)")
+	assert.Contains(t, ddl, "ENGINE = ReplacingMergeTree()")
+	assert.Contains(t, ddl, "ORDER BY (entity_id, last_updated, event_hash)")
+	assert.Contains(t, parseDDLColumns(ddl), eventHashColumn)
+}
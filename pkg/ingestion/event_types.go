@@ -0,0 +1,222 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/channel"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+)
+
+// eventColumn is a column of an event table populated from a field of the event data
+type eventColumn struct {
+	name string
+	typ  string
+}
+
+// eventSchema is the schema of the table of an event type on top of the common event columns
+type eventSchema struct {
+	columns []eventColumn
+	orderBy string
+}
+
+// eventSchemas are the schemas of event types with well-known data, other event types only get the data column
+var eventSchemas = map[hass.EventType]eventSchema{
+	"call_service": {
+		columns: []eventColumn{
+			{name: "domain", typ: "LowCardinality(String)"},
+			{name: "service", typ: "LowCardinality(String)"},
+			{name: "service_data", typ: "String CODEC(ZSTD(3))"},
+		},
+		orderBy: "(domain, service, time_fired)",
+	},
+	"automation_triggered": {
+		columns: []eventColumn{
+			{name: "entity_id", typ: "LowCardinality(String)"},
+			{name: "name", typ: "String"},
+			{name: "source", typ: "String"},
+		},
+		orderBy: "(entity_id, time_fired)",
+	},
+	"script_started": {
+		columns: []eventColumn{
+			{name: "entity_id", typ: "LowCardinality(String)"},
+			{name: "name", typ: "String"},
+		},
+		orderBy: "(entity_id, time_fired)",
+	},
+}
+
+var genericEventSchema = eventSchema{orderBy: "time_fired"}
+
+// WithEventTypes ingests events of other types than state_changed, each into a table named after the
+// event type, e.g. call_service. Well-known event types get columns of their data fields,
+// all of them store the whole event data as JSON in the data column.
+func WithEventTypes(eventTypes ...hass.EventType) PipelineOption {
+	return func(p *Pipeline) {
+		for _, eventType := range eventTypes {
+			if eventType != hass.EventTypeStateChanged {
+				p.eventTypes = append(p.eventTypes, eventType)
+			}
+		}
+	}
+}
+
+// eventTableName returns the name of the table of an event type, e.g. ios.action_fired is stored in ios_action_fired
+func eventTableName(eventType hass.EventType) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(string(eventType)))
+}
+
+func schemaOfEvent(eventType hass.EventType) eventSchema {
+	if schema, ok := eventSchemas[eventType]; ok {
+		return schema
+	}
+	return genericEventSchema
+}
+
+// eventDDL returns the DDL of the table of an event type, formatted with the database and table name
+func eventDDL(eventType hass.EventType) string {
+	schema := schemaOfEvent(eventType)
+
+	var columns strings.Builder
+	for _, column := range schema.columns {
+		fmt.Fprintf(&columns, ",\n    %s %s", column.name, column.typ)
+	}
+	return strings.NewReplacer("{columns}", columns.String(), "{order_by}", schema.orderBy).Replace(eventsDDL)
+}
+
+// eventRow returns the row of an event. Fields of the data not stored as strings are stored as JSON.
+func eventRow(event *hass.EventMessage) map[string]any {
+	e := event.Event
+	data := string(e.RawData)
+	if data == "" {
+		data = "{}"
+	}
+
+	row := map[string]any{
+		"event_type":        string(e.EventType),
+		"time_fired":        e.TimeFired.UTC().Format(time.RFC3339Nano),
+		"origin":            e.Origin,
+		"context_id":        e.Context.ID,
+		"context_user_id":   e.Context.UserID,
+		"context_parent_id": e.Context.ParentID,
+		"data":              data,
+	}
+
+	schema := schemaOfEvent(e.EventType)
+	if len(schema.columns) == 0 {
+		return row
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(e.RawData, &fields); err != nil {
+		log.Debug().Err(err).Str("event_type", string(e.EventType)).Msg("event data is not an object")
+	}
+	for _, column := range schema.columns {
+		field, ok := fields[column.name]
+		if !ok {
+			continue
+		}
+
+		var s string
+		if err := json.Unmarshal(field, &s); err == nil {
+			row[column.name] = s
+		} else {
+			row[column.name] = string(field)
+		}
+	}
+
+	return row
+}
+
+// watchEventTypes subscribes to the additional event types and inserts their events in batches per event type
+func (p *Pipeline) watchEventTypes(ctx context.Context) error {
+	events := make(chan *hass.EventMessage, p.eventBuffer)
+	for _, eventType := range p.eventTypes {
+		eventsChan, err := p.source.SubscribeEvents(ctx, hass.SubscribeEventsWithEventType(eventType))
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s events: %w", eventType, err)
+		}
+
+		go recovery.Run("pipeline_events_"+string(eventType), func() {
+			for event := range eventsChan {
+				metrics.EventTypeEventsReceived.WithLabelValues(string(event.Event.EventType)).Inc()
+
+				// Every instance of a sharded deployment sees the event, only the first one stores it
+				if p.shard != nil && p.shard.Index != 0 {
+					p.ack([]*hass.EventMessage{event})
+					continue
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+
+	batches, errChan := channel.Batch(events, channel.BatchOptions[*hass.EventMessage]{
+		MaxSize: p.batchSize,
+		MaxWait: p.batchWait,
+		Align:   p.batchAlign,
+		PartitionBy: func(event *hass.EventMessage) (string, error) {
+			return string(event.Event.EventType), nil
+		},
+		Clock: p.clock,
+	})
+
+	go recovery.Run("pipeline_events", func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-errChan:
+				if ok {
+					log.Error().Err(err).Msg("failed to batch events")
+				}
+			case batch, ok := <-batches:
+				if !ok {
+					return
+				}
+				p.insertEvents(ctx, batch)
+			}
+		}
+	})
+
+	return nil
+}
+
+// insertEvents inserts a batch of events of a single event type into its table
+func (p *Pipeline) insertEvents(ctx context.Context, batch []*hass.EventMessage) {
+	eventType := batch[0].Event.EventType
+	tableName := eventTableName(eventType)
+
+	database, err := p.ensureTable(ctx, tableName, eventDDL(eventType))
+	if err != nil {
+		log.Error().Err(err).Str("table", tableName).Int("rows", len(batch)).Msg("failed to create event table")
+		return
+	}
+
+	rows := make([]any, 0, len(batch))
+	for _, event := range batch {
+		rows = append(rows, eventRow(event))
+	}
+
+	if err := p.insertBatch(ctx, newBatchID(), database, tableName, rows, len(rows), 0); err == nil {
+		p.ack(batch)
+	}
+}
@@ -0,0 +1,37 @@
+package ingestion
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestEventTableName(t *testing.T) {
+	assert.Equal(t, "call_service", eventTableName("call_service"))
+	assert.Equal(t, "ios_action_fired", eventTableName("ios.action_fired"))
+}
+
+func TestEventRow(t *testing.T) {
+	raw := []byte(`{"id":3,"type":"event","event":{"event_type":"call_service","time_fired":"2026-01-02T03:04:05.678Z","origin":"LOCAL",` +
+		`"context":{"id":"ctx","parent_id":null,"user_id":"user"},"data":{"domain":"light","service":"turn_on","service_data":{"brightness":255}}}}`)
+	msg, err := hass.UnmarshalMessage(raw)
+	require.NoError(t, err)
+
+	row := eventRow(msg.(*hass.EventMessage))
+	assert.Equal(t, "call_service", row["event_type"])
+	assert.Equal(t, time.Date(2026, 1, 2, 3, 4, 5, 678_000_000, time.UTC).Format(time.RFC3339Nano), row["time_fired"])
+	assert.Equal(t, "light", row["domain"])
+	assert.Equal(t, "turn_on", row["service"])
+	assert.Equal(t, `{"brightness":255}`, row["service_data"])
+	assert.JSONEq(t, `{"domain":"light","service":"turn_on","service_data":{"brightness":255}}`, row["data"].(string))
+
+	ddl := fmt.Sprintf(eventDDL("call_service"), "hass", "call_service")
+	assert.Contains(t, ddl, "service_data String CODEC(ZSTD(3)),\n    data String")
+	assert.Contains(t, ddl, "ORDER BY (domain, service, time_fired)")
+	assert.Contains(t, fmt.Sprintf(eventDDL("zha_event"), "hass", "zha_event"), "ORDER BY time_fired")
+}
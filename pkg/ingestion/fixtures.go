@@ -0,0 +1,239 @@
+package ingestion
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+// fixtureDatabase is the database of fixtures, they are resolved by a pipeline with the default configuration
+const fixtureDatabase = "hass"
+
+// Fixture is a golden file of a state change event and the table, row and DDL the default pipeline
+// resolves it to. Fixtures recorded from real installs reproduce schema bugs in the test suite.
+type Fixture struct {
+	Event *hass.EventMessage `json:"event"`
+	Table string             `json:"table,omitempty"`
+	Row   json.RawMessage    `json:"row,omitempty"`
+	DDL   string             `json:"ddl,omitempty"`
+	Error string             `json:"error,omitempty"`
+}
+
+// newFixture resolves an event with a pipeline with the default configuration
+func newFixture(event *hass.EventMessage) (*Fixture, error) {
+	p := NewPipeline(nil, nil, fixtureDatabase, WithoutDDL())
+	row := p.resolveRow(event)
+
+	fixture := &Fixture{Event: event, Table: row.Table}
+	if row.Err != nil {
+		fixture.Error = row.Err.Error()
+		return fixture, nil
+	}
+
+	var err error
+	if fixture.Row, err = json.Marshal(row.Input); err != nil {
+		return nil, fmt.Errorf("failed to marshal row: %w", err)
+	}
+
+	domain := extractDomainFromState(event.Event.Data.NewState)
+	fixture.DDL, err = p.stateChangeDDL(RowModelV1, fixtureDatabase, row.Table, domain, p.stateTypeOf(domain))
+	if err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+// FixtureRecorder samples anonymized state change events into fixtures, one per destination table
+// and one per distinct error
+type FixtureRecorder struct {
+	dir  string
+	salt []byte
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// NewFixtureRecorder creates a recorder writing fixtures to dir
+func NewFixtureRecorder(dir string) (*FixtureRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create fixtures directory: %w", err)
+	}
+
+	// Identifiers are hashed with a random salt, so they cannot be recovered by hashing guesses
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate anonymization salt: %w", err)
+	}
+
+	return &FixtureRecorder{dir: dir, salt: salt, seen: make(map[string]bool)}, nil
+}
+
+// Record anonymizes the event and writes its fixture, unless a fixture of its table or error has been
+// written already. It returns the path of the fixture, empty if the event has not been sampled.
+func (r *FixtureRecorder) Record(event *hass.EventMessage) (string, error) {
+	if event.Event.EventType != hass.EventTypeStateChanged || event.Event.Data.NewState == nil {
+		return "", nil
+	}
+
+	anonymized, err := r.anonymizeEvent(event)
+	if err != nil {
+		return "", err
+	}
+	fixture, err := newFixture(anonymized)
+	if err != nil {
+		return "", err
+	}
+
+	key, name := "table:"+fixture.Table, fixture.Table
+	if fixture.Error != "" {
+		key, name = "error:"+fixture.Error, "error_"+r.hash(fixture.Error)
+	}
+
+	r.mu.Lock()
+	seen := r.seen[key]
+	r.seen[key] = true
+	r.mu.Unlock()
+	if seen {
+		return "", nil
+	}
+
+	content, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal fixture: %w", err)
+	}
+
+	path := filepath.Join(r.dir, name+".json")
+	if err := os.WriteFile(path, append(content, '\n'), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write fixture: %w", err)
+	}
+	return path, nil
+}
+
+// keptAttributes are attributes shaping the schema, kept as they are
+var keptAttributes = map[string]bool{
+	"device_class":        true,
+	"state_class":         true,
+	"unit_of_measurement": true,
+	"supported_features":  true,
+	"icon":                true,
+}
+
+// zeroedAttributes are numeric attributes revealing where people are
+var zeroedAttributes = map[string]bool{
+	"latitude":     true,
+	"longitude":    true,
+	"gps_accuracy": true,
+}
+
+// freeTextDomains are domains whose states may contain personal data, e.g. the zone a person is in
+var freeTextDomains = map[string]bool{
+	hass.EntityPerson:        true,
+	hass.EntityDeviceTracker: true,
+	"input_text":             true,
+	"text":                   true,
+}
+
+// anonymizeEvent returns a copy of the event with identifiers, free-text states and string attributes
+// replaced by salted hashes. Domains, numbers and the structure of attributes are kept, as they shape the rows.
+func (r *FixtureRecorder) anonymizeEvent(event *hass.EventMessage) (*hass.EventMessage, error) {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy event: %w", err)
+	}
+	anonymized := &hass.EventMessage{}
+	if err := json.Unmarshal(raw, anonymized); err != nil {
+		return nil, fmt.Errorf("failed to copy event: %w", err)
+	}
+
+	e := &anonymized.Event
+	r.anonymizeContext(&e.Context)
+	e.Data.EntityID = r.anonymizeEntityID(e.Data.EntityID)
+	for _, state := range []*hass.State{e.Data.OldState, e.Data.NewState} {
+		if state == nil {
+			continue
+		}
+
+		domain, _, _ := strings.Cut(state.EntityID, ".")
+		state.EntityID = r.anonymizeEntityID(state.EntityID)
+		if freeTextDomains[domain] {
+			state.State = r.hash(state.State)
+		}
+		r.anonymizeContext(&state.Context)
+
+		if len(state.Attributes) > 0 {
+			var attributes any
+			if err := json.Unmarshal(state.Attributes, &attributes); err != nil {
+				return nil, fmt.Errorf("failed to decode attributes: %w", err)
+			}
+			if state.Attributes, err = json.Marshal(r.anonymizeValue("", attributes)); err != nil {
+				return nil, fmt.Errorf("failed to encode attributes: %w", err)
+			}
+		}
+	}
+
+	return anonymized, nil
+}
+
+func (r *FixtureRecorder) anonymizeValue(key string, value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, nested := range v {
+			v[k] = r.anonymizeValue(k, nested)
+		}
+		return v
+	case []any:
+		for i, nested := range v {
+			v[i] = r.anonymizeValue(key, nested)
+		}
+		return v
+	case string:
+		if keptAttributes[key] {
+			return v
+		}
+		return r.hash(v)
+	case float64:
+		if zeroedAttributes[key] {
+			return 0
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func (r *FixtureRecorder) anonymizeContext(c *hass.EventContext) {
+	c.ID = r.hash(c.ID)
+	for _, id := range []*string{c.ParentID, c.UserID} {
+		if id != nil {
+			*id = r.hash(*id)
+		}
+	}
+}
+
+// anonymizeEntityID hashes the object ID of an entity, keeping the domain the table depends on
+func (r *FixtureRecorder) anonymizeEntityID(entityID string) string {
+	domain, objectID, ok := strings.Cut(entityID, ".")
+	if !ok {
+		return r.hash(entityID)
+	}
+	return domain + "." + r.hash(objectID)
+}
+
+func (r *FixtureRecorder) hash(s string) string {
+	if s == "" {
+		return ""
+	}
+	h := sha256.New()
+	h.Write(r.salt)
+	h.Write([]byte(s))
+	return "anon_" + hex.EncodeToString(h.Sum(nil))[:12]
+}
@@ -0,0 +1,84 @@
+package ingestion
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+var updateFixtures = flag.Bool("update", false, "update the rows and DDL of fixtures in testdata/fixtures")
+
+// TestFixtures resolves the events of fixtures, e.g. recorded with --record-fixtures, and compares
+// the results with the golden rows and DDL
+func TestFixtures(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "fixtures", "*.json"))
+	require.NoError(t, err)
+
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".json"), func(t *testing.T) {
+			content, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			var want Fixture
+			require.NoError(t, json.Unmarshal(content, &want))
+
+			got, err := newFixture(want.Event)
+			require.NoError(t, err)
+
+			if *updateFixtures {
+				content, err := json.MarshalIndent(got, "", "  ")
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(path, append(content, '\n'), 0o644))
+				return
+			}
+
+			assert.Equal(t, want.Table, got.Table)
+			assert.Equal(t, want.Error, got.Error)
+			assert.Equal(t, want.DDL, got.DDL)
+			if want.Row != nil {
+				assert.JSONEq(t, string(want.Row), string(got.Row))
+			}
+		})
+	}
+}
+
+func TestFixtureRecorder(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "..", "test", "assets", "state_changed.json"))
+	require.NoError(t, err)
+	msg, err := hass.UnmarshalMessage(content)
+	require.NoError(t, err)
+	event := msg.(*hass.EventMessage)
+
+	dir := t.TempDir()
+	r, err := NewFixtureRecorder(dir)
+	require.NoError(t, err)
+
+	path, err := r.Record(event)
+	require.NoError(t, err)
+	require.NotEmpty(t, path)
+
+	// A single fixture is sampled per table
+	again, err := r.Record(event)
+	require.NoError(t, err)
+	assert.Empty(t, again)
+
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	var fixture Fixture
+	require.NoError(t, json.Unmarshal(content, &fixture))
+
+	assert.True(t, strings.HasPrefix(fixture.Event.Event.Data.EntityID, "sensor.anon_"))
+	assert.NotContains(t, string(content), "sensor.temperature")
+	assert.NotContains(t, string(content), "0x54ef44100028dcdc")
+	assert.Equal(t, event.Event.Data.NewState.State, fixture.Event.Event.Data.NewState.State)
+	assert.NotEmpty(t, fixture.DDL)
+	assert.NotEmpty(t, fixture.Row)
+}
@@ -0,0 +1,330 @@
+package ingestion
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+const (
+	flapCountColumn   = "flap_count UInt32 DEFAULT 0"
+	flapStartedColumn = "flap_started Nullable(DateTime64(3, 'UTC'))"
+
+	// flapCheckInterval is how often flapping entities are checked for having settled
+	flapCheckInterval = time.Second
+)
+
+// FlapLimit defines flapping of an entity: at least Threshold state transitions within Window
+type FlapLimit struct {
+	Window    time.Duration
+	Threshold int
+}
+
+// FlapConfig configures flap detection. Entity limits take precedence over domain limits.
+type FlapConfig struct {
+	Domains  map[string]FlapLimit
+	Entities map[string]FlapLimit
+
+	// Collapse replaces the state changes of a flapping entity with a single row of its final state,
+	// stored once the entity has settled with the number of transitions in flap_count
+	Collapse bool
+}
+
+// ParseFlapConfig parses limits in the form of "key=window:threshold,key=window:threshold".
+// Keys containing a dot are entity IDs, other keys are domains (e.g. binary_sensor).
+func ParseFlapConfig(s string) (FlapConfig, error) {
+	conf := FlapConfig{
+		Domains:  make(map[string]FlapLimit),
+		Entities: make(map[string]FlapLimit),
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return conf, fmt.Errorf("invalid flap limit %q: expected key=window:threshold", part)
+		}
+
+		windowValue, thresholdValue, ok := strings.Cut(strings.TrimSpace(value), ":")
+		if !ok {
+			return conf, fmt.Errorf("invalid flap limit %q: expected key=window:threshold", part)
+		}
+
+		window, err := time.ParseDuration(windowValue)
+		if err != nil || window <= 0 {
+			return conf, fmt.Errorf("invalid flap window %q", windowValue)
+		}
+
+		threshold, err := strconv.Atoi(thresholdValue)
+		if err != nil || threshold < 2 {
+			return conf, fmt.Errorf("invalid flap threshold %q: expected at least 2", thresholdValue)
+		}
+
+		limit := FlapLimit{Window: window, Threshold: threshold}
+		if key = strings.TrimSpace(key); strings.Contains(key, ".") {
+			conf.Entities[key] = limit
+		} else {
+			conf.Domains[key] = limit
+		}
+	}
+
+	return conf, nil
+}
+
+// WithFlapDetection detects entities rapidly flapping between states, e.g. flaky binary sensors,
+// and optionally collapses their state changes, see FlapConfig.Collapse
+func WithFlapDetection(conf FlapConfig) PipelineOption {
+	return func(p *Pipeline) {
+		// The clock is read through the pipeline, as WithClock may be applied after this option
+		p.flaps = newFlapDetector(conf, func() time.Time { return p.clock.Now() })
+		// State changes collapsed into a row are acknowledged once the row is stored
+		p.flaps.keepSuperseded = p.acker != nil
+		p.filters = append(p.filters, p.flaps)
+		p.transformers = append(p.transformers, p.flaps)
+	}
+}
+
+type flapSummary struct {
+	count   int
+	started time.Time
+}
+
+type flapEntity struct {
+	limit FlapLimit
+
+	// transitions within the window, until the entity starts flapping
+	transitions []time.Time
+
+	flapping       bool
+	flapSummary    flapSummary
+	lastTransition time.Time
+	last           *hass.EventMessage
+	// superseded are the held back state changes before last, if kept to be acknowledged
+	superseded []*hass.EventMessage
+}
+
+// flapDetector tracks recent state transitions of entities with a flap limit
+type flapDetector struct {
+	conf FlapConfig
+	now  func() time.Time
+	// keepSuperseded keeps the held back state changes replaced by a later one, to be acknowledged with it
+	keepSuperseded bool
+
+	entitiesMtx sync.Mutex
+	entities    map[string]*flapEntity
+	collapsed   map[*hass.EventMessage]flapSummary
+	// heldBack are the state changes held back by Allow, until the pipeline checks why they were not allowed
+	heldBack map[*hass.EventMessage]struct{}
+	// superseded are the held back state changes collapsed into a released one
+	superseded map[*hass.EventMessage][]*hass.EventMessage
+}
+
+func newFlapDetector(conf FlapConfig, now func() time.Time) *flapDetector {
+	return &flapDetector{
+		conf:       conf,
+		now:        now,
+		entities:   make(map[string]*flapEntity),
+		collapsed:  make(map[*hass.EventMessage]flapSummary),
+		heldBack:   make(map[*hass.EventMessage]struct{}),
+		superseded: make(map[*hass.EventMessage][]*hass.EventMessage),
+	}
+}
+
+func (d *flapDetector) limit(entityID string) (FlapLimit, bool) {
+	if limit, ok := d.conf.Entities[entityID]; ok {
+		return limit, true
+	}
+
+	domain, _, _ := strings.Cut(entityID, ".")
+	limit, ok := d.conf.Domains[domain]
+	return limit, ok
+}
+
+func (d *flapDetector) stageName() string {
+	return StageFlapDetection
+}
+
+// Allow records the state change event and reports whether it should be stored.
+// Only state changes of flapping entities are held back, and only if collapsing is enabled.
+func (d *flapDetector) Allow(event *hass.EventMessage) bool {
+	data := event.Event.Data
+	if data.NewState == nil || data.OldState == nil || data.NewState.State == data.OldState.State {
+		return true
+	}
+
+	limit, ok := d.limit(data.EntityID)
+	if !ok {
+		return true
+	}
+
+	d.entitiesMtx.Lock()
+	defer d.entitiesMtx.Unlock()
+
+	now := d.now()
+	entity, ok := d.entities[data.EntityID]
+	if !ok {
+		entity = &flapEntity{limit: limit}
+		d.entities[data.EntityID] = entity
+	}
+	entity.lastTransition = now
+
+	if entity.flapping {
+		entity.flapSummary.count++
+		if d.conf.Collapse {
+			d.holdBack(entity, event)
+			return false
+		}
+		entity.last = event
+		return true
+	}
+
+	transitions := entity.transitions[:0]
+	for _, t := range entity.transitions {
+		if now.Sub(t) < limit.Window {
+			transitions = append(transitions, t)
+		}
+	}
+	entity.transitions = append(transitions, now)
+
+	if len(entity.transitions) < limit.Threshold {
+		return true
+	}
+
+	entity.flapping = true
+	entity.flapSummary = flapSummary{count: len(entity.transitions), started: entity.transitions[0]}
+	entity.transitions = nil
+
+	metrics.FlapsDetected.WithLabelValues(data.EntityID).Inc()
+	log.Warn().
+		Str("entity_id", data.EntityID).
+		Int("transitions", entity.flapSummary.count).
+		Dur("window", limit.Window).
+		Msg("entity is flapping")
+
+	// Transitions before the threshold was reached have already been stored
+	if d.conf.Collapse {
+		entity.flapSummary.count = 1
+		d.holdBack(entity, event)
+		return false
+	}
+	entity.last = event
+	return true
+}
+
+// holdBack makes the state change the last one of a flapping entity, to be released once it settles.
+// The caller holds the lock.
+func (d *flapDetector) holdBack(entity *flapEntity, event *hass.EventMessage) {
+	if d.keepSuperseded && entity.last != nil {
+		entity.superseded = append(entity.superseded, entity.last)
+	}
+	entity.last = event
+	d.heldBack[event] = struct{}{}
+}
+
+// wasHeldBack reports whether the state change not allowed by the filters was held back by Allow,
+// so it is not acknowledged before the row it is collapsed into is stored
+func (d *flapDetector) wasHeldBack(event *hass.EventMessage) bool {
+	d.entitiesMtx.Lock()
+	defer d.entitiesMtx.Unlock()
+	_, ok := d.heldBack[event]
+	delete(d.heldBack, event)
+	return ok
+}
+
+// takeSuperseded returns the held back state changes collapsed into the released ones among the events,
+// to be acknowledged once they are stored. A nil detector has none.
+func (d *flapDetector) takeSuperseded(events []*hass.EventMessage) []*hass.EventMessage {
+	if d == nil || !d.keepSuperseded {
+		return nil
+	}
+
+	d.entitiesMtx.Lock()
+	defer d.entitiesMtx.Unlock()
+
+	var superseded []*hass.EventMessage
+	for _, event := range events {
+		if held, ok := d.superseded[event]; ok {
+			superseded = append(superseded, held...)
+			delete(d.superseded, event)
+		}
+	}
+	return superseded
+}
+
+// settle ends flapping of entities without a transition for their window. If collapsing is enabled,
+// the last held back state change of every settled entity is returned to be stored.
+func (d *flapDetector) settle(now time.Time) []*hass.EventMessage {
+	d.entitiesMtx.Lock()
+	defer d.entitiesMtx.Unlock()
+
+	var events []*hass.EventMessage
+	for entityID, entity := range d.entities {
+		if now.Sub(entity.lastTransition) < entity.limit.Window {
+			continue
+		}
+		delete(d.entities, entityID)
+
+		if !entity.flapping {
+			continue
+		}
+
+		log.Info().
+			Str("entity_id", entityID).
+			Int("transitions", entity.flapSummary.count).
+			Time("started", entity.flapSummary.started).
+			Msg("entity stopped flapping")
+
+		if d.conf.Collapse {
+			metrics.FlapStateChangesCollapsed.WithLabelValues(entityID).Add(float64(entity.flapSummary.count - 1))
+			d.collapsed[entity.last] = entity.flapSummary
+			if len(entity.superseded) > 0 {
+				d.superseded[entity.last] = entity.superseded
+			}
+			events = append(events, entity.last)
+		}
+	}
+
+	return events
+}
+
+// released reports whether the state change was held back and has been released by settle, so it is not passed
+// through the filters again, e.g. dropped by a rate limit or recorded as another transition
+func (d *flapDetector) released(event *hass.EventMessage) bool {
+	d.entitiesMtx.Lock()
+	defer d.entitiesMtx.Unlock()
+	_, ok := d.collapsed[event]
+	return ok
+}
+
+func (d *flapDetector) Columns(string) []string {
+	if !d.conf.Collapse {
+		return nil
+	}
+	return []string{flapCountColumn, flapStartedColumn}
+}
+
+func (d *flapDetector) Transform(event *hass.EventMessage, change *StateChange) {
+	d.entitiesMtx.Lock()
+	summary, ok := d.collapsed[event]
+	delete(d.collapsed, event)
+	d.entitiesMtx.Unlock()
+
+	if !ok {
+		return
+	}
+
+	started := summary.started.UTC().Format(time.RFC3339Nano)
+	change.FlapCount = summary.count
+	change.FlapStarted = &started
+}
@@ -0,0 +1,173 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+func TestParseFlapConfig(t *testing.T) {
+	conf, err := ParseFlapConfig("binary_sensor=10s:5, binary_sensor.door=1m:3")
+	require.NoError(t, err)
+	assert.Equal(t, FlapLimit{Window: 10 * time.Second, Threshold: 5}, conf.Domains["binary_sensor"])
+	assert.Equal(t, FlapLimit{Window: time.Minute, Threshold: 3}, conf.Entities["binary_sensor.door"])
+
+	_, err = ParseFlapConfig("binary_sensor=10s:1")
+	assert.Error(t, err)
+}
+
+func TestFlapDetector_Collapse(t *testing.T) {
+	now := time.Now()
+	detector := newFlapDetector(FlapConfig{
+		Domains:  map[string]FlapLimit{"binary_sensor": {Window: 10 * time.Second, Threshold: 3}},
+		Collapse: true,
+	}, func() time.Time { return now })
+
+	states := []string{"on", "off"}
+	toggle := func(i int) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{Data: hass.EventData{
+			EntityID: "binary_sensor.door",
+			OldState: &hass.State{EntityID: "binary_sensor.door", State: states[i%2]},
+			NewState: &hass.State{EntityID: "binary_sensor.door", State: states[(i+1)%2]},
+		}}}
+	}
+
+	assert.True(t, detector.Allow(toggle(0)))
+	assert.True(t, detector.Allow(toggle(1)))
+	for i := 2; i < 10; i++ {
+		now = now.Add(time.Second)
+		assert.False(t, detector.Allow(toggle(i)), "held back while flapping")
+	}
+	last := toggle(10)
+	assert.False(t, detector.Allow(last))
+
+	assert.Empty(t, detector.settle(now.Add(5*time.Second)), "still within the window")
+
+	settled := detector.settle(now.Add(10 * time.Second))
+	require.Equal(t, []*hass.EventMessage{last}, settled)
+
+	change := &StateChange{}
+	detector.Transform(last, change)
+	assert.Equal(t, 9, change.FlapCount)
+	require.NotNil(t, change.FlapStarted)
+}
+
+// streamSource streams the state change events sent to it to the pipeline
+type streamSource struct {
+	Source
+	events chan *hass.EventMessage
+}
+
+func (s *streamSource) SubscribeEvents(context.Context, ...hass.SubscribeEventsOption) (chan *hass.EventMessage, error) {
+	return s.events, nil
+}
+
+func (s *streamSource) GetStates(context.Context) ([]hass.State, error) {
+	return nil, nil
+}
+
+// rowSink collects the state changes inserted by the pipeline, failing inserts while down
+type rowSink struct {
+	mtx      sync.Mutex
+	down     bool
+	attempts int
+	rows     []*StateChange
+}
+
+func (s *rowSink) sink() SinkFunc {
+	return func(_ context.Context, _, _ string, rows []any) error {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.attempts++
+		if s.down {
+			return fmt.Errorf("connection refused")
+		}
+		for _, row := range rows {
+			s.rows = append(s.rows, row.(*StateChange))
+		}
+		return nil
+	}
+}
+
+func (s *rowSink) inserted() []*StateChange {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]*StateChange(nil), s.rows...)
+}
+
+func (s *rowSink) insertAttempts() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.attempts
+}
+
+func (s *rowSink) setDown(down bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.down = down
+}
+
+// stateChangeAt is a state change of an entity from the old to the new state at the time
+func stateChangeAt(entityID, oldState, newState string, at time.Time) *hass.EventMessage {
+	return &hass.EventMessage{Event: hass.Event{EventType: hass.EventTypeStateChanged, Data: hass.EventData{
+		EntityID: entityID,
+		OldState: &hass.State{EntityID: entityID, State: oldState, LastUpdated: at},
+		NewState: &hass.State{EntityID: entityID, State: newState, LastUpdated: at, LastChanged: at},
+	}}}
+}
+
+func TestPipeline_FlapCollapseRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	source := &streamSource{events: make(chan *hass.EventMessage)}
+	sink := &rowSink{}
+	p := NewPipeline(source, sink.sink(), "hass", WithoutDDL(), WithBatchSize(1),
+		WithFlapDetection(FlapConfig{
+			Domains:  map[string]FlapLimit{"binary_sensor": {Window: 10 * time.Second, Threshold: 3}},
+			Collapse: true,
+		}),
+		// The rate limit allows the state changes stored before the flapping is detected, but not another one
+		// by the time the entity has settled
+		WithRateLimit(RateLimitConfig{Domains: map[string]RateLimit{"binary_sensor": {Rate: 0.01, Burst: 2}}}),
+		WithClock(clk),
+	)
+	go func() {
+		_ = p.Run(ctx)
+	}()
+
+	// Two transitions are stored, the third one starts flapping and the next ones are collapsed
+	states := []string{"off", "on"}
+	for i := 0; i < 5; i++ {
+		source.events <- stateChangeAt("binary_sensor.door", states[i%2], states[(i+1)%2], clk.Now())
+	}
+	source.events <- stateChangeAt("light.kitchen", "off", "on", clk.Now())
+	require.Eventually(t, func() bool { return len(sink.inserted()) == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	// Once settled, the last state change is stored with the number of collapsed transitions,
+	// without being limited again
+	require.Eventually(t, func() bool {
+		clk.Advance(time.Second)
+		return len(sink.inserted()) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	collapsed := sink.inserted()[3]
+	assert.Equal(t, true, collapsed.State)
+	assert.Equal(t, 3, collapsed.FlapCount)
+	require.NotNil(t, collapsed.FlapStarted)
+
+	// The released state change has not been recorded as a transition of a new flap
+	p.flaps.entitiesMtx.Lock()
+	defer p.flaps.entitiesMtx.Unlock()
+	assert.Empty(t, p.flaps.entities)
+	assert.Empty(t, p.flaps.collapsed)
+}
@@ -0,0 +1,131 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+const (
+	gapsTableName = "gaps"
+
+	// gapResyncAttempts is the number of times the history of a gap is read before it is given up,
+	// e.g. while the recorder of a restarted Home Assistant is not ready yet
+	gapResyncAttempts = 5
+	// gapResyncRetryInterval is the time before the history of a gap is read again, doubled on every attempt
+	gapResyncRetryInterval = 10 * time.Second
+)
+
+// Statuses of re-synced gaps
+const (
+	GapStatusResynced = "resynced"
+	GapStatusFailed   = "failed"
+)
+
+// Gap is a row of the gaps table recording a window in which the connection to Home Assistant was lost
+type Gap struct {
+	EventType string `json:"event_type"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	// MissedEstimate is the estimated number of missed state changes, see hass2ch_events_missed_estimate_total
+	MissedEstimate int `json:"missed_estimate"`
+	// Resynced is the number of state changes of the window read from the history of Home Assistant
+	Resynced   int    `json:"resynced"`
+	Status     string `json:"status"`
+	Error      string `json:"error"`
+	RecordedAt string `json:"recorded_at"`
+}
+
+// WithGapBackfill re-syncs windows in which the connection to Home Assistant was lost: the state changes of all
+// entities within the window are read from its history and inserted, and the window is recorded in the gaps table.
+// The source must implement HistorySource.
+func WithGapBackfill() PipelineOption {
+	return func(p *Pipeline) {
+		p.gapBackfill = true
+	}
+}
+
+// resyncGap inserts the state changes of a gap from the history and records the gap
+func (p *Pipeline) resyncGap(ctx context.Context, gap *hass.MissedEventsError, states []hass.State, missedEstimate int) {
+	row := Gap{
+		EventType:      string(gap.EventType),
+		From:           gap.From.UTC().Format(time.RFC3339Nano),
+		To:             gap.To.UTC().Format(time.RFC3339Nano),
+		MissedEstimate: missedEstimate,
+		Status:         GapStatusResynced,
+	}
+
+	resynced, err := p.resyncGapHistory(ctx, gap, states)
+	row.Resynced = resynced
+	if err != nil {
+		row.Status = GapStatusFailed
+		row.Error = err.Error()
+		log.Error().Err(err).Time("from", gap.From).Time("to", gap.To).Msg("failed to re-sync gap")
+	} else {
+		log.Info().Time("from", gap.From).Time("to", gap.To).Int("state_changes", resynced).Msg("re-synced gap")
+	}
+	metrics.GapResyncs.WithLabelValues(row.Status).Inc()
+
+	database, err := p.ensureTable(ctx, gapsTableName, gapsDDL)
+	if err != nil {
+		log.Error().Err(err).Str("table", gapsTableName).Msg("failed to create gaps table")
+		return
+	}
+	row.RecordedAt = p.clock.Now().UTC().Format(time.RFC3339Nano)
+	p.insertBatch(ctx, newBatchID(), database, gapsTableName, []any{row}, 0, 0)
+}
+
+// resyncGapHistory reads the history of the owned entities within the gap, retrying while it fails,
+// and inserts the state changes not received already. It returns the number of state changes read.
+func (p *Pipeline) resyncGapHistory(ctx context.Context, gap *hass.MissedEventsError, states []hass.State) (int, error) {
+	history, ok := p.source.(HistorySource)
+	if !ok {
+		return 0, errors.New("source does not support reading history")
+	}
+
+	var entityIDs []string
+	for _, state := range states {
+		if p.owns(state.EntityID) {
+			entityIDs = append(entityIDs, state.EntityID)
+		}
+	}
+	if len(entityIDs) == 0 {
+		return 0, nil
+	}
+	sort.Strings(entityIDs)
+
+	var recorded map[string][]hass.State
+	retry := gapResyncRetryInterval
+	for attempt := 1; ; attempt++ {
+		var err error
+		if recorded, err = history.HistoryDuringPeriod(ctx, gap.From, gap.To, entityIDs); err == nil {
+			break
+		}
+		if attempt == gapResyncAttempts {
+			return 0, fmt.Errorf("failed to read history after %d attempts: %w", attempt, err)
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("retry_in", retry).Msg("failed to read history of gap, retrying")
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-p.clock.After(retry):
+		}
+		retry *= 2
+	}
+
+	// State changes received right after subscriptions were restored are in the window too
+	events := p.sequences.unseen(historyStateChanges(recorded))
+	if failed := p.insertHistory(ctx, events); failed > 0 {
+		return len(events), fmt.Errorf("%d batches failed to be inserted", failed)
+	}
+	metrics.GapBackfillEvents.Add(float64(len(events)))
+	return len(events), nil
+}
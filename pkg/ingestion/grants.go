@@ -0,0 +1,112 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// querier is implemented by sinks able to run read queries, e.g. *clickhouse.Client.
+// It is required for the pre-flight check of grants.
+type querier interface {
+	Query(ctx context.Context, query string, fn func(row json.RawMessage) error, opts ...clickhouse.QueryOption) error
+}
+
+// WithoutDDL disables all automatic DDL. Tables must be created in advance, e.g. by a privileged user,
+// and the pipeline only needs the INSERT grant.
+func WithoutDDL() PipelineOption {
+	return func(p *Pipeline) {
+		p.noDDL = true
+	}
+}
+
+// requiredGrants returns the grants the pipeline needs on every database it writes to
+func (p *Pipeline) requiredGrants() []string {
+	if p.noDDL {
+		return []string{"INSERT"}
+	}
+	grants := []string{"INSERT", "CREATE TABLE", "ALTER ADD COLUMN"}
+	if p.databaseConf != nil {
+		grants = []string{"INSERT", "CREATE DATABASE", "CREATE TABLE", "ALTER ADD COLUMN"}
+	}
+	if p.migrateSchema {
+		grants = append(grants, "ALTER COMMENT COLUMN", "ALTER MODIFY TTL")
+	}
+	return grants
+}
+
+// databases returns all databases the pipeline writes to
+func (p *Pipeline) databases() []string {
+	seen := map[string]bool{p.database: true}
+	for _, database := range p.tableDatabases {
+		seen[database] = true
+	}
+
+	databases := make([]string, 0, len(seen))
+	for database := range seen {
+		databases = append(databases, database)
+	}
+	sort.Strings(databases)
+
+	return databases
+}
+
+// CheckGrants verifies that the ClickHouse user has all grants required by the pipeline and returns
+// an error listing the missing ones. The check is skipped if the sink cannot run queries or
+// ClickHouse does not support CHECK GRANT.
+func (p *Pipeline) CheckGrants(ctx context.Context) error {
+	q, ok := p.sink.(querier)
+	if !ok {
+		return nil
+	}
+
+	var missing []string
+	for _, database := range p.databases() {
+		for _, grant := range p.requiredGrants() {
+			target := fmt.Sprintf("%s ON %s.*", grant, database)
+
+			granted, err := checkGrant(ctx, q, target)
+			if err != nil {
+				log.Warn().Err(err).Msg("unable to check ClickHouse grants, skipping the pre-flight check")
+				return nil
+			}
+			if !granted {
+				missing = append(missing, target)
+			}
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	hint := "grant them to the ClickHouse user"
+	if !p.noDDL {
+		hint += ", or pre-create the tables and disable automatic DDL"
+	}
+
+	return fmt.Errorf("ClickHouse user is missing grants: %s; %s", strings.Join(missing, ", "), hint)
+}
+
+func checkGrant(ctx context.Context, q querier, target string) (bool, error) {
+	granted := false
+	err := q.Query(ctx, "CHECK GRANT "+target, func(row json.RawMessage) error {
+		// The result is a single row with a single column
+		var values map[string]any
+		if err := json.Unmarshal(row, &values); err != nil {
+			return err
+		}
+		for _, value := range values {
+			granted = fmt.Sprint(value) == "1"
+		}
+		return nil
+	})
+
+	return granted, err
+}
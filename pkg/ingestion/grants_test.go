@@ -0,0 +1,45 @@
+package ingestion
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// grantsSink grants all privileges except the denied ones
+type grantsSink struct {
+	denied map[string]bool
+}
+
+func (s *grantsSink) Execute(context.Context, string, io.ReadSeeker, ...clickhouse.QueryOption) error {
+	return nil
+}
+
+func (s *grantsSink) Query(_ context.Context, query string, fn func(row json.RawMessage) error, _ ...clickhouse.QueryOption) error {
+	if s.denied[strings.TrimPrefix(query, "CHECK GRANT ")] {
+		return fn(json.RawMessage(`{"result":0}`))
+	}
+	return fn(json.RawMessage(`{"result":1}`))
+}
+
+func TestPipeline_CheckGrants(t *testing.T) {
+	sink := &grantsSink{denied: map[string]bool{
+		"CREATE TABLE ON hass.*":     true,
+		"ALTER ADD COLUMN ON hass.*": true,
+	}}
+
+	p := NewPipeline(nil, sink, "hass")
+	err := p.CheckGrants(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "CREATE TABLE ON hass.*, ALTER ADD COLUMN ON hass.*")
+
+	p = NewPipeline(nil, sink, "hass", WithoutDDL())
+	assert.NoError(t, p.CheckGrants(context.Background()))
+}
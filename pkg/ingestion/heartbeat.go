@@ -0,0 +1,146 @@
+package ingestion
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+const heartbeatsTableName = "heartbeats"
+
+// Heartbeat is a synthetic row telling that an entity still exists although its state has not changed for a while
+type Heartbeat struct {
+	EntityID    string `json:"entity_id"`
+	State       string `json:"state"`
+	LastUpdated string `json:"last_updated"`
+	EmittedAt   string `json:"emitted_at"`
+}
+
+// WithHeartbeats emits a row into the heartbeats table for every entity whose state has not changed
+// for the given interval, and again every interval afterwards. Downstream queries can tell apart an
+// unchanged value from an entity that stopped reporting (removed entities stop getting heartbeats).
+func WithHeartbeats(interval time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.heartbeats = newHeartbeatTracker(interval)
+		p.transformers = append(p.transformers, p.heartbeats)
+	}
+}
+
+type heartbeatEntity struct {
+	state       string
+	lastUpdated time.Time
+	lastBeat    time.Time
+}
+
+// heartbeatTracker keeps the last state of every entity to find the ones that are due a heartbeat
+type heartbeatTracker struct {
+	interval time.Duration
+
+	entitiesMtx sync.Mutex
+	entities    map[string]*heartbeatEntity
+}
+
+func newHeartbeatTracker(interval time.Duration) *heartbeatTracker {
+	return &heartbeatTracker{
+		interval: interval,
+		entities: make(map[string]*heartbeatEntity),
+	}
+}
+
+func (t *heartbeatTracker) Transform(*hass.EventMessage, *StateChange) {}
+
+func (t *heartbeatTracker) Columns(string) []string {
+	return nil
+}
+
+func (t *heartbeatTracker) Seed(states []hass.State) {
+	for i := range states {
+		t.track(states[i].EntityID, &states[i])
+	}
+}
+
+func (t *heartbeatTracker) Observe(event *hass.EventMessage) {
+	if event.Event.EventType != hass.EventTypeStateChanged {
+		return
+	}
+	t.track(event.Event.Data.EntityID, event.Event.Data.NewState)
+}
+
+func (t *heartbeatTracker) track(entityID string, state *hass.State) {
+	t.entitiesMtx.Lock()
+	defer t.entitiesMtx.Unlock()
+
+	if state == nil {
+		delete(t.entities, entityID)
+		return
+	}
+
+	t.entities[entityID] = &heartbeatEntity{
+		state:       state.State,
+		lastUpdated: state.LastUpdated,
+	}
+}
+
+// due returns heartbeats of owned entities without a state change or heartbeat for the interval
+func (t *heartbeatTracker) due(now time.Time, owns func(entityID string) bool) []any {
+	t.entitiesMtx.Lock()
+	defer t.entitiesMtx.Unlock()
+
+	var heartbeats []any
+	for entityID, entity := range t.entities {
+		last := entity.lastUpdated
+		if entity.lastBeat.After(last) {
+			last = entity.lastBeat
+		}
+		if now.Sub(last) < t.interval || !owns(entityID) {
+			continue
+		}
+
+		entity.lastBeat = now
+		heartbeats = append(heartbeats, Heartbeat{
+			EntityID:    entityID,
+			State:       entity.state,
+			LastUpdated: entity.lastUpdated.Format(time.RFC3339Nano),
+			EmittedAt:   now.Format(time.RFC3339Nano),
+		})
+	}
+
+	return heartbeats
+}
+
+// checkInterval is how often entities are checked for due heartbeats
+func (t *heartbeatTracker) checkInterval() time.Duration {
+	return min(max(t.interval/10, time.Second), time.Minute)
+}
+
+// emitHeartbeats periodically inserts heartbeats of idle entities until the context is done
+func (p *Pipeline) emitHeartbeats(ctx context.Context) {
+	ticker := p.clock.NewTicker(p.heartbeats.checkInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C():
+			heartbeats := p.heartbeats.due(now.UTC(), p.owns)
+			if len(heartbeats) == 0 {
+				continue
+			}
+
+			database, err := p.ensureTable(ctx, heartbeatsTableName, heartbeatsDDL)
+			if err != nil {
+				log.Error().Err(err).Str("table", heartbeatsTableName).Msg("failed to create heartbeats table")
+				continue
+			}
+
+			metrics.HeartbeatsEmitted.Add(float64(len(heartbeats)))
+			p.insertBatch(ctx, newBatchID(), database, heartbeatsTableName, heartbeats, 0, 0)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestHeartbeatTracker_Due(t *testing.T) {
+	now := time.Now()
+	tracker := newHeartbeatTracker(time.Hour)
+	ownsAll := func(string) bool { return true }
+	tracker.Seed([]hass.State{
+		{EntityID: "sensor.idle", State: "21.5", LastUpdated: now.Add(-2 * time.Hour)},
+		{EntityID: "sensor.busy", State: "3", LastUpdated: now.Add(-time.Minute)},
+	})
+
+	assert.Equal(t, []any{Heartbeat{
+		EntityID:    "sensor.idle",
+		State:       "21.5",
+		LastUpdated: now.Add(-2 * time.Hour).Format(time.RFC3339Nano),
+		EmittedAt:   now.Format(time.RFC3339Nano),
+	}}, tracker.due(now, ownsAll))
+
+	assert.Empty(t, tracker.due(now.Add(time.Minute), ownsAll), "heartbeats are emitted once per interval")
+	assert.Len(t, tracker.due(now.Add(time.Hour), ownsAll), 2)
+
+	tracker.Observe(&hass.EventMessage{Event: hass.Event{
+		EventType: hass.EventTypeStateChanged,
+		Data:      hass.EventData{EntityID: "sensor.idle"},
+	}})
+	assert.Len(t, tracker.due(now.Add(3*time.Hour), ownsAll), 1, "removed entities stop getting heartbeats")
+}
@@ -0,0 +1,112 @@
+package ingestion
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+const insertStatsTableName = "insert_stats"
+
+// InsertStats is a row of the insert_stats self-monitoring table describing a single insert
+type InsertStats struct {
+	BatchID           string  `json:"batch_id"`
+	Database          string  `json:"database"`
+	Table             string  `json:"table"`
+	Rows              int     `json:"rows"`
+	UncompressedBytes uint64  `json:"uncompressed_bytes"`
+	SentBytes         uint64  `json:"sent_bytes"`
+	WrittenBytes      uint64  `json:"written_bytes"`
+	DurationMs        int64   `json:"duration_ms"`
+	RowsPerSecond     float64 `json:"rows_per_second"`
+	InsertedAt        string  `json:"inserted_at"`
+}
+
+// WithInsertStats stores statistics of every insert in the insert_stats table, flushed every interval
+func WithInsertStats(interval time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.insertStats = &insertStatsBuffer{interval: interval}
+	}
+}
+
+// insertStatsBuffer collects insert statistics until they are flushed
+type insertStatsBuffer struct {
+	interval time.Duration
+
+	rowsMtx sync.Mutex
+	rows    []any
+}
+
+func (b *insertStatsBuffer) add(stats InsertStats) {
+	b.rowsMtx.Lock()
+	defer b.rowsMtx.Unlock()
+
+	b.rows = append(b.rows, stats)
+}
+
+func (b *insertStatsBuffer) take() []any {
+	b.rowsMtx.Lock()
+	defer b.rowsMtx.Unlock()
+
+	rows := b.rows
+	b.rows = nil
+	return rows
+}
+
+// recordInsertStats updates the insert efficiency metrics and buffers a row of the insert_stats table
+func (p *Pipeline) recordInsertStats(batchID, database, tableName string, rows int, duration time.Duration, request *clickhouse.RequestStats, summary *clickhouse.Summary) {
+	rowsPerSecond := float64(rows) / max(duration.Seconds(), time.Millisecond.Seconds())
+
+	metrics.CHInsertUncompressedBytes.WithLabelValues(tableName).Add(float64(request.UncompressedBytes))
+	metrics.CHInsertSentBytes.WithLabelValues(tableName).Add(float64(request.SentBytes))
+	metrics.CHInsertRowsPerSecond.WithLabelValues(tableName).Observe(rowsPerSecond)
+
+	// Statistics of the insert_stats table itself are not recorded in it
+	if p.insertStats == nil || tableName == insertStatsTableName {
+		return
+	}
+
+	p.insertStats.add(InsertStats{
+		BatchID:           batchID,
+		Database:          database,
+		Table:             tableName,
+		Rows:              rows,
+		UncompressedBytes: request.UncompressedBytes,
+		SentBytes:         request.SentBytes,
+		WrittenBytes:      summary.WrittenBytes,
+		DurationMs:        duration.Milliseconds(),
+		RowsPerSecond:     rowsPerSecond,
+		InsertedAt:        p.clock.Now().UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// flushInsertStats periodically inserts the buffered insert statistics until the context is done
+func (p *Pipeline) flushInsertStats(ctx context.Context) {
+	ticker := p.clock.NewTicker(p.insertStats.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			rows := p.insertStats.take()
+			if len(rows) == 0 {
+				continue
+			}
+
+			database, err := p.ensureTable(ctx, insertStatsTableName, insertStatsDDL)
+			if err != nil {
+				log.Error().Err(err).Str("table", insertStatsTableName).Msg("failed to create insert stats table")
+				continue
+			}
+
+			p.insertBatch(ctx, newBatchID(), database, insertStatsTableName, rows, 0, 0)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package ingestion
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse/format"
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Label is a static column added to every row, e.g. to tell apart homes aggregated into one cluster
+type Label struct {
+	Name  string
+	Value string
+}
+
+// ParseLabels parses labels in the form of "name=value,name=value"
+func ParseLabels(s string) ([]Label, error) {
+	var labels []Label
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !labelNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid label %q: expected name=value with a valid column name", part)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate label %q", name)
+		}
+		seen[name] = true
+
+		labels = append(labels, Label{Name: name, Value: strings.TrimSpace(value)})
+	}
+
+	return labels, nil
+}
+
+// WithLabels adds static label columns to every table and row written by the pipeline
+func WithLabels(labels []Label) PipelineOption {
+	return func(p *Pipeline) {
+		p.labels = labels
+	}
+}
+
+func (p *Pipeline) labelColumns() []string {
+	columns := make([]string, 0, len(p.labels))
+	for _, label := range p.labels {
+		columns = append(columns, fmt.Sprintf("`%s` LowCardinality(String)", label.Name))
+	}
+	return columns
+}
+
+// newRowReader returns a JSONEachRow reader of rows with the pipeline labels
+func (p *Pipeline) newRowReader(values []any) *format.JSONEachRowReader {
+	return format.NewJSONEachRowReader(p.labeledRows(values))
+}
+
+// labeledRows returns the rows with label fields appended, the rows themselves if there are no labels
+func (p *Pipeline) labeledRows(values []any) []any {
+	if len(p.labels) == 0 {
+		return values
+	}
+
+	labeled := make([]any, 0, len(values))
+	for _, value := range values {
+		labeled = append(labeled, labeledRow{row: value, labels: p.labels})
+	}
+	return labeled
+}
+
+// labeledRow marshals a row object with label fields appended
+type labeledRow struct {
+	row    any
+	labels []Label
+}
+
+func (r labeledRow) MarshalJSON() ([]byte, error) {
+	row, err := json.Marshal(r.row)
+	if err != nil {
+		return nil, err
+	}
+
+	row = bytes.TrimSpace(row)
+	if len(row) < 2 || row[len(row)-1] != '}' {
+		return nil, fmt.Errorf("row is not a JSON object: %s", row)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(row)+32*len(r.labels)))
+	buf.Write(row[:len(row)-1])
+	needsComma := len(bytes.TrimSpace(row[1:len(row)-1])) > 0
+	for _, label := range r.labels {
+		if needsComma {
+			buf.WriteByte(',')
+		}
+		needsComma = true
+
+		name, _ := json.Marshal(label.Name)
+		value, _ := json.Marshal(label.Value)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// RowValues returns the column values of the row with the label columns, see clickhouse.RowValuer
+func (r labeledRow) RowValues() (map[string]any, error) {
+	row, err := clickhouse.RowValues(r.row)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]any, len(row)+len(r.labels))
+	for name, value := range row {
+		values[name] = value
+	}
+	for _, label := range r.labels {
+		values[label.Name] = label.Value
+	}
+	return values, nil
+}
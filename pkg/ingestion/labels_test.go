@@ -0,0 +1,45 @@
+package ingestion
+
+import (
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("site=cabin, tenant=acme")
+	require.NoError(t, err)
+	assert.Equal(t, []Label{{Name: "site", Value: "cabin"}, {Name: "tenant", Value: "acme"}}, labels)
+
+	_, err = ParseLabels("site")
+	assert.Error(t, err)
+
+	_, err = ParseLabels("my-site=cabin")
+	assert.Error(t, err)
+
+	_, err = ParseLabels("site=a,site=b")
+	assert.Error(t, err)
+}
+
+func TestLabeledRow_MarshalJSON(t *testing.T) {
+	labels := []Label{{Name: "site", Value: "cabin"}}
+
+	row, err := json.Marshal(labeledRow{row: DeadLetter{DestinationTable: "sensor"}, labels: labels})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"destination_table":"sensor","row":"","error":"","site":"cabin"}`, string(row))
+
+	row, err = json.Marshal(labeledRow{row: struct{}{}, labels: labels})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"site":"cabin"}`, string(row))
+}
+
+func TestLabeledRow_RowValues(t *testing.T) {
+	labels := []Label{{Name: "site", Value: "cabin"}}
+
+	values, err := labeledRow{row: &AttributeChange{EntityID: "light.kitchen"}, labels: labels}.RowValues()
+	require.NoError(t, err)
+	assert.Equal(t, "light.kitchen", values["entity_id"])
+	assert.Equal(t, "cabin", values["site"])
+}
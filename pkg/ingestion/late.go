@@ -0,0 +1,65 @@
+package ingestion
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+const isLateColumn = "is_late Bool DEFAULT false"
+
+// WithLateEvents flags state changes updated more than threshold before the ingestion watermark
+// of their table, e.g. replayed by Home Assistant, with the is_late column.
+// The watermark of a table is the latest last_updated of its state changes seen so far.
+func WithLateEvents(threshold time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.transformers = append(p.transformers, &lateTransformer{
+			threshold:  threshold,
+			watermarks: make(map[string]time.Time),
+		})
+	}
+}
+
+// lateTransformer tracks per-table watermarks, so streaming materialized views can exclude late rows
+type lateTransformer struct {
+	threshold time.Duration
+
+	watermarksMtx sync.Mutex
+	watermarks    map[string]time.Time
+}
+
+func (t *lateTransformer) stageName() string {
+	return StageLateEvents
+}
+
+func (t *lateTransformer) Columns(string) []string {
+	return []string{isLateColumn}
+}
+
+func (t *lateTransformer) Transform(event *hass.EventMessage, change *StateChange) {
+	table := extractDomainFromState(event.Event.Data.NewState)
+	lastUpdated := event.Event.Data.NewState.LastUpdated
+
+	t.watermarksMtx.Lock()
+	watermark := t.watermarks[table]
+	if lastUpdated.After(watermark) {
+		t.watermarks[table] = lastUpdated
+	}
+	t.watermarksMtx.Unlock()
+
+	if watermark.IsZero() || !lastUpdated.Before(watermark.Add(-t.threshold)) {
+		return
+	}
+
+	change.IsLate = true
+	metrics.LateEvents.WithLabelValues(table).Inc()
+	log.Debug().
+		Str("entity_id", change.EntityID).
+		Time("last_updated", lastUpdated).
+		Time("watermark", watermark).
+		Msg("late state change")
+}
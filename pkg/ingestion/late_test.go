@@ -0,0 +1,29 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestLateTransformer(t *testing.T) {
+	transformer := &lateTransformer{threshold: time.Minute, watermarks: make(map[string]time.Time)}
+	now := time.Now()
+
+	isLate := func(entityID string, lastUpdated time.Time) bool {
+		change := &StateChange{EntityID: entityID}
+		transformer.Transform(&hass.EventMessage{Event: hass.Event{Data: hass.EventData{
+			EntityID: entityID,
+			NewState: &hass.State{EntityID: entityID, State: "on", LastUpdated: lastUpdated},
+		}}}, change)
+		return change.IsLate
+	}
+
+	assert.False(t, isLate("light.kitchen", now), "the first state change sets the watermark")
+	assert.False(t, isLate("light.kitchen", now.Add(-30*time.Second)), "within the threshold")
+	assert.True(t, isLate("light.hall", now.Add(-time.Hour)))
+	assert.False(t, isLate("switch.fan", now.Add(-time.Hour)), "watermarks are tracked per table")
+}
@@ -0,0 +1,85 @@
+package ingestion
+
+import (
+	"context"
+	"runtime/metrics"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	internalmetrics "github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// memoryCheckInterval is how often the heap is compared to the soft memory limit
+const memoryCheckInterval = time.Second
+
+// heapObjectsMetric is the runtime metric of memory occupied by live and not yet collected heap objects
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// WithSoftMemoryLimit flushes all pending batches early when the heap grows beyond the limit in bytes,
+// instead of holding events in memory until batches fill up or time out. It is meant to be set below
+// the runtime memory limit (GOMEMLIMIT) on small devices.
+func WithSoftMemoryLimit(limit uint64) PipelineOption {
+	return func(p *Pipeline) {
+		p.softMemoryLimit = limit
+	}
+}
+
+// eventOverhead is the estimated size of an event besides the attributes of its states, e.g. of its IDs and times
+const eventOverhead = 512
+
+// WithBatchBytes limits the estimated size in bytes of a batch of a single table, and of the events pending in all
+// batches. A batch reaching maxBytes is inserted like one reaching the batch size, and while the pending events
+// exceed pendingBytes, the largest batches are inserted early, so a flood of events with large attributes, e.g. of
+// cameras, cannot exhaust memory. Sizes are estimated from the attributes of the events. 0 disables a limit.
+func WithBatchBytes(maxBytes, pendingBytes int) PipelineOption {
+	return func(p *Pipeline) {
+		p.batchBytes = maxBytes
+		p.pendingBytes = pendingBytes
+	}
+}
+
+// estimatedEventSize estimates the memory held by a state change event
+func estimatedEventSize(event *hass.EventMessage) int {
+	size := eventOverhead
+	for _, state := range []*hass.State{event.Event.Data.OldState, event.Event.Data.NewState} {
+		if state != nil {
+			size += len(state.EntityID) + len(state.State) + len(state.Attributes)
+		}
+	}
+	return size
+}
+
+// watchMemory requests a flush of pending batches whenever the heap exceeds the soft memory limit
+func (p *Pipeline) watchMemory(ctx context.Context, flush chan<- struct{}) {
+	ticker := p.clock.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			metrics.Read(sample)
+			if sample[0].Value.Kind() != metrics.KindUint64 {
+				log.Error().Str("metric", heapObjectsMetric).Msg("heap size is not supported by the runtime, soft memory limit is disabled")
+				return
+			}
+
+			heap := sample[0].Value.Uint64()
+			if heap < p.softMemoryLimit {
+				continue
+			}
+
+			// A flush still pending covers this one
+			select {
+			case flush <- struct{}{}:
+				internalmetrics.MemoryPressureFlushes.Inc()
+				log.Debug().Uint64("heap_bytes", heap).Uint64("limit_bytes", p.softMemoryLimit).Msg("heap exceeds the soft memory limit, flushing batches")
+			default:
+			}
+		}
+	}
+}
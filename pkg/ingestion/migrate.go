@@ -0,0 +1,234 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// Kinds of schema changes
+const (
+	SchemaChangeAddColumn     = "add_column"
+	SchemaChangeModifyTTL     = "modify_ttl"
+	SchemaChangeCommentColumn = "comment_column"
+	// SchemaChangeIncompatible is a difference that cannot be applied without rewriting data, e.g. a column type
+	SchemaChangeIncompatible = "incompatible"
+)
+
+// SchemaChange is a difference between an existing table and the schema the pipeline generates
+type SchemaChange struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Column   string `json:"column,omitempty"`
+	Kind     string `json:"kind"`
+	// Statement is the ALTER applying the change, empty for incompatible changes
+	Statement string `json:"statement,omitempty"`
+	// Detail describes the difference, e.g. the existing and the expected type of a column
+	Detail string `json:"detail,omitempty"`
+}
+
+// Safe reports whether the change can be applied by Migrate
+func (c SchemaChange) Safe() bool {
+	return c.Kind != SchemaChangeIncompatible
+}
+
+// WithSchemaMigration applies safe schema changes to existing tables on startup: columns missing from the
+// generated schema are added, the TTL of the DDL template is set on state change tables without one, and
+// column comments are updated. Incompatible differences are logged. See PlanMigration.
+func WithSchemaMigration() PipelineOption {
+	return func(p *Pipeline) {
+		p.migrateSchema = true
+	}
+}
+
+// existingColumn is a column of a table in ClickHouse
+type existingColumn struct {
+	Type    string
+	Comment string
+}
+
+// existingTable is a table in ClickHouse
+type existingTable struct {
+	columns map[string]existingColumn
+	hasTTL  bool
+}
+
+// PlanMigration diffs the existing tables against the schema the pipeline generates and returns the changes
+// bringing them in line, safe ones first. Tables that do not exist yet are left to the pipeline to create.
+func (p *Pipeline) PlanMigration(ctx context.Context) ([]SchemaChange, error) {
+	q, ok := p.sink.(querier)
+	if !ok {
+		return nil, errors.New("sink does not support queries")
+	}
+
+	catalog, err := p.Catalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]*existingTable)
+	for _, database := range p.databases() {
+		if err := introspectDatabase(ctx, q, database, existing); err != nil {
+			return nil, err
+		}
+	}
+
+	var safe, incompatible []SchemaChange
+	for _, table := range catalog.Tables {
+		actual, ok := existing[table.Database+"."+table.Name]
+		if !table.Generated || !ok {
+			continue
+		}
+		qualified := table.Database + "." + table.Name
+
+		var comments []SchemaChange
+		for _, column := range table.Columns {
+			if column.Type == "" {
+				continue
+			}
+
+			current, exists := actual.columns[column.Name]
+			switch {
+			case !exists:
+				safe = append(safe, SchemaChange{
+					Database:  table.Database,
+					Table:     table.Name,
+					Column:    column.Name,
+					Kind:      SchemaChangeAddColumn,
+					Statement: fmt.Sprintf(addColumnDDL, table.Database, table.Name, table.definitions[column.Name]),
+				})
+			case current.Type != column.Type:
+				incompatible = append(incompatible, SchemaChange{
+					Database: table.Database,
+					Table:    table.Name,
+					Column:   column.Name,
+					Kind:     SchemaChangeIncompatible,
+					Detail: fmt.Sprintf("type is %s, expected %s; change it with ALTER TABLE %s MODIFY COLUMN %s %s after checking the data fits",
+						current.Type, column.Type, qualified, column.Name, column.Type),
+				})
+			}
+
+			if description := columnDescriptions[column.Name]; description != "" && description != current.Comment {
+				comments = append(comments, SchemaChange{
+					Database:  table.Database,
+					Table:     table.Name,
+					Column:    column.Name,
+					Kind:      SchemaChangeCommentColumn,
+					Statement: fmt.Sprintf("ALTER TABLE %s COMMENT COLUMN %s %s", qualified, column.Name, clickhouse.QuoteString(description)),
+				})
+			}
+		}
+		// Comments of new columns are set once they are added
+		safe = append(safe, comments...)
+
+		if ttl := p.tableTTL(table); ttl != "" && !actual.hasTTL {
+			safe = append(safe, SchemaChange{
+				Database:  table.Database,
+				Table:     table.Name,
+				Kind:      SchemaChangeModifyTTL,
+				Statement: fmt.Sprintf("ALTER TABLE %s MODIFY TTL %s", qualified, ttl),
+			})
+		}
+	}
+
+	return append(safe, incompatible...), nil
+}
+
+// Migrate applies the safe changes and returns the number of applied ones. Incompatible changes are skipped.
+func (p *Pipeline) Migrate(ctx context.Context, changes []SchemaChange) (int, error) {
+	applied := 0
+	for _, change := range changes {
+		if !change.Safe() {
+			continue
+		}
+		if err := p.sink.Execute(ctx, change.Statement, nil); err != nil {
+			return applied, fmt.Errorf("failed to migrate %s.%s: %w", change.Database, change.Table, err)
+		}
+		applied++
+		log.Info().Str("table", change.Database+"."+change.Table).Str("kind", change.Kind).Str("column", change.Column).Msg("migrated schema")
+	}
+	return applied, nil
+}
+
+// migrate applies safe schema changes on startup if enabled, logging incompatible ones
+func (p *Pipeline) migrate(ctx context.Context) error {
+	if !p.migrateSchema || p.noDDL {
+		return nil
+	}
+
+	changes, err := p.PlanMigration(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to plan schema migration: %w", err)
+	}
+	for _, change := range changes {
+		if !change.Safe() {
+			log.Warn().Str("table", change.Database+"."+change.Table).Str("column", change.Column).Msg("incompatible schema difference: " + change.Detail)
+		}
+	}
+
+	_, err = p.Migrate(ctx, changes)
+	return err
+}
+
+// tableTTL returns the TTL expected on a generated table, the one of the DDL template for state change tables
+func (p *Pipeline) tableTTL(table *CatalogTable) string {
+	if p.ddlTemplate == nil || table.Kind != TableKindStateChanges {
+		return ""
+	}
+	return p.ddlTemplate.TTL
+}
+
+// introspectDatabase reads the columns and TTLs of the tables of a database
+func introspectDatabase(ctx context.Context, q querier, database string, tables map[string]*existingTable) error {
+	query := fmt.Sprintf("SELECT table, name, type, comment FROM system.columns WHERE database = %s ORDER BY table, position",
+		clickhouse.QuoteString(database))
+	err := q.Query(ctx, query, func(raw json.RawMessage) error {
+		var row struct {
+			Table   string `json:"table"`
+			Name    string `json:"name"`
+			Type    string `json:"type"`
+			Comment string `json:"comment"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return err
+		}
+
+		key := database + "." + row.Table
+		table, ok := tables[key]
+		if !ok {
+			table = &existingTable{columns: make(map[string]existingColumn)}
+			tables[key] = table
+		}
+		table.columns[row.Name] = existingColumn{Type: row.Type, Comment: row.Comment}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query columns of database %s: %w", database, err)
+	}
+
+	query = fmt.Sprintf("SELECT name, engine_full FROM system.tables WHERE database = %s", clickhouse.QuoteString(database))
+	err = q.Query(ctx, query, func(raw json.RawMessage) error {
+		var row struct {
+			Name       string `json:"name"`
+			EngineFull string `json:"engine_full"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return err
+		}
+		if table, ok := tables[database+"."+row.Name]; ok {
+			table.hasTTL = strings.Contains(row.EngineFull, " TTL ")
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query tables of database %s: %w", database, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package ingestion
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// migrationSink serves rows of system.columns and system.tables and records executed statements
+type migrationSink struct {
+	columns  []string
+	tables   []string
+	executed []string
+}
+
+func (s *migrationSink) Execute(_ context.Context, query string, _ io.ReadSeeker, _ ...clickhouse.QueryOption) error {
+	s.executed = append(s.executed, query)
+	return nil
+}
+
+func (s *migrationSink) Query(_ context.Context, query string, fn func(row json.RawMessage) error, _ ...clickhouse.QueryOption) error {
+	rows := s.tables
+	if strings.Contains(query, "system.columns") {
+		rows = s.columns
+	}
+	for _, row := range rows {
+		if err := fn(json.RawMessage(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPipeline_PlanMigration(t *testing.T) {
+	sink := &migrationSink{
+		columns: []string{
+			`{"table":"light","name":"entity_id","type":"LowCardinality(String)","comment":"Entity ID, e.g. light.kitchen"}`,
+			`{"table":"light","name":"state","type":"Float64","comment":""}`,
+		},
+		tables: []string{`{"name":"light","engine_full":"MergeTree ORDER BY (entity_id, last_updated)"}`},
+	}
+	p := NewPipeline(nil, sink, "hass")
+
+	changes, err := p.PlanMigration(context.Background())
+	require.NoError(t, err)
+
+	byColumn := make(map[string][]SchemaChange)
+	for _, change := range changes {
+		require.Equal(t, "light", change.Table, "only existing tables are migrated")
+		byColumn[change.Column] = append(byColumn[change.Column], change)
+	}
+
+	// Missing columns are added and commented
+	require.Len(t, byColumn["last_updated"], 2)
+	assert.Equal(t, SchemaChangeAddColumn, byColumn["last_updated"][0].Kind)
+	assert.True(t, strings.HasPrefix(byColumn["last_updated"][0].Statement, "ALTER TABLE hass.light ADD COLUMN IF NOT EXISTS last_updated "))
+	assert.Equal(t, SchemaChange{
+		Database:  "hass",
+		Table:     "light",
+		Column:    "last_updated",
+		Kind:      SchemaChangeCommentColumn,
+		Statement: "ALTER TABLE hass.light COMMENT COLUMN last_updated 'When the state or attributes last changed'",
+	}, byColumn["last_updated"][1])
+
+	// Up-to-date columns are left alone
+	assert.Empty(t, byColumn["entity_id"])
+
+	// Type changes are incompatible and come last
+	last := changes[len(changes)-1]
+	assert.Equal(t, "state", last.Column)
+	assert.Equal(t, SchemaChangeIncompatible, last.Kind)
+	assert.False(t, last.Safe())
+	assert.Empty(t, last.Statement)
+	assert.Contains(t, last.Detail, "type is Float64")
+
+	applied, err := p.Migrate(context.Background(), changes)
+	require.NoError(t, err)
+	assert.Equal(t, len(changes)-1, applied)
+	assert.Len(t, sink.executed, applied)
+	for _, statement := range sink.executed {
+		assert.NotContains(t, statement, "MODIFY COLUMN")
+	}
+}
+
+func TestPipeline_PlanMigrationTTL(t *testing.T) {
+	sink := &migrationSink{
+		columns: []string{
+			`{"table":"light","name":"state","type":"LowCardinality(String)","comment":"State after the change"}`,
+			`{"table":"switch","name":"state","type":"Bool","comment":"State after the change"}`,
+		},
+		tables: []string{
+			`{"name":"light","engine_full":"MergeTree ORDER BY (entity_id, last_updated) SETTINGS index_granularity = 8192"}`,
+			`{"name":"switch","engine_full":"MergeTree ORDER BY (entity_id, last_updated) TTL toDateTime(last_updated) + toIntervalDay(30) SETTINGS index_granularity = 8192"}`,
+		},
+	}
+	p := NewPipeline(nil, sink, "hass", WithDDLTemplate(DDLTemplateConfig{
+		Template: template.Must(template.New("ddl").Parse("CREATE TABLE {{.Database}}.{{.Table}} (state {{.StateType}}) TTL {{.TTL}}")),
+		TTL:      "toDateTime(last_updated) + INTERVAL 1 YEAR",
+	}))
+
+	changes, err := p.PlanMigration(context.Background())
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, SchemaChange{
+		Database:  "hass",
+		Table:     "light",
+		Kind:      SchemaChangeModifyTTL,
+		Statement: "ALTER TABLE hass.light MODIFY TTL toDateTime(last_updated) + INTERVAL 1 YEAR",
+	}, changes[0])
+}
+
+func TestPipeline_PlanMigrationWithoutQueries(t *testing.T) {
+	p := NewPipeline(nil, &outageSink{}, "hass")
+	_, err := p.PlanMigration(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// sequenceTracker remembers when the last received state change of every entity was updated and its context,
+// to tell the state changes missed in a gap from the ones received
+type sequenceTracker struct {
+	mtx     sync.Mutex
+	entries map[string]sequenceEntry
+}
+
+type sequenceEntry struct {
+	lastUpdated time.Time
+	contextID   string
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{entries: make(map[string]sequenceEntry)}
+}
+
+// received records a state change received from Home Assistant
+func (t *sequenceTracker) received(event *hass.EventMessage) {
+	state := event.Event.Data.NewState
+	if event.Event.EventType != hass.EventTypeStateChanged || state == nil {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if entry, ok := t.entries[state.EntityID]; !ok || state.LastUpdated.After(entry.lastUpdated) {
+		t.entries[state.EntityID] = sequenceEntry{lastUpdated: state.LastUpdated, contextID: state.Context.ID}
+	}
+}
+
+// missed returns the IDs of the entities whose current state was updated within the gap but not received.
+// Each of them missed at least one state change, so their number is a lower bound of the missed events:
+// further state changes of the same entity, or of entities updated again after the gap, are not told apart.
+func (t *sequenceTracker) missed(states []hass.State, from, to time.Time) []string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	var entityIDs []string
+	for _, state := range states {
+		if state.LastUpdated.Before(from) || state.LastUpdated.After(to) {
+			continue
+		}
+		if entry, ok := t.entries[state.EntityID]; ok &&
+			(!state.LastUpdated.After(entry.lastUpdated) || state.Context.ID == entry.contextID) {
+			continue
+		}
+		entityIDs = append(entityIDs, state.EntityID)
+	}
+	sort.Strings(entityIDs)
+	return entityIDs
+}
+
+// unseen returns the state changes other than the last one received of their entity
+func (t *sequenceTracker) unseen(events []*hass.EventMessage) []*hass.EventMessage {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	unseen := events[:0]
+	for _, event := range events {
+		entry, ok := t.entries[event.Event.Data.EntityID]
+		if ok && event.Event.Data.NewState.LastUpdated.Equal(entry.lastUpdated) {
+			continue
+		}
+		unseen = append(unseen, event)
+	}
+	return unseen
+}
+
+// estimateMissed estimates the state changes missed in a gap, and re-syncs the gap from the history if enabled
+func (p *Pipeline) estimateMissed(ctx context.Context, gap *hass.MissedEventsError) error {
+	states, err := p.source.GetStates(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get states: %w", err)
+	}
+
+	var entityIDs []string
+	for _, entityID := range p.sequences.missed(states, gap.From, gap.To) {
+		if p.owns(entityID) {
+			entityIDs = append(entityIDs, entityID)
+		}
+	}
+
+	metrics.EventsMissedEstimate.Add(float64(len(entityIDs)))
+	log.Warn().
+		Time("from", gap.From).
+		Time("to", gap.To).
+		Int("entities", len(entityIDs)).
+		Msg("estimated state changes missed in the gap")
+
+	if p.gapBackfill {
+		p.resyncGap(ctx, gap, states, len(entityIDs))
+	}
+	return nil
+}
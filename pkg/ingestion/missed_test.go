@@ -0,0 +1,91 @@
+package ingestion
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestSequenceTracker_Missed(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Minute)
+
+	tracker := newSequenceTracker()
+	tracker.received(&hass.EventMessage{Event: hass.Event{EventType: hass.EventTypeStateChanged, Data: hass.EventData{
+		NewState: &hass.State{EntityID: "light.kitchen", LastUpdated: from.Add(10 * time.Second), Context: hass.EventContext{ID: "a"}},
+	}}})
+
+	missed := tracker.missed([]hass.State{
+		// Received before the connection was lost
+		{EntityID: "light.kitchen", LastUpdated: from.Add(10 * time.Second), Context: hass.EventContext{ID: "a"}},
+		// Updated within the gap
+		{EntityID: "switch.fan", LastUpdated: from.Add(30 * time.Second)},
+		// Updated before and after the gap
+		{EntityID: "sensor.old", LastUpdated: from.Add(-time.Hour)},
+		{EntityID: "sensor.new", LastUpdated: to.Add(time.Second)},
+	}, from, to)
+	assert.Equal(t, []string{"switch.fan"}, missed)
+}
+
+func TestPipeline_ResyncGap(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	source := &historySource{
+		states: []hass.State{
+			{EntityID: "light.kitchen", State: "on", LastUpdated: from.Add(30 * time.Second)},
+			{EntityID: "switch.fan", State: "on", LastUpdated: from.Add(50 * time.Second)},
+		},
+		history: map[string][]hass.State{
+			"light.kitchen": {
+				{EntityID: "light.kitchen", State: "off", LastUpdated: from.Add(-time.Hour)},
+				{EntityID: "light.kitchen", State: "on", LastUpdated: from.Add(30 * time.Second)},
+			},
+			// Received once subscriptions were restored
+			"switch.fan": {
+				{EntityID: "switch.fan", State: "off", LastUpdated: from.Add(-time.Hour)},
+				{EntityID: "switch.fan", State: "on", LastUpdated: from.Add(50 * time.Second)},
+			},
+		},
+	}
+	sink := &outageSink{}
+
+	p := NewPipeline(source, sink, "hass", WithoutDDL(), WithGapBackfill())
+	p.tableExists = make(map[string]bool)
+	p.sequences.received(&hass.EventMessage{Event: hass.Event{EventType: hass.EventTypeStateChanged, Data: hass.EventData{
+		EntityID: "switch.fan",
+		NewState: &source.states[1],
+	}}})
+	require.NoError(t, p.estimateMissed(context.Background(), &hass.MissedEventsError{
+		EventType: hass.EventTypeStateChanged,
+		From:      from,
+		To:        from.Add(time.Minute),
+	}))
+
+	assert.Equal(t, [][2]time.Time{{from, from.Add(time.Minute)}}, source.windows)
+	require.Len(t, sink.inserted, 2)
+	assert.True(t, strings.HasPrefix(sink.inserted[0], "hass.light "))
+	assert.Contains(t, sink.inserted[0], `"state":"on","old_state":"off"`)
+	assert.True(t, strings.HasPrefix(sink.inserted[1], "hass.gaps "))
+	assert.Contains(t, sink.inserted[1], `"from":"2024-01-01T00:00:00Z","to":"2024-01-01T00:01:00Z","missed_estimate":1,"resynced":1,"status":"resynced"`)
+}
+
+func TestPipeline_ResyncGapWithoutHistory(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink := &outageSink{}
+
+	p := NewPipeline(&ackSource{}, sink, "hass", WithoutDDL(), WithGapBackfill())
+	p.tableExists = make(map[string]bool)
+	p.resyncGap(context.Background(), &hass.MissedEventsError{
+		EventType: hass.EventTypeStateChanged,
+		From:      from,
+		To:        from.Add(time.Minute),
+	}, nil, 0)
+
+	require.Len(t, sink.inserted, 1)
+	assert.Contains(t, sink.inserted[0], `"status":"failed","error":"source does not support reading history"`)
+}
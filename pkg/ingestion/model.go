@@ -0,0 +1,184 @@
+package ingestion
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+// RowModel is a version of the row model state changes are stored with.
+// Every version is stored in its own set of tables, so a schema-affecting change can be
+// rolled out by writing both versions until all queries are migrated to the new tables.
+type RowModel string
+
+const (
+	// RowModelV1 is the original row model stored in tables named after the domain
+	RowModelV1 RowModel = "v1"
+
+	// RowModelV2 splits the context into columns, stores the domain and derived columns natively,
+	// and stores a missing last_reported as NULL. It is stored in tables with the _v2 suffix.
+	RowModelV2 RowModel = "v2"
+)
+
+// WithRowModels sets the row models state changes are written with. The first one is the primary model.
+// Writing multiple models at once allows migrating to a new model without breaking existing tables.
+func WithRowModels(models ...RowModel) PipelineOption {
+	return func(p *Pipeline) {
+		if len(models) > 0 {
+			p.rowModels = models
+		}
+	}
+}
+
+// ParseRowModels parses a comma-separated list of row models
+func ParseRowModels(s string) ([]RowModel, error) {
+	var models []RowModel
+	for _, part := range strings.Split(s, ",") {
+		switch model := RowModel(strings.TrimSpace(part)); model {
+		case RowModelV1, RowModelV2:
+			models = append(models, model)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown row model %q", model)
+		}
+	}
+	return models, nil
+}
+
+// tableName returns the name of the table of the given domain table in this row model
+func (m RowModel) tableName(tableName string) string {
+	if m == RowModelV1 {
+		return tableName
+	}
+	return tableName + "_" + string(m)
+}
+
+func (m RowModel) ddl() string {
+	if m == RowModelV2 {
+		return stateChangeV2DDL
+	}
+	return stateChangeDDL
+}
+
+// StateChangeV2 represents a processed state change event in the v2 row model
+type StateChangeV2 struct {
+	EntityID        string  `json:"entity_id"`
+	Domain          string  `json:"domain"`
+	State           any     `json:"state"`
+	OldState        any     `json:"old_state"`
+	Attributes      any     `json:"attributes"`
+	ContextID       string  `json:"context_id"`
+	ContextParentID *string `json:"context_parent_id"`
+	ContextUserID   *string `json:"context_user_id"`
+	LastChanged     string  `json:"last_changed"`
+	LastUpdated     string  `json:"last_updated"`
+	LastReported    *string `json:"last_reported"`
+
+	Cost       *float64 `json:"cost,omitempty"`
+	ValueDelta *float64 `json:"value_delta,omitempty"`
+	IsLate     bool     `json:"is_late,omitempty"`
+
+	FlapCount   int     `json:"flap_count,omitempty"`
+	FlapStarted *string `json:"flap_started,omitempty"`
+
+	EventHash      uint64 `json:"event_hash,omitempty"`
+	ContextBatchID string `json:"context_batch_id,omitempty"`
+	Sign           int8   `json:"sign,omitempty"`
+
+	AttributesDiff    bool     `json:"attributes_diff,omitempty"`
+	AttributesRemoved []string `json:"attributes_removed,omitempty"`
+}
+
+// StateChangeV1ToV2 converts a v1 row stored in the table of the given domain into a v2 row
+func StateChangeV1ToV2(domain string, c *StateChange) *StateChangeV2 {
+	v2 := &StateChangeV2{
+		EntityID:    c.EntityID,
+		Domain:      domain,
+		State:       c.State,
+		OldState:    c.OldState,
+		Attributes:  c.Attributes,
+		LastChanged: c.LastChanged,
+		LastUpdated: c.LastUpdated,
+		Cost:        c.Cost,
+		ValueDelta:  c.ValueDelta,
+		IsLate:      c.IsLate,
+		FlapCount:   c.FlapCount,
+		FlapStarted: c.FlapStarted,
+		EventHash:   c.EventHash,
+		Sign:        c.Sign,
+
+		ContextBatchID: c.ContextBatchID,
+
+		AttributesDiff:    c.AttributesDiff,
+		AttributesRemoved: c.AttributesRemoved,
+	}
+
+	if eventContext, ok := c.Context.(hass.EventContext); ok {
+		v2.ContextID = eventContext.ID
+		v2.ContextParentID = eventContext.ParentID
+		v2.ContextUserID = eventContext.UserID
+	}
+
+	if c.LastReported != "" {
+		lastReported := c.LastReported
+		v2.LastReported = &lastReported
+	}
+
+	return v2
+}
+
+// StateChangeV2ToV1 converts a v2 row into a v1 row
+func StateChangeV2ToV1(c *StateChangeV2) *StateChange {
+	v1 := &StateChange{
+		EntityID:    c.EntityID,
+		State:       c.State,
+		OldState:    c.OldState,
+		Attributes:  c.Attributes,
+		LastChanged: c.LastChanged,
+		LastUpdated: c.LastUpdated,
+		Cost:        c.Cost,
+		ValueDelta:  c.ValueDelta,
+		IsLate:      c.IsLate,
+		FlapCount:   c.FlapCount,
+		FlapStarted: c.FlapStarted,
+		EventHash:   c.EventHash,
+		Sign:        c.Sign,
+
+		ContextBatchID: c.ContextBatchID,
+
+		AttributesDiff:    c.AttributesDiff,
+		AttributesRemoved: c.AttributesRemoved,
+		Context: hass.EventContext{
+			ID:       c.ContextID,
+			ParentID: c.ContextParentID,
+			UserID:   c.ContextUserID,
+		},
+	}
+
+	if c.LastReported != nil {
+		v1.LastReported = *c.LastReported
+	}
+
+	return v1
+}
+
+// convertStateChanges converts v1 rows of the given domain table into rows of the given model.
+// Rows of tables without a domain, e.g. of a TableOverride, are of the domain of their entity.
+func convertStateChanges(values []any, domain string, model RowModel) []any {
+	if model == RowModelV1 {
+		return values
+	}
+
+	converted := make([]any, 0, len(values))
+	for _, value := range values {
+		if change, ok := value.(*StateChange); ok {
+			rowDomain := domain
+			if rowDomain == "" {
+				rowDomain, _, _ = strings.Cut(change.EntityID, ".")
+			}
+			converted = append(converted, StateChangeV1ToV2(rowDomain, change))
+		}
+	}
+	return converted
+}
@@ -0,0 +1,45 @@
+package ingestion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestStateChangeConversion(t *testing.T) {
+	parentID := "01J5RQTGS79C8T2CD2Y9Y9A36P"
+	v1 := &StateChange{
+		EntityID:    "sensor.energy",
+		State:       "12.5",
+		OldState:    "12",
+		Attributes:  map[string]any{"unit_of_measurement": "kWh"},
+		Context:     hass.EventContext{ID: "01J5RQTGS79C8T2CD2Y9Y9A36Q", ParentID: &parentID},
+		LastChanged: "2024-08-20T19:28:08.555689Z",
+		LastUpdated: "2024-08-20T20:32:00.295576Z",
+		Cost:        ptr(0.25),
+	}
+
+	v2 := StateChangeV1ToV2(hass.EntityNumericSensor, v1)
+	assert.Equal(t, hass.EntityNumericSensor, v2.Domain)
+	assert.Equal(t, "01J5RQTGS79C8T2CD2Y9Y9A36Q", v2.ContextID)
+	assert.Equal(t, &parentID, v2.ContextParentID)
+	assert.Nil(t, v2.ContextUserID)
+	assert.Nil(t, v2.LastReported, "missing last_reported is stored as NULL")
+
+	assert.Equal(t, v1, StateChangeV2ToV1(v2))
+}
+
+func TestParseRowModels(t *testing.T) {
+	models, err := ParseRowModels("v1, v2")
+	require.NoError(t, err)
+	assert.Equal(t, []RowModel{RowModelV1, RowModelV2}, models)
+
+	_, err = ParseRowModels("v3")
+	assert.Error(t, err)
+
+	assert.Equal(t, "light", RowModelV1.tableName("light"))
+	assert.Equal(t, "light_v2", RowModelV2.tableName("light"))
+}
@@ -0,0 +1,138 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// OrderCheckOptions select the rows checked by CheckOrder
+type OrderCheckOptions struct {
+	// Since bounds the rows checked by when they were received, all rows if zero
+	Since time.Time
+	// Tables are glob patterns of the tables checked, all tables of state changes if empty
+	Tables []string
+}
+
+// OrderTable are the out-of-order rows of a table
+type OrderTable struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Rows     uint64 `json:"rows"`
+	// OutOfOrder is the number of rows received after a row of the same entity with a later last_updated
+	OutOfOrder uint64 `json:"out_of_order"`
+	// Entities are the entities with out-of-order rows, the ones with most first
+	Entities []OrderEntity `json:"entities,omitempty"`
+}
+
+// OrderEntity are the out-of-order rows of an entity
+type OrderEntity struct {
+	EntityID   string `json:"entity_id"`
+	OutOfOrder uint64 `json:"out_of_order"`
+	// MaxLag is the largest difference between the last_updated of an out-of-order row and the latest
+	// last_updated of the entity received before it
+	MaxLag time.Duration `json:"max_lag"`
+}
+
+// CheckOrder scans the tables of state changes in the databases of the pipeline for rows of an entity received
+// after a row of the entity with a later last_updated, i.e. rows inserted out of order. Rows of the same insert
+// are in order, as batches are sorted by last_updated. Tables are the MergeTree tables with entity_id,
+// last_updated and received_at columns, including tables of domains created on demand and overflow tables.
+func (p *Pipeline) CheckOrder(ctx context.Context, opts OrderCheckOptions) ([]*OrderTable, error) {
+	q, ok := p.sink.(querier)
+	if !ok {
+		return nil, errors.New("sink does not support queries")
+	}
+
+	var tables []*OrderTable
+	for _, database := range p.databases() {
+		quoted := clickhouse.QuoteString(database)
+		query := fmt.Sprintf(`SELECT table FROM system.columns
+WHERE database = %s AND name IN ('entity_id', 'last_updated', 'received_at')
+	AND table IN (SELECT name FROM system.tables WHERE database = %s AND engine LIKE '%%MergeTree')
+GROUP BY table
+HAVING count() = 3
+ORDER BY table`, quoted, quoted)
+		err := q.Query(ctx, query, func(raw json.RawMessage) error {
+			var row struct {
+				Table string `json:"table"`
+			}
+			if err := json.Unmarshal(raw, &row); err != nil {
+				return err
+			}
+			if matchesAny(opts.Tables, row.Table) {
+				tables = append(tables, &OrderTable{Database: database, Table: row.Table})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query tables of database %s: %w", database, err)
+		}
+	}
+
+	for _, table := range tables {
+		if err := checkTableOrder(ctx, q, table, opts.Since); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+// checkTableOrder counts the rows of every entity of a table received after a row of the entity with a later
+// last_updated. Rows are ordered by received_at and, within an insert, by last_updated.
+func checkTableOrder(ctx context.Context, q querier, table *OrderTable, since time.Time) error {
+	where := ""
+	if !since.IsZero() {
+		where = fmt.Sprintf("WHERE received_at >= fromUnixTimestamp64Milli(%d)", since.UnixMilli())
+	}
+
+	query := fmt.Sprintf(`SELECT entity_id, count() AS row_count, countIf(last_updated < previous) AS out_of_order,
+	maxIf(dateDiff('millisecond', last_updated, previous), last_updated < previous) AS max_lag_ms
+FROM (
+	SELECT entity_id, last_updated,
+		max(last_updated) OVER (PARTITION BY entity_id ORDER BY received_at, last_updated ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING) AS previous
+	FROM %s.%s
+	%s
+)
+GROUP BY entity_id`, table.Database, table.Table, where)
+	err := q.Query(ctx, query, func(raw json.RawMessage) error {
+		var row struct {
+			EntityID   string `json:"entity_id"`
+			Rows       uint64 `json:"row_count,string"`
+			OutOfOrder uint64 `json:"out_of_order,string"`
+			MaxLagMs   int64  `json:"max_lag_ms,string"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return err
+		}
+
+		table.Rows += row.Rows
+		if row.OutOfOrder == 0 {
+			return nil
+		}
+		table.OutOfOrder += row.OutOfOrder
+		table.Entities = append(table.Entities, OrderEntity{
+			EntityID:   row.EntityID,
+			OutOfOrder: row.OutOfOrder,
+			MaxLag:     time.Duration(row.MaxLagMs) * time.Millisecond,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check the order of %s.%s: %w", table.Database, table.Table, err)
+	}
+
+	sort.Slice(table.Entities, func(i, j int) bool {
+		if table.Entities[i].OutOfOrder != table.Entities[j].OutOfOrder {
+			return table.Entities[i].OutOfOrder > table.Entities[j].OutOfOrder
+		}
+		return table.Entities[i].EntityID < table.Entities[j].EntityID
+	})
+	return nil
+}
@@ -0,0 +1,77 @@
+package ingestion
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// orderSink serves the tables with the columns of state changes and the order counts of their entities
+type orderSink struct {
+	tables  []string
+	entries map[string][]string
+	queries []string
+}
+
+func (s *orderSink) Execute(context.Context, string, io.ReadSeeker, ...clickhouse.QueryOption) error {
+	return nil
+}
+
+func (s *orderSink) Query(_ context.Context, query string, fn func(row json.RawMessage) error, _ ...clickhouse.QueryOption) error {
+	s.queries = append(s.queries, query)
+	rows := s.tables
+	if !strings.Contains(query, "FROM system.columns") {
+		rows = nil
+		for table, entries := range s.entries {
+			if strings.Contains(query, "FROM hass."+table+"\n") {
+				rows = entries
+			}
+		}
+	}
+	for _, row := range rows {
+		if err := fn(json.RawMessage(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPipeline_CheckOrder(t *testing.T) {
+	sink := &orderSink{
+		tables: []string{`{"table":"cover"}`, `{"table":"light"}`, `{"table":"numeric_sensor"}`},
+		entries: map[string][]string{
+			"light": {
+				`{"entity_id":"light.kitchen","row_count":"10","out_of_order":"0","max_lag_ms":"0"}`,
+			},
+			"numeric_sensor": {
+				`{"entity_id":"sensor.power","row_count":"100","out_of_order":"2","max_lag_ms":"1500"}`,
+				`{"entity_id":"sensor.temperature","row_count":"50","out_of_order":"5","max_lag_ms":"250"}`,
+				`{"entity_id":"sensor.humidity","row_count":"50","out_of_order":"0","max_lag_ms":"0"}`,
+			},
+		},
+	}
+	p := NewPipeline(nil, sink, "hass")
+
+	since := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	tables, err := p.CheckOrder(context.Background(), OrderCheckOptions{Since: since, Tables: []string{"light", "numeric_*"}})
+	require.NoError(t, err)
+	assert.Equal(t, []*OrderTable{
+		{Database: "hass", Table: "light", Rows: 10},
+		{Database: "hass", Table: "numeric_sensor", Rows: 200, OutOfOrder: 7, Entities: []OrderEntity{
+			{EntityID: "sensor.temperature", OutOfOrder: 5, MaxLag: 250 * time.Millisecond},
+			{EntityID: "sensor.power", OutOfOrder: 2, MaxLag: 1500 * time.Millisecond},
+		}},
+	}, tables)
+
+	// Tables are discovered once and scanned from the given time only
+	require.Len(t, sink.queries, 3)
+	assert.Contains(t, sink.queries[1], "WHERE received_at >= fromUnixTimestamp64Milli(1767312000000)")
+}
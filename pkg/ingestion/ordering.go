@@ -0,0 +1,84 @@
+package ingestion
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+// tableSequencer serializes a stage (e.g. inserts) of batches of the same table in the order the batches
+// were produced, while batches of different tables are still processed concurrently
+type tableSequencer struct {
+	mtx  sync.Mutex
+	last map[string]chan struct{}
+}
+
+func newTableSequencer() *tableSequencer {
+	return &tableSequencer{last: make(map[string]chan struct{})}
+}
+
+// next reserves the next batch of a table. The batch must wait for the returned channel
+// to be closed and call done once finished, whatever its outcome.
+func (s *tableSequencer) next(table string) (<-chan struct{}, func()) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	prev := s.last[table]
+	current := make(chan struct{})
+	s.last[table] = current
+
+	var once sync.Once
+	return prev, func() {
+		once.Do(func() { close(current) })
+	}
+}
+
+// wait blocks until the previous batch of the table has finished
+func (s *tableSequencer) wait(ctx context.Context, prev <-chan struct{}) error {
+	if prev == nil {
+		return nil
+	}
+
+	select {
+	case <-prev:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// transformTask is a batch of events of a single table waiting to be transformed
+type transformTask struct {
+	batch []*hass.EventMessage
+	prev  <-chan struct{}
+	done  func()
+
+	// insertPrev and insertDone reserve the insert of the batch, see tableSequencer.next
+	insertPrev <-chan struct{}
+	insertDone func()
+}
+
+// insertTask is a transformed batch waiting to be inserted
+type insertTask struct {
+	batch *preparedBatch
+	prev  <-chan struct{}
+	done  func()
+}
+
+// sortByLastUpdated orders events of a batch by the time their state was updated,
+// so rows of every entity are inserted in last_updated order
+func sortByLastUpdated(batch []*hass.EventMessage) {
+	sort.SliceStable(batch, func(i, j int) bool {
+		return lastUpdated(batch[i]).Before(lastUpdated(batch[j]))
+	})
+}
+
+func lastUpdated(event *hass.EventMessage) time.Time {
+	if event.Event.Data.NewState == nil {
+		return time.Time{}
+	}
+	return event.Event.Data.NewState.LastUpdated
+}
@@ -0,0 +1,65 @@
+package ingestion
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestInsertSequencer(t *testing.T) {
+	s := newTableSequencer()
+
+	var mtx sync.Mutex
+	var order []int
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		prev, done := s.next("sensor")
+		wg.Add(1)
+
+		// Later inserts are started first, they still finish in order
+		go func(i int) {
+			defer wg.Done()
+			defer done()
+			time.Sleep(time.Duration(5-i) * time.Millisecond)
+			assert.NoError(t, s.wait(context.Background(), prev))
+
+			mtx.Lock()
+			order = append(order, i)
+			mtx.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, order)
+
+	// Other tables are not blocked
+	prev, _ := s.next("light")
+	assert.Nil(t, prev)
+}
+
+func TestSortByLastUpdated(t *testing.T) {
+	now := time.Now()
+	event := func(entityID string, lastUpdated time.Time) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{Data: hass.EventData{
+			EntityID: entityID,
+			NewState: &hass.State{EntityID: entityID, LastUpdated: lastUpdated},
+		}}}
+	}
+
+	batch := []*hass.EventMessage{
+		event("sensor.a", now.Add(2*time.Second)),
+		event("sensor.b", now),
+		event("sensor.a", now.Add(time.Second)),
+	}
+	sortByLastUpdated(batch)
+
+	assert.Equal(t, now, batch[0].Event.Data.NewState.LastUpdated)
+	assert.Equal(t, now.Add(time.Second), batch[1].Event.Data.NewState.LastUpdated)
+	assert.Equal(t, now.Add(2*time.Second), batch[2].Event.Data.NewState.LastUpdated)
+}
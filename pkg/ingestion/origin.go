@@ -0,0 +1,108 @@
+package ingestion
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// Origins of Home Assistant events
+const (
+	OriginLocal  = "LOCAL"
+	OriginRemote = "REMOTE"
+)
+
+// Actors of state changes, told apart by the user ID of their context
+const (
+	ActorUser       = "user"
+	ActorAutomation = "automation"
+)
+
+// OriginConfig selects state changes by where they originate from
+type OriginConfig struct {
+	// Origins are the allowed event origins, e.g. LOCAL to exclude events mirrored from remote instances.
+	// Empty allows all origins.
+	Origins []string
+	// Actor allows only state changes caused by a user (a context with a user ID), or by automations and
+	// integrations (a context without a user ID). Empty allows both.
+	Actor string
+}
+
+// ParseOriginConfig parses a comma-separated list of origins and an actor
+func ParseOriginConfig(origins, actor string) (OriginConfig, error) {
+	var conf OriginConfig
+	for _, origin := range strings.Split(origins, ",") {
+		switch origin = strings.ToUpper(strings.TrimSpace(origin)); origin {
+		case "":
+		case OriginLocal, OriginRemote:
+			conf.Origins = append(conf.Origins, origin)
+		default:
+			return conf, fmt.Errorf("invalid origin %q, expected %s or %s", origin, OriginLocal, OriginRemote)
+		}
+	}
+
+	switch actor = strings.TrimSpace(actor); actor {
+	case "", ActorUser, ActorAutomation:
+		conf.Actor = actor
+	default:
+		return conf, fmt.Errorf("invalid actor %q, expected %s or %s", actor, ActorUser, ActorAutomation)
+	}
+
+	return conf, nil
+}
+
+// WithOriginFilter drops state changes not matching the allowed origins and actor, e.g. to ingest only
+// user-driven changes or to exclude changes mirrored from remote instances
+func WithOriginFilter(conf OriginConfig) PipelineOption {
+	return func(p *Pipeline) {
+		p.filters = append(p.filters, &originFilter{conf: conf})
+	}
+}
+
+type originFilter struct {
+	conf OriginConfig
+}
+
+func (f *originFilter) stageName() string {
+	return StageOrigin
+}
+
+// Allow reports whether the state change event has an allowed origin and actor
+func (f *originFilter) Allow(event *hass.EventMessage) bool {
+	if len(f.conf.Origins) > 0 && !f.allowsOrigin(event.Event.Origin) {
+		metrics.EventsOriginFiltered.WithLabelValues("origin").Inc()
+		return false
+	}
+
+	if f.conf.Actor == "" {
+		return true
+	}
+
+	userID := event.Event.Context.UserID
+	if userID == nil && event.Event.Data.NewState != nil {
+		userID = event.Event.Data.NewState.Context.UserID
+	}
+
+	actor := ActorAutomation
+	if userID != nil && *userID != "" {
+		actor = ActorUser
+	}
+
+	if actor != f.conf.Actor {
+		metrics.EventsOriginFiltered.WithLabelValues("actor").Inc()
+		return false
+	}
+
+	return true
+}
+
+func (f *originFilter) allowsOrigin(origin string) bool {
+	for _, allowed := range f.conf.Origins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
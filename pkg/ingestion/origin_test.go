@@ -0,0 +1,43 @@
+package ingestion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestParseOriginConfig(t *testing.T) {
+	conf, err := ParseOriginConfig("local, REMOTE", ActorUser)
+	require.NoError(t, err)
+	assert.Equal(t, OriginConfig{Origins: []string{OriginLocal, OriginRemote}, Actor: ActorUser}, conf)
+
+	_, err = ParseOriginConfig("cloud", "")
+	assert.Error(t, err)
+	_, err = ParseOriginConfig("", "admin")
+	assert.Error(t, err)
+}
+
+func TestOriginFilter(t *testing.T) {
+	userID := "abc"
+	event := func(origin string, userID *string) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{
+			Origin:  origin,
+			Context: hass.EventContext{UserID: userID},
+		}}
+	}
+
+	local := &originFilter{conf: OriginConfig{Origins: []string{OriginLocal}}}
+	assert.True(t, local.Allow(event("LOCAL", nil)))
+	assert.False(t, local.Allow(event("REMOTE", nil)))
+
+	users := &originFilter{conf: OriginConfig{Actor: ActorUser}}
+	assert.True(t, users.Allow(event("LOCAL", &userID)))
+	assert.False(t, users.Allow(event("LOCAL", nil)))
+
+	automations := &originFilter{conf: OriginConfig{Actor: ActorAutomation}}
+	assert.True(t, automations.Allow(event("REMOTE", nil)))
+	assert.False(t, automations.Allow(event("LOCAL", &userID)))
+}
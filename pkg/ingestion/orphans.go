@@ -0,0 +1,195 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// OrphanTable is a table in a database of the pipeline that the current configuration does not produce,
+// e.g. the table of a removed table override or of a disabled feature
+type OrphanTable struct {
+	Database   string `json:"database"`
+	Name       string `json:"name"`
+	Engine     string `json:"engine"`
+	TotalRows  uint64 `json:"total_rows"`
+	TotalBytes uint64 `json:"total_bytes"`
+}
+
+// WithOrphanReport logs the orphaned tables of the databases of the pipeline on startup and exposes
+// their number as a metric. See FindOrphans.
+func WithOrphanReport() PipelineOption {
+	return func(p *Pipeline) {
+		p.orphanReport = true
+	}
+}
+
+// FindOrphans returns the tables of the databases of the pipeline that are not in its catalog. Views, materialized
+// views, dictionaries and their inner tables are not considered, as hass2ch never creates them. Neither are the state
+// change tables of domains created on demand, e.g. cover, whose entities are of the domain they are named after.
+func (p *Pipeline) FindOrphans(ctx context.Context) ([]OrphanTable, error) {
+	q, ok := p.sink.(querier)
+	if !ok {
+		return nil, errors.New("sink does not support queries")
+	}
+
+	catalog, err := p.Catalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(catalog.Tables))
+	for _, table := range catalog.Tables {
+		known[table.Database+"."+table.Name] = true
+	}
+
+	var orphans []OrphanTable
+	for _, database := range p.databases() {
+		quoted := clickhouse.QuoteString(database)
+		query := fmt.Sprintf(`SELECT name, engine, ifNull(total_rows, 0) AS total_rows, ifNull(total_bytes, 0) AS total_bytes,
+	name IN (SELECT table FROM system.columns WHERE database = %s AND name = 'entity_id') AS has_entity_id
+FROM system.tables
+WHERE database = %s AND NOT is_temporary AND engine NOT IN ('View', 'MaterializedView', 'LiveView', 'Dictionary')
+ORDER BY name`, quoted, quoted)
+		type candidate struct {
+			OrphanTable
+			hasEntityID bool
+		}
+		var candidates []candidate
+		err := q.Query(ctx, query, func(raw json.RawMessage) error {
+			var row struct {
+				Name        string `json:"name"`
+				Engine      string `json:"engine"`
+				TotalRows   uint64 `json:"total_rows,string"`
+				TotalBytes  uint64 `json:"total_bytes,string"`
+				HasEntityID uint8  `json:"has_entity_id"`
+			}
+			if err := json.Unmarshal(raw, &row); err != nil {
+				return err
+			}
+
+			if known[database+"."+row.Name] || strings.HasPrefix(row.Name, ".inner") {
+				return nil
+			}
+			candidates = append(candidates, candidate{
+				OrphanTable: OrphanTable{
+					Database:   database,
+					Name:       row.Name,
+					Engine:     row.Engine,
+					TotalRows:  row.TotalRows,
+					TotalBytes: row.TotalBytes,
+				},
+				hasEntityID: row.HasEntityID == 1,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query tables of database %s: %w", database, err)
+		}
+
+		for _, candidate := range candidates {
+			if candidate.hasEntityID {
+				domainTable, err := p.isDomainTable(ctx, q, database, candidate.Name)
+				if err != nil {
+					return nil, err
+				}
+				if domainTable {
+					continue
+				}
+			}
+			orphans = append(orphans, candidate.OrphanTable)
+		}
+	}
+
+	return orphans, nil
+}
+
+// isDomainTable reports whether a table with entities is the state change table of the domain of its entities,
+// taking the suffixes of the row models of the pipeline into account, e.g. cover_v2 holding cover entities.
+// An empty table has no entities to tell its domain by, so it is kept as the table of a domain created on demand
+// whose entities have not changed yet.
+func (p *Pipeline) isDomainTable(ctx context.Context, q querier, database, table string) (bool, error) {
+	domain := table
+	for _, model := range p.rowModels {
+		if model == RowModelV1 {
+			continue
+		}
+		if trimmed, ok := strings.CutSuffix(table, "_"+string(model)); ok {
+			domain = trimmed
+		}
+	}
+
+	var entityDomain string
+	var rows uint64
+	query := fmt.Sprintf("SELECT splitByChar('.', any(entity_id))[1] AS domain, count() AS row_count FROM %s.%s", database, table)
+	err := q.Query(ctx, query, func(raw json.RawMessage) error {
+		var row struct {
+			Domain string `json:"domain"`
+			Rows   uint64 `json:"row_count,string"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return err
+		}
+		entityDomain = row.Domain
+		rows = row.Rows
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to query the domain of the entities of %s.%s: %w", database, table, err)
+	}
+
+	return rows == 0 || entityDomain == domain, nil
+}
+
+// PruneOrphans drops orphaned tables, or moves them into the archive database if it is set,
+// creating the database if it does not exist
+func (p *Pipeline) PruneOrphans(ctx context.Context, orphans []OrphanTable, archiveDatabase string) error {
+	if archiveDatabase != "" {
+		if err := p.sink.Execute(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", archiveDatabase), nil); err != nil {
+			return fmt.Errorf("failed to create archive database %s: %w", archiveDatabase, err)
+		}
+	}
+
+	for _, orphan := range orphans {
+		table := orphan.Database + "." + orphan.Name
+		statement := fmt.Sprintf("DROP TABLE IF EXISTS %s", table)
+		if archiveDatabase != "" {
+			statement = fmt.Sprintf("RENAME TABLE %s TO %s.%s", table, archiveDatabase, orphan.Name)
+		}
+		if err := p.sink.Execute(ctx, statement, nil); err != nil {
+			return fmt.Errorf("failed to prune orphaned table %s: %w", table, err)
+		}
+		log.Info().Str("table", table).Str("archive", archiveDatabase).Msg("pruned orphaned table")
+	}
+
+	return nil
+}
+
+// reportOrphans logs the orphaned tables on startup if enabled. Failures are logged, as the report is informational.
+func (p *Pipeline) reportOrphans(ctx context.Context) {
+	if !p.orphanReport {
+		return
+	}
+
+	orphans, err := p.FindOrphans(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to find orphaned tables")
+		return
+	}
+
+	metrics.OrphanedTables.Set(float64(len(orphans)))
+	for _, orphan := range orphans {
+		log.Warn().
+			Str("table", orphan.Database+"."+orphan.Name).
+			Str("engine", orphan.Engine).
+			Uint64("rows", orphan.TotalRows).
+			Uint64("bytes", orphan.TotalBytes).
+			Msg("table is not produced by the current configuration, prune it with the orphans command")
+	}
+}
@@ -0,0 +1,94 @@
+package ingestion
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// orphanSink serves the domains of the entities of tables in addition to the rows of a migrationSink,
+// tables with an empty domain have no rows
+type orphanSink struct {
+	*migrationSink
+	domains map[string]string
+}
+
+func (s *orphanSink) Query(ctx context.Context, query string, fn func(row json.RawMessage) error, opts ...clickhouse.QueryOption) error {
+	for table, domain := range s.domains {
+		if strings.HasSuffix(query, "FROM hass."+table) {
+			rows := "1"
+			if domain == "" {
+				rows = "0"
+			}
+			return fn(json.RawMessage(`{"domain":"` + domain + `","row_count":"` + rows + `"}`))
+		}
+	}
+	// The query of tables filters them by their columns
+	if strings.Contains(query, "FROM system.tables") {
+		for _, row := range s.tables {
+			if err := fn(json.RawMessage(row)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.migrationSink.Query(ctx, query, fn, opts...)
+}
+
+func TestPipeline_FindOrphans(t *testing.T) {
+	sink := &orphanSink{
+		migrationSink: &migrationSink{
+			columns: []string{`{"table":"light_overflow","name":"state","type":"String"}`},
+			tables: []string{
+				`{"name":"light","engine":"MergeTree","total_rows":"10","total_bytes":"100","has_entity_id":1}`,
+				`{"name":"light_overflow","engine":"MergeTree","total_rows":"1","total_bytes":"10","has_entity_id":1}`,
+				`{"name":"cover","engine":"MergeTree","total_rows":"5","total_bytes":"50","has_entity_id":1}`,
+				`{"name":"cover_v2","engine":"MergeTree","total_rows":"5","total_bytes":"50","has_entity_id":1}`,
+				`{"name":"power","engine":"MergeTree","total_rows":"42","total_bytes":"4200","has_entity_id":1}`,
+				`{"name":"climate","engine":"MergeTree","total_rows":"0","total_bytes":"0","has_entity_id":1}`,
+				`{"name":".inner_id.0f6c","engine":"AggregatingMergeTree","total_rows":"0","total_bytes":"0","has_entity_id":0}`,
+			},
+		},
+		// Tables of domains created on demand hold entities of their domain, override tables of other domains.
+		// An empty table of a domain created on demand has no entities to tell its domain by.
+		domains: map[string]string{"cover": "cover", "cover_v2": "cover", "power": "sensor", "climate": ""},
+	}
+	p := NewPipeline(nil, sink, "hass")
+
+	orphans, err := p.FindOrphans(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []OrphanTable{
+		// Tables of a row model that is not configured are orphaned
+		{Database: "hass", Name: "cover_v2", Engine: "MergeTree", TotalRows: 5, TotalBytes: 50},
+		{Database: "hass", Name: "power", Engine: "MergeTree", TotalRows: 42, TotalBytes: 4200},
+	}, orphans)
+
+	// Tables of the configuration are not orphaned
+	overrides, err := ParseTableOverrides("sensor.power_*=power", "", "", "")
+	require.NoError(t, err)
+	orphans, err = NewPipeline(nil, sink, "hass", WithTableOverrides(overrides...), WithRowModels(RowModelV1, RowModelV2)).FindOrphans(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+}
+
+func TestPipeline_PruneOrphans(t *testing.T) {
+	orphans := []OrphanTable{{Database: "hass", Name: "power"}, {Database: "hass", Name: "energy"}}
+
+	sink := &migrationSink{}
+	require.NoError(t, NewPipeline(nil, sink, "hass").PruneOrphans(context.Background(), orphans, ""))
+	assert.Equal(t, []string{"DROP TABLE IF EXISTS hass.power", "DROP TABLE IF EXISTS hass.energy"}, sink.executed)
+
+	sink = &migrationSink{}
+	require.NoError(t, NewPipeline(nil, sink, "hass").PruneOrphans(context.Background(), orphans, "hass_archive"))
+	assert.Equal(t, []string{
+		"CREATE DATABASE IF NOT EXISTS hass_archive",
+		"RENAME TABLE hass.power TO hass_archive.power",
+		"RENAME TABLE hass.energy TO hass_archive.energy",
+	}, sink.executed)
+}
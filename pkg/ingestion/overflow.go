@@ -0,0 +1,77 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// overflowTableSuffix is appended to the name of a table to get its String-typed sibling table
+// storing rows whose state does not fit the state type of the table
+const overflowTableSuffix = "_overflow"
+
+// fitsStateType reports whether the states of a row can be coerced into the state type of its table.
+// Empty values stand for skipped old states and are accepted.
+func fitsStateType(stateType string, change *StateChange) bool {
+	for _, value := range []any{change.State, change.OldState} {
+		s, ok := value.(string)
+		if !ok || s == "" {
+			continue
+		}
+
+		var err error
+		switch stateType {
+		case "Float64", "Nullable(Float64)":
+			_, err = strconv.ParseFloat(s, 64)
+		case "Int64":
+			_, err = strconv.ParseInt(s, 10, 64)
+		default:
+			if strings.HasPrefix(stateType, "Enum8(") && !enumTypeHasValue(stateType, s) {
+				return false
+			}
+		}
+		if err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeOverflow stores rows rejected by fitsStateType in the overflow table of their table,
+// preserving them until the schema of the table is changed
+func (p *Pipeline) writeOverflow(ctx context.Context, batchID, database, table string, rows []any) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	model := p.rowModels[0]
+	overflowTable := model.tableName(table) + overflowTableSuffix
+
+	tableKey := fmt.Sprintf("%s.%s", database, overflowTable)
+	if !p.hasTable(tableKey) {
+		ddl, err := p.stateChangeDDL(model, database, overflowTable, table, "String")
+		if err == nil {
+			err = createStateChangeTable(ctx, p.sink, ddl, database, overflowTable, p.tableColumns(table))
+		}
+		if err != nil {
+			log.Error().Err(err).Str("table", tableKey).Int("rows", len(rows)).Msg("failed to create overflow table, rows are lost")
+			return fmt.Errorf("failed to create overflow table %s: %w", tableKey, err)
+		}
+		p.markTable(tableKey)
+	}
+
+	metrics.OverflowRows.WithLabelValues(table).Add(float64(len(rows)))
+	log.Warn().
+		Str("database", database).
+		Str("table", table).
+		Int("rows", len(rows)).
+		Msg("states do not fit the table type, storing rows in the overflow table")
+
+	return p.insertBatch(ctx, batchID, database, overflowTable, convertStateChanges(rows, p.tableDomain(table), model), len(rows), 0)
+}
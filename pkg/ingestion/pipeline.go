@@ -0,0 +1,968 @@
+package ingestion
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/channel"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+	"github.com/jkaflik/hass2ch/pkg/pool"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+)
+
+// Source is a source of Home Assistant events and states. It is implemented by *hass.Client.
+type Source interface {
+	SubscribeEvents(ctx context.Context, opts ...hass.SubscribeEventsOption) (chan *hass.EventMessage, error)
+	GetStates(ctx context.Context) ([]hass.State, error)
+}
+
+// Sink executes ClickHouse queries. It is implemented by *clickhouse.Client.
+type Sink interface {
+	Execute(ctx context.Context, query string, body io.ReadSeeker, opts ...clickhouse.QueryOption) error
+}
+
+// Inserter is implemented by sinks consuming rows without encoding them as JSONEachRow,
+// e.g. *clickhouse.NativeClient and SinkFunc. Rows are inserted with Insert if the sink implements it.
+type Inserter interface {
+	Insert(ctx context.Context, database, table string, rows []any, opts ...clickhouse.QueryOption) error
+}
+
+// Pipeline ingests state changes of Home Assistant into ClickHouse tables
+type Pipeline struct {
+	source   Source
+	sink     Sink
+	database string
+	acker    Acknowledger
+
+	tableDatabases map[string]string
+	labels         []Label
+
+	transformers        []Transformer
+	attributeChanges    bool
+	availability        bool
+	attributeColumns    map[string][]string
+	strict              bool
+	heartbeats          *heartbeatTracker
+	ddlTemplate         *DDLTemplateConfig
+	topology            *ClusterTopology
+	databaseConf        *DatabaseConfig
+	noDDL               bool
+	insertStats         *insertStatsBuffer
+	asyncInsertFeedback time.Duration
+	restartLog          bool
+	initialSnapshot     bool
+	gapBackfill         bool
+	statistics          *StatisticsConfig
+	entityMetadata      *entityMetadata
+	eventTypes          []hass.EventType
+	eventHash           *EventHashConfig
+	tableEngines        *TableEngineConfig
+	storageTiering      *StorageTieringConfig
+	tableOverrides      map[string]*TableOverride
+	tableRoutes         []tableRoute
+	migrateSchema       bool
+	orphanReport        bool
+	shard               *Shard
+	filters             []Filter
+	flaps               *flapDetector
+	contextGroups       *contextGrouper
+	stateEnums          map[string]string
+	stateLabels         map[string]map[string]string
+	stageOrder          []string
+	traffic             *TrafficRecorder
+
+	insertWorkers      int
+	tableInsertWorkers int
+	transformWorkers   int
+	batchSize          int
+	batchWait          time.Duration
+	batchAlign         time.Duration
+	batchBytes         int
+	pendingBytes       int
+	eventBuffer        int
+	softMemoryLimit    uint64
+	backpressure       *backpressure
+	walDir             string
+	walMaxSize         uint64
+	wal                *wal
+	rowModels          []RowModel
+	clock              clock.Clock
+
+	deadLetterDir string
+	deadLetterMtx sync.Mutex
+
+	tableExistsMtx sync.Mutex
+	tableExists    map[string]bool
+
+	stats     *pipelineStats
+	queues    *tableQueues
+	readiness *readiness
+	sequences *sequenceTracker
+}
+
+const (
+	defaultInsertWorkers    = 4
+	defaultTableWorkers     = 4
+	defaultTransformWorkers = 2
+	defaultBatchSize        = 100_000
+	defaultBatchWait        = time.Second
+	defaultEventBuffer      = 1_000
+)
+
+// PipelineOption is a function that configures a Pipeline
+type PipelineOption func(*Pipeline)
+
+// WithInsertWorkers sets the number of batches inserted into ClickHouse concurrently
+func WithInsertWorkers(workers int) PipelineOption {
+	return func(p *Pipeline) {
+		p.insertWorkers = workers
+	}
+}
+
+// WithTableInsertWorkers sets the number of tables of a single batch inserted concurrently,
+// for batches whose rows are routed to more than one table
+func WithTableInsertWorkers(workers int) PipelineOption {
+	return func(p *Pipeline) {
+		p.tableInsertWorkers = workers
+	}
+}
+
+// WithTransformWorkers sets the number of batches resolved and transformed concurrently
+func WithTransformWorkers(workers int) PipelineOption {
+	return func(p *Pipeline) {
+		p.transformWorkers = workers
+	}
+}
+
+// WithBatchSize sets the maximum number of events in a batch of a single table
+func WithBatchSize(size int) PipelineOption {
+	return func(p *Pipeline) {
+		p.batchSize = size
+	}
+}
+
+// WithBatchWait sets the maximum time events wait in a batch before it is inserted
+func WithBatchWait(wait time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.batchWait = wait
+	}
+}
+
+// WithBatchAlignment inserts all pending batches at every multiple of align of the wall clock, e.g. at :00
+// of every minute, instead of after the batch wait, so inserts have a regular cadence
+func WithBatchAlignment(align time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.batchAlign = align
+	}
+}
+
+// WithEventBuffer sets the number of filtered events buffered in front of the batcher
+func WithEventBuffer(size int) PipelineOption {
+	return func(p *Pipeline) {
+		p.eventBuffer = size
+	}
+}
+
+// WithClock sets the clock timing batches, tickers of background tasks and timestamps of rows written by
+// the pipeline itself, e.g. a fake clock in tests
+func WithClock(clk clock.Clock) PipelineOption {
+	return func(p *Pipeline) {
+		p.clock = clk
+	}
+}
+
+// WithTableDatabases routes tables (e.g. light, attribute_changes) to databases other than the pipeline database
+func WithTableDatabases(databases map[string]string) PipelineOption {
+	return func(p *Pipeline) {
+		p.tableDatabases = databases
+	}
+}
+
+// ParseTableDatabases parses table routing rules in the form of "table=database,table=database"
+func ParseTableDatabases(s string) (map[string]string, error) {
+	databases := make(map[string]string)
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		table, database, ok := strings.Cut(part, "=")
+		table, database = strings.TrimSpace(table), strings.TrimSpace(database)
+		if !ok || table == "" || database == "" {
+			return nil, fmt.Errorf("invalid table database %q: expected table=database", part)
+		}
+
+		databases[table] = database
+	}
+
+	return databases, nil
+}
+
+// NewPipeline creates a pipeline ingesting events of the source into tables of the database in the sink
+func NewPipeline(source Source, sink Sink, database string, opts ...PipelineOption) *Pipeline {
+	p := &Pipeline{
+		source:             source,
+		sink:               sink,
+		database:           database,
+		insertWorkers:      defaultInsertWorkers,
+		tableInsertWorkers: defaultTableWorkers,
+		transformWorkers:   defaultTransformWorkers,
+		batchSize:          defaultBatchSize,
+		batchWait:          defaultBatchWait,
+		eventBuffer:        defaultEventBuffer,
+		rowModels:          []RowModel{RowModelV1},
+		stats:              newPipelineStats(),
+		queues:             newTableQueues(),
+		readiness:          &readiness{grace: defaultReadinessGrace},
+		sequences:          newSequenceTracker(),
+		clock:              clock.Real,
+	}
+
+	if acker, ok := source.(Acknowledger); ok {
+		p.acker = acker
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.traffic != nil && p.sink != nil {
+		p.sink = p.traffic.sink(p.sink)
+	}
+
+	return p
+}
+
+func (p *Pipeline) Run(ctx context.Context) (err error) {
+	log.Info().Msg("starting pipeline")
+
+	p.stats.setState(PipelineStateStarting)
+	defer func() {
+		if err != nil {
+			p.stats.setError(err)
+		}
+		p.stats.setState(PipelineStateStopped)
+	}()
+
+	if err := p.orderStages(); err != nil {
+		return fmt.Errorf("invalid stage order: %w", err)
+	}
+
+	// Set connection status metrics
+	metrics.HassConnectionStatus.Set(1)
+	metrics.CHConnectionStatus.Set(1)
+
+	p.tableExists = make(map[string]bool)
+
+	if err := p.CheckGrants(ctx); err != nil {
+		metrics.CHConnectionStatus.Set(0)
+		return err
+	}
+
+	if err := p.createDatabases(ctx); err != nil {
+		metrics.CHConnectionStatus.Set(0)
+		return err
+	}
+
+	if err := p.discoverTopology(ctx); err != nil {
+		metrics.CHConnectionStatus.Set(0)
+		return err
+	}
+
+	if err := p.migrate(ctx); err != nil {
+		metrics.CHConnectionStatus.Set(0)
+		return err
+	}
+
+	p.reportOrphans(ctx)
+
+	if err := p.writeStateLabels(ctx); err != nil {
+		metrics.CHConnectionStatus.Set(0)
+		return err
+	}
+
+	if p.walDir != "" {
+		if p.wal, err = openWAL(p.walDir, p.walMaxSize); err != nil {
+			return err
+		}
+		go recovery.Run("pipeline_wal", func() {
+			p.replayWAL(ctx)
+		})
+	}
+
+	// Batches of different tables are transformed and inserted concurrently, batches of the same table in order
+	transformSequencer := newTableSequencer()
+	insertSequencer := newTableSequencer()
+	inserts := pool.New(ctx, "insert", p.insertWorkers, func(ctx context.Context, task insertTask) error {
+		defer task.done()
+		if err := insertSequencer.wait(ctx, task.prev); err != nil {
+			return err
+		}
+
+		// Events of batches not fully stored stay in the upstream buffer of the source, including the state changes
+		// collapsed into their rows
+		superseded := p.flaps.takeSuperseded(task.batch.events)
+		if err := p.insertPreparedBatch(ctx, task.batch); err == nil {
+			p.ack(task.batch.events)
+			p.ack(superseded)
+		}
+		p.dequeued(task.batch.events)
+		metrics.BatchProcessingDuration.Observe(time.Since(task.batch.started).Seconds())
+		return nil
+	})
+	defer inserts.Close()
+
+	transforms := pool.New(ctx, "transform", p.transformWorkers, func(ctx context.Context, task transformTask) error {
+		defer task.done()
+		if err := transformSequencer.wait(ctx, task.prev); err != nil {
+			task.insertDone()
+			p.dequeued(task.batch)
+			return err
+		}
+
+		// The insert is submitted before the next batch of the table is transformed, keeping inserts in order
+		err := inserts.Submit(ctx, insertTask{batch: p.prepareBatch(task.batch), prev: task.insertPrev, done: task.insertDone})
+		if err != nil {
+			task.insertDone()
+			p.dequeued(task.batch)
+		}
+		return err
+	})
+	defer transforms.Close()
+
+	if err := p.seed(ctx); err != nil {
+		metrics.HassConnectionStatus.Set(0)
+		return fmt.Errorf("failed to get initial states: %w", err)
+	}
+
+	eventsChan, err := p.source.SubscribeEvents(ctx,
+		hass.SubscribeEventsWithEventType(hass.EventTypeStateChanged),
+		hass.SubscribeEventsWithErrorHandler(p.subscriptionErrorHandler(ctx)),
+	)
+	if err != nil {
+		metrics.HassConnectionStatus.Set(0)
+		return fmt.Errorf("failed to get states: %w", err)
+	}
+
+	p.readiness.started(p.clock.Now())
+	p.stats.setState(PipelineStateRunning)
+
+	if p.restartLog {
+		if err := p.watchRestarts(ctx); err != nil {
+			return err
+		}
+	}
+
+	if len(p.eventTypes) > 0 {
+		if err := p.watchEventTypes(ctx); err != nil {
+			return err
+		}
+	}
+
+	if p.entityMetadata != nil {
+		if source, ok := p.source.(RegistrySource); ok {
+			if err := p.watchRegistries(ctx, source); err != nil {
+				return err
+			}
+		} else {
+			log.Error().Msg("the source cannot list registries, entity metadata is disabled")
+		}
+	}
+
+	if p.heartbeats != nil {
+		go recovery.Run("pipeline_heartbeats", func() {
+			p.emitHeartbeats(ctx)
+		})
+	}
+
+	go recovery.Run("pipeline_queue_ages", func() {
+		p.reportQueueAges(ctx)
+	})
+
+	if p.statistics != nil {
+		if source, ok := p.source.(StatisticsSource); ok {
+			go recovery.Run("pipeline_statistics", func() {
+				p.importStatistics(ctx, source)
+			})
+		} else {
+			log.Error().Msg("the source cannot read statistics, their import is disabled")
+		}
+	}
+
+	if p.insertStats != nil {
+		go recovery.Run("pipeline_insert_stats", func() {
+			p.flushInsertStats(ctx)
+		})
+	}
+
+	if p.asyncInsertFeedback > 0 {
+		if q, ok := p.sink.(querier); ok {
+			go recovery.Run("pipeline_async_inserts", func() {
+				p.watchAsyncInserts(ctx, q)
+			})
+		} else {
+			log.Error().Msg("the sink cannot run queries, asynchronous insert feedback is disabled")
+		}
+	}
+
+	// State changes of the initial snapshot and missed while subscriptions were paused by backpressure
+	snapshots := make(chan *hass.EventMessage)
+	if p.initialSnapshot {
+		go recovery.Run("pipeline_initial_snapshot", func() {
+			p.sendInitialSnapshot(ctx, snapshots)
+		})
+	}
+	if p.backpressure != nil {
+		if pauser, ok := p.source.(Pauser); ok {
+			go recovery.Run("pipeline_backpressure", func() {
+				p.watchBackpressure(ctx, pauser, snapshots)
+			})
+		} else {
+			log.Error().Msg("the source cannot pause subscriptions, backpressure is disabled")
+		}
+	}
+
+	// Create a wrapper that counts received events
+	countedEventsChan := make(chan *hass.EventMessage)
+	go func() {
+		defer close(countedEventsChan)
+		recovery.Run("pipeline_receive", func() {
+			var settle <-chan time.Time
+			if p.flaps != nil {
+				ticker := p.clock.NewTicker(flapCheckInterval)
+				defer ticker.Stop()
+				settle = ticker.C()
+			}
+
+			for {
+				select {
+				case event, ok := <-eventsChan:
+					if !ok {
+						return
+					}
+					if p.traffic != nil {
+						p.traffic.recordEvent(event)
+					}
+					metrics.EventsReceived.Inc()
+					p.stats.eventReceived()
+					p.sequences.received(event)
+					p.observe(event)
+					countedEventsChan <- event
+				case event := <-snapshots:
+					if p.traffic != nil {
+						p.traffic.recordEvent(event)
+					}
+					p.observe(event)
+					countedEventsChan <- event
+				case now := <-settle:
+					// State changes held back while their entity was flapping
+					for _, event := range p.flaps.settle(now) {
+						countedEventsChan <- event
+					}
+				}
+			}
+		})
+	}()
+
+	// Filter only state_changed events
+	stateChangeChan := channel.Buffered(
+		channel.Filter(countedEventsChan, func(event *hass.EventMessage) bool {
+			if event.Event.EventType != hass.EventTypeStateChanged {
+				metrics.EventsFiltered.Inc()
+				log.Debug().Str("event_type", string(event.Event.EventType)).Msg("unsupported event type")
+				p.ack([]*hass.EventMessage{event})
+				return false
+			}
+
+			// State changes released by the flap detector went through the filters when they were held back
+			if (p.flaps == nil || !p.flaps.released(event)) && !p.allow(event) {
+				// State changes held back by the flap detector are acknowledged once their collapsed row is stored
+				if p.flaps == nil || !p.flaps.wasHeldBack(event) {
+					p.ack([]*hass.EventMessage{event})
+				}
+				return false
+			}
+
+			p.queued(event)
+			return true
+		}),
+		p.eventBuffer,
+	)
+
+	var flush chan struct{}
+	if p.softMemoryLimit > 0 {
+		flush = make(chan struct{}, 1)
+		go recovery.Run("pipeline_memory", func() {
+			p.watchMemory(ctx, flush)
+		})
+	}
+
+	// State changes of a context are released together and kept in one batch of every table
+	var groupBy func(*hass.EventMessage) string
+	if p.contextGroups != nil {
+		stateChangeChan = p.groupContexts(ctx, stateChangeChan)
+		groupBy = contextIDOf
+	}
+
+	// Batch state change events by entity domain
+	stateChangeBatch, errChan := channel.Batch(stateChangeChan, channel.BatchOptions[*hass.EventMessage]{
+		MaxSize:     p.batchSize,
+		MaxWait:     p.batchWait,
+		Align:       p.batchAlign,
+		PartitionBy: p.partition,
+		GroupBy:     groupBy,
+		Flush:       flush,
+		Clock:       p.clock,
+
+		SizeOf:          estimatedEventSize,
+		MaxBytes:        p.batchBytes,
+		MaxPendingBytes: p.pendingBytes,
+	})
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Err(ctx.Err()).Msg("pipeline has been stopped")
+			metrics.HassConnectionStatus.Set(0)
+			metrics.CHConnectionStatus.Set(0)
+			return nil
+		case err, ok := <-errChan:
+			if !ok {
+				continue
+			}
+			log.Error().Err(err).Msg("failed to batch events")
+		case batch, ok := <-stateChangeBatch:
+			if !ok {
+				log.Debug().Msg("batch state change channel has been closed")
+				return nil
+			}
+
+			// Record batch size
+			metrics.BatchSize.Observe(float64(len(batch)))
+			metrics.BatchesProcessed.Inc()
+
+			partition, _ := p.partition(batch[0])
+			prev, done := transformSequencer.next(partition)
+			insertPrev, insertDone := insertSequencer.next(partition)
+			task := transformTask{batch: batch, prev: prev, done: done, insertPrev: insertPrev, insertDone: insertDone}
+			if err := transforms.Submit(ctx, task); err != nil {
+				done()
+				insertDone()
+				p.dequeued(batch)
+				log.Error().Err(err).Int("rows", len(batch)).Msg("failed to submit batch for transform")
+			}
+		}
+	}
+}
+
+func (p *Pipeline) partition(event *hass.EventMessage) (string, error) {
+	if p.attributeChanges && isAttributeChange(event) {
+		return attributeChangesTableName, nil
+	}
+	if _, err := partitionByStateChangeEntityDomain(event); err != nil {
+		return "", err
+	}
+	return p.stateChangeTable(event.Event.Data.NewState), nil
+}
+
+func (p *Pipeline) resolveInput(event *hass.EventMessage) (*insert, error) {
+	var insert *insert
+	var err error
+	if p.attributeChanges && isAttributeChange(event) {
+		insert, err = resolveAttributeChangeDestination(event, p.database)
+	} else {
+		insert, err = resolveInput(event, p.database)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := insert.Input.(*StateChange); ok {
+		insert.TableName = p.stateChangeTable(event.Event.Data.NewState)
+	}
+	insert.Database = p.databaseFor(insert.TableName)
+	return insert, nil
+}
+
+// databaseFor returns the database of a destination table
+func (p *Pipeline) databaseFor(table string) string {
+	if database, ok := p.tableDatabases[table]; ok {
+		return database
+	}
+	return p.database
+}
+
+func (p *Pipeline) hasTable(tableKey string) bool {
+	// Tables are expected to be created in advance
+	if p.noDDL {
+		return true
+	}
+
+	p.tableExistsMtx.Lock()
+	defer p.tableExistsMtx.Unlock()
+	return p.tableExists[tableKey]
+}
+
+func (p *Pipeline) markTable(tableKey string) {
+	p.tableExistsMtx.Lock()
+	defer p.tableExistsMtx.Unlock()
+	p.tableExists[tableKey] = true
+}
+
+// createTable creates the destination table of the resolved insert
+func (p *Pipeline) createTable(ctx context.Context, event *hass.EventMessage, insert *insert) error {
+	switch insert.Input.(type) {
+	case *AttributeChange:
+		return createAttributeChangesTable(ctx, p.sink, insert.Database, p.labelColumns())
+	case *AvailabilityChange:
+		_, err := p.ensureTable(ctx, availabilityTableName, availabilityDDL)
+		return err
+	}
+
+	// State change tables are named after their domain unless overridden
+	stateType := p.stateTypeOf(insert.TableName)
+
+	for _, model := range p.rowModels {
+		tableName := model.tableName(insert.TableName)
+		ddl, err := p.stateChangeDDL(model, insert.Database, tableName, insert.TableName, stateType)
+		if err != nil {
+			return err
+		}
+
+		err = createStateChangeTable(ctx, p.sink, ddl, insert.Database, tableName, p.tableColumns(insert.TableName))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// preparedBatch is a batch of rows, transformed, grouped by their table and ready to be inserted
+type preparedBatch struct {
+	// id tags the inserts of the batch in system.query_log
+	id      string
+	started time.Time
+
+	// tables are the rows of the batch by table, in the order of their first row
+	tables []*preparedTable
+
+	// newTables are tables not known to exist yet, with the first event routed to each of them
+	newTables map[string]newTable
+
+	// errorCount is the number of events that could not be resolved into rows
+	errorCount int
+
+	// events are the events the batch was prepared from, acknowledged once its rows are stored
+	events []*hass.EventMessage
+}
+
+// preparedTable are the rows of a prepared batch routed to a single table
+type preparedTable struct {
+	database  string
+	tableName string
+
+	values   []any
+	overflow []any
+
+	processedCount int
+}
+
+type newTable struct {
+	event  *hass.EventMessage
+	insert *insert
+}
+
+// prepareBatch resolves and transforms the rows of a batch of events and groups them by their table
+func (p *Pipeline) prepareBatch(batch []*hass.EventMessage) *preparedBatch {
+	sortByLastUpdated(batch)
+
+	prepared := &preparedBatch{
+		id:        newBatchID(),
+		started:   time.Now(),
+		newTables: make(map[string]newTable),
+		events:    batch,
+	}
+	tables := make(map[string]*preparedTable)
+
+	// Batches are partitioned by table, but rows may still be routed elsewhere, e.g. by a table override
+	tableOf := func(insert *insert) (*preparedTable, string) {
+		tableKey := fmt.Sprintf("%s.%s", insert.Database, insert.TableName)
+		table, ok := tables[tableKey]
+		if !ok {
+			table = &preparedTable{database: insert.Database, tableName: insert.TableName, values: make([]any, 0, len(batch))}
+			tables[tableKey] = table
+			prepared.tables = append(prepared.tables, table)
+		}
+		return table, tableKey
+	}
+
+	for _, event := range batch {
+		// Transitions to and from unknown and unavailable states are recorded in the availability table,
+		// the ones to them are stored there only
+		var availabilityTable *preparedTable
+		if availability := p.availabilityChange(event); availability != nil {
+			insert := &insert{Database: p.databaseFor(availabilityTableName), TableName: availabilityTableName, Input: availability}
+			var tableKey string
+			availabilityTable, tableKey = tableOf(insert)
+			availabilityTable.values = append(availabilityTable.values, availability)
+			if _, ok := prepared.newTables[tableKey]; !ok && !p.hasTable(tableKey) {
+				prepared.newTables[tableKey] = newTable{event: event, insert: insert}
+			}
+		}
+
+		insert, err := p.resolveInput(event)
+		if availabilityTable != nil && errors.Is(err, errSkippedState) {
+			availabilityTable.processedCount++
+			continue
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to resolve input for event")
+			prepared.errorCount++
+			continue
+		}
+
+		if change, ok := insert.Input.(*StateChange); ok {
+			p.transform(event, change)
+		}
+
+		table, tableKey := tableOf(insert)
+
+		if change, ok := insert.Input.(*StateChange); ok && p.stateChangeEngine(insert.TableName).signed {
+			change.Sign = 1
+		}
+
+		if change, ok := insert.Input.(*StateChange); ok && !fitsStateType(p.stateTypeOf(insert.TableName), change) {
+			table.overflow = append(table.overflow, change)
+			continue
+		}
+
+		table.values = append(table.values, insert.Input)
+		table.processedCount++
+
+		if _, ok := prepared.newTables[tableKey]; !ok && !p.hasTable(tableKey) {
+			prepared.newTables[tableKey] = newTable{event: event, insert: insert}
+		}
+	}
+
+	return prepared
+}
+
+// insertPreparedBatch creates missing tables of a prepared batch and inserts its rows
+func (p *Pipeline) insertPreparedBatch(ctx context.Context, batch *preparedBatch) error {
+	for tableKey, table := range batch.newTables {
+		// The table might have been created by a batch of another row model or destination meanwhile
+		if p.hasTable(tableKey) {
+			continue
+		}
+
+		log.Info().Str("table", tableKey).Msg("creating table")
+
+		// Time table creation
+		startTime := time.Now()
+		if err := p.createTable(ctx, table.event, table.insert); err != nil {
+			metrics.DatabaseOperationsTotal.WithLabelValues("create_table", "error").Inc()
+			log.Error().Err(err).
+				Str("database", table.insert.Database).
+				Str("table", table.insert.TableName).
+				Msg("failed to create table")
+			continue
+		}
+		metrics.DatabaseOperationsTotal.WithLabelValues("create_table", "success").Inc()
+		metrics.CHQueryDuration.WithLabelValues("create_table").Observe(time.Since(startTime).Seconds())
+		p.markTable(tableKey)
+	}
+
+	switch len(batch.tables) {
+	case 0:
+		return nil
+	case 1:
+		return p.insertPreparedTable(ctx, batch.id, batch.tables[0], batch.errorCount)
+	}
+
+	// Tables of a batch are inserted concurrently. Unresolved events are counted with the first table.
+	errs := make([]error, len(batch.tables))
+	for i := range errs {
+		errs[i] = errTableNotInserted
+	}
+	inserts := pool.New(ctx, "table_insert", p.tableInsertWorkers, func(ctx context.Context, i int) error {
+		errorCount := 0
+		if i == 0 {
+			errorCount = batch.errorCount
+		}
+		errs[i] = p.insertPreparedTable(ctx, batch.id, batch.tables[i], errorCount)
+		return errs[i]
+	})
+	for i := range batch.tables {
+		if err := inserts.Submit(ctx, i); err != nil {
+			break
+		}
+	}
+	inserts.Close()
+
+	return errors.Join(errs...)
+}
+
+// errTableNotInserted is the error of tables of a batch whose insert was canceled or panicked
+var errTableNotInserted = errors.New("table of the batch was not inserted")
+
+// insertPreparedTable inserts the rows of a prepared batch routed to a table, with every row model
+func (p *Pipeline) insertPreparedTable(ctx context.Context, batchID string, table *preparedTable, errorCount int) error {
+	database, tableName := table.database, table.tableName
+	values, processedCount := table.values, table.processedCount
+
+	overflowErr := p.writeOverflow(ctx, batchID, database, tableName, table.overflow)
+
+	if len(values) == 0 {
+		return overflowErr
+	}
+
+	// Attribute changes are not versioned
+	if _, ok := values[0].(*StateChange); !ok {
+		return errors.Join(overflowErr, p.insertBatch(ctx, batchID, database, tableName, values, processedCount, errorCount))
+	}
+
+	errs := []error{overflowErr}
+	for i, model := range p.rowModels {
+		// Events are counted as processed by the primary row model only
+		if i > 0 {
+			processedCount, errorCount = 0, 0
+		}
+		errs = append(errs, p.insertBatch(ctx, batchID, database, model.tableName(tableName), convertStateChanges(values, p.tableDomain(tableName), model), processedCount, errorCount))
+	}
+	return errors.Join(errs...)
+}
+
+// insertBatch inserts rows into a table, isolating rows rejected by ClickHouse in strict mode
+func (p *Pipeline) insertBatch(ctx context.Context, batchID, database, tableName string, values []any, processedCount, errorCount int) error {
+	// Batches are queued behind the ones waiting for replay, keeping them in order
+	if p.wal != nil && p.wal.pending() {
+		if err := p.spill(database, tableName, values); err == nil {
+			metrics.EventsProcessed.Add(float64(processedCount))
+			return nil
+		}
+	}
+
+	// Time the insert operation
+	startTime := time.Now()
+	queryID := fmt.Sprintf("hass2ch-insert-%s.%s-%d", database, tableName, startTime.UnixNano())
+	var summary clickhouse.Summary
+	var requestStats clickhouse.RequestStats
+	opts := append(p.insertOptions(),
+		clickhouse.WithQueryID(queryID),
+		clickhouse.WithSummary(&summary),
+		clickhouse.WithRequestStats(&requestStats),
+		clickhouse.WithLogCommentField("batch_id", batchID),
+	)
+	err := p.insert(ctx, database, tableName, values, opts...)
+	if err != nil && p.strict && clickhouse.IsDataError(err) {
+		log.Warn().Err(err).
+			Str("database", database).
+			Str("table", tableName).
+			Int("rows", len(values)).
+			Msg("ClickHouse rejected rows, isolating them")
+
+		var deadLetters []DeadLetter
+		deadLetters, err = p.isolateRejectedRows(ctx, database, tableName, values, err)
+		if deadLetterErr := p.writeDeadLetters(ctx, database, deadLetters); err == nil {
+			err = deadLetterErr
+		}
+		processedCount -= len(deadLetters)
+
+		// The summary is not collected while isolating rejected rows
+		summary = clickhouse.Summary{}
+	}
+
+	p.stats.inserted(database+"."+tableName, len(values), err)
+	if err == nil {
+		p.readiness.insertSucceeded()
+	}
+
+	// Batches ClickHouse failed to store after all retries are kept until it recovers
+	if err != nil && p.wal != nil && !clickhouse.IsDataError(err) {
+		spillErr := p.spill(database, tableName, values)
+		if spillErr == nil {
+			metrics.EventsProcessed.Add(float64(processedCount))
+			log.Warn().Err(err).
+				Str("database", database).
+				Str("table", tableName).
+				Int("rows", len(values)).
+				Msg("failed to insert data, spilled it to the write-ahead log")
+			return nil
+		}
+		err = errors.Join(err, spillErr)
+	}
+
+	if err != nil {
+		metrics.DatabaseOperationsTotal.WithLabelValues("insert", "error").Inc()
+		metrics.EventsProcessed.Add(float64(errorCount))
+		log.Error().Err(err).
+			Str("database", database).
+			Str("table", tableName).
+			Int("rows", len(values)).
+			Msg("failed to insert data")
+	} else {
+		metrics.DatabaseOperationsTotal.WithLabelValues("insert", "success").Inc()
+		metrics.EventsProcessed.Add(float64(processedCount))
+		duration := time.Since(startTime)
+		metrics.CHQueryDuration.WithLabelValues("insert").Observe(duration.Seconds())
+		log.Info().
+			Str("database", database).
+			Str("table", tableName).
+			Int("rows", len(values)).
+			Uint64("uncompressed_bytes", requestStats.UncompressedBytes).
+			Uint64("sent_bytes", requestStats.SentBytes).
+			Msg("inserted data")
+
+		verifyWrittenRows(database, tableName, queryID, len(values), &summary)
+		p.recordInsertStats(batchID, database, tableName, len(values), duration, &requestStats, &summary)
+	}
+	return err
+}
+
+// newBatchID returns a random ID of a batch
+func newBatchID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// verifyWrittenRows detects silent partial writes, e.g. rows dropped as malformed
+// because of input_format_skip_unknown_fields
+func verifyWrittenRows(database, tableName, queryID string, sent int, summary *clickhouse.Summary) {
+	// The summary is not reported by all ClickHouse versions and setups
+	if summary.WrittenRows == 0 && summary.WrittenBytes == 0 {
+		return
+	}
+
+	if summary.WrittenRows == uint64(sent) {
+		return
+	}
+
+	metrics.InsertWrittenRowsMismatches.Inc()
+	if summary.WrittenRows < uint64(sent) {
+		metrics.InsertRowsNotWritten.Add(float64(uint64(sent) - summary.WrittenRows))
+	}
+
+	log.Warn().
+		Str("database", database).
+		Str("table", tableName).
+		Str("query_id", queryID).
+		Int("sent_rows", sent).
+		Uint64("written_rows", summary.WrittenRows).
+		Msg("ClickHouse reported a different number of written rows than sent")
+}
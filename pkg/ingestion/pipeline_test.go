@@ -0,0 +1,78 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestPipeline_ResolveInputDatabase(t *testing.T) {
+	p := NewPipeline(nil, nil, "home", WithTableDatabases(map[string]string{"light": "lights"}))
+
+	event := func(entityID string) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{
+			EventType: hass.EventTypeStateChanged,
+			Data: hass.EventData{
+				EntityID: entityID,
+				OldState: &hass.State{EntityID: entityID, State: "off"},
+				NewState: &hass.State{EntityID: entityID, State: "on"},
+			},
+		}}
+	}
+
+	insert, err := p.resolveInput(event("switch.fan"))
+	require.NoError(t, err)
+	assert.Equal(t, "home", insert.Database)
+
+	insert, err = p.resolveInput(event("light.kitchen"))
+	require.NoError(t, err)
+	assert.Equal(t, "lights", insert.Database)
+}
+
+func TestFitsStateType(t *testing.T) {
+	assert.True(t, fitsStateType("Float64", &StateChange{State: "1.5", OldState: ""}))
+	assert.False(t, fitsStateType("Nullable(Float64)", &StateChange{State: "low", OldState: "1"}))
+	assert.False(t, fitsStateType("Int64", &StateChange{State: "2", OldState: "1.5"}))
+	assert.True(t, fitsStateType("String", &StateChange{State: "anything"}))
+}
+
+func TestPipeline_InsertPreparedBatchTables(t *testing.T) {
+	stateChange := func(entityID string) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{EventType: hass.EventTypeStateChanged, Data: hass.EventData{
+			EntityID: entityID,
+			OldState: &hass.State{EntityID: entityID, State: "off"},
+			NewState: &hass.State{EntityID: entityID, State: "on", LastUpdated: time.Now()},
+		}}}
+	}
+
+	var mtx sync.Mutex
+	inserted := make(map[string]int)
+	sink := SinkFunc(func(_ context.Context, database, table string, rows []any) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if table == "switch" {
+			return errors.New("connection refused")
+		}
+		inserted[database+"."+table] += len(rows)
+		return nil
+	})
+	p := NewPipeline(nil, sink, "hass", WithoutDDL(), WithTableInsertWorkers(2))
+
+	// Rows of a batch routed to different tables are grouped instead of being dropped
+	batch := p.prepareBatch([]*hass.EventMessage{stateChange("light.kitchen"), stateChange("switch.fan"), stateChange("light.hall")})
+	require.Len(t, batch.tables, 2)
+	assert.Equal(t, "light", batch.tables[0].tableName)
+	assert.Len(t, batch.tables[0].values, 2)
+	assert.Equal(t, "switch", batch.tables[1].tableName)
+
+	// Tables are inserted independently, a failed one fails the batch
+	assert.Error(t, p.insertPreparedBatch(context.Background(), batch))
+	assert.Equal(t, map[string]int{"hass.light": 2}, inserted)
+}
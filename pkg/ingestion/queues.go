@@ -0,0 +1,106 @@
+package ingestion
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// queueMetricsInterval is how often the age of the oldest pending event of every table is updated
+const queueMetricsInterval = time.Second
+
+// tableQueues tracks the events passed by filters and not inserted yet per destination table, i.e. partition
+// of the batcher. Events of a table are inserted in the order they were queued, so the first one is the oldest.
+type tableQueues struct {
+	mtx    sync.Mutex
+	queued map[string][]time.Time
+}
+
+func newTableQueues() *tableQueues {
+	return &tableQueues{queued: make(map[string][]time.Time)}
+}
+
+// push queues an event of the table received at the given time
+func (q *tableQueues) push(table string, at time.Time) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.queued[table] = append(q.queued[table], at)
+	metrics.TableQueuedRows.WithLabelValues(table).Set(float64(len(q.queued[table])))
+}
+
+// pop removes the n oldest events of the table, once they were inserted or dropped
+func (q *tableQueues) pop(table string, n int) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	queued := q.queued[table]
+	n = min(n, len(queued))
+	if n == len(queued) {
+		// Release the backing array of a drained queue
+		delete(q.queued, table)
+	} else {
+		q.queued[table] = queued[n:]
+	}
+	metrics.TableQueuedRows.WithLabelValues(table).Set(float64(len(queued) - n))
+}
+
+// oldest returns the time the oldest pending event of every table with pending events was queued at
+func (q *tableQueues) oldest() map[string]time.Time {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	oldest := make(map[string]time.Time, len(q.queued))
+	for table, queued := range q.queued {
+		oldest[table] = queued[0]
+	}
+	return oldest
+}
+
+// queued records an event passed by filters as in flight
+func (p *Pipeline) queued(event *hass.EventMessage) {
+	p.stats.eventsInFlight(1)
+	if table, err := p.partition(event); err == nil {
+		p.queues.push(table, p.clock.Now())
+	}
+}
+
+// dequeued records a batch of events of a single table as no longer in flight, whatever its outcome
+func (p *Pipeline) dequeued(batch []*hass.EventMessage) {
+	p.stats.eventsInFlight(-len(batch))
+	if len(batch) == 0 {
+		return
+	}
+	if table, err := p.partition(batch[0]); err == nil {
+		p.queues.pop(table, len(batch))
+	}
+}
+
+// reportQueueAges periodically updates the age of the oldest pending event of every table until the context is done
+func (p *Pipeline) reportQueueAges(ctx context.Context) {
+	ticker := p.clock.NewTicker(queueMetricsInterval)
+	defer ticker.Stop()
+
+	// Tables seen with pending events, reported as 0 once drained
+	tables := make(map[string]struct{})
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C():
+			oldest := p.queues.oldest()
+			for table := range tables {
+				if _, ok := oldest[table]; !ok {
+					metrics.TableOldestPendingAge.WithLabelValues(table).Set(0)
+				}
+			}
+			for table, at := range oldest {
+				tables[table] = struct{}{}
+				metrics.TableOldestPendingAge.WithLabelValues(table).Set(now.Sub(at).Seconds())
+			}
+		}
+	}
+}
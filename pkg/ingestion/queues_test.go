@@ -0,0 +1,44 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+func TestPipeline_TableQueues(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	p := NewPipeline(nil, nil, "hass", WithClock(clk))
+
+	event := func(entityID string) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{
+			EventType: hass.EventTypeStateChanged,
+			Data: hass.EventData{
+				EntityID: entityID,
+				NewState: &hass.State{EntityID: entityID, State: "on"},
+			},
+		}}
+	}
+
+	kitchen, hall, fan := event("light.kitchen"), event("light.hall"), event("switch.fan")
+	p.queued(kitchen)
+	clk.Advance(time.Second)
+	p.queued(hall)
+	p.queued(fan)
+
+	assert.Equal(t, map[string]time.Time{"light": start, "switch": start.Add(time.Second)}, p.queues.oldest())
+	assert.Equal(t, int64(3), p.Stats().EventsInFlight)
+
+	p.dequeued([]*hass.EventMessage{kitchen})
+	assert.Equal(t, map[string]time.Time{"light": start.Add(time.Second), "switch": start.Add(time.Second)}, p.queues.oldest())
+
+	p.dequeued([]*hass.EventMessage{hall})
+	p.dequeued([]*hass.EventMessage{fan})
+	assert.Empty(t, p.queues.oldest())
+	assert.Equal(t, int64(0), p.Stats().EventsInFlight)
+}
@@ -0,0 +1,159 @@
+package ingestion
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// RateLimit is a token bucket limit of state changes of a single entity
+type RateLimit struct {
+	// Rate is the number of state changes per second the bucket is refilled with
+	Rate float64
+	// Burst is the number of state changes allowed in a row before the rate applies
+	Burst int
+}
+
+// RateLimitConfig configures per-entity rate limits. Entity limits take precedence over
+// domain limits (e.g. binary_sensor), which take precedence over the default limit.
+type RateLimitConfig struct {
+	Default  *RateLimit
+	Domains  map[string]RateLimit
+	Entities map[string]RateLimit
+}
+
+// ParseRateLimitConfig parses limits in the form of "key=rate:burst,key=rate:burst".
+// Keys containing a dot are entity IDs, "*" is the default limit and other keys are domains.
+func ParseRateLimitConfig(s string) (RateLimitConfig, error) {
+	conf := RateLimitConfig{
+		Domains:  make(map[string]RateLimit),
+		Entities: make(map[string]RateLimit),
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return conf, fmt.Errorf("invalid rate limit %q: expected key=rate:burst", part)
+		}
+
+		rateValue, burstValue, ok := strings.Cut(strings.TrimSpace(value), ":")
+		if !ok {
+			return conf, fmt.Errorf("invalid rate limit %q: expected key=rate:burst", part)
+		}
+
+		rate, err := strconv.ParseFloat(rateValue, 64)
+		if err != nil || rate <= 0 {
+			return conf, fmt.Errorf("invalid rate %q", rateValue)
+		}
+
+		burst, err := strconv.Atoi(burstValue)
+		if err != nil || burst < 1 {
+			return conf, fmt.Errorf("invalid burst %q", burstValue)
+		}
+
+		limit := RateLimit{Rate: rate, Burst: burst}
+		switch key = strings.TrimSpace(key); {
+		case key == "*":
+			conf.Default = &limit
+		case strings.Contains(key, "."):
+			conf.Entities[key] = limit
+		default:
+			conf.Domains[key] = limit
+		}
+	}
+
+	return conf, nil
+}
+
+// WithRateLimit drops state changes of entities exceeding their rate limit. Unlike sampling, occasional
+// bursts up to the burst size are preserved and only runaway entities, e.g. a flapping binary_sensor, are capped.
+func WithRateLimit(conf RateLimitConfig) PipelineOption {
+	return func(p *Pipeline) {
+		// The clock is read through the pipeline, as WithClock may be applied after this option
+		p.filters = append(p.filters, newRateLimiter(conf, func() time.Time { return p.clock.Now() }))
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket of every limited entity
+type rateLimiter struct {
+	conf RateLimitConfig
+	now  func() time.Time
+
+	bucketsMtx sync.Mutex
+	buckets    map[string]*tokenBucket
+}
+
+func newRateLimiter(conf RateLimitConfig, now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		conf:    conf,
+		now:     now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *rateLimiter) limit(entityID string) (RateLimit, bool) {
+	if limit, ok := l.conf.Entities[entityID]; ok {
+		return limit, true
+	}
+
+	domain, _, _ := strings.Cut(entityID, ".")
+	if limit, ok := l.conf.Domains[domain]; ok {
+		return limit, true
+	}
+
+	if l.conf.Default != nil {
+		return *l.conf.Default, true
+	}
+
+	return RateLimit{}, false
+}
+
+func (l *rateLimiter) stageName() string {
+	return StageRateLimit
+}
+
+// Allow reports whether the state change event is within the rate limit of its entity
+func (l *rateLimiter) Allow(event *hass.EventMessage) bool {
+	entityID := event.Event.Data.EntityID
+
+	limit, ok := l.limit(entityID)
+	if !ok {
+		return true
+	}
+
+	l.bucketsMtx.Lock()
+	defer l.bucketsMtx.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[entityID]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[entityID] = bucket
+	}
+
+	bucket.tokens = min(bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate, float64(limit.Burst))
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		metrics.EventsRateLimited.WithLabelValues(entityID).Inc()
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
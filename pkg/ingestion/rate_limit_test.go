@@ -0,0 +1,46 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestParseRateLimitConfig(t *testing.T) {
+	conf, err := ParseRateLimitConfig("*=10:50, binary_sensor=1:5, binary_sensor.door=0.5:2")
+	require.NoError(t, err)
+	assert.Equal(t, &RateLimit{Rate: 10, Burst: 50}, conf.Default)
+	assert.Equal(t, RateLimit{Rate: 1, Burst: 5}, conf.Domains["binary_sensor"])
+	assert.Equal(t, RateLimit{Rate: 0.5, Burst: 2}, conf.Entities["binary_sensor.door"])
+
+	_, err = ParseRateLimitConfig("binary_sensor=1")
+	assert.Error(t, err)
+	_, err = ParseRateLimitConfig("binary_sensor=1:0")
+	assert.Error(t, err)
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(RateLimitConfig{
+		Domains: map[string]RateLimit{"binary_sensor": {Rate: 1, Burst: 3}},
+	}, func() time.Time { return now })
+
+	allow := func(entityID string) bool {
+		return limiter.Allow(&hass.EventMessage{Event: hass.Event{Data: hass.EventData{EntityID: entityID}}})
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, allow("binary_sensor.door"), "burst")
+	}
+	assert.False(t, allow("binary_sensor.door"))
+	assert.True(t, allow("binary_sensor.window"), "buckets are per entity")
+	assert.True(t, allow("light.kitchen"), "entities without a limit")
+
+	now = now.Add(time.Second)
+	assert.True(t, allow("binary_sensor.door"), "refilled")
+	assert.False(t, allow("binary_sensor.door"))
+}
@@ -0,0 +1,83 @@
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultReadinessGrace is the period after startup the pipeline waits for its first insert by default
+const defaultReadinessGrace = time.Minute
+
+// WithReadinessGrace sets the period after startup the pipeline waits for its first successful insert before it
+// is reported ready without one, e.g. because no state changes happened. With 0, it is ready once started.
+func WithReadinessGrace(grace time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.readiness.grace = grace
+	}
+}
+
+// readiness tracks the warm-up of a pipeline. Once warmed up, the pipeline stays ready until it stops.
+type readiness struct {
+	grace time.Duration
+
+	mtx              sync.Mutex
+	startedAt        time.Time
+	registriesSynced bool
+	inserted         bool
+	warm             bool
+}
+
+func (r *readiness) started(now time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.startedAt = now
+}
+
+func (r *readiness) synced() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.registriesSynced = true
+}
+
+func (r *readiness) insertSucceeded() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.inserted = true
+}
+
+// Ready returns nil once the pipeline has warmed up: grants and tables have been verified, initial states seeded,
+// subscriptions made, registries synced if entity metadata is enabled, and either a batch has been inserted or
+// the readiness grace period has passed. Otherwise the error tells what the pipeline is waiting for.
+// It backs readiness probes, e.g. of Kubernetes rolling updates.
+func (p *Pipeline) Ready() error {
+	switch state := p.Stats().State; state {
+	case PipelineStateRunning, PipelineStateDegraded:
+	default:
+		return fmt.Errorf("pipeline is %s", state)
+	}
+
+	r := p.readiness
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.warm {
+		return nil
+	}
+	if p.entityMetadata != nil && !r.registriesSynced {
+		return errors.New("waiting for registries to be synced")
+	}
+	if !r.inserted && p.clock.Since(r.startedAt) < r.grace {
+		return errors.New("waiting for the first insert")
+	}
+
+	r.warm = true
+	log.Info().Bool("inserted", r.inserted).Msg("pipeline is ready")
+	return nil
+}
@@ -0,0 +1,45 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+func TestPipeline_Ready(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := NewPipeline(nil, nil, "hass", WithClock(clk), WithReadinessGrace(time.Minute), WithEntityMetadata())
+	assert.EqualError(t, p.Ready(), "pipeline is idle")
+
+	p.readiness.started(clk.Now())
+	p.stats.setState(PipelineStateRunning)
+	assert.EqualError(t, p.Ready(), "waiting for registries to be synced")
+
+	p.readiness.synced()
+	assert.EqualError(t, p.Ready(), "waiting for the first insert")
+
+	// Without state changes, the pipeline is ready after the grace period
+	clk.Advance(time.Minute)
+	assert.NoError(t, p.Ready())
+
+	// Once warmed up, it stays ready until it stops
+	p.stats.setState(PipelineStateDegraded)
+	assert.NoError(t, p.Ready())
+	p.stats.setState(PipelineStateStopped)
+	assert.EqualError(t, p.Ready(), "pipeline is stopped")
+}
+
+func TestPipeline_ReadyAfterInsert(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := NewPipeline(nil, nil, "hass", WithClock(clk))
+
+	p.readiness.started(clk.Now())
+	p.stats.setState(PipelineStateRunning)
+	assert.Error(t, p.Ready())
+
+	p.readiness.insertSucceeded()
+	assert.NoError(t, p.Ready())
+}
@@ -0,0 +1,106 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+)
+
+const restartsTableName = "restarts"
+
+// restartEventTypes are the Home Assistant lifecycle events recorded in the restarts table
+var restartEventTypes = []hass.EventType{
+	hass.EventTypeHomeAssistantStart,
+	hass.EventTypeHomeAssistantStarted,
+	hass.EventTypeHomeAssistantStop,
+	hass.EventTypeCoreConfigUpdated,
+}
+
+// Restart is a marker row of the restarts table telling that Home Assistant started, stopped or changed its core configuration
+type Restart struct {
+	EventType  string `json:"event_type"`
+	FiredAt    string `json:"fired_at"`
+	RecordedAt string `json:"recorded_at"`
+}
+
+// WithRestartLog records Home Assistant starts, stops and core configuration changes in the restarts table,
+// so downtime windows can be accounted for, and refreshes the states transformers are seeded with
+// once Home Assistant has started or its configuration has changed.
+func WithRestartLog() PipelineOption {
+	return func(p *Pipeline) {
+		p.restartLog = true
+	}
+}
+
+// watchRestarts subscribes to Home Assistant lifecycle events and handles them until the context is done
+func (p *Pipeline) watchRestarts(ctx context.Context) error {
+	events := make(chan *hass.EventMessage)
+	for _, eventType := range restartEventTypes {
+		eventsChan, err := p.source.SubscribeEvents(ctx, hass.SubscribeEventsWithEventType(eventType))
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s events: %w", eventType, err)
+		}
+
+		go recovery.Run("pipeline_restarts_"+string(eventType), func() {
+			for event := range eventsChan {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+
+	go recovery.Run("pipeline_restarts", func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				p.handleRestart(ctx, event)
+			}
+		}
+	})
+
+	return nil
+}
+
+// handleRestart inserts a marker row for a lifecycle event and reseeds transformers once Home Assistant is up
+func (p *Pipeline) handleRestart(ctx context.Context, event *hass.EventMessage) {
+	eventType := event.Event.EventType
+	log.Info().
+		Str("event_type", string(eventType)).
+		Time("time_fired", event.Event.TimeFired).
+		Msg("Home Assistant lifecycle event")
+	metrics.HassLifecycleEvents.WithLabelValues(string(eventType)).Inc()
+
+	// Every instance of a sharded deployment sees the event, only the first one records it
+	if p.shard != nil && p.shard.Index != 0 {
+		log.Debug().Str("event_type", string(eventType)).Msg("restart marker is recorded by shard 0")
+	} else if database, err := p.ensureTable(ctx, restartsTableName, restartsDDL); err != nil {
+		log.Error().Err(err).Str("table", restartsTableName).Msg("failed to create restarts table")
+	} else {
+		row := Restart{
+			EventType:  string(eventType),
+			FiredAt:    event.Event.TimeFired.UTC().Format(time.RFC3339Nano),
+			RecordedAt: p.clock.Now().UTC().Format(time.RFC3339Nano),
+		}
+		p.insertBatch(ctx, newBatchID(), database, restartsTableName, []any{row}, 0, 0)
+	}
+
+	switch eventType {
+	case hass.EventTypeHomeAssistantStarted, hass.EventTypeCoreConfigUpdated:
+		// Entities may have been added, removed or reconfigured in the meantime
+		if err := p.seed(ctx); err != nil {
+			log.Error().Err(err).Str("event_type", string(eventType)).Msg("failed to refresh states")
+		}
+	default:
+	}
+}
@@ -0,0 +1,107 @@
+package ingestion
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+// RoundingConfig configures rounding of numeric states to a number of decimal places.
+// Entity precisions take precedence over domain precisions.
+type RoundingConfig struct {
+	Domains  map[string]int
+	Entities map[string]int
+}
+
+// ParseRoundingConfig parses precisions in the form of "key=places,key=places".
+// Keys containing a dot are entity IDs, other keys are domains (e.g. numeric_sensor).
+func ParseRoundingConfig(s string) (RoundingConfig, error) {
+	conf := RoundingConfig{
+		Domains:  make(map[string]int),
+		Entities: make(map[string]int),
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return conf, fmt.Errorf("invalid precision %q: expected key=places", part)
+		}
+
+		places, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || places < 0 {
+			return conf, fmt.Errorf("invalid number of decimal places %q", value)
+		}
+
+		key = strings.TrimSpace(key)
+		if strings.Contains(key, ".") {
+			conf.Entities[key] = places
+		} else {
+			conf.Domains[key] = places
+		}
+	}
+
+	return conf, nil
+}
+
+// WithRounding enables rounding of numeric states before they are stored
+func WithRounding(conf RoundingConfig) PipelineOption {
+	return func(p *Pipeline) {
+		p.transformers = append(p.transformers, &roundingTransformer{conf: conf})
+	}
+}
+
+// roundingTransformer rounds numeric states, removing floating point noise that hurts compression
+type roundingTransformer struct {
+	conf RoundingConfig
+}
+
+func (t *roundingTransformer) stageName() string {
+	return StageRounding
+}
+
+func (t *roundingTransformer) Columns(string) []string {
+	return nil
+}
+
+func (t *roundingTransformer) precision(state *hass.State) (int, bool) {
+	if places, ok := t.conf.Entities[state.EntityID]; ok {
+		return places, true
+	}
+
+	places, ok := t.conf.Domains[extractDomainFromState(state)]
+	return places, ok
+}
+
+func (t *roundingTransformer) Transform(event *hass.EventMessage, change *StateChange) {
+	places, ok := t.precision(event.Event.Data.NewState)
+	if !ok {
+		return
+	}
+
+	change.State = roundValue(change.State, places)
+	change.OldState = roundValue(change.OldState, places)
+}
+
+// roundValue rounds a numeric string state, leaving other values untouched
+func roundValue(value any, places int) any {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return value
+	}
+
+	scale := math.Pow10(places)
+	return strconv.FormatFloat(math.Round(f*scale)/scale, 'f', -1, 64)
+}
@@ -0,0 +1,79 @@
+package ingestion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestParseRoundingConfig(t *testing.T) {
+	conf, err := ParseRoundingConfig("numeric_sensor=2, sensor.temperature=1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"numeric_sensor": 2}, conf.Domains)
+	assert.Equal(t, map[string]int{"sensor.temperature": 1}, conf.Entities)
+
+	for _, invalid := range []string{"numeric_sensor", "numeric_sensor=two", "numeric_sensor=-1"} {
+		_, err := ParseRoundingConfig(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRoundValue(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		value  any
+		places int
+		want   any
+	}{
+		{name: "noise", value: "21.500000000000004", places: 2, want: "21.5"},
+		{name: "half away from zero", value: "0.125", places: 2, want: "0.13"},
+		{name: "negative", value: "-3.14159", places: 3, want: "-3.142"},
+		{name: "zero places", value: "7.6", places: 0, want: "8"},
+		{name: "negative precision rounds to tens", value: "1234.5", places: -1, want: "1230"},
+		{name: "negative precision rounds to hundreds", value: "-1250", places: -2, want: "-1300"},
+		{name: "integer", value: "42", places: 2, want: "42"},
+		{name: "non-numeric state", value: "on", places: 2, want: "on"},
+		{name: "unavailable", value: hass.UnavailableValue, places: 2, want: hass.UnavailableValue},
+		{name: "empty", value: "", places: 2, want: ""},
+		{name: "NaN", value: "NaN", places: 2, want: "NaN"},
+		{name: "Inf", value: "+Inf", places: 2, want: "+Inf"},
+		{name: "negative Inf", value: "-inf", places: 2, want: "-inf"},
+		{name: "non-string", value: 21.456, places: 1, want: 21.456},
+		{name: "nil", value: nil, places: 1, want: nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, roundValue(tt.value, tt.places))
+		})
+	}
+}
+
+func TestRoundingTransformer(t *testing.T) {
+	transformer := &roundingTransformer{conf: RoundingConfig{
+		Domains:  map[string]int{"numeric_sensor": 2},
+		Entities: map[string]int{"sensor.temperature": 0},
+	}}
+	event := func(entityID, newState string) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{Data: hass.EventData{
+			EntityID: entityID,
+			NewState: &hass.State{EntityID: entityID, State: newState},
+		}}}
+	}
+
+	// Entity precisions take precedence over domain precisions, old states are rounded as well
+	change := &StateChange{State: "21.46", OldState: "20.51"}
+	transformer.Transform(event("sensor.temperature", "21.46"), change)
+	assert.Equal(t, "21", change.State)
+	assert.Equal(t, "21", change.OldState)
+
+	change = &StateChange{State: "0.30000000000000004"}
+	transformer.Transform(event("sensor.power", "0.30000000000000004"), change)
+	assert.Equal(t, "0.3", change.State)
+
+	// Domains without a precision are untouched
+	change = &StateChange{State: "0.30000000000000004"}
+	transformer.Transform(event("input_number.level", "0.30000000000000004"), change)
+	assert.Equal(t, "0.30000000000000004", change.State)
+}
@@ -0,0 +1,185 @@
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+// SandboxTable is a destination table of the events of a sandbox run
+type SandboxTable struct {
+	Database  string `json:"database"`
+	Table     string `json:"table"`
+	StateType string `json:"state_type,omitempty"`
+	Rows      int    `json:"rows"`
+	// Overflow is the number of rows whose state does not fit the state type, stored in the overflow table
+	Overflow int `json:"overflow,omitempty"`
+	Entities int `json:"entities"`
+	// Generated is set for tables of the schema of the pipeline, e.g. domains, overrides and event types;
+	// other tables are created on the fly from the events
+	Generated bool `json:"generated"`
+
+	entities map[string]bool
+}
+
+// SandboxReport is the distribution of a sample of events over the tables of the pipeline
+type SandboxReport struct {
+	Events int `json:"events"`
+	// Filtered is the number of events dropped by filters or belonging to other shards
+	Filtered int `json:"filtered"`
+	// Ignored is the number of events of types that are not ingested
+	Ignored int `json:"ignored"`
+	// Errors counts the events that would be skipped by their error
+	Errors map[string]int  `json:"errors,omitempty"`
+	Tables []*SandboxTable `json:"tables"`
+}
+
+// ReadEvents reads recorded events from a stream of JSON objects, e.g. the output of the dump command
+// or JSON lines
+func ReadEvents(r io.Reader) ([]*hass.EventMessage, error) {
+	var events []*hass.EventMessage
+	decoder := json.NewDecoder(r)
+	for {
+		var event hass.EventMessage
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return events, nil
+			}
+			return nil, fmt.Errorf("failed to read event %d: %w", len(events)+1, err)
+		}
+		events = append(events, &event)
+	}
+}
+
+// Sandbox resolves a sample of events with the configuration of the pipeline, e.g. table overrides, event
+// types and databases, without connecting to Home Assistant or ClickHouse, and reports the tables they
+// would be stored in. It shows the effect of new routing before it creates any tables.
+func (p *Pipeline) Sandbox(events []*hass.EventMessage) (*SandboxReport, error) {
+	if err := p.orderStages(); err != nil {
+		return nil, fmt.Errorf("invalid stage order: %w", err)
+	}
+
+	generated := make(map[string]bool)
+	for _, domain := range p.catalogDomains() {
+		generated[p.databaseFor(domain)+"."+domain] = true
+	}
+	for table := range p.tableOverrides {
+		generated[p.databaseFor(table)+"."+table] = true
+	}
+	for _, eventType := range p.eventTypes {
+		generated[p.database+"."+eventTableName(eventType)] = true
+	}
+	if p.attributeChanges {
+		generated[p.databaseFor(attributeChangesTableName)+"."+attributeChangesTableName] = true
+	}
+	if p.availability {
+		generated[p.databaseFor(availabilityTableName)+"."+availabilityTableName] = true
+	}
+
+	report := &SandboxReport{Errors: make(map[string]int)}
+	tables := make(map[string]*SandboxTable)
+	record := func(database, table, stateType, entityID string, overflow bool) {
+		key := database + "." + table
+		t, ok := tables[key]
+		if !ok {
+			t = &SandboxTable{Database: database, Table: table, StateType: stateType, Generated: generated[key], entities: make(map[string]bool)}
+			tables[key] = t
+			report.Tables = append(report.Tables, t)
+		}
+		t.Rows++
+		if overflow {
+			t.Overflow++
+		}
+		if entityID != "" && !t.entities[entityID] {
+			t.entities[entityID] = true
+			t.Entities++
+		}
+	}
+
+	for _, event := range events {
+		report.Events++
+
+		if event.Event.EventType != hass.EventTypeStateChanged {
+			if !p.ingestsEventType(event.Event.EventType) {
+				report.Ignored++
+				continue
+			}
+			record(p.database, eventTableName(event.Event.EventType), "", event.Event.Data.EntityID, false)
+			continue
+		}
+
+		if !p.allow(event) {
+			report.Filtered++
+			continue
+		}
+		p.observe(event)
+
+		availability := p.availabilityChange(event)
+		if availability != nil {
+			record(p.databaseFor(availabilityTableName), availabilityTableName, "", availability.EntityID, false)
+		}
+
+		row := p.resolveRow(event)
+		if availability != nil && errors.Is(row.Err, errSkippedState) {
+			continue
+		}
+		if row.Err != nil {
+			report.Errors[row.Err.Error()]++
+			continue
+		}
+
+		change, ok := row.Input.(*StateChange)
+		if !ok {
+			record(row.Database, row.Table, "", event.Event.Data.EntityID, false)
+			continue
+		}
+		stateType := p.stateTypeOf(row.Table)
+		record(row.Database, row.Table, stateType, change.EntityID, !fitsStateType(stateType, change))
+	}
+
+	sort.Slice(report.Tables, func(i, j int) bool {
+		if report.Tables[i].Rows != report.Tables[j].Rows {
+			return report.Tables[i].Rows > report.Tables[j].Rows
+		}
+		return report.Tables[i].Database+"."+report.Tables[i].Table < report.Tables[j].Database+"."+report.Tables[j].Table
+	})
+
+	return report, nil
+}
+
+// ingestsEventType reports whether events of a type other than state_changed are ingested
+func (p *Pipeline) ingestsEventType(eventType hass.EventType) bool {
+	for _, t := range p.eventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// NewTables returns the tables of the report that are not part of the schema of the pipeline
+func (r *SandboxReport) NewTables() []string {
+	var names []string
+	for _, table := range r.Tables {
+		if !table.Generated {
+			names = append(names, table.Database+"."+table.Table)
+		}
+	}
+	return names
+}
+
+// String summarizes the report
+func (r *SandboxReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d events, %d filtered, %d ignored, %d tables", r.Events, r.Filtered, r.Ignored, len(r.Tables))
+	if n := len(r.NewTables()); n > 0 {
+		fmt.Fprintf(&b, " (%d not generated)", n)
+	}
+	return b.String()
+}
@@ -0,0 +1,74 @@
+package ingestion
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestReadEvents(t *testing.T) {
+	// Indented objects as written by the dump command, and JSON lines
+	events, err := ReadEvents(strings.NewReader(`{
+  "id": 1,
+  "type": "event",
+  "event": {"event_type": "state_changed", "data": {"entity_id": "light.kitchen", "new_state": {"entity_id": "light.kitchen", "state": "on"}}}
+}
+{"id":1,"type":"event","event":{"event_type":"call_service","data":{"domain":"light"}}}
+`))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "light.kitchen", events[0].Event.Data.EntityID)
+	assert.Equal(t, hass.EventType("call_service"), events[1].Event.EventType)
+
+	_, err = ReadEvents(strings.NewReader(`{"id":1,"type":"event"} {`))
+	assert.Error(t, err)
+}
+
+func sandboxEvent(entityID, state string) *hass.EventMessage {
+	return &hass.EventMessage{Event: hass.Event{
+		EventType: hass.EventTypeStateChanged,
+		Data: hass.EventData{
+			EntityID: entityID,
+			OldState: &hass.State{EntityID: entityID, State: state},
+			NewState: &hass.State{EntityID: entityID, State: state},
+		},
+	}}
+}
+
+func TestPipeline_Sandbox(t *testing.T) {
+	overrides, err := ParseTableOverrides("sensor.power_*=power", "power=Float64", "", "")
+	require.NoError(t, err)
+	p := NewPipeline(nil, nil, "hass", WithTableOverrides(overrides...), WithEventTypes("call_service"))
+
+	report, err := p.Sandbox([]*hass.EventMessage{
+		sandboxEvent("sensor.power_meter", "12.5"),
+		sandboxEvent("sensor.power_plug", "idle"),
+		sandboxEvent("sensor.power_meter", "13"),
+		sandboxEvent("light.kitchen", "on"),
+		{Event: hass.Event{EventType: "call_service"}},
+		{Event: hass.Event{EventType: "automation_triggered"}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 6, report.Events)
+	assert.Equal(t, 1, report.Ignored)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.NewTables())
+	require.Len(t, report.Tables, 3)
+
+	power := report.Tables[0]
+	assert.Equal(t, "power", power.Table)
+	assert.Equal(t, "Float64", power.StateType)
+	assert.Equal(t, 3, power.Rows)
+	assert.Equal(t, 1, power.Overflow)
+	assert.Equal(t, 2, power.Entities)
+	assert.True(t, power.Generated)
+
+	assert.Equal(t, "call_service", report.Tables[1].Table)
+	assert.Equal(t, "light", report.Tables[2].Table)
+	assert.Equal(t, "6 events, 0 filtered, 1 ignored, 3 tables", report.String())
+}
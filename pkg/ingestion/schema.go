@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/jkaflik/hass2ch/hass"
-	"github.com/jkaflik/hass2ch/pkg/clickhouse"
 )
 
 // StateChange represents a processed state change event ready for insertion into ClickHouse
@@ -22,6 +21,34 @@ type StateChange struct {
 	LastChanged  string `json:"last_changed"`
 	LastUpdated  string `json:"last_updated"`
 	LastReported string `json:"last_reported,omitempty"`
+
+	// Cost is the price of the energy consumed since the old state, set for energy entities only
+	Cost *float64 `json:"cost,omitempty"`
+
+	// ValueDelta is the difference from the previously stored value, set for numeric entities only
+	ValueDelta *float64 `json:"value_delta,omitempty"`
+
+	// IsLate marks state changes updated long before the ingestion watermark of their table
+	IsLate bool `json:"is_late,omitempty"`
+
+	// FlapCount is the number of state transitions collapsed into this row, set for flapping entities only
+	FlapCount int `json:"flap_count,omitempty"`
+	// FlapStarted is when the collapsed flapping started
+	FlapStarted *string `json:"flap_started,omitempty"`
+
+	// EventHash identifies the state change across repeated ingestion, set with WithEventHash only
+	EventHash uint64 `json:"event_hash,omitempty"`
+
+	// ContextBatchID identifies the group of state changes sharing a context, set with WithContextGrouping only
+	ContextBatchID string `json:"context_batch_id,omitempty"`
+
+	// AttributesDiff marks rows whose attributes are the ones changed since the old state only, see WithAttributeDiff
+	AttributesDiff bool `json:"attributes_diff,omitempty"`
+	// AttributesRemoved are the keys of attributes removed since the old state, set with AttributesDiff only
+	AttributesRemoved []string `json:"attributes_removed,omitempty"`
+
+	// Sign is the sign of rows of CollapsingMergeTree tables, see WithTableEngines
+	Sign int8 `json:"sign,omitempty"`
 }
 
 func partitionByStateChangeEntityDomain(event *hass.EventMessage) (string, error) {
@@ -31,16 +58,16 @@ func partitionByStateChangeEntityDomain(event *hass.EventMessage) (string, error
 	return extractDomainFromState(event.Event.Data.NewState), nil
 }
 
-func resolveInput(event *hass.EventMessage) (*insert, error) {
+func resolveInput(event *hass.EventMessage, database string) (*insert, error) {
 	switch event.Event.EventType {
 	case hass.EventTypeStateChanged:
-		return resolveStateChangeDestination(event)
+		return resolveStateChangeDestination(event, database)
 	default:
 		return nil, fmt.Errorf("unsupported event type: %s", event.Event.EventType)
 	}
 }
 
-func resolveStateChangeDestination(event *hass.EventMessage) (*insert, error) {
+func resolveStateChangeDestination(event *hass.EventMessage, database string) (*insert, error) {
 	data := event.Event.Data
 
 	if data.EntityID == "" {
@@ -63,7 +90,7 @@ func resolveStateChangeDestination(event *hass.EventMessage) (*insert, error) {
 	}
 
 	return &insert{
-		Database:  "hass", // Default database, will be overridden in pipeline if needed
+		Database:  database,
 		TableName: domain,
 		Input:     input,
 	}, nil
@@ -77,7 +104,7 @@ func resolveStateChangeInput(domain string, oldState, newState *hass.State) (*St
 		oldStateValue = ""
 	}
 	if isSkippedValue(newStateValue) {
-		return nil, fmt.Errorf("skipping event with unknown state: %s", newStateValue)
+		return nil, fmt.Errorf("%w: %s", errSkippedState, newStateValue)
 	}
 
 	switch domain {
@@ -166,10 +193,51 @@ type insert struct {
 	Input     interface{}
 }
 
-// createStateChangeTable creates a table for a state change event in ClickHouse
-func createStateChangeTable(ctx context.Context, client *clickhouse.Client, database, tableName string, stateType string) error {
-	query := fmt.Sprintf(stateChangeDDL, database, tableName, stateType, stateType)
-	return client.Execute(ctx, query, nil)
+// createStateChangeTable creates a table for a state change event in ClickHouse with the given DDL.
+// Extra columns are added to the table if it already exists without them.
+func createStateChangeTable(
+	ctx context.Context,
+	sink Sink,
+	ddl, database, tableName string,
+	extraColumns []string,
+) error {
+	if err := sink.Execute(ctx, ddl, nil); err != nil {
+		return err
+	}
+
+	return addColumns(ctx, sink, database, tableName, extraColumns)
+}
+
+// ensureTable creates a table of hass2ch's own rows (heartbeats, statistics, ...) with the given DDL unless
+// it is known to exist, and returns its database
+func (p *Pipeline) ensureTable(ctx context.Context, tableName, ddl string) (string, error) {
+	database := p.databaseFor(tableName)
+	tableKey := fmt.Sprintf("%s.%s", database, tableName)
+	if p.hasTable(tableKey) {
+		return database, nil
+	}
+
+	if err := p.sink.Execute(ctx, fmt.Sprintf(ddl, database, tableName), nil); err != nil {
+		return "", err
+	}
+	if err := addColumns(ctx, p.sink, database, tableName, p.labelColumns()); err != nil {
+		return "", err
+	}
+	p.markTable(tableKey)
+
+	return database, nil
+}
+
+// addColumns adds columns missing in an existing table
+func addColumns(ctx context.Context, sink Sink, database, tableName string, columns []string) error {
+	for _, column := range columns {
+		query := fmt.Sprintf(addColumnDDL, database, tableName, column)
+		if err := sink.Execute(ctx, query, nil); err != nil {
+			return fmt.Errorf("failed to add column %q: %w", column, err)
+		}
+	}
+
+	return nil
 }
 
 func normalizeBooleanValue(value string) any {
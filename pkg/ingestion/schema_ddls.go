@@ -0,0 +1,191 @@
+package ingestion
+
+const (
+	stateChangeDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    entity_id LowCardinality(String),
+    state %s,
+    old_state %s,
+    attributes JSON,
+    context JSON,
+    last_changed DateTime64(3, 'UTC'),
+    last_updated DateTime64(3, 'UTC'),
+    last_reported DateTime64(3, 'UTC'),
+    received_at DateTime64(3, 'UTC') DEFAULT now64(3)%s
+) ENGINE = %s
+PARTITION BY %s
+ORDER BY %s%s
+SETTINGS index_granularity = 8192%s;`
+
+	stateChangeV2DDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    entity_id LowCardinality(String),
+    domain LowCardinality(String),
+    state %s,
+    old_state %s,
+    attributes JSON,
+    context_id String,
+    context_parent_id Nullable(String),
+    context_user_id Nullable(String),
+    last_changed DateTime64(3, 'UTC'),
+    last_updated DateTime64(3, 'UTC'),
+    last_reported Nullable(DateTime64(3, 'UTC')),
+    cost Nullable(Float64),
+    value_delta Nullable(Float64),
+    received_at DateTime64(3, 'UTC') DEFAULT now64(3)%s
+) ENGINE = %s
+PARTITION BY %s
+ORDER BY %s%s
+SETTINGS index_granularity = 8192%s;`
+
+	attributeChangesDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    entity_id LowCardinality(String),
+    changed_keys Array(LowCardinality(String)),
+    old_values JSON,
+    new_values JSON,
+    context JSON,
+    last_updated DateTime64(3, 'UTC'),
+    received_at DateTime64(3, 'UTC') DEFAULT now64(3)
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(last_updated)
+ORDER BY (entity_id, last_updated)
+SETTINGS index_granularity = 8192;`
+
+	deadLetterDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    destination_table LowCardinality(String),
+    row String,
+    error String,
+    failed_at DateTime64(3, 'UTC') DEFAULT now64(3)
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(failed_at)
+ORDER BY (destination_table, failed_at)
+SETTINGS index_granularity = 8192;`
+
+	heartbeatsDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    entity_id LowCardinality(String),
+    state String,
+    last_updated DateTime64(3, 'UTC'),
+    emitted_at DateTime64(3, 'UTC')
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(emitted_at)
+ORDER BY (entity_id, emitted_at)
+SETTINGS index_granularity = 8192;`
+
+	insertStatsDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    batch_id String,
+    database LowCardinality(String),
+    table LowCardinality(String),
+    rows UInt32,
+    uncompressed_bytes UInt64,
+    sent_bytes UInt64,
+    written_bytes UInt64,
+    duration_ms UInt32,
+    rows_per_second Float64,
+    inserted_at DateTime64(3, 'UTC')
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(inserted_at)
+ORDER BY (table, inserted_at)
+SETTINGS index_granularity = 8192;`
+
+	restartsDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    event_type LowCardinality(String),
+    fired_at DateTime64(3, 'UTC'),
+    recorded_at DateTime64(3, 'UTC')
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(fired_at)
+ORDER BY fired_at
+SETTINGS index_granularity = 8192;`
+
+	// eventsDDL is the DDL of tables of events other than state_changed,
+	// {columns} are the columns of the event type and {order_by} its sorting key
+	eventsDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    event_type LowCardinality(String),
+    time_fired DateTime64(3, 'UTC') CODEC(Delta, ZSTD(1)),
+    origin LowCardinality(String),
+    context_id String,
+    context_user_id Nullable(String),
+    context_parent_id Nullable(String){columns},
+    data String CODEC(ZSTD(3))
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(time_fired)
+ORDER BY {order_by}
+SETTINGS index_granularity = 8192;`
+	statisticsDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    statistic_id LowCardinality(String),
+    start DateTime('UTC'),
+    end DateTime('UTC'),
+    mean Nullable(Float64),
+    min Nullable(Float64),
+    max Nullable(Float64),
+    state Nullable(Float64),
+    sum Nullable(Float64),
+    last_reset Nullable(DateTime64(3, 'UTC')),
+    imported_at DateTime64(3, 'UTC')
+) ENGINE = ReplacingMergeTree(imported_at)
+PARTITION BY toYYYYMM(start)
+ORDER BY (statistic_id, start)
+SETTINGS index_granularity = 8192;`
+	entitiesDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    entity_id String,
+    domain LowCardinality(String),
+    friendly_name String,
+    platform LowCardinality(String),
+    device_id String,
+    device_name String,
+    area LowCardinality(String),
+    device_class LowCardinality(String),
+    unit LowCardinality(String),
+    updated_at DateTime64(3, 'UTC')
+) ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY entity_id
+SETTINGS index_granularity = 8192;`
+	gapsDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    event_type LowCardinality(String),
+    from DateTime64(3, 'UTC'),
+    to DateTime64(3, 'UTC'),
+    missed_estimate UInt32,
+    resynced UInt32,
+    status LowCardinality(String),
+    error String,
+    recorded_at DateTime64(3, 'UTC')
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(from)
+ORDER BY from
+SETTINGS index_granularity = 8192;`
+
+	stateLabelsDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    domain LowCardinality(String),
+    state String,
+    value Int8,
+    locale LowCardinality(String),
+    label String
+) ENGINE = ReplacingMergeTree()
+ORDER BY (domain, state, locale)
+SETTINGS index_granularity = 8192;`
+
+	availabilityDDL = `
+CREATE TABLE IF NOT EXISTS %s.%s (
+    entity_id LowCardinality(String),
+    domain LowCardinality(String),
+    event Enum8('became_unavailable' = 1, 'became_unknown' = 2, 'became_available' = 3),
+    state LowCardinality(String),
+    old_state LowCardinality(String),
+    last_changed DateTime64(3, 'UTC'),
+    received_at DateTime64(3, 'UTC') DEFAULT now64(3)
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(last_changed)
+ORDER BY (entity_id, last_changed)
+SETTINGS index_granularity = 8192;`
+
+	addColumnDDL = `ALTER TABLE %s.%s ADD COLUMN IF NOT EXISTS %s`
+)
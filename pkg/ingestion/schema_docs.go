@@ -0,0 +1,261 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// Formats of schema documentation
+const (
+	SchemaDocsMarkdown = "markdown"
+	SchemaDocsHTML     = "html"
+)
+
+// tableKindDescriptions describe the tables of a kind in schema documentation
+var tableKindDescriptions = map[string]string{
+	TableKindStateChanges:     "State changes of Home Assistant entities, one row per state_changed event.",
+	TableKindOverflow:         "State changes whose state does not fit the state type of their table, stored with a String state.",
+	TableKindAttributeChanges: "Changes of attributes without a change of the state.",
+	TableKindDeadLetter:       "Rows rejected by ClickHouse in strict mode, with the error.",
+	TableKindHeartbeats:       "Current states of entities without state changes for a while.",
+	TableKindInsertStats:      "Statistics of every insert of hass2ch.",
+	TableKindRestarts:         "Starts, stops and core configuration changes of Home Assistant.",
+	TableKindEvents:           "Home Assistant events of a type other than state_changed.",
+	TableKindStatistics:       "Long-term statistics of Home Assistant, one row per statistic and hour.",
+	TableKindEntities:         "Metadata of entities from the entity, device and area registries.",
+	TableKindGaps:             "Windows in which the connection to Home Assistant was lost, and whether they were re-synced.",
+	TableKindStateLabels:      "Values and labels by locale of the enumerated states of Enum8 state columns.",
+	TableKindAvailability:     "Transitions of entities to and from the unavailable and unknown states.",
+}
+
+// columnDescriptions describe the columns of generated tables in schema documentation
+var columnDescriptions = map[string]string{
+	"entity_id":          "Entity ID, e.g. light.kitchen",
+	"domain":             "Domain of the entity ID, e.g. light",
+	"state":              "State after the change",
+	"old_state":          "State before the change, empty if unknown",
+	"attributes":         "Attributes of the entity after the change",
+	"context":            "Context of the change: its ID, parent ID and the ID of the user who caused it",
+	"context_id":         "ID of the context of the change",
+	"context_parent_id":  "ID of the context that caused the change, e.g. of an automation",
+	"context_user_id":    "ID of the user who caused the change, NULL for automations and integrations",
+	"last_changed":       "When the state last changed",
+	"last_updated":       "When the state or attributes last changed",
+	"last_reported":      "When the state was last reported, even without a change",
+	"received_at":        "When hass2ch received the state change",
+	"cost":               "Price of the energy consumed since the old state",
+	"value_delta":        "Difference from the previously stored value",
+	"is_late":            "Whether the state change arrived long after newer ones of its table",
+	"flap_count":         "Number of transitions collapsed into the row while the entity was flapping",
+	"flap_started":       "When the collapsed flapping started",
+	"event_hash":         "Hash identifying the state change across replays and backfills",
+	"value":              "Value of the state in the Enum8 state column",
+	"locale":             "Locale of the label, e.g. en",
+	"label":              "Label of the state shown by Home Assistant in the locale",
+	"event":              "Transition of the availability: became_unavailable, became_unknown or became_available",
+	"context_batch_id":   "ID of the group of state changes sharing the context, e.g. of one run of an automation",
+	"sign":               "Sign of the row of a CollapsingMergeTree, -1 cancels a row",
+	"attributes_diff":    "Whether attributes holds only the attributes changed since the old state",
+	"attributes_removed": "Keys of attributes removed since the old state",
+	"changed_keys":       "Keys of the changed attributes",
+	"old_values":         "Values of the changed attributes before the change",
+	"new_values":         "Values of the changed attributes after the change",
+}
+
+// SampleAttributes sets the attribute keys of the existing state change tables of a catalog, found in a sample
+// of at most the given number of rows of each table. Tables whose attributes cannot be read are skipped.
+func (p *Pipeline) SampleAttributes(ctx context.Context, catalog *Catalog, rows int) error {
+	q, ok := p.sink.(querier)
+	if !ok {
+		return fmt.Errorf("sink does not support queries")
+	}
+
+	for _, table := range catalog.Tables {
+		if !table.Exists || (table.Kind != TableKindStateChanges && table.Kind != TableKindOverflow) {
+			continue
+		}
+
+		query := fmt.Sprintf("SELECT DISTINCT arrayJoin(JSONAllPaths(attributes)) AS key FROM (SELECT attributes FROM %s.%s LIMIT %d) ORDER BY key",
+			table.Database, table.Name, rows)
+		var keys []string
+		err := q.Query(ctx, query, func(raw json.RawMessage) error {
+			var row struct {
+				Key string `json:"key"`
+			}
+			if err := json.Unmarshal(raw, &row); err != nil {
+				return err
+			}
+			keys = append(keys, row.Key)
+			return nil
+		})
+		if err != nil {
+			log.Warn().Err(err).Str("table", table.Database+"."+table.Name).Msg("failed to sample attributes")
+			continue
+		}
+		table.Attributes = keys
+	}
+
+	return nil
+}
+
+// WriteSchemaDocs writes documentation of the tables of a catalog, their columns and the fields of
+// Home Assistant events they are populated from, as Markdown or HTML
+func WriteSchemaDocs(w io.Writer, catalog *Catalog, format string) error {
+	switch format {
+	case SchemaDocsMarkdown:
+		return writeMarkdownSchemaDocs(w, catalog)
+	case SchemaDocsHTML:
+		return schemaDocsTemplate.Execute(w, schemaDocs(catalog))
+	default:
+		return fmt.Errorf("unknown schema documentation format %q, expected %s or %s", format, SchemaDocsMarkdown, SchemaDocsHTML)
+	}
+}
+
+// docsTable is a table of schema documentation
+type docsTable struct {
+	*CatalogTable
+	Description string
+	Columns     []docsColumn
+}
+
+// docsColumn is a column of schema documentation
+type docsColumn struct {
+	CatalogColumn
+	Description string
+	// Drift is set if the type of an existing column differs from the one hass2ch creates
+	Drift bool
+}
+
+func schemaDocs(catalog *Catalog) []docsTable {
+	tables := make([]docsTable, 0, len(catalog.Tables))
+	for _, table := range catalog.Tables {
+		doc := docsTable{CatalogTable: table, Description: tableKindDescriptions[table.Kind]}
+		for _, column := range table.Columns {
+			doc.Columns = append(doc.Columns, docsColumn{
+				CatalogColumn: column,
+				Description:   columnDescriptions[column.Name],
+				Drift:         column.Type != "" && column.ExistingType != "" && column.Type != column.ExistingType,
+			})
+		}
+		tables = append(tables, doc)
+	}
+	return tables
+}
+
+func writeMarkdownSchemaDocs(w io.Writer, catalog *Catalog) error {
+	var b strings.Builder
+	b.WriteString("# hass2ch Schema\n\n")
+	b.WriteString("Tables written by hass2ch with the current configuration.\n")
+
+	for _, table := range schemaDocs(catalog) {
+		fmt.Fprintf(&b, "\n## %s.%s\n\n", table.Database, table.Name)
+		if table.Description != "" {
+			b.WriteString(table.Description + "\n\n")
+		}
+
+		fmt.Fprintf(&b, "- Kind: `%s`\n", table.Kind)
+		if table.Domain != "" {
+			fmt.Fprintf(&b, "- Domain: `%s`\n", table.Domain)
+		}
+		if table.RowModel != "" {
+			fmt.Fprintf(&b, "- Row model: `%s`\n", table.RowModel)
+		}
+		fmt.Fprintf(&b, "- Status: %s\n", tableStatus(table.CatalogTable))
+
+		b.WriteString("\n| Column | Type | Source | Description |\n|--------|------|--------|-------------|\n")
+		for _, column := range table.Columns {
+			columnType := markdownCode(column.Type)
+			if column.Type == "" {
+				columnType = markdownCode(column.ExistingType) + " (not generated)"
+			} else if column.Drift {
+				columnType += " (exists as " + markdownCode(column.ExistingType) + ")"
+			}
+			fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n",
+				column.Name, columnType, markdownCode(column.Source), markdownEscape(column.Description))
+		}
+
+		if len(table.Attributes) > 0 {
+			b.WriteString("\nAttributes found in the `attributes` column: ")
+			for i, key := range table.Attributes {
+				if i > 0 {
+					b.WriteString(", ")
+				}
+				b.WriteString(markdownCode(key))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// tableStatus describes whether a table is generated by hass2ch and exists in ClickHouse
+func tableStatus(table *CatalogTable) string {
+	switch {
+	case table.Generated && table.Exists:
+		return "generated, exists"
+	case table.Generated:
+		return "generated, not created yet"
+	default:
+		return "exists"
+	}
+}
+
+func markdownCode(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "`" + s + "`"
+}
+
+func markdownEscape(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+var schemaDocsTemplate = template.Must(template.New("schema").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>hass2ch Schema</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+code { background: #f4f4f4; }
+.drift { color: #b00; }
+</style>
+</head>
+<body>
+<h1>hass2ch Schema</h1>
+<p>Tables written by hass2ch with the current configuration.</p>
+<ul>
+{{- range .}}
+<li><a href="#{{.Database}}.{{.Name}}">{{.Database}}.{{.Name}}</a></li>
+{{- end}}
+</ul>
+{{- range .}}
+<h2 id="{{.Database}}.{{.Name}}">{{.Database}}.{{.Name}}</h2>
+{{- if .Description}}
+<p>{{.Description}}</p>
+{{- end}}
+<p>Kind: <code>{{.Kind}}</code>{{if .Domain}}, domain: <code>{{.Domain}}</code>{{end}}{{if .RowModel}}, row model: <code>{{.RowModel}}</code>{{end}}{{if .Generated}}, generated{{end}}{{if .Exists}}, exists{{end}}</p>
+<table>
+<tr><th>Column</th><th>Type</th><th>Source</th><th>Description</th></tr>
+{{- range .Columns}}
+<tr><td><code>{{.Name}}</code></td><td>{{if .Type}}<code>{{.Type}}</code>{{if .Drift}} <span class="drift">(exists as <code>{{.ExistingType}}</code>)</span>{{end}}{{else}}<code>{{.ExistingType}}</code> (not generated){{end}}</td><td>{{if .Source}}<code>{{.Source}}</code>{{end}}</td><td>{{.Description}}</td></tr>
+{{- end}}
+</table>
+{{- if .Attributes}}
+<p>Attributes found in the <code>attributes</code> column: {{range $i, $key := .Attributes}}{{if $i}}, {{end}}<code>{{$key}}</code>{{end}}</p>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
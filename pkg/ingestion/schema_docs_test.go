@@ -0,0 +1,85 @@
+package ingestion
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+func TestWriteSchemaDocs(t *testing.T) {
+	catalog := &Catalog{Tables: []*CatalogTable{{
+		Database:  "hass",
+		Name:      "light",
+		Kind:      TableKindStateChanges,
+		Domain:    "light",
+		RowModel:  "v1",
+		Generated: true,
+		Exists:    true,
+		Columns: []CatalogColumn{
+			{Name: "entity_id", Type: "LowCardinality(String)", ExistingType: "LowCardinality(String)", Source: "new_state.entity_id"},
+			{Name: "state", Type: "LowCardinality(String)", ExistingType: "String", Source: "new_state.state"},
+			{Name: "note", ExistingType: "String"},
+		},
+		Attributes: []string{"brightness", "color_mode"},
+	}}}
+
+	var md bytes.Buffer
+	require.NoError(t, WriteSchemaDocs(&md, catalog, SchemaDocsMarkdown))
+	assert.Contains(t, md.String(), "## hass.light\n")
+	assert.Contains(t, md.String(), "| `entity_id` | `LowCardinality(String)` | `new_state.entity_id` | Entity ID, e.g. light.kitchen |")
+	assert.Contains(t, md.String(), "| `state` | `LowCardinality(String)` (exists as `String`) |")
+	assert.Contains(t, md.String(), "| `note` | `String` (not generated) |")
+	assert.Contains(t, md.String(), "`brightness`, `color_mode`")
+
+	var html bytes.Buffer
+	require.NoError(t, WriteSchemaDocs(&html, catalog, SchemaDocsHTML))
+	assert.Contains(t, html.String(), `<h2 id="hass.light">hass.light</h2>`)
+	assert.Contains(t, html.String(), `<span class="drift">(exists as <code>String</code>)</span>`)
+
+	assert.Error(t, WriteSchemaDocs(&md, catalog, "pdf"))
+}
+
+// attributesSink serves attribute keys to every query and records the queries
+type attributesSink struct {
+	keys    []string
+	queries []string
+}
+
+func (s *attributesSink) Execute(context.Context, string, io.ReadSeeker, ...clickhouse.QueryOption) error {
+	return nil
+}
+
+func (s *attributesSink) Query(_ context.Context, query string, fn func(row json.RawMessage) error, _ ...clickhouse.QueryOption) error {
+	s.queries = append(s.queries, query)
+	for _, key := range s.keys {
+		if err := fn(json.RawMessage(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPipeline_SampleAttributes(t *testing.T) {
+	sink := &attributesSink{keys: []string{`{"key":"brightness"}`, `{"key":"friendly_name"}`}}
+	p := NewPipeline(nil, sink, "hass")
+
+	catalog := &Catalog{Tables: []*CatalogTable{
+		{Database: "hass", Name: "light", Kind: TableKindStateChanges, Exists: true},
+		{Database: "hass", Name: "switch", Kind: TableKindStateChanges},
+		{Database: "hass", Name: "dead_letter", Kind: TableKindDeadLetter, Exists: true},
+	}}
+	require.NoError(t, p.SampleAttributes(context.Background(), catalog, 100))
+
+	require.Len(t, sink.queries, 1)
+	assert.Contains(t, sink.queries[0], "FROM hass.light LIMIT 100")
+	assert.Equal(t, []string{"brightness", "friendly_name"}, catalog.Tables[0].Attributes)
+	assert.Nil(t, catalog.Tables[1].Attributes, "not created yet")
+	assert.Nil(t, catalog.Tables[2].Attributes, "no attributes column")
+}
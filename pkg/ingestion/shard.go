@@ -0,0 +1,62 @@
+package ingestion
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Shard is the subset of entities ingested by one of multiple instances sharing the load of a
+// Home Assistant installation. Entities are assigned to shards by the hash of their entity ID.
+type Shard struct {
+	Index int
+	Count int
+}
+
+// ParseShard parses a shard in the form of "index/count", e.g. 0/3 for the first of three instances
+func ParseShard(s string) (Shard, error) {
+	index, count, ok := strings.Cut(s, "/")
+	if !ok {
+		return Shard{}, fmt.Errorf("invalid shard %q: expected index/count", s)
+	}
+
+	var shard Shard
+	var err error
+	if shard.Index, err = strconv.Atoi(strings.TrimSpace(index)); err != nil {
+		return Shard{}, fmt.Errorf("invalid shard index %q", index)
+	}
+	if shard.Count, err = strconv.Atoi(strings.TrimSpace(count)); err != nil {
+		return Shard{}, fmt.Errorf("invalid shard count %q", count)
+	}
+
+	if shard.Count < 1 || shard.Index < 0 || shard.Index >= shard.Count {
+		return Shard{}, fmt.Errorf("invalid shard %q: index must be between 0 and count-1", s)
+	}
+
+	return shard, nil
+}
+
+// Owns reports whether the entity is ingested by the shard
+func (s Shard) Owns(entityID string) bool {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(entityID))
+	return int(h.Sum32()%uint32(s.Count)) == s.Index
+}
+
+func (s Shard) String() string {
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+// WithShard ingests only the entities of the shard. Every instance of a sharded deployment must
+// be configured with the same shard count and a distinct index.
+func WithShard(shard Shard) PipelineOption {
+	return func(p *Pipeline) {
+		p.shard = &shard
+	}
+}
+
+// owns reports whether the entity is ingested by this pipeline
+func (p *Pipeline) owns(entityID string) bool {
+	return p.shard == nil || p.shard.Owns(entityID)
+}
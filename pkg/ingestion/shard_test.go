@@ -0,0 +1,36 @@
+package ingestion
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseShard(t *testing.T) {
+	shard, err := ParseShard("1/3")
+	require.NoError(t, err)
+	assert.Equal(t, Shard{Index: 1, Count: 3}, shard)
+
+	for _, s := range []string{"3/3", "-1/3", "0/0", "1", "a/3"} {
+		_, err := ParseShard(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestShard_Owns(t *testing.T) {
+	shards := []Shard{{Index: 0, Count: 3}, {Index: 1, Count: 3}, {Index: 2, Count: 3}}
+
+	for i := 0; i < 100; i++ {
+		entityID := fmt.Sprintf("sensor.temperature_%d", i)
+
+		owners := 0
+		for _, shard := range shards {
+			if shard.Owns(entityID) {
+				owners++
+			}
+		}
+		assert.Equal(t, 1, owners, "every entity is owned by exactly one shard: %s", entityID)
+	}
+}
@@ -0,0 +1,50 @@
+package ingestion
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// jsonEachRowInsertPattern matches the inserts the pipeline encodes as JSONEachRow, capturing the database and table
+var jsonEachRowInsertPattern = regexp.MustCompile(`^INSERT INTO ([^\s.]+)\.(\S+) FORMAT JSONEachRow$`)
+
+// SinkFunc is a Sink passing batches of rows to a function instead of ClickHouse, e.g. to publish them to a
+// message queue. Rows are the rows of the pipeline, e.g. *StateChange, except for rows the pipeline inserts
+// as JSONEachRow, e.g. replayed from the write-ahead log or dead letters, which are json.RawMessage.
+// Other statements, e.g. DDL, are ignored, so pair it with WithoutDDL to skip generating them.
+type SinkFunc func(ctx context.Context, database, table string, rows []any) error
+
+// Insert passes a batch of rows to the function
+func (f SinkFunc) Insert(ctx context.Context, database, table string, rows []any, _ ...clickhouse.QueryOption) error {
+	return f(ctx, database, table, rows)
+}
+
+// Execute passes the rows of a JSONEachRow insert to the function and ignores any other statement
+func (f SinkFunc) Execute(ctx context.Context, query string, body io.ReadSeeker, _ ...clickhouse.QueryOption) error {
+	match := jsonEachRowInsertPattern.FindStringSubmatch(query)
+	if match == nil || body == nil {
+		return nil
+	}
+
+	var rows []any
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rows = append(rows, json.RawMessage(append([]byte(nil), scanner.Bytes()...)))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read rows of %s.%s: %w", match[1], match[2], err)
+	}
+
+	return f(ctx, match[1], match[2], rows)
+}
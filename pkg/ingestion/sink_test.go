@@ -0,0 +1,37 @@
+package ingestion
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinkFunc(t *testing.T) {
+	type batch struct {
+		table string
+		rows  []any
+	}
+	var batches []batch
+	sink := SinkFunc(func(_ context.Context, database, table string, rows []any) error {
+		batches = append(batches, batch{table: database + "." + table, rows: rows})
+		return nil
+	})
+
+	p := NewPipeline(nil, sink, "hass", WithoutDDL())
+	change := &StateChange{EntityID: "light.kitchen", State: "on"}
+	require.NoError(t, p.insertRows(context.Background(), "hass", "light", []any{change}))
+
+	// JSONEachRow inserts are passed as raw rows, other statements are ignored
+	body := strings.NewReader("{\"entity_id\":\"light.kitchen\"}\n{\"entity_id\":\"light.hall\"}\n")
+	require.NoError(t, sink.Execute(context.Background(), "INSERT INTO hass.light FORMAT JSONEachRow", body))
+	require.NoError(t, sink.Execute(context.Background(), "CREATE TABLE IF NOT EXISTS hass.light (entity_id String) ENGINE = MergeTree", nil))
+
+	require.Len(t, batches, 2)
+	assert.Equal(t, batch{table: "hass.light", rows: []any{change}}, batches[0])
+	assert.Equal(t, "hass.light", batches[1].table)
+	assert.Equal(t, []any{json.RawMessage(`{"entity_id":"light.kitchen"}`), json.RawMessage(`{"entity_id":"light.hall"}`)}, batches[1].rows)
+}
@@ -0,0 +1,66 @@
+package ingestion
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// WithInitialSnapshot inserts the current state of every entity on startup, once subscribed to state changes,
+// so tables are not empty for entities that rarely change until their first state change. Snapshot rows have
+// the state as both the state and the old state. Every restart inserts a snapshot again; with WithEventHash
+// and deduplication, the rows of unchanged entities are collapsed.
+func WithInitialSnapshot() PipelineOption {
+	return func(p *Pipeline) {
+		p.initialSnapshot = true
+	}
+}
+
+// sendInitialSnapshot sends a state change of the current state of every entity to the snapshots channel
+func (p *Pipeline) sendInitialSnapshot(ctx context.Context, snapshots chan<- *hass.EventMessage) {
+	states, err := p.source.GetStates(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get states, the initial snapshot is not inserted")
+		return
+	}
+
+	events := snapshotStateChanges(states)
+	log.Info().Int("entities", len(events)).Msg("inserting initial snapshot of states")
+	metrics.InitialSnapshotEvents.Add(float64(len(events)))
+
+	for _, event := range events {
+		select {
+		case snapshots <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// snapshotStateChanges returns a state change event of every state from and to itself, ordered by last updated
+func snapshotStateChanges(states []hass.State) []*hass.EventMessage {
+	events := make([]*hass.EventMessage, 0, len(states))
+	for _, state := range states {
+		oldState, newState := state, state
+		events = append(events, &hass.EventMessage{
+			BaseMessage: hass.BaseMessage{Type: hass.MessageTypeEvent},
+			Event: hass.Event{
+				EventType: hass.EventTypeStateChanged,
+				TimeFired: newState.LastUpdated,
+				Origin:    OriginLocal,
+				Context:   newState.Context,
+				Data: hass.EventData{
+					EntityID: newState.EntityID,
+					OldState: &oldState,
+					NewState: &newState,
+				},
+			},
+		})
+	}
+
+	sortByLastUpdated(events)
+	return events
+}
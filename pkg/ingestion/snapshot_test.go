@@ -0,0 +1,32 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestSnapshotStateChanges(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := snapshotStateChanges([]hass.State{
+		{EntityID: "sensor.temperature", State: "21.5", LastUpdated: now},
+		{EntityID: "light.kitchen", State: "on", LastUpdated: now.Add(-time.Hour)},
+	})
+	require.Len(t, events, 2)
+
+	// Snapshot rows are ordered by last updated, with the state as the old state
+	assert.Equal(t, "light.kitchen", events[0].Event.Data.EntityID)
+	assert.Equal(t, "sensor.temperature", events[1].Event.Data.EntityID)
+
+	insert, err := resolveInput(events[0], "hass")
+	require.NoError(t, err)
+	assert.Equal(t, "light", insert.TableName)
+	stateChange, ok := insert.Input.(*StateChange)
+	require.True(t, ok)
+	assert.Equal(t, stateChange.State, stateChange.OldState)
+	assert.Equal(t, now.Add(-time.Hour), events[0].Event.TimeFired)
+}
@@ -0,0 +1,152 @@
+package ingestion
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// Names of the built-in stages, used to declare their order with WithStageOrder
+const (
+	StageOrigin        = "origin"
+	StageRateLimit     = "rate_limit"
+	StageFlapDetection = "flap_detection"
+	StageRounding      = "rounding"
+	StageValueDelta    = "value_delta"
+	StageCost          = "cost"
+	StageLateEvents    = "late_events"
+)
+
+var stageNames = []string{StageOrigin, StageRateLimit, StageFlapDetection, StageRounding, StageValueDelta, StageCost, StageLateEvents}
+
+// Filter decides whether a state change event enters the pipeline. Filters run in order before
+// events are batched; an event dropped by a filter is not seen by the following ones.
+type Filter interface {
+	Allow(event *hass.EventMessage) bool
+}
+
+// WithFilter registers a custom filter on the pipeline
+func WithFilter(f Filter) PipelineOption {
+	return func(p *Pipeline) {
+		p.filters = append(p.filters, f)
+	}
+}
+
+// namedStage is implemented by built-in filters and transformers that can be ordered with WithStageOrder
+type namedStage interface {
+	stageName() string
+}
+
+// WithStageOrder declares the order of the built-in filters and transformers, overriding the order
+// they were registered in. Every configured built-in stage must be listed, and filters must be listed
+// before transformers (enrichers), since they run before batching. Custom stages run after the built-in ones.
+func WithStageOrder(names ...string) PipelineOption {
+	return func(p *Pipeline) {
+		p.stageOrder = names
+	}
+}
+
+// ParseStageOrder parses a comma-separated list of stage names
+func ParseStageOrder(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// orderStages validates the declared stage order and reorders the filters and transformers accordingly
+func (p *Pipeline) orderStages() error {
+	if len(p.stageOrder) == 0 {
+		return nil
+	}
+
+	configured := make(map[string]bool)
+	filters := make(map[string]bool)
+	for _, f := range p.filters {
+		if n, ok := f.(namedStage); ok {
+			configured[n.stageName()] = true
+			filters[n.stageName()] = true
+		}
+	}
+	for _, t := range p.transformers {
+		if n, ok := t.(namedStage); ok {
+			configured[n.stageName()] = true
+		}
+	}
+
+	positions := make(map[string]int, len(p.stageOrder))
+	lastEnricher := ""
+	for i, name := range p.stageOrder {
+		switch {
+		case !isStageName(name):
+			return fmt.Errorf("unknown stage %q, expected one of: %s", name, strings.Join(stageNames, ", "))
+		case !configured[name]:
+			return fmt.Errorf("stage %q is not configured", name)
+		}
+		if _, ok := positions[name]; ok {
+			return fmt.Errorf("stage %q is listed more than once", name)
+		}
+		if filters[name] && lastEnricher != "" {
+			return fmt.Errorf("filter stage %q cannot run after enricher stage %q, filters run before batching", name, lastEnricher)
+		}
+		if !filters[name] {
+			lastEnricher = name
+		}
+		positions[name] = i
+	}
+
+	for _, name := range stageNames {
+		if _, ok := positions[name]; configured[name] && !ok {
+			return fmt.Errorf("stage %q is configured but missing from the stage order", name)
+		}
+	}
+
+	sortStages(p.filters, positions)
+	sortStages(p.transformers, positions)
+
+	return nil
+}
+
+func isStageName(name string) bool {
+	for _, n := range stageNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sortStages orders named stages by their positions, keeping the other stages after them in their order
+func sortStages[T any](stages []T, positions map[string]int) {
+	position := func(stage T) int {
+		if n, ok := any(stage).(namedStage); ok {
+			return positions[n.stageName()]
+		}
+		return len(positions)
+	}
+
+	sort.SliceStable(stages, func(i, j int) bool {
+		return position(stages[i]) < position(stages[j])
+	})
+}
+
+func (p *Pipeline) allow(event *hass.EventMessage) bool {
+	// Entities of other shards are not seen by filters, so they don't keep state of them
+	if !p.owns(event.Event.Data.EntityID) {
+		metrics.ShardEventsSkipped.Inc()
+		return false
+	}
+
+	for _, f := range p.filters {
+		if !f.Allow(event) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package ingestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline_OrderStages(t *testing.T) {
+	opts := []PipelineOption{
+		WithRounding(RoundingConfig{}),
+		WithValueDelta(),
+		WithRateLimit(RateLimitConfig{}),
+		WithFlapDetection(FlapConfig{}),
+	}
+	stageNamesOf := func(p *Pipeline) (filters, transformers []string) {
+		for _, f := range p.filters {
+			filters = append(filters, f.(namedStage).stageName())
+		}
+		for _, t := range p.transformers {
+			transformers = append(transformers, t.(namedStage).stageName())
+		}
+		return filters, transformers
+	}
+
+	p := NewPipeline(nil, nil, "hass", append(opts, WithStageOrder(StageFlapDetection, StageRateLimit, StageValueDelta, StageRounding))...)
+	require.NoError(t, p.orderStages())
+	filters, transformers := stageNamesOf(p)
+	assert.Equal(t, []string{StageFlapDetection, StageRateLimit}, filters)
+	assert.Equal(t, []string{StageFlapDetection, StageValueDelta, StageRounding}, transformers)
+
+	for order, expected := range map[string]string{
+		"rate_limit,flap_detection,rounding":                      `stage "value_delta" is configured but missing from the stage order`,
+		"rate_limit,flap_detection,rounding,value_delta,dedupe":   `unknown stage "dedupe"`,
+		"rate_limit,flap_detection,rounding,value_delta,cost":     `stage "cost" is not configured`,
+		"rate_limit,rounding,flap_detection,value_delta":          `filter stage "flap_detection" cannot run after enricher stage "rounding"`,
+		"rate_limit,flap_detection,rounding,value_delta,rounding": `stage "rounding" is listed more than once`,
+	} {
+		p := NewPipeline(nil, nil, "hass", append(opts, WithStageOrder(ParseStageOrder(order)...))...)
+		assert.ErrorContains(t, p.orderStages(), expected, order)
+	}
+
+	// Stages run in the order they were registered unless the order is declared
+	p = NewPipeline(nil, nil, "hass", WithLateEvents(time.Minute), WithRounding(RoundingConfig{}))
+	require.NoError(t, p.orderStages())
+	_, transformers = stageNamesOf(p)
+	assert.Equal(t, []string{StageLateEvents, StageRounding}, transformers)
+}
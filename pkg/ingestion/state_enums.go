@@ -0,0 +1,226 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+const (
+	stateLabelsTableName = "state_labels"
+
+	// defaultStateLabelLocale is the locale of the built-in labels of enumerated states
+	defaultStateLabelLocale = "en"
+)
+
+// stateEnums are the states of domains with enumerated states, in the order of their Enum8 values
+var stateEnums = map[string][]string{
+	hass.EntityClimate:           {"off", "heat", "cool", "heat_cool", "auto", "dry", "fan_only"},
+	hass.EntityMediaPlayer:       {"off", "on", "idle", "playing", "paused", "standby", "buffering"},
+	hass.EntityAlarmControlPanel: {"disarmed", "armed_home", "armed_away", "armed_night", "armed_vacation", "armed_custom_bypass", "pending", "arming", "disarming", "triggered"},
+}
+
+// defaultStateLabels are the English labels of enumerated states, as shown by Home Assistant
+var defaultStateLabels = map[string]string{
+	"climate.off":       "Off",
+	"climate.heat":      "Heat",
+	"climate.cool":      "Cool",
+	"climate.heat_cool": "Heat/Cool",
+	"climate.auto":      "Auto",
+	"climate.dry":       "Dry",
+	"climate.fan_only":  "Fan only",
+
+	"media_player.off":       "Off",
+	"media_player.on":        "On",
+	"media_player.idle":      "Idle",
+	"media_player.playing":   "Playing",
+	"media_player.paused":    "Paused",
+	"media_player.standby":   "Standby",
+	"media_player.buffering": "Buffering",
+
+	"alarm_control_panel.disarmed":            "Disarmed",
+	"alarm_control_panel.armed_home":          "Armed home",
+	"alarm_control_panel.armed_away":          "Armed away",
+	"alarm_control_panel.armed_night":         "Armed night",
+	"alarm_control_panel.armed_vacation":      "Armed vacation",
+	"alarm_control_panel.armed_custom_bypass": "Armed custom bypass",
+	"alarm_control_panel.pending":             "Pending",
+	"alarm_control_panel.arming":              "Arming",
+	"alarm_control_panel.disarming":           "Disarming",
+	"alarm_control_panel.triggered":           "Triggered",
+}
+
+// StateEnumConfig configures Enum8 state columns of domains with enumerated states
+type StateEnumConfig struct {
+	// Domains are the domains whose state columns are Enum8 of their states, see EnumDomains
+	Domains []string
+	// Labels are labels of states by locale and domain.state, e.g. de and climate.heat, added to the English ones
+	Labels map[string]map[string]string
+}
+
+// EnumDomains returns the domains with enumerated states supported by WithStateEnums
+func EnumDomains() []string {
+	domains := make([]string, 0, len(stateEnums))
+	for domain := range stateEnums {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// ParseStateEnums parses a comma-separated list of domains with enumerated states, or "all" for every supported
+// one, and the labels of their states in the form of "locale:domain.state=label;...", e.g. "de:climate.heat=Heizen".
+// Labels are separated by semicolons, as they may contain commas.
+func ParseStateEnums(domains, labels string) (StateEnumConfig, error) {
+	var conf StateEnumConfig
+	for _, domain := range strings.Split(domains, ",") {
+		domain = strings.TrimSpace(domain)
+		switch {
+		case domain == "":
+			continue
+		case domain == "all":
+			conf.Domains = EnumDomains()
+			continue
+		case stateEnums[domain] == nil:
+			return conf, fmt.Errorf("domain %q has no enumerated states, expected one of %s", domain, strings.Join(EnumDomains(), ", "))
+		}
+		conf.Domains = append(conf.Domains, domain)
+	}
+
+	for _, part := range strings.Split(labels, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, label, ok := strings.Cut(part, "=")
+		locale, state, hasLocale := strings.Cut(strings.TrimSpace(key), ":")
+		domain, value, hasDomain := strings.Cut(state, ".")
+		if !ok || !hasLocale || !hasDomain || locale == "" || strings.TrimSpace(label) == "" {
+			return conf, fmt.Errorf("invalid state label %q: expected locale:domain.state=label", part)
+		}
+		if !enumHasState(domain, value) {
+			return conf, fmt.Errorf("invalid state label %q: %s is not an enumerated state of %s", part, value, domain)
+		}
+
+		if conf.Labels == nil {
+			conf.Labels = make(map[string]map[string]string)
+		}
+		if conf.Labels[locale] == nil {
+			conf.Labels[locale] = make(map[string]string)
+		}
+		conf.Labels[locale][state] = strings.TrimSpace(label)
+	}
+
+	return conf, nil
+}
+
+// WithStateEnums stores the states of the given domains in Enum8 columns instead of strings, which compress better
+// and reject misspelled states in queries. The values of every state and its labels by locale are maintained in the
+// state_labels table. States outside the enum, e.g. of a newer Home Assistant, are stored in the overflow table.
+// Only new tables get Enum8 columns, the migrate command reports the existing ones.
+func WithStateEnums(conf StateEnumConfig) PipelineOption {
+	return func(p *Pipeline) {
+		p.stateEnums = make(map[string]string, len(conf.Domains))
+		for _, domain := range conf.Domains {
+			p.stateEnums[domain] = stateEnumType(stateEnums[domain])
+		}
+		p.stateLabels = conf.Labels
+	}
+}
+
+// stateEnumType returns the Enum8 type of the given states. The empty string is the old state of entities
+// that were unavailable or unknown.
+func stateEnumType(states []string) string {
+	values := make([]string, 0, len(states)+1)
+	values = append(values, "'' = 0")
+	for i, state := range states {
+		values = append(values, fmt.Sprintf("%s = %d", clickhouse.QuoteString(state), i+1))
+	}
+	return "Enum8(" + strings.Join(values, ", ") + ")"
+}
+
+// enumTypeHasValue reports whether an Enum8 type has the given value
+func enumTypeHasValue(enumType, value string) bool {
+	return strings.Contains(enumType, clickhouse.QuoteString(value)+" = ")
+}
+
+func enumHasState(domain, state string) bool {
+	for _, s := range stateEnums[domain] {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// stateLabel is a row of the state_labels table
+type stateLabel struct {
+	Domain string `json:"domain"`
+	State  string `json:"state"`
+	Value  int8   `json:"value"`
+	Locale string `json:"locale"`
+	Label  string `json:"label"`
+}
+
+// stateLabelRows returns the rows of the state_labels table: the English label of every state of the enum domains,
+// and the configured labels of other locales
+func (p *Pipeline) stateLabelRows() []any {
+	locales := make([]string, 0, len(p.stateLabels))
+	for locale := range p.stateLabels {
+		if locale != defaultStateLabelLocale {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales)
+
+	domains := make([]string, 0, len(p.stateEnums))
+	for domain := range p.stateEnums {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	var rows []any
+	for _, domain := range domains {
+		for i, state := range stateEnums[domain] {
+			key := domain + "." + state
+			label := defaultStateLabels[key]
+			if custom, ok := p.stateLabels[defaultStateLabelLocale][key]; ok {
+				label = custom
+			}
+			rows = append(rows, &stateLabel{Domain: domain, State: state, Value: int8(i + 1), Locale: defaultStateLabelLocale, Label: label})
+
+			for _, locale := range locales {
+				if label, ok := p.stateLabels[locale][key]; ok {
+					rows = append(rows, &stateLabel{Domain: domain, State: state, Value: int8(i + 1), Locale: locale, Label: label})
+				}
+			}
+		}
+	}
+	return rows
+}
+
+// writeStateLabels maintains the state_labels table on startup if enum states are enabled
+func (p *Pipeline) writeStateLabels(ctx context.Context) error {
+	if len(p.stateEnums) == 0 {
+		return nil
+	}
+
+	database, err := p.ensureTable(ctx, stateLabelsTableName, stateLabelsDDL)
+	if err != nil {
+		return fmt.Errorf("failed to create state labels table: %w", err)
+	}
+
+	rows := p.stateLabelRows()
+	if err := p.insertRows(ctx, database, stateLabelsTableName, rows); err != nil {
+		return fmt.Errorf("failed to write state labels: %w", err)
+	}
+	log.Info().Str("table", database+"."+stateLabelsTableName).Int("rows", len(rows)).Msg("wrote state labels")
+	return nil
+}
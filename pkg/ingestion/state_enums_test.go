@@ -0,0 +1,51 @@
+package ingestion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStateEnums(t *testing.T) {
+	conf, err := ParseStateEnums("climate, media_player", "de:climate.heat=Heizen; de:climate.cool=Kühlen")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"climate", "media_player"}, conf.Domains)
+	assert.Equal(t, map[string]map[string]string{"de": {"climate.heat": "Heizen", "climate.cool": "Kühlen"}}, conf.Labels)
+
+	conf, err = ParseStateEnums("all", "")
+	require.NoError(t, err)
+	assert.Equal(t, EnumDomains(), conf.Domains)
+
+	_, err = ParseStateEnums("light", "")
+	assert.Error(t, err)
+	_, err = ParseStateEnums("climate", "climate.heat=Heizen")
+	assert.Error(t, err)
+	_, err = ParseStateEnums("climate", "de:climate.eco=Eco")
+	assert.Error(t, err)
+}
+
+func TestPipeline_StateEnums(t *testing.T) {
+	conf, err := ParseStateEnums("climate", "de:climate.heat=Heizen")
+	require.NoError(t, err)
+	p := NewPipeline(nil, nil, "hass", WithStateEnums(conf))
+
+	stateType := p.stateTypeOf("climate")
+	assert.Equal(t, "Enum8('' = 0, 'off' = 1, 'heat' = 2, 'cool' = 3, 'heat_cool' = 4, 'auto' = 5, 'dry' = 6, 'fan_only' = 7)", stateType)
+	assert.Equal(t, "String", p.stateTypeOf("media_player"), "only configured domains are enums")
+
+	ddl, err := p.stateChangeDDL(RowModelV1, "hass", "climate", "climate", stateType)
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "state "+stateType+",")
+
+	// States outside the enum overflow, empty old states of unavailable entities fit
+	assert.True(t, fitsStateType(stateType, &StateChange{State: "heat_cool", OldState: ""}))
+	assert.False(t, fitsStateType(stateType, &StateChange{State: "eco", OldState: "heat"}))
+	assert.False(t, fitsStateType(stateType, &StateChange{State: "heat", OldState: "'"}))
+
+	rows := p.stateLabelRows()
+	require.Len(t, rows, 8)
+	assert.Equal(t, &stateLabel{Domain: "climate", State: "off", Value: 1, Locale: "en", Label: "Off"}, rows[0])
+	assert.Equal(t, &stateLabel{Domain: "climate", State: "heat", Value: 2, Locale: "en", Label: "Heat"}, rows[1])
+	assert.Equal(t, &stateLabel{Domain: "climate", State: "heat", Value: 2, Locale: "de", Label: "Heizen"}, rows[2])
+}
@@ -0,0 +1,153 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+const (
+	statisticsTableName = "statistics"
+
+	defaultStatisticsInterval = time.Hour
+	defaultStatisticsLookback = 24 * time.Hour
+)
+
+// StatisticsSource is optionally implemented by a Source able to read the long-term statistics of the recorder,
+// e.g. *hass.Client. It is required by WithStatistics.
+type StatisticsSource interface {
+	StatisticsDuringPeriod(ctx context.Context, start, end time.Time, statisticIDs []string) (map[string][]hass.Statistic, error)
+}
+
+// StatisticsConfig configures the import of long-term statistics
+type StatisticsConfig struct {
+	// Interval is the time between imports, an hour if 0
+	Interval time.Duration
+	// Lookback is the period of statistics read by every import, a day if 0. Statistics read repeatedly
+	// replace each other in the background merges of the table.
+	Lookback time.Duration
+}
+
+// Statistic is a row of the statistics table holding a long-term statistic of Home Assistant aggregated over an hour
+type Statistic struct {
+	StatisticID string   `json:"statistic_id"`
+	Start       string   `json:"start"`
+	End         string   `json:"end"`
+	Mean        *float64 `json:"mean"`
+	Min         *float64 `json:"min"`
+	Max         *float64 `json:"max"`
+	State       *float64 `json:"state"`
+	Sum         *float64 `json:"sum"`
+	LastReset   *string  `json:"last_reset"`
+	ImportedAt  string   `json:"imported_at"`
+}
+
+// WithStatistics periodically imports the hourly long-term statistics of Home Assistant (mean, min, max, state
+// and sum) into the statistics table, so aggregates are kept after the recorder purges them.
+func WithStatistics(conf StatisticsConfig) PipelineOption {
+	return func(p *Pipeline) {
+		if conf.Interval <= 0 {
+			conf.Interval = defaultStatisticsInterval
+		}
+		if conf.Lookback <= 0 {
+			conf.Lookback = defaultStatisticsLookback
+		}
+		p.statistics = &conf
+	}
+}
+
+// importStatistics imports statistics on start and every interval until the context is done
+func (p *Pipeline) importStatistics(ctx context.Context, source StatisticsSource) {
+	ticker := p.clock.NewTicker(p.statistics.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.importStatisticsOnce(ctx, source); err != nil {
+			log.Error().Err(err).Msg("failed to import statistics")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// importStatisticsOnce reads the statistics of the lookback period ending with the current hour and inserts them
+func (p *Pipeline) importStatisticsOnce(ctx context.Context, source StatisticsSource) error {
+	now := p.clock.Now().UTC()
+	end := now.Truncate(time.Hour)
+	start := end.Add(-p.statistics.Lookback)
+
+	statistics, err := source.StatisticsDuringPeriod(ctx, start, end, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read statistics: %w", err)
+	}
+
+	// Every instance of a sharded deployment imports the statistics of the entities it owns
+	for statisticID := range statistics {
+		if !p.owns(statisticID) {
+			delete(statistics, statisticID)
+		}
+	}
+
+	rows := statisticRows(statistics, now)
+	if len(rows) == 0 {
+		return nil
+	}
+
+	database, err := p.ensureTable(ctx, statisticsTableName, statisticsDDL)
+	if err != nil {
+		return fmt.Errorf("failed to create statistics table: %w", err)
+	}
+
+	if err := p.insertBatch(ctx, newBatchID(), database, statisticsTableName, rows, 0, 0); err != nil {
+		return err
+	}
+
+	log.Info().
+		Time("start", start).
+		Time("end", end).
+		Int("statistics", len(statistics)).
+		Int("rows", len(rows)).
+		Msg("imported statistics")
+	return nil
+}
+
+// statisticRows returns rows of the statistics table ordered by statistic ID and start
+func statisticRows(statistics map[string][]hass.Statistic, importedAt time.Time) []any {
+	statisticIDs := make([]string, 0, len(statistics))
+	for statisticID := range statistics {
+		statisticIDs = append(statisticIDs, statisticID)
+	}
+	sort.Strings(statisticIDs)
+
+	var rows []any
+	for _, statisticID := range statisticIDs {
+		for _, s := range statistics[statisticID] {
+			row := Statistic{
+				StatisticID: statisticID,
+				Start:       s.Start.UTC().Format(time.RFC3339),
+				End:         s.End.UTC().Format(time.RFC3339),
+				Mean:        s.Mean,
+				Min:         s.Min,
+				Max:         s.Max,
+				State:       s.State,
+				Sum:         s.Sum,
+				ImportedAt:  importedAt.Format(time.RFC3339Nano),
+			}
+			if s.LastReset != nil {
+				lastReset := s.LastReset.UTC().Format(time.RFC3339Nano)
+				row.LastReset = &lastReset
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
@@ -0,0 +1,45 @@
+package ingestion
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clock"
+)
+
+// statisticsSource serves the same statistics for every period it is asked for
+type statisticsSource struct {
+	statistics map[string][]hass.Statistic
+	periods    [][2]time.Time
+}
+
+func (s *statisticsSource) StatisticsDuringPeriod(_ context.Context, start, end time.Time, _ []string) (map[string][]hass.Statistic, error) {
+	s.periods = append(s.periods, [2]time.Time{start, end})
+	return s.statistics, nil
+}
+
+func TestPipeline_ImportStatistics(t *testing.T) {
+	hour := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	mean, sum := 21.5, 3.25
+	source := &statisticsSource{statistics: map[string][]hass.Statistic{
+		"sensor.temperature": {{Start: hour, End: hour.Add(time.Hour), Mean: &mean}},
+		"sensor.energy":      {{Start: hour, End: hour.Add(time.Hour), Sum: &sum}},
+	}}
+	sink := &outageSink{}
+
+	p := NewPipeline(nil, sink, "hass", WithoutDDL(), WithClock(clock.NewFake(hour.Add(90*time.Minute))),
+		WithStatistics(StatisticsConfig{Lookback: 6 * time.Hour}))
+	require.NoError(t, p.importStatisticsOnce(context.Background(), source))
+
+	assert.Equal(t, [][2]time.Time{{hour.Add(-5 * time.Hour), hour.Add(time.Hour)}}, source.periods)
+	require.Len(t, sink.inserted, 1)
+	assert.Equal(t, "hass.statistics FORMAT JSONEachRow "+
+		`{"statistic_id":"sensor.energy","start":"2024-01-01T10:00:00Z","end":"2024-01-01T11:00:00Z","mean":null,"min":null,"max":null,"state":null,"sum":3.25,"last_reset":null,"imported_at":"2024-01-01T11:30:00Z"}`+"\n"+
+		`{"statistic_id":"sensor.temperature","start":"2024-01-01T10:00:00Z","end":"2024-01-01T11:00:00Z","mean":21.5,"min":null,"max":null,"state":null,"sum":null,"last_reset":null,"imported_at":"2024-01-01T11:30:00Z"}`,
+		sink.inserted[0])
+}
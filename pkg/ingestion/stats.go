@@ -0,0 +1,179 @@
+package ingestion
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PipelineState is the lifecycle state of a pipeline
+type PipelineState string
+
+const (
+	// PipelineStateIdle is the state of a pipeline not started yet
+	PipelineStateIdle PipelineState = "idle"
+	// PipelineStateStarting is the state of a pipeline checking grants and seeding initial states
+	PipelineStateStarting PipelineState = "starting"
+	// PipelineStateRunning is the state of a pipeline ingesting events
+	PipelineStateRunning PipelineState = "running"
+	// PipelineStateDegraded is the state of a running pipeline whose last insert failed
+	PipelineStateDegraded PipelineState = "degraded"
+	// PipelineStateStopped is the state of a pipeline that returned from Run
+	PipelineStateStopped PipelineState = "stopped"
+)
+
+// stateSubscriptionBuffer is the number of state transitions buffered for a slow subscriber
+const stateSubscriptionBuffer = 16
+
+// PipelineStats is a consistent snapshot of the statistics of a pipeline
+type PipelineStats struct {
+	State PipelineState `json:"state"`
+
+	// EventsReceived is the number of events received from Home Assistant
+	EventsReceived uint64 `json:"events_received"`
+	// EventsInFlight is the number of events passed by filters and not inserted yet
+	EventsInFlight int64 `json:"events_in_flight"`
+
+	// Tables are the insert statistics per table, keyed by database.table
+	Tables map[string]TableStats `json:"tables"`
+
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// TableStats are the insert statistics of a single table
+type TableStats struct {
+	Inserts      uint64    `json:"inserts"`
+	Rows         uint64    `json:"rows"`
+	Errors       uint64    `json:"errors"`
+	LastInsertAt time.Time `json:"last_insert_at,omitempty"`
+}
+
+// pipelineStats collects the statistics of a pipeline and notifies subscribers of state transitions
+type pipelineStats struct {
+	mtx         sync.Mutex
+	stats       PipelineStats
+	subscribers map[chan PipelineState]struct{}
+}
+
+func newPipelineStats() *pipelineStats {
+	return &pipelineStats{
+		stats: PipelineStats{
+			State:  PipelineStateIdle,
+			Tables: make(map[string]TableStats),
+		},
+		subscribers: make(map[chan PipelineState]struct{}),
+	}
+}
+
+// Stats returns a snapshot of the statistics of the pipeline, for embedders and status pages
+// that need a single consistent source instead of scraping Prometheus metrics
+func (p *Pipeline) Stats() PipelineStats {
+	p.stats.mtx.Lock()
+	defer p.stats.mtx.Unlock()
+
+	stats := p.stats.stats
+	stats.Tables = make(map[string]TableStats, len(p.stats.stats.Tables))
+	for table, tableStats := range p.stats.stats.Tables {
+		stats.Tables[table] = tableStats
+	}
+	return stats
+}
+
+// SubscribeState returns a channel receiving the current state of the pipeline and every state transition
+// afterwards, until the context is done. Transitions are dropped for subscribers falling far behind.
+func (p *Pipeline) SubscribeState(ctx context.Context) <-chan PipelineState {
+	ch := make(chan PipelineState, stateSubscriptionBuffer)
+
+	p.stats.mtx.Lock()
+	ch <- p.stats.stats.State
+	p.stats.subscribers[ch] = struct{}{}
+	p.stats.mtx.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		p.stats.mtx.Lock()
+		delete(p.stats.subscribers, ch)
+		close(ch)
+		p.stats.mtx.Unlock()
+	}()
+
+	return ch
+}
+
+// setState transitions the pipeline into the given state and notifies subscribers
+func (s *pipelineStats) setState(state PipelineState) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.setStateLocked(state)
+}
+
+func (s *pipelineStats) setStateLocked(state PipelineState) {
+	if s.stats.State == state {
+		return
+	}
+
+	log.Info().Str("from", string(s.stats.State)).Str("to", string(state)).Msg("pipeline state changed")
+	s.stats.State = state
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- state:
+		default:
+			log.Warn().Str("state", string(state)).Msg("dropped pipeline state transition for a slow subscriber")
+		}
+	}
+}
+
+func (s *pipelineStats) setError(err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.stats.LastError = err.Error()
+	s.stats.LastErrorAt = time.Now()
+}
+
+func (s *pipelineStats) eventReceived() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.stats.EventsReceived++
+}
+
+// eventsInFlight adds delta to the number of events passed by filters and not inserted yet
+func (s *pipelineStats) eventsInFlight(delta int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.stats.EventsInFlight += int64(delta)
+}
+
+// inserted records an insert into a table. A failed insert degrades a running pipeline,
+// a successful one recovers it.
+func (s *pipelineStats) inserted(tableKey string, rows int, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	table := s.stats.Tables[tableKey]
+	table.Inserts++
+	if err != nil {
+		table.Errors++
+		s.stats.LastError = err.Error()
+		s.stats.LastErrorAt = time.Now()
+	} else {
+		table.Rows += uint64(rows)
+		table.LastInsertAt = time.Now()
+	}
+	s.stats.Tables[tableKey] = table
+
+	switch {
+	case err != nil && s.stats.State == PipelineStateRunning:
+		s.setStateLocked(PipelineStateDegraded)
+	case err == nil && s.stats.State == PipelineStateDegraded:
+		s.setStateLocked(PipelineStateRunning)
+	}
+}
@@ -0,0 +1,43 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline_Stats(t *testing.T) {
+	p := NewPipeline(nil, nil, "hass")
+	ctx, cancel := context.WithCancel(context.Background())
+	states := p.SubscribeState(ctx)
+	assert.Equal(t, PipelineStateIdle, <-states)
+
+	p.stats.setState(PipelineStateRunning)
+	p.stats.eventReceived()
+	p.stats.eventsInFlight(2)
+	p.stats.inserted("hass.light", 2, errors.New("connection refused"))
+	p.stats.inserted("hass.light", 2, nil)
+	p.stats.eventsInFlight(-2)
+
+	stats := p.Stats()
+	assert.Equal(t, PipelineStateRunning, stats.State)
+	assert.Equal(t, uint64(1), stats.EventsReceived)
+	assert.Zero(t, stats.EventsInFlight)
+	assert.Equal(t, "connection refused", stats.LastError)
+	require.Contains(t, stats.Tables, "hass.light")
+	assert.Equal(t, uint64(2), stats.Tables["hass.light"].Inserts)
+	assert.Equal(t, uint64(1), stats.Tables["hass.light"].Errors)
+	assert.Equal(t, uint64(2), stats.Tables["hass.light"].Rows)
+
+	assert.Equal(t, PipelineStateRunning, <-states)
+	assert.Equal(t, PipelineStateDegraded, <-states)
+	assert.Equal(t, PipelineStateRunning, <-states)
+
+	cancel()
+	for range states {
+		// Drained until closed on cancellation
+	}
+}
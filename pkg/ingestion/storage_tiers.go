@@ -0,0 +1,125 @@
+package ingestion
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// Destinations of storage tiers
+const (
+	StorageTierVolume = "volume"
+	StorageTierDisk   = "disk"
+)
+
+// StorageTier moves the parts of a state change table to a volume or disk of its storage policy once their
+// rows are older than a number of days by last_updated
+type StorageTier struct {
+	Days int
+	// Kind is StorageTierVolume or StorageTierDisk
+	Kind string
+	// Name is the name of the volume or disk, e.g. cold or s3
+	Name string
+}
+
+// StorageTieringConfig configures the storage policy and the storage tiers of new state change tables per table
+// (domain). Table tiers take precedence over the default tiers.
+type StorageTieringConfig struct {
+	// Policy is the storage policy of new state change tables, e.g. tiered, the default policy if empty.
+	// It must contain the volumes and disks of the tiers.
+	Policy  string
+	Default []StorageTier
+	Tables  map[string][]StorageTier
+}
+
+// ParseStorageTieringConfig parses storage tiers in the form of "table=days:volume|disk:name,...", e.g.
+// "*=30d:volume:cold,*=365d:disk:s3,numeric_sensor=7d:volume:cold". "*" sets the default tiers, a table
+// listed more than once gets all of its tiers. The storage policy is left empty.
+func ParseStorageTieringConfig(s string) (StorageTieringConfig, error) {
+	conf := StorageTieringConfig{Tables: make(map[string][]StorageTier)}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		table, value, ok := strings.Cut(part, "=")
+		fields := strings.Split(value, ":")
+		if !ok || len(fields) != 3 {
+			return conf, fmt.Errorf("invalid storage tier %q: expected table=days:volume|disk:name", part)
+		}
+
+		days, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(fields[0]), "d"))
+		if err != nil || days <= 0 {
+			return conf, fmt.Errorf("invalid storage tier %q: the age must be a positive number of days, e.g. 30d", part)
+		}
+		tier := StorageTier{Days: days, Kind: strings.TrimSpace(fields[1]), Name: strings.TrimSpace(fields[2])}
+		if tier.Kind != StorageTierVolume && tier.Kind != StorageTierDisk {
+			return conf, fmt.Errorf("invalid storage tier %q: expected %s or %s", part, StorageTierVolume, StorageTierDisk)
+		}
+		if tier.Name == "" {
+			return conf, fmt.Errorf("invalid storage tier %q: missing the name of the %s", part, tier.Kind)
+		}
+
+		table = strings.TrimSpace(table)
+		tiers := conf.Tables[table]
+		if table == "*" {
+			tiers = conf.Default
+		}
+		for _, other := range tiers {
+			if other.Days == days {
+				return conf, fmt.Errorf("table %s has more than one storage tier after %d days", table, days)
+			}
+		}
+		tiers = append(tiers, tier)
+		sort.Slice(tiers, func(i, j int) bool { return tiers[i].Days < tiers[j].Days })
+
+		if table == "*" {
+			conf.Default = tiers
+		} else {
+			conf.Tables[table] = tiers
+		}
+	}
+
+	return conf, nil
+}
+
+// WithStorageTiering creates new state change tables with the storage policy and a TTL moving their parts to
+// the volumes and disks of the tiers as they age, e.g. to object storage after a year, on servers with tiered
+// storage. Existing tables keep their storage policy and TTL.
+func WithStorageTiering(conf StorageTieringConfig) PipelineOption {
+	return func(p *Pipeline) {
+		p.storageTiering = &conf
+	}
+}
+
+// storageTTL returns the TTL expression moving the parts of the state change tables of a table (domain)
+// to its tiers, empty without tiers
+func (p *Pipeline) storageTTL(table string) string {
+	if p.storageTiering == nil {
+		return ""
+	}
+	tiers, ok := p.storageTiering.Tables[table]
+	if !ok {
+		tiers = p.storageTiering.Default
+	}
+
+	moves := make([]string, 0, len(tiers))
+	for _, tier := range tiers {
+		moves = append(moves, fmt.Sprintf("toDateTime(last_updated) + INTERVAL %d DAY TO %s %s",
+			tier.Days, strings.ToUpper(tier.Kind), clickhouse.QuoteString(tier.Name)))
+	}
+	return strings.Join(moves, ", ")
+}
+
+// storagePolicy returns the storage policy of new state change tables, empty for the default policy
+func (p *Pipeline) storagePolicy() string {
+	if p.storageTiering == nil {
+		return ""
+	}
+	return p.storageTiering.Policy
+}
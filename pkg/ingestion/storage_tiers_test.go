@@ -0,0 +1,59 @@
+package ingestion
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStorageTieringConfig(t *testing.T) {
+	conf, err := ParseStorageTieringConfig("*=365d:disk:s3, *=30d:volume:cold, numeric_sensor=7:volume:cold")
+	require.NoError(t, err)
+	assert.Equal(t, []StorageTier{
+		{Days: 30, Kind: StorageTierVolume, Name: "cold"},
+		{Days: 365, Kind: StorageTierDisk, Name: "s3"},
+	}, conf.Default)
+	assert.Equal(t, []StorageTier{{Days: 7, Kind: StorageTierVolume, Name: "cold"}}, conf.Tables["numeric_sensor"])
+
+	for _, invalid := range []string{
+		"light=30d:volume",
+		"light=0d:volume:cold",
+		"light=30d:shelf:cold",
+		"light=30d:disk:",
+		"light=30d:volume:cold,light=30d:disk:s3",
+	} {
+		_, err := ParseStorageTieringConfig(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPipeline_StateChangeDDLStorageTiering(t *testing.T) {
+	conf, err := ParseStorageTieringConfig("*=30d:volume:cold,*=365d:disk:s3,light=90d:disk:s3")
+	require.NoError(t, err)
+	conf.Policy = "tiered"
+	p := NewPipeline(nil, nil, "hass", WithStorageTiering(conf))
+
+	ddl, err := p.stateChangeDDL(RowModelV1, "hass", "numeric_sensor", "numeric_sensor", "Float64")
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "ORDER BY (entity_id, last_updated)\n"+
+		"TTL toDateTime(last_updated) + INTERVAL 30 DAY TO VOLUME 'cold', toDateTime(last_updated) + INTERVAL 365 DAY TO DISK 's3'\n"+
+		"SETTINGS index_granularity = 8192, storage_policy = 'tiered';")
+
+	ddl, err = p.stateChangeDDL(RowModelV2, "hass", "light_v2", "light", "Bool")
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "TTL toDateTime(last_updated) + INTERVAL 90 DAY TO DISK 's3'\n")
+
+	// Without tiering, the built-in DDL is unchanged
+	ddl, err = NewPipeline(nil, nil, "hass").stateChangeDDL(RowModelV1, "hass", "light", "light", "Bool")
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "ORDER BY (entity_id, last_updated)\nSETTINGS index_granularity = 8192;")
+
+	// Templates get the TTL and policy to render themselves
+	tmpl := template.Must(template.New("ddl").Parse("{{.StorageTTL}} {{.StoragePolicy}}"))
+	p = NewPipeline(nil, nil, "hass", WithStorageTiering(conf), WithDDLTemplate(DDLTemplateConfig{Template: tmpl}))
+	ddl, err = p.stateChangeDDL(RowModelV1, "hass", "light", "light", "Bool")
+	require.NoError(t, err)
+	assert.Equal(t, "toDateTime(last_updated) + INTERVAL 90 DAY TO DISK 's3' tiered", ddl)
+}
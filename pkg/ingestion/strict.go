@@ -0,0 +1,73 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// WithStrictMode makes ClickHouse reject rows with unknown fields instead of silently skipping them.
+// Rejected rows are isolated and stored in the dead-letter table together with the server's error.
+func WithStrictMode() PipelineOption {
+	return func(p *Pipeline) {
+		p.strict = true
+	}
+}
+
+// insertOptions returns the query options used for all inserts of the pipeline
+func (p *Pipeline) insertOptions() []clickhouse.QueryOption {
+	if !p.strict {
+		return nil
+	}
+
+	return []clickhouse.QueryOption{
+		clickhouse.WithSetting("input_format_skip_unknown_fields", "0"),
+		clickhouse.WithSetting("input_format_allow_errors_num", "0"),
+		clickhouse.WithSetting("input_format_allow_errors_ratio", "0"),
+	}
+}
+
+func (p *Pipeline) insertRows(ctx context.Context, database, tableName string, values []any) error {
+	return p.insert(ctx, database, tableName, values, p.insertOptions()...)
+}
+
+// insert inserts rows with the sink, as row objects if it supports it or as JSONEachRow otherwise
+func (p *Pipeline) insert(ctx context.Context, database, tableName string, values []any, opts ...clickhouse.QueryOption) error {
+	if ins, ok := p.sink.(Inserter); ok {
+		return ins.Insert(ctx, database, tableName, p.labeledRows(values), opts...)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s.%s FORMAT JSONEachRow", database, tableName)
+	return p.sink.Execute(ctx, query, p.newRowReader(values), opts...)
+}
+
+// isolateRejectedRows bisects a batch rejected by ClickHouse with the given error until the
+// rejected rows are found, inserting all other rows. It returns the rejected rows as dead letters
+// and the first error that is not caused by the data.
+func (p *Pipeline) isolateRejectedRows(ctx context.Context, database, tableName string, values []any, err error) ([]DeadLetter, error) {
+	if len(values) == 1 {
+		return []DeadLetter{newDeadLetter(tableName, values[0], err)}, nil
+	}
+
+	var deadLetters []DeadLetter
+	mid := len(values) / 2
+	for _, half := range [][]any{values[:mid], values[mid:]} {
+		err := p.insertRows(ctx, database, tableName, half)
+		if err == nil {
+			continue
+		}
+
+		if !clickhouse.IsDataError(err) {
+			return deadLetters, err
+		}
+
+		rejected, err := p.isolateRejectedRows(ctx, database, tableName, half, err)
+		deadLetters = append(deadLetters, rejected...)
+		if err != nil {
+			return deadLetters, err
+		}
+	}
+
+	return deadLetters, nil
+}
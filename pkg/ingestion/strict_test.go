@@ -0,0 +1,92 @@
+package ingestion
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// rejectingSink rejects inserts containing a rejected row as a whole, like ClickHouse in strict mode,
+// and records the rows of accepted inserts
+type rejectingSink struct {
+	rejected map[string]bool
+	inserted []string
+	inserts  int
+	err      error
+}
+
+func (s *rejectingSink) Execute(_ context.Context, _ string, body io.ReadSeeker, _ ...clickhouse.QueryOption) error {
+	s.inserts++
+	if s.err != nil {
+		return s.err
+	}
+
+	var rows []string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		row := scanner.Text()
+		if s.rejected[row] {
+			return &clickhouse.Exception{StatusCode: 400, Code: 117, Message: fmt.Sprintf("Code: 117. Incorrect data: %s", row)}
+		}
+		rows = append(rows, row)
+	}
+	s.inserted = append(s.inserted, rows...)
+	return scanner.Err()
+}
+
+func TestPipeline_IsolateRejectedRows(t *testing.T) {
+	ctx := context.Background()
+	var values []any
+	for i := 0; i < 10; i++ {
+		values = append(values, map[string]any{"entity_id": fmt.Sprintf("sensor.s%d", i)})
+	}
+	row := func(i int) string {
+		return fmt.Sprintf(`{"entity_id":"sensor.s%d"}`, i)
+	}
+
+	sink := &rejectingSink{rejected: map[string]bool{row(2): true, row(3): true, row(9): true}}
+	p := NewPipeline(nil, sink, "hass", WithStrictMode())
+	deadLetters, err := p.isolateRejectedRows(ctx, "hass", "numeric_sensor", values, errors.New("batch rejected"))
+	require.NoError(t, err)
+
+	// Only the rejected rows are dead-lettered, with the error of their own insert
+	require.Len(t, deadLetters, 3)
+	for i, rejected := range []int{2, 3, 9} {
+		assert.Equal(t, "numeric_sensor", deadLetters[i].DestinationTable)
+		assert.Equal(t, row(rejected), deadLetters[i].Row)
+		assert.Contains(t, deadLetters[i].Error, row(rejected))
+	}
+
+	// All other rows are inserted exactly once
+	var expected []string
+	for i := 0; i < 10; i++ {
+		if !sink.rejected[row(i)] {
+			expected = append(expected, row(i))
+		}
+	}
+	assert.ElementsMatch(t, expected, sink.inserted)
+
+	// A batch of one row is dead-lettered without inserting it again
+	sink = &rejectingSink{}
+	p = NewPipeline(nil, sink, "hass", WithStrictMode())
+	deadLetters, err = p.isolateRejectedRows(ctx, "hass", "numeric_sensor", values[:1], errors.New("row rejected"))
+	require.NoError(t, err)
+	assert.Equal(t, []DeadLetter{{DestinationTable: "numeric_sensor", Row: row(0), Error: "row rejected"}}, deadLetters)
+	assert.Zero(t, sink.inserts)
+
+	// Errors not caused by the data stop the bisection
+	sink = &rejectingSink{err: errors.New("connection refused")}
+	p = NewPipeline(nil, sink, "hass", WithStrictMode())
+	deadLetters, err = p.isolateRejectedRows(ctx, "hass", "numeric_sensor", values, errors.New("batch rejected"))
+	require.EqualError(t, err, "connection refused")
+	assert.Empty(t, deadLetters)
+	assert.Equal(t, 1, sink.inserts)
+}
@@ -0,0 +1,45 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+)
+
+// subscriptionErrorHandler returns the error handler of the state_changed subscription. Missed events
+// are reported in the pipeline stats and estimated, and the states transformers are seeded with are refreshed,
+// so derived columns do not carry values from before the gap.
+func (p *Pipeline) subscriptionErrorHandler(ctx context.Context) func(error) {
+	return func(err error) {
+		p.stats.setError(err)
+
+		var missed *hass.MissedEventsError
+		if !errors.As(err, &missed) {
+			log.Error().Err(err).Msg("state_changed subscription failed, events are not received until the next reconnection")
+			return
+		}
+
+		log.Warn().
+			Err(err).
+			Str("event_type", string(missed.EventType)).
+			Time("from", missed.From).
+			Time("to", missed.To).
+			Msg("events may have been missed, refreshing states")
+		metrics.SubscriptionGaps.Inc()
+
+		// The handler must not block the reconnection
+		go recovery.Run("pipeline_subscription_gap", func() {
+			if err := p.estimateMissed(ctx, missed); err != nil {
+				log.Error().Err(err).Msg("failed to estimate missed events")
+			}
+			if err := p.seed(ctx); err != nil {
+				log.Error().Err(err).Msg("failed to refresh states after missed events")
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package ingestion
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Engines state change tables can be created with
+const (
+	EngineMergeTree           = "merge_tree"
+	EngineReplacingMergeTree  = "replacing"
+	EngineCollapsingMergeTree = "collapsing"
+)
+
+const (
+	signColumnName = "sign"
+	signColumn     = "sign Int8 DEFAULT 1"
+)
+
+// TableEngine is the engine of a state change table
+type TableEngine struct {
+	// Kind is one of EngineMergeTree, EngineReplacingMergeTree and EngineCollapsingMergeTree
+	Kind string
+	// Version is the version column of a ReplacingMergeTree, e.g. received_at. When empty,
+	// the last inserted row is kept.
+	Version string
+}
+
+// TableEngineConfig configures the engines of new state change tables per table (domain).
+// Table engines take precedence over the default engine.
+type TableEngineConfig struct {
+	Default *TableEngine
+	Tables  map[string]TableEngine
+}
+
+// ParseTableEngineConfig parses engines in the form of "table=kind[:version],*=kind", e.g.
+// "light=replacing:received_at,numeric_sensor=collapsing". "*" is the default engine.
+func ParseTableEngineConfig(s string) (TableEngineConfig, error) {
+	conf := TableEngineConfig{Tables: make(map[string]TableEngine)}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		table, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return conf, fmt.Errorf("invalid table engine %q: expected table=kind[:version]", part)
+		}
+
+		kind, version, _ := strings.Cut(strings.TrimSpace(value), ":")
+		engine := TableEngine{Kind: strings.TrimSpace(kind), Version: strings.TrimSpace(version)}
+		switch engine.Kind {
+		case EngineMergeTree, EngineCollapsingMergeTree:
+			if engine.Version != "" {
+				return conf, fmt.Errorf("invalid table engine %q: only %s takes a version column", part, EngineReplacingMergeTree)
+			}
+		case EngineReplacingMergeTree:
+		default:
+			return conf, fmt.Errorf("unknown table engine %q, expected %s, %s or %s",
+				engine.Kind, EngineMergeTree, EngineReplacingMergeTree, EngineCollapsingMergeTree)
+		}
+
+		if table = strings.TrimSpace(table); table == "*" {
+			conf.Default = &engine
+		} else {
+			conf.Tables[table] = engine
+		}
+	}
+
+	return conf, nil
+}
+
+// WithTableEngines creates new state change tables with the configured engines, for engine-level
+// deduplication. Rows of CollapsingMergeTree tables are inserted with a sign of 1; rows are canceled
+// by inserting them again with a sign of -1. Existing tables keep their engine.
+func WithTableEngines(conf TableEngineConfig) PipelineOption {
+	return func(p *Pipeline) {
+		p.tableEngines = &conf
+	}
+}
+
+func (c *TableEngineConfig) engine(table string) (TableEngine, bool) {
+	if engine, ok := c.Tables[table]; ok {
+		return engine, true
+	}
+	if c.Default != nil {
+		return *c.Default, true
+	}
+	return TableEngine{}, false
+}
+
+// tableEngine is the engine and sorting key state change tables are created with
+type tableEngine struct {
+	engine string
+	// sortingKey are the columns of the ORDER BY clause
+	sortingKey []string
+	// sortingKeyOverride replaces the ORDER BY clause if set, see TableOverride
+	sortingKeyOverride string
+	partitionBy        string
+	// columns are the definitions of columns required by the engine, not part of the built-in DDL
+	columns []string
+	// signed tables are inserted rows with a sign
+	signed bool
+}
+
+func (e tableEngine) orderBy() string {
+	if e.sortingKeyOverride != "" {
+		return e.sortingKeyOverride
+	}
+	return "(" + strings.Join(e.sortingKey, ", ") + ")"
+}
+
+// stateChangeEngine returns the engine of new state change tables of the given domain
+func (p *Pipeline) stateChangeEngine(domain string) tableEngine {
+	engine := tableEngine{
+		engine:      "MergeTree()",
+		sortingKey:  []string{"entity_id", "last_updated"},
+		partitionBy: defaultPartitionBy,
+	}
+	if override, ok := p.tableOverrides[domain]; ok {
+		engine.sortingKeyOverride = override.OrderBy
+		if override.PartitionBy != "" {
+			engine.partitionBy = override.PartitionBy
+		}
+	}
+
+	if p.eventHash != nil && p.eventHash.Deduplicate {
+		engine.engine = "ReplacingMergeTree()"
+		engine.sortingKey = append(engine.sortingKey, eventHashColumnName)
+		engine.columns = append(engine.columns, eventHashColumn)
+	}
+
+	if p.tableEngines == nil {
+		return engine
+	}
+
+	configured, ok := p.tableEngines.engine(domain)
+	if !ok {
+		return engine
+	}
+
+	switch configured.Kind {
+	case EngineMergeTree:
+		engine.engine = "MergeTree()"
+	case EngineReplacingMergeTree:
+		engine.engine = fmt.Sprintf("ReplacingMergeTree(%s)", configured.Version)
+	case EngineCollapsingMergeTree:
+		engine.engine = fmt.Sprintf("CollapsingMergeTree(%s)", signColumnName)
+		engine.columns = append(engine.columns, signColumn)
+		engine.signed = true
+	}
+
+	return engine
+}
@@ -0,0 +1,41 @@
+package ingestion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTableEngineConfig(t *testing.T) {
+	conf, err := ParseTableEngineConfig("light=replacing:received_at, numeric_sensor=collapsing, *=replacing")
+	require.NoError(t, err)
+	assert.Equal(t, &TableEngine{Kind: EngineReplacingMergeTree}, conf.Default)
+	assert.Equal(t, TableEngine{Kind: EngineReplacingMergeTree, Version: "received_at"}, conf.Tables["light"])
+	assert.Equal(t, TableEngine{Kind: EngineCollapsingMergeTree}, conf.Tables["numeric_sensor"])
+
+	_, err = ParseTableEngineConfig("light=summing")
+	assert.Error(t, err)
+	_, err = ParseTableEngineConfig("light=collapsing:received_at")
+	assert.Error(t, err)
+}
+
+func TestPipeline_StateChangeDDLTableEngines(t *testing.T) {
+	conf, err := ParseTableEngineConfig("light=replacing:received_at,numeric_sensor=collapsing")
+	require.NoError(t, err)
+	p := NewPipeline(nil, nil, "hass", WithTableEngines(conf))
+
+	ddl, err := p.stateChangeDDL(RowModelV1, "hass", "light", "light", "LowCardinality(String)")
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "ENGINE = ReplacingMergeTree(received_at)")
+
+	ddl, err = p.stateChangeDDL(RowModelV2, "hass", "numeric_sensor_v2", "numeric_sensor", "Float64")
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "ENGINE = CollapsingMergeTree(sign)")
+	assert.Contains(t, parseDDLColumns(ddl), signColumn)
+	assert.True(t, p.stateChangeEngine("numeric_sensor").signed)
+
+	ddl, err = p.stateChangeDDL(RowModelV1, "hass", "switch", "switch", "Bool")
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "ENGINE = MergeTree()")
+}
@@ -0,0 +1,192 @@
+package ingestion
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+const defaultPartitionBy = "toYYYYMM(last_updated)"
+
+// tableNamePattern matches valid names of override tables
+var tableNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// TableOverride routes the state changes of matching entities into a custom state change table
+// instead of the table of their domain
+type TableOverride struct {
+	Table string
+	// Match are domains, e.g. light or numeric_sensor, and glob patterns of entity IDs, e.g. sensor.power_*.
+	// Entity patterns take precedence over domains.
+	Match []string
+	// StateType is the ClickHouse type of the state and old_state columns, String if empty
+	StateType string
+	// OrderBy is the sorting key, e.g. (entity_id, last_updated), the one of the table engine if empty
+	OrderBy string
+	// PartitionBy is the partition key, toYYYYMM(last_updated) if empty
+	PartitionBy string
+}
+
+// ParseTableOverrides parses the routes of entities to custom tables in the form of "match=table,...",
+// e.g. "sensor.power_*=power,light=lights", and the state types, sorting keys and partition keys of the
+// tables in the form of "table=value;...", e.g. "power=Float64". The latter are separated by semicolons,
+// as their values may contain commas.
+func ParseTableOverrides(routes, stateTypes, orderBy, partitionBy string) ([]TableOverride, error) {
+	var overrides []TableOverride
+	byTable := make(map[string]int)
+
+	for _, part := range strings.Split(routes, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		match, table, ok := strings.Cut(part, "=")
+		match, table = strings.TrimSpace(match), strings.TrimSpace(table)
+		if !ok || match == "" {
+			return nil, fmt.Errorf("invalid table route %q: expected domain=table or entity pattern=table", part)
+		}
+		if _, err := path.Match(match, ""); err != nil {
+			return nil, fmt.Errorf("invalid entity pattern %q: %w", match, err)
+		}
+		if !tableNamePattern.MatchString(table) {
+			return nil, fmt.Errorf("invalid table name %q", table)
+		}
+		if slices.Contains(stateChangeDomains, table) {
+			return nil, fmt.Errorf("table %s is the table of a domain and cannot be overridden", table)
+		}
+
+		i, ok := byTable[table]
+		if !ok {
+			i = len(overrides)
+			byTable[table] = i
+			overrides = append(overrides, TableOverride{Table: table})
+		}
+		overrides[i].Match = append(overrides[i].Match, match)
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value string
+		set   func(*TableOverride, string)
+	}{
+		{"state type", stateTypes, func(o *TableOverride, v string) { o.StateType = v }},
+		{"sorting key", orderBy, func(o *TableOverride, v string) { o.OrderBy = v }},
+		{"partition key", partitionBy, func(o *TableOverride, v string) { o.PartitionBy = v }},
+	} {
+		for _, part := range strings.Split(setting.value, ";") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			table, value, ok := strings.Cut(part, "=")
+			table, value = strings.TrimSpace(table), strings.TrimSpace(value)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("invalid %s %q: expected table=value", setting.name, part)
+			}
+			i, ok := byTable[table]
+			if !ok {
+				return nil, fmt.Errorf("%s of table %s, which no entities are routed to", setting.name, table)
+			}
+			setting.set(&overrides[i], value)
+		}
+	}
+
+	return overrides, nil
+}
+
+// WithTableOverrides routes the state changes of matching entities into custom tables, created with
+// their own state type, sorting key and partition key. Tables of overrides get the columns of the
+// enrichers of all domains, as they may hold entities of any domain.
+func WithTableOverrides(overrides ...TableOverride) PipelineOption {
+	return func(p *Pipeline) {
+		p.tableOverrides = make(map[string]*TableOverride, len(overrides))
+		p.tableRoutes = nil
+		for i := range overrides {
+			override := &overrides[i]
+			p.tableOverrides[override.Table] = override
+			for _, match := range override.Match {
+				p.tableRoutes = append(p.tableRoutes, tableRoute{match: match, table: override.Table, entity: strings.Contains(match, ".")})
+			}
+		}
+		// Entity patterns are matched before domains, in the order they are configured
+		sort.SliceStable(p.tableRoutes, func(i, j int) bool {
+			return p.tableRoutes[i].entity && !p.tableRoutes[j].entity
+		})
+	}
+}
+
+// tableRoute routes the entities of a domain or matching an entity pattern into an override table
+type tableRoute struct {
+	match  string
+	table  string
+	entity bool
+}
+
+// stateChangeTable returns the table the state changes of an entity are stored in:
+// the table of a matching override, or the table of its domain
+func (p *Pipeline) stateChangeTable(state *hass.State) string {
+	domain := extractDomainFromState(state)
+	if len(p.tableRoutes) == 0 {
+		return domain
+	}
+
+	entityDomain, _, _ := strings.Cut(state.EntityID, ".")
+	for _, route := range p.tableRoutes {
+		if route.entity {
+			if ok, _ := path.Match(route.match, state.EntityID); ok {
+				return route.table
+			}
+		} else if route.match == domain || route.match == entityDomain {
+			return route.table
+		}
+	}
+	return domain
+}
+
+// stateTypeOf returns the type of the state columns of a state change table
+func (p *Pipeline) stateTypeOf(table string) string {
+	if override, ok := p.tableOverrides[table]; ok {
+		if override.StateType == "" {
+			return "String"
+		}
+		return override.StateType
+	}
+	if enumType, ok := p.stateEnums[table]; ok {
+		return enumType
+	}
+	return resolveStateChangeType(table)
+}
+
+// tableDomain returns the domain of the rows of a state change table, empty for override tables
+// whose rows are of the domain of their entity
+func (p *Pipeline) tableDomain(table string) string {
+	if _, ok := p.tableOverrides[table]; ok {
+		return ""
+	}
+	return table
+}
+
+// tableColumns returns the extra columns of a state change table
+func (p *Pipeline) tableColumns(table string) []string {
+	if _, ok := p.tableOverrides[table]; !ok {
+		return p.columns(table)
+	}
+
+	seen := make(map[string]bool)
+	var columns []string
+	for _, domain := range stateChangeDomains {
+		for _, column := range p.columns(domain) {
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, column)
+			}
+		}
+	}
+	return columns
+}
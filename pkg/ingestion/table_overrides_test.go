@@ -0,0 +1,96 @@
+package ingestion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestParseTableOverrides(t *testing.T) {
+	overrides, err := ParseTableOverrides(
+		"sensor.power_*=power, sensor.energy_*=power, light=lights",
+		"power=Float64",
+		"power=(entity_id, toStartOfHour(last_updated), last_updated)",
+		"power=toYYYYMMDD(last_updated)",
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []TableOverride{
+		{
+			Table:       "power",
+			Match:       []string{"sensor.power_*", "sensor.energy_*"},
+			StateType:   "Float64",
+			OrderBy:     "(entity_id, toStartOfHour(last_updated), last_updated)",
+			PartitionBy: "toYYYYMMDD(last_updated)",
+		},
+		{Table: "lights", Match: []string{"light"}},
+	}, overrides)
+
+	_, err = ParseTableOverrides("sensor.power_*=Power", "", "", "")
+	assert.Error(t, err)
+	_, err = ParseTableOverrides("sensor.power_*=numeric_sensor", "", "", "")
+	assert.Error(t, err)
+	_, err = ParseTableOverrides("sensor.power_*=power", "energy=Float64", "", "")
+	assert.Error(t, err)
+}
+
+func TestPipeline_StateChangeTable(t *testing.T) {
+	overrides, err := ParseTableOverrides("sensor=sensors,sensor.power_*=power", "", "", "")
+	require.NoError(t, err)
+	p := NewPipeline(nil, nil, "hass", WithTableOverrides(overrides...))
+
+	// Entity patterns take precedence over domains
+	assert.Equal(t, "power", p.stateChangeTable(&hass.State{EntityID: "sensor.power_meter", State: "12.5"}))
+	// Domains match both the table domain and the domain of the entity ID
+	assert.Equal(t, "sensors", p.stateChangeTable(&hass.State{EntityID: "sensor.temperature", State: "21.5"}))
+	assert.Equal(t, "sensors", p.stateChangeTable(&hass.State{EntityID: "sensor.status", State: "idle"}))
+	assert.Equal(t, "light", p.stateChangeTable(&hass.State{EntityID: "light.kitchen", State: "on"}))
+}
+
+func TestPipeline_TableOverrideDDL(t *testing.T) {
+	overrides, err := ParseTableOverrides("sensor.power_*=power", "power=Float64", "power=(entity_id, last_updated, received_at)", "power=toYYYYMMDD(last_updated)")
+	require.NoError(t, err)
+	p := NewPipeline(nil, nil, "hass", WithTableOverrides(overrides...), WithValueDelta())
+
+	ddl, err := p.stateChangeDDL(RowModelV1, "hass", "power", "power", p.stateTypeOf("power"))
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "state Float64,")
+	assert.Contains(t, ddl, "PARTITION BY toYYYYMMDD(last_updated)\nORDER BY (entity_id, last_updated, received_at)")
+	// Enricher columns of all domains
+	assert.Contains(t, p.tableColumns("power"), valueDeltaColumn)
+
+	ddl, err = p.stateChangeDDL(RowModelV1, "hass", "light", "light", p.stateTypeOf("light"))
+	require.NoError(t, err)
+	assert.Contains(t, ddl, "PARTITION BY toYYYYMM(last_updated)\nORDER BY (entity_id, last_updated)")
+}
+
+func TestPipeline_TableOverrideBatch(t *testing.T) {
+	overrides, err := ParseTableOverrides("sensor.power_*=power", "power=Float64", "", "")
+	require.NoError(t, err)
+	p := NewPipeline(nil, nil, "hass", WithTableOverrides(overrides...), WithRowModels(RowModelV1, RowModelV2))
+
+	event := &hass.EventMessage{Event: hass.Event{
+		EventType: hass.EventTypeStateChanged,
+		Data: hass.EventData{
+			EntityID: "sensor.power_meter",
+			OldState: &hass.State{EntityID: "sensor.power_meter", State: "10"},
+			NewState: &hass.State{EntityID: "sensor.power_meter", State: "unavailable_soon"},
+		},
+	}}
+	partition, err := p.partition(event)
+	require.NoError(t, err)
+	assert.Equal(t, "power", partition)
+
+	// States not fitting the state type of the override table overflow
+	batch := p.prepareBatch([]*hass.EventMessage{event})
+	require.Len(t, batch.tables, 1)
+	assert.Equal(t, "power", batch.tables[0].tableName)
+	assert.Len(t, batch.tables[0].overflow, 1)
+
+	// Rows of override tables keep the domain of their entity
+	converted := convertStateChanges(batch.tables[0].overflow, p.tableDomain("power"), RowModelV2)
+	require.Len(t, converted, 1)
+	assert.Equal(t, hass.EntitySensor, converted[0].(*StateChangeV2).Domain)
+}
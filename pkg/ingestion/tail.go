@@ -0,0 +1,77 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+// Row is a state change event after the full transformation, as it would be inserted into ClickHouse
+type Row struct {
+	Event    *hass.EventMessage
+	Database string
+	Table    string
+
+	// Input is the row inserted into the table, either *StateChange or *AttributeChange
+	Input any
+
+	// Err is set if the event would not be inserted
+	Err error
+}
+
+// Tail subscribes to state change events and passes every transformed row to fn without
+// inserting anything into ClickHouse. It blocks until the context is canceled.
+func (p *Pipeline) Tail(ctx context.Context, fn func(Row)) error {
+	if err := p.orderStages(); err != nil {
+		return fmt.Errorf("invalid stage order: %w", err)
+	}
+
+	if err := p.seed(ctx); err != nil {
+		return fmt.Errorf("failed to get initial states: %w", err)
+	}
+
+	eventsChan, err := p.source.SubscribeEvents(ctx, hass.SubscribeEventsWithEventType(hass.EventTypeStateChanged))
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to events: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-eventsChan:
+			if !ok {
+				return nil
+			}
+
+			p.observe(event)
+			fn(p.resolveRow(event))
+		}
+	}
+}
+
+func (p *Pipeline) resolveRow(event *hass.EventMessage) Row {
+	row := Row{Event: event}
+
+	if _, err := p.partition(event); err != nil {
+		row.Err = err
+		return row
+	}
+
+	insert, err := p.resolveInput(event)
+	if err != nil {
+		row.Err = err
+		return row
+	}
+
+	if change, ok := insert.Input.(*StateChange); ok {
+		p.transform(event, change)
+	}
+
+	row.Database = insert.Database
+	row.Table = insert.TableName
+	row.Input = insert.Input
+
+	return row
+}
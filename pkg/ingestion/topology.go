@@ -0,0 +1,135 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+// ClusterTopology is the place of the ClickHouse server in its cluster, passed to DDL templates
+type ClusterTopology struct {
+	// Cluster is the name of the cluster for ON CLUSTER clauses
+	Cluster string
+	// Shard and Replica identify the server, e.g. in the ZooKeeper path of a ReplicatedMergeTree
+	Shard   string
+	Replica string
+	// Macros are all macros of the server
+	Macros map[string]string
+}
+
+// WithClusterTopology passes the cluster topology to DDL templates as .Cluster, .Shard, .Replica and .Macros.
+// Fields left empty are discovered on startup from system.macros and system.clusters: the cluster, shard and
+// replica macros take precedence over the cluster the server is a local member of.
+func WithClusterTopology(topology ClusterTopology) PipelineOption {
+	return func(p *Pipeline) {
+		p.topology = &topology
+	}
+}
+
+// discoverTopology fills the fields of the configured topology not set explicitly from system tables
+func (p *Pipeline) discoverTopology(ctx context.Context) error {
+	if p.topology == nil || (p.topology.Cluster != "" && p.topology.Shard != "" && p.topology.Replica != "") {
+		return nil
+	}
+
+	q, ok := p.sink.(querier)
+	if !ok {
+		return errors.New("sink does not support queries, the cluster topology cannot be discovered")
+	}
+
+	macros := make(map[string]string)
+	err := q.Query(ctx, "SELECT macro, substitution FROM system.macros", func(row json.RawMessage) error {
+		var macro struct {
+			Macro        string `json:"macro"`
+			Substitution string `json:"substitution"`
+		}
+		if err := json.Unmarshal(row, &macro); err != nil {
+			return err
+		}
+		macros[macro.Macro] = macro.Substitution
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read system.macros: %w", err)
+	}
+
+	type member struct {
+		Cluster string `json:"cluster"`
+		Shard   string `json:"shard"`
+		Replica string `json:"replica"`
+	}
+	var members []member
+	err = q.Query(ctx, "SELECT cluster, toString(shard_num) AS shard, toString(replica_num) AS replica "+
+		"FROM system.clusters WHERE is_local = 1 ORDER BY cluster", func(row json.RawMessage) error {
+		var m member
+		if err := json.Unmarshal(row, &m); err != nil {
+			return err
+		}
+		members = append(members, m)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read system.clusters: %w", err)
+	}
+
+	t := p.topology
+	t.Macros = mergeMacros(macros, t.Macros)
+	t.Cluster = firstNonEmpty(t.Cluster, macros["cluster"])
+
+	// The cluster the server is a member of is used only if it is unambiguous
+	var local *member
+	for i := range members {
+		if members[i].Cluster == t.Cluster || (t.Cluster == "" && len(members) == 1) {
+			local = &members[i]
+		}
+	}
+	if local != nil {
+		t.Cluster = firstNonEmpty(t.Cluster, local.Cluster)
+		t.Shard = firstNonEmpty(t.Shard, macros["shard"], local.Shard)
+		t.Replica = firstNonEmpty(t.Replica, macros["replica"], local.Replica)
+	} else {
+		t.Shard = firstNonEmpty(t.Shard, macros["shard"])
+		t.Replica = firstNonEmpty(t.Replica, macros["replica"])
+	}
+
+	if t.Cluster == "" {
+		clusters := make([]string, 0, len(members))
+		for _, m := range members {
+			clusters = append(clusters, m.Cluster)
+		}
+		return fmt.Errorf("failed to discover the ClickHouse cluster, the server is a member of %d clusters (%s); set it explicitly",
+			len(members), strings.Join(clusters, ", "))
+	}
+
+	log.Info().
+		Str("cluster", t.Cluster).
+		Str("shard", t.Shard).
+		Str("replica", t.Replica).
+		Int("macros", len(t.Macros)).
+		Msg("discovered ClickHouse cluster topology")
+	return nil
+}
+
+// mergeMacros returns the discovered macros overridden by the configured ones
+func mergeMacros(discovered, configured map[string]string) map[string]string {
+	macros := make(map[string]string, len(discovered)+len(configured))
+	for _, m := range []map[string]string{discovered, configured} {
+		for name, value := range m {
+			macros[name] = value
+		}
+	}
+	return macros
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
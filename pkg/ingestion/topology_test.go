@@ -0,0 +1,71 @@
+package ingestion
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// topologySink serves rows of system.macros and system.clusters
+type topologySink struct {
+	macros   []string
+	clusters []string
+}
+
+func (s *topologySink) Execute(context.Context, string, io.ReadSeeker, ...clickhouse.QueryOption) error {
+	return nil
+}
+
+func (s *topologySink) Query(_ context.Context, query string, fn func(row json.RawMessage) error, _ ...clickhouse.QueryOption) error {
+	rows := s.clusters
+	if strings.Contains(query, "system.macros") {
+		rows = s.macros
+	}
+	for _, row := range rows {
+		if err := fn(json.RawMessage(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPipeline_DiscoverTopology(t *testing.T) {
+	ctx := context.Background()
+	sink := &topologySink{
+		macros: []string{`{"macro":"replica","substitution":"ch-1"}`},
+		clusters: []string{
+			`{"cluster":"default","shard":"1","replica":"1"}`,
+			`{"cluster":"hass","shard":"2","replica":"1"}`,
+		},
+	}
+
+	// The server is a member of two clusters
+	p := NewPipeline(nil, sink, "hass", WithClusterTopology(ClusterTopology{}))
+	assert.ErrorContains(t, p.discoverTopology(ctx), "default, hass")
+
+	p = NewPipeline(nil, sink, "hass", WithClusterTopology(ClusterTopology{Cluster: "hass"}))
+	require.NoError(t, p.discoverTopology(ctx))
+	assert.Equal(t, &ClusterTopology{
+		Cluster: "hass",
+		Shard:   "2",
+		Replica: "ch-1",
+		Macros:  map[string]string{"replica": "ch-1"},
+	}, p.topology)
+
+	tmpl, err := template.New("ddl").Parse("CREATE TABLE {{.Database}}.{{.Table}} ON CLUSTER {{.Cluster}} ENGINE = " +
+		"ReplicatedMergeTree('/clickhouse/tables/{{.Shard}}/{{.Table}}', '{{.Replica}}')")
+	require.NoError(t, err)
+	p.ddlTemplate = &DDLTemplateConfig{Template: tmpl}
+
+	ddl, err := p.stateChangeDDL(RowModelV1, "hass", "light", "light", "Bool")
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE hass.light ON CLUSTER hass ENGINE = ReplicatedMergeTree('/clickhouse/tables/2/light', 'ch-1')", ddl)
+}
@@ -0,0 +1,503 @@
+package ingestion
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/hass"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// Files of a traffic recording
+const (
+	trafficEventsFile  = "events.jsonl"
+	trafficStatesFile  = "states.json"
+	trafficQueriesFile = "queries.jsonl"
+)
+
+// maxReplaySamples is the number of missing and unexpected rows of a table kept in a replay report
+const maxReplaySamples = 10
+
+// tableDDLPattern matches the statements creating a table or adding columns to it, capturing the database and table
+var tableDDLPattern = regexp.MustCompile(`^\s*(?:CREATE TABLE IF NOT EXISTS ([^\s.]+)\.([^\s(]+)|ALTER TABLE ([^\s.]+)\.(\S+) ADD COLUMN)`)
+
+// RecordedQuery is a statement sent to ClickHouse while recording traffic
+type RecordedQuery struct {
+	Query string `json:"query"`
+	Body  string `json:"body,omitempty"`
+	// Read marks read queries, whose results are not recorded
+	Read bool `json:"read,omitempty"`
+}
+
+// TrafficRecorder records the events received by a pipeline, the states its transformers are seeded with and
+// the statements it sends to ClickHouse into files of a directory. VerifyRecording replays the recording with
+// another version or configuration and compares its output with the recorded one.
+type TrafficRecorder struct {
+	dir string
+
+	mtx     sync.Mutex
+	events  *os.File
+	queries *os.File
+}
+
+// NewTrafficRecorder creates a recorder writing to dir, replacing a previous recording in it
+func NewTrafficRecorder(dir string) (*TrafficRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	r := &TrafficRecorder{dir: dir}
+	var err error
+	if r.events, err = os.Create(filepath.Join(dir, trafficEventsFile)); err != nil {
+		return nil, fmt.Errorf("failed to create recording of events: %w", err)
+	}
+	if r.queries, err = os.Create(filepath.Join(dir, trafficQueriesFile)); err != nil {
+		_ = r.events.Close()
+		return nil, fmt.Errorf("failed to create recording of queries: %w", err)
+	}
+	// States of an earlier recording must not seed the replay of this one
+	if err := os.Remove(filepath.Join(dir, trafficStatesFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		_ = r.Close()
+		return nil, fmt.Errorf("failed to remove recorded states: %w", err)
+	}
+	return r, nil
+}
+
+// Close flushes the files of the recording to disk and closes them
+func (r *TrafficRecorder) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return errors.Join(r.events.Sync(), r.events.Close(), r.queries.Sync(), r.queries.Close())
+}
+
+// WithTrafficRecorder records the traffic of the pipeline with the recorder. Rows are sent as JSONEachRow
+// while recording, also by sinks able to insert row objects, e.g. with the native protocol.
+func WithTrafficRecorder(recorder *TrafficRecorder) PipelineOption {
+	return func(p *Pipeline) {
+		p.traffic = recorder
+	}
+}
+
+// writeLine appends a value to a file of the recording as a JSON line. Lines are written unbuffered,
+// so a recording is complete up to the last statement even if the process is killed.
+func (r *TrafficRecorder) writeLine(f *os.File, value any) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func (r *TrafficRecorder) recordEvent(event *hass.EventMessage) {
+	if err := r.writeLine(r.events, event); err != nil {
+		log.Error().Err(err).Msg("failed to record event")
+	}
+}
+
+func (r *TrafficRecorder) recordStates(states []hass.State) {
+	content, err := json.Marshal(states)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(r.dir, trafficStatesFile), content, 0o644)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to record states")
+	}
+}
+
+func (r *TrafficRecorder) recordQuery(query RecordedQuery) {
+	if err := r.writeLine(r.queries, query); err != nil {
+		log.Error().Err(err).Msg("failed to record query")
+	}
+}
+
+// sink wraps a sink, recording the statements it executes
+func (r *TrafficRecorder) sink(sink Sink) Sink {
+	recording := &recordingSink{sink: sink, recorder: r}
+	if q, ok := sink.(querier); ok {
+		return &recordingQuerier{recordingSink: recording, querier: q}
+	}
+	return recording
+}
+
+// recordingSink is a sink recording the statements executed by another sink
+type recordingSink struct {
+	sink     Sink
+	recorder *TrafficRecorder
+}
+
+// Execute executes the statement and records it once it succeeded, so rows rejected by ClickHouse
+// and isolated in strict mode are not recorded twice
+func (s *recordingSink) Execute(ctx context.Context, query string, body io.ReadSeeker, opts ...clickhouse.QueryOption) error {
+	recorded, err := readStatement(query, body)
+	if err != nil {
+		return err
+	}
+	if err := s.sink.Execute(ctx, query, body, opts...); err != nil {
+		return err
+	}
+	s.recorder.recordQuery(recorded)
+	return nil
+}
+
+// recordingQuerier is a recordingSink of a sink able to run read queries
+type recordingQuerier struct {
+	*recordingSink
+	querier querier
+}
+
+func (s *recordingQuerier) Query(ctx context.Context, query string, fn func(row json.RawMessage) error, opts ...clickhouse.QueryOption) error {
+	if err := s.querier.Query(ctx, query, fn, opts...); err != nil {
+		return err
+	}
+	s.recorder.recordQuery(RecordedQuery{Query: query, Read: true})
+	return nil
+}
+
+// readStatement reads the body of a statement and rewinds it to be sent
+func readStatement(query string, body io.ReadSeeker) (RecordedQuery, error) {
+	recorded := RecordedQuery{Query: query}
+	if body == nil {
+		return recorded, nil
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return recorded, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return recorded, fmt.Errorf("failed to rewind request body: %w", err)
+	}
+	recorded.Body = string(content)
+	return recorded, nil
+}
+
+// trafficCapture is the sink of replays, keeping the statements in memory instead of sending them
+type trafficCapture struct {
+	mtx     sync.Mutex
+	queries []RecordedQuery
+}
+
+func (c *trafficCapture) Execute(_ context.Context, query string, body io.ReadSeeker, _ ...clickhouse.QueryOption) error {
+	recorded, err := readStatement(query, body)
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.queries = append(c.queries, recorded)
+	return nil
+}
+
+// ReplayTable compares the rows and DDL of a table in a recording and in its replay
+type ReplayTable struct {
+	Table        string `json:"table"`
+	RecordedRows int    `json:"recorded_rows"`
+	ReplayedRows int    `json:"replayed_rows"`
+	// MissingRows is the number of recorded rows the replay did not produce, UnexpectedRows the number
+	// of replayed rows that were not recorded
+	MissingRows    int `json:"missing_rows"`
+	UnexpectedRows int `json:"unexpected_rows"`
+	// MissingSamples and UnexpectedSamples are the first missing and unexpected rows
+	MissingSamples    []json.RawMessage `json:"missing_samples,omitempty"`
+	UnexpectedSamples []json.RawMessage `json:"unexpected_samples,omitempty"`
+	// MissingDDL and UnexpectedDDL are the differing statements creating the table and adding its columns
+	MissingDDL    []string `json:"missing_ddl,omitempty"`
+	UnexpectedDDL []string `json:"unexpected_ddl,omitempty"`
+}
+
+// Matches reports whether the replay produced the recorded rows and DDL of the table
+func (t *ReplayTable) Matches() bool {
+	return t.MissingRows == 0 && t.UnexpectedRows == 0 && len(t.MissingDDL) == 0 && len(t.UnexpectedDDL) == 0
+}
+
+// ReplayReport is the outcome of VerifyRecording
+type ReplayReport struct {
+	Events int            `json:"events"`
+	Tables []*ReplayTable `json:"tables"`
+	// Skipped are recorded tables written by other parts of the pipeline than the ingestion of state
+	// changes, e.g. heartbeats, which replays do not reproduce
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// Matches reports whether the replay produced the recorded rows and DDL of all tables
+func (r *ReplayReport) Matches() bool {
+	for _, table := range r.Tables {
+		if !table.Matches() {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyRecording replays the events of a recording of a TrafficRecorder with the configuration of the
+// pipeline, without connecting to Home Assistant or ClickHouse, and compares the rows and DDL it produces
+// with the recorded ones, e.g. to check that an upgrade does not change how events are stored. Rows are
+// compared per table regardless of their order and batches. Events are replayed at once, so rows depending
+// on when events were received, e.g. late state changes, may differ from the recording.
+func (p *Pipeline) VerifyRecording(ctx context.Context, dir string) (*ReplayReport, error) {
+	if err := p.orderStages(); err != nil {
+		return nil, fmt.Errorf("invalid stage order: %w", err)
+	}
+
+	recorded, err := readRecordedQueries(filepath.Join(dir, trafficQueriesFile))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, trafficEventsFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recorded events: %w", err)
+	}
+	defer f.Close()
+	events, err := ReadEvents(f)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, trafficStatesFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read recorded states: %w", err)
+	default:
+		var states []hass.State
+		if err := json.Unmarshal(content, &states); err != nil {
+			return nil, fmt.Errorf("failed to decode recorded states: %w", err)
+		}
+		for _, s := range p.seeders() {
+			s.Seed(states)
+		}
+	}
+
+	capture := &trafficCapture{}
+	p.sink = capture
+	p.tableExists = make(map[string]bool)
+
+	stateChanges := make([]*hass.EventMessage, 0, len(events))
+	for _, event := range events {
+		if event.Event.EventType == hass.EventTypeStateChanged && p.allow(event) {
+			stateChanges = append(stateChanges, event)
+		}
+	}
+	// State changes still held back by flap detection are released at the end of the recording
+	if p.flaps != nil {
+		stateChanges = append(stateChanges, p.flaps.settle(time.Unix(1<<62, 0))...)
+	}
+	p.insertHistory(ctx, stateChanges)
+
+	report, err := p.compareTraffic(recorded, capture.queries)
+	if err != nil {
+		return nil, err
+	}
+	report.Events = len(events)
+	return report, nil
+}
+
+// readRecordedQueries reads the statements of a recording
+func readRecordedQueries(path string) ([]RecordedQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recorded queries: %w", err)
+	}
+	defer f.Close()
+
+	var queries []RecordedQuery
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var query RecordedQuery
+		if err := json.Unmarshal(scanner.Bytes(), &query); err != nil {
+			return nil, fmt.Errorf("failed to decode recorded query %d: %w", len(queries)+1, err)
+		}
+		queries = append(queries, query)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recorded queries: %w", err)
+	}
+	return queries, nil
+}
+
+// trafficTable are the rows inserted into a table and the DDL of the table
+type trafficTable struct {
+	rows     map[string]int
+	rowCount int
+	ddl      map[string]bool
+}
+
+// trafficTables groups the inserted rows and DDL of statements by their table. Rows are normalized,
+// so rows with the same values are equal regardless of the order of their fields.
+func trafficTables(queries []RecordedQuery) (map[string]*trafficTable, error) {
+	tables := make(map[string]*trafficTable)
+	tableOf := func(database, tableName string) *trafficTable {
+		key := database + "." + tableName
+		table, ok := tables[key]
+		if !ok {
+			table = &trafficTable{rows: make(map[string]int), ddl: make(map[string]bool)}
+			tables[key] = table
+		}
+		return table
+	}
+
+	for _, query := range queries {
+		if query.Read {
+			continue
+		}
+
+		statement := strings.TrimSpace(query.Query)
+		if match := tableDDLPattern.FindStringSubmatch(statement); match != nil {
+			if match[1] != "" {
+				tableOf(match[1], match[2]).ddl[statement] = true
+			} else {
+				tableOf(match[3], match[4]).ddl[statement] = true
+			}
+			continue
+		}
+
+		match := jsonEachRowInsertPattern.FindStringSubmatch(statement)
+		if match == nil {
+			continue
+		}
+		table := tableOf(match[1], match[2])
+		for _, line := range strings.Split(query.Body, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			row, err := normalizeRow(line)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode row of %s.%s: %w", match[1], match[2], err)
+			}
+			table.rows[row]++
+			table.rowCount++
+		}
+	}
+	return tables, nil
+}
+
+// normalizeRow re-encodes a JSON row with sorted fields, keeping numbers as they are
+func normalizeRow(line string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var row any
+	if err := decoder.Decode(&row); err != nil {
+		return "", err
+	}
+	normalized, err := json.Marshal(row)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(normalized)), nil
+}
+
+// compareTraffic compares the rows and DDL of recorded and replayed statements per table
+func (p *Pipeline) compareTraffic(recorded, replayed []RecordedQuery) (*ReplayReport, error) {
+	recordedTables, err := trafficTables(recorded)
+	if err != nil {
+		return nil, err
+	}
+	replayedTables, err := trafficTables(replayed)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(recordedTables)+len(replayedTables))
+	for name := range recordedTables {
+		names = append(names, name)
+	}
+	for name := range replayedTables {
+		if _, ok := recordedTables[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	report := &ReplayReport{Tables: []*ReplayTable{}}
+	empty := &trafficTable{}
+	for _, name := range names {
+		recordedTable, ok := recordedTables[name]
+		if !ok {
+			recordedTable = empty
+		}
+		replayedTable, ok := replayedTables[name]
+		if !ok {
+			_, tableName, _ := strings.Cut(name, ".")
+			if p.unreplayedTable(tableName) {
+				report.Skipped = append(report.Skipped, name)
+				continue
+			}
+			replayedTable = empty
+		}
+
+		table := &ReplayTable{Table: name, RecordedRows: recordedTable.rowCount, ReplayedRows: replayedTable.rowCount}
+		table.MissingRows, table.MissingSamples = diffRows(recordedTable.rows, replayedTable.rows)
+		table.UnexpectedRows, table.UnexpectedSamples = diffRows(replayedTable.rows, recordedTable.rows)
+		table.MissingDDL = diffDDL(recordedTable.ddl, replayedTable.ddl)
+		table.UnexpectedDDL = diffDDL(replayedTable.ddl, recordedTable.ddl)
+		report.Tables = append(report.Tables, table)
+	}
+	return report, nil
+}
+
+// diffRows returns the number of rows of a missing from b and the first of them in sorted order
+func diffRows(a, b map[string]int) (int, []json.RawMessage) {
+	var rows []string
+	count := 0
+	for row, n := range a {
+		if n > b[row] {
+			count += n - b[row]
+			rows = append(rows, row)
+		}
+	}
+	sort.Strings(rows)
+
+	var samples []json.RawMessage
+	for _, row := range rows[:min(len(rows), maxReplaySamples)] {
+		samples = append(samples, json.RawMessage(row))
+	}
+	return count, samples
+}
+
+// diffDDL returns the statements of a missing from b in sorted order
+func diffDDL(a, b map[string]bool) []string {
+	var statements []string
+	for statement := range a {
+		if !b[statement] {
+			statements = append(statements, statement)
+		}
+	}
+	sort.Strings(statements)
+	return statements
+}
+
+// unreplayedTable reports whether a table is written by other parts of the pipeline than the ingestion
+// of state changes, e.g. heartbeats or the entity registry
+func (p *Pipeline) unreplayedTable(tableName string) bool {
+	switch tableName {
+	case availabilityTableName:
+		return false
+	case entitiesTableName, gapsTableName, stateLabelsTableName, statisticsTableName:
+		return true
+	}
+	return p.isInternalTable(tableName)
+}
@@ -0,0 +1,79 @@
+package ingestion
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+func TestTrafficRecorder_VerifyRecording(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	stateChange := func(entityID, oldState, newState string, minute int) *hass.EventMessage {
+		return &hass.EventMessage{Event: hass.Event{EventType: hass.EventTypeStateChanged, Data: hass.EventData{
+			EntityID: entityID,
+			OldState: &hass.State{EntityID: entityID, State: oldState},
+			NewState: &hass.State{EntityID: entityID, State: newState, LastUpdated: time.Date(2026, 1, 2, 3, minute, 0, 0, time.UTC)},
+		}}}
+	}
+	events := []*hass.EventMessage{
+		stateChange("light.kitchen", "off", "on", 1),
+		stateChange("sensor.temperature", "21.5", "22", 2),
+		stateChange("light.kitchen", "on", hass.UnavailableValue, 3),
+	}
+
+	recorder, err := NewTrafficRecorder(dir)
+	require.NoError(t, err)
+	sink := &trafficCapture{}
+	p := NewPipeline(nil, sink, "hass", WithTrafficRecorder(recorder))
+	p.tableExists = make(map[string]bool)
+	for _, event := range events {
+		recorder.recordEvent(event)
+	}
+	assert.Zero(t, p.insertHistory(ctx, events))
+	// Tables of other parts of the pipeline are not replayed
+	require.NoError(t, p.sink.Execute(ctx, "INSERT INTO hass.heartbeats FORMAT JSONEachRow", strings.NewReader(`{"source":"hass2ch"}`)))
+	require.NoError(t, recorder.Close())
+
+	// The recorded sink got the statements as well
+	assert.NotEmpty(t, sink.queries)
+
+	report, err := NewPipeline(nil, nil, "hass").VerifyRecording(ctx, dir)
+	require.NoError(t, err)
+	assert.True(t, report.Matches())
+	assert.Equal(t, 3, report.Events)
+	assert.Equal(t, []string{"hass.heartbeats"}, report.Skipped)
+	require.Len(t, report.Tables, 2)
+	assert.Equal(t, "hass.light", report.Tables[0].Table)
+	assert.Equal(t, 1, report.Tables[0].RecordedRows)
+	assert.Equal(t, "hass.numeric_sensor", report.Tables[1].Table)
+
+	// Recording availability adds a table and its rows
+	report, err = NewPipeline(nil, nil, "hass", WithAvailability()).VerifyRecording(ctx, dir)
+	require.NoError(t, err)
+	assert.False(t, report.Matches())
+	require.Len(t, report.Tables, 3)
+	availability := report.Tables[0]
+	assert.Equal(t, "hass.availability", availability.Table)
+	assert.Zero(t, availability.RecordedRows)
+	assert.Equal(t, 1, availability.UnexpectedRows)
+	require.Len(t, availability.UnexpectedSamples, 1)
+	assert.Contains(t, string(availability.UnexpectedSamples[0]), AvailabilityBecameUnavailable)
+	assert.Len(t, availability.UnexpectedDDL, 1)
+	assert.True(t, report.Tables[1].Matches())
+}
+
+func TestNormalizeRow(t *testing.T) {
+	a, err := normalizeRow(`{"state":21.50,"entity_id":"sensor.temperature"}`)
+	require.NoError(t, err)
+	b, err := normalizeRow(`{"entity_id":"sensor.temperature","state":21.50}`)
+	require.NoError(t, err)
+	assert.Equal(t, a, b)
+	assert.Equal(t, `{"entity_id":"sensor.temperature","state":21.50}`, a)
+}
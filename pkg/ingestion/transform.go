@@ -0,0 +1,90 @@
+package ingestion
+
+import (
+	"context"
+
+	"github.com/jkaflik/hass2ch/hass"
+)
+
+// Transformer enriches a resolved state change before it is inserted into ClickHouse.
+// Transformers run in the order they were registered on the pipeline.
+type Transformer interface {
+	// Transform mutates the state change resolved from the given event.
+	Transform(event *hass.EventMessage, change *StateChange)
+
+	// Columns returns additional column definitions required in the table of the given domain.
+	Columns(domain string) []string
+}
+
+// Observer is implemented by transformers that need to see every received event,
+// including the ones that are not routed to the transformer's tables.
+type Observer interface {
+	Observe(event *hass.EventMessage)
+}
+
+// WithTransformer registers a custom transformer on the pipeline
+func WithTransformer(t Transformer) PipelineOption {
+	return func(p *Pipeline) {
+		p.transformers = append(p.transformers, t)
+	}
+}
+
+func (p *Pipeline) transform(event *hass.EventMessage, change *StateChange) {
+	for _, t := range p.transformers {
+		t.Transform(event, change)
+	}
+}
+
+func (p *Pipeline) observe(event *hass.EventMessage) {
+	for _, t := range p.transformers {
+		if o, ok := t.(Observer); ok {
+			o.Observe(event)
+		}
+	}
+}
+
+func (p *Pipeline) columns(domain string) []string {
+	var columns []string
+	for _, t := range p.transformers {
+		columns = append(columns, t.Columns(domain)...)
+	}
+	columns = append(columns, p.attributeColumns[domain]...)
+	return append(columns, p.labelColumns()...)
+}
+
+// Seeder is implemented by transformers that need the current states when the pipeline starts.
+type Seeder interface {
+	Seed(states []hass.State)
+}
+
+func (p *Pipeline) seed(ctx context.Context) error {
+	seeders := p.seeders()
+	if len(seeders) == 0 {
+		return nil
+	}
+
+	states, err := p.source.GetStates(ctx)
+	if err != nil {
+		return err
+	}
+
+	if p.traffic != nil {
+		p.traffic.recordStates(states)
+	}
+
+	for _, s := range seeders {
+		s.Seed(states)
+	}
+
+	return nil
+}
+
+func (p *Pipeline) seeders() []Seeder {
+	var seeders []Seeder
+	for _, t := range p.transformers {
+		if s, ok := t.(Seeder); ok {
+			seeders = append(seeders, s)
+		}
+	}
+	return seeders
+}
@@ -0,0 +1,372 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+const (
+	tuneScratchPrefix     = "_hass2ch_tune_"
+	defaultTuneSampleRows = 100_000
+
+	// minTuneSavings is the share of compressed bytes a codec must save to be suggested
+	minTuneSavings = 0.05
+)
+
+// generalCodecs are candidate codecs applicable to columns of any type
+var generalCodecs = []string{"LZ4", "ZSTD(1)", "ZSTD(3)", "ZSTD(9)"}
+
+// TuneOptions configures the compression benchmark run by Pipeline.Tune
+type TuneOptions struct {
+	// Tables are the tables of the pipeline database to benchmark, all non-empty MergeTree tables when empty
+	Tables []string
+	// SampleRows is the number of rows copied from every table into the scratch tables
+	SampleRows int
+	// OrderBys are candidate sorting keys compared to the current one, e.g. "(entity_id, last_updated)"
+	OrderBys []string
+}
+
+// TuneReport is the result of a compression benchmark
+type TuneReport struct {
+	Tables []*TuneTable `json:"tables"`
+}
+
+// TuneTable is the benchmark of a single table
+type TuneTable struct {
+	Database    string `json:"database"`
+	Name        string `json:"name"`
+	OrderBy     string `json:"order_by"`
+	Rows        uint64 `json:"rows"`
+	SampledRows uint64 `json:"sampled_rows"`
+
+	// CompressedBytes is the current size of the table, EstimatedBytes the size with the suggested codecs
+	CompressedBytes uint64 `json:"compressed_bytes"`
+	EstimatedBytes  uint64 `json:"estimated_bytes"`
+
+	Columns   []*TuneColumn   `json:"columns"`
+	Orderings []*TuneOrdering `json:"orderings,omitempty"`
+
+	// Alters are the suggested statements changing the codecs of the table
+	Alters []string `json:"alters,omitempty"`
+}
+
+// TuneColumn is the benchmark of the codecs of a single column
+type TuneColumn struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Codec string `json:"codec"`
+
+	CompressedBytes uint64 `json:"compressed_bytes"`
+	EstimatedBytes  uint64 `json:"estimated_bytes"`
+
+	// SampleBytes are the compressed bytes of the sample with the current codec, Candidates with every candidate codec
+	SampleBytes uint64            `json:"sample_bytes"`
+	Candidates  map[string]uint64 `json:"candidates,omitempty"`
+	// BestCodec is the suggested codec, empty if none saves enough over the current one
+	BestCodec string `json:"best_codec,omitempty"`
+}
+
+// TuneOrdering is the compressed size of the sample with the current codecs and another sorting key
+type TuneOrdering struct {
+	OrderBy     string `json:"order_by"`
+	SampleBytes uint64 `json:"sample_bytes"`
+}
+
+// Tune benchmarks compression codecs and sorting keys of existing tables. A sample of every table is copied
+// into scratch tables, one per candidate codec or sorting key, and the compressed sizes of their columns are
+// compared. Codecs saving enough over the current ones are suggested as ALTER statements.
+func (p *Pipeline) Tune(ctx context.Context, opts TuneOptions) (*TuneReport, error) {
+	q, ok := p.sink.(querier)
+	if !ok {
+		return nil, errors.New("sink does not support queries")
+	}
+
+	if opts.SampleRows <= 0 {
+		opts.SampleRows = defaultTuneSampleRows
+	}
+
+	tables, err := p.tuneTables(ctx, q, opts.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &TuneReport{}
+	for _, table := range tables {
+		log.Info().Str("database", table.Database).Str("table", table.Name).Msg("Benchmarking compression codecs")
+
+		if err := p.tuneTable(ctx, q, table, opts); err != nil {
+			return nil, fmt.Errorf("failed to benchmark %s.%s: %w", table.Database, table.Name, err)
+		}
+		report.Tables = append(report.Tables, table)
+	}
+
+	return report, nil
+}
+
+// tuneTables lists the tables to benchmark with their columns
+func (p *Pipeline) tuneTables(ctx context.Context, q querier, names []string) ([]*TuneTable, error) {
+	query := fmt.Sprintf(`SELECT name, sorting_key, total_rows FROM system.tables
+WHERE database = %s AND engine LIKE '%%MergeTree' AND total_rows > 0 AND NOT startsWith(name, %s)
+ORDER BY name`, clickhouse.QuoteString(p.database), clickhouse.QuoteString(tuneScratchPrefix))
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var tables []*TuneTable
+	err := q.Query(ctx, query, func(raw json.RawMessage) error {
+		var row struct {
+			Name       string `json:"name"`
+			SortingKey string `json:"sorting_key"`
+			TotalRows  uint64 `json:"total_rows,string"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return err
+		}
+
+		orderBy := "tuple()"
+		if row.SortingKey != "" {
+			orderBy = "(" + row.SortingKey + ")"
+		}
+
+		if len(wanted) == 0 || wanted[row.Name] {
+			tables = append(tables, &TuneTable{
+				Database: p.database,
+				Name:     row.Name,
+				OrderBy:  orderBy,
+				Rows:     row.TotalRows,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	for _, table := range tables {
+		columns, err := tuneColumns(ctx, q, table.Database, table.Name)
+		if err != nil {
+			return nil, err
+		}
+		table.Columns = columns
+		for _, column := range columns {
+			table.CompressedBytes += column.CompressedBytes
+		}
+	}
+
+	return tables, nil
+}
+
+func tuneColumns(ctx context.Context, q querier, database, table string) ([]*TuneColumn, error) {
+	query := fmt.Sprintf(`SELECT name, type, compression_codec, data_compressed_bytes FROM system.columns
+WHERE database = %s AND table = %s AND default_kind != 'ALIAS' ORDER BY position`,
+		clickhouse.QuoteString(database), clickhouse.QuoteString(table))
+
+	var columns []*TuneColumn
+	err := q.Query(ctx, query, func(raw json.RawMessage) error {
+		var row struct {
+			Name            string `json:"name"`
+			Type            string `json:"type"`
+			Codec           string `json:"compression_codec"`
+			CompressedBytes uint64 `json:"data_compressed_bytes,string"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return err
+		}
+
+		columns = append(columns, &TuneColumn{
+			Name:            row.Name,
+			Type:            row.Type,
+			Codec:           row.Codec,
+			CompressedBytes: row.CompressedBytes,
+			Candidates:      make(map[string]uint64),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns of %s.%s: %w", database, table, err)
+	}
+
+	return columns, nil
+}
+
+// tuneTable benchmarks the candidate codecs and sorting keys of a table and suggests codecs
+func (p *Pipeline) tuneTable(ctx context.Context, q querier, table *TuneTable, opts TuneOptions) error {
+	sample, err := p.sampleBytes(ctx, q, table, table.OrderBy, "", opts.SampleRows)
+	if err != nil {
+		return err
+	}
+	for _, column := range table.Columns {
+		column.SampleBytes = sample[column.Name]
+	}
+	table.SampledRows = min(table.Rows, uint64(opts.SampleRows))
+
+	for _, codec := range tuneCodecs(table.Columns) {
+		sample, err := p.sampleBytes(ctx, q, table, table.OrderBy, codec, opts.SampleRows)
+		if err != nil {
+			return err
+		}
+		for _, column := range table.Columns {
+			if slices.Contains(candidateCodecs(column.Type), codec) {
+				column.Candidates[codec] = sample[column.Name]
+			}
+		}
+	}
+
+	for _, orderBy := range opts.OrderBys {
+		sample, err := p.sampleBytes(ctx, q, table, orderBy, "", opts.SampleRows)
+		if err != nil {
+			return err
+		}
+
+		ordering := &TuneOrdering{OrderBy: orderBy}
+		for _, bytes := range sample {
+			ordering.SampleBytes += bytes
+		}
+		table.Orderings = append(table.Orderings, ordering)
+	}
+
+	suggestCodecs(table)
+
+	return nil
+}
+
+// sampleBytes copies a sample of the table into a scratch table with the given sorting key and, when set,
+// the codec applied to all columns it is a candidate for, and returns the compressed bytes per column
+func (p *Pipeline) sampleBytes(ctx context.Context, q querier, table *TuneTable, orderBy, codec string, sampleRows int) (map[string]uint64, error) {
+	scratch := fmt.Sprintf("%s.`%s%s`", table.Database, tuneScratchPrefix, table.Name)
+	source := fmt.Sprintf("%s.`%s`", table.Database, table.Name)
+
+	statements := []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", scratch),
+		fmt.Sprintf("CREATE TABLE %s AS %s ENGINE = MergeTree() ORDER BY %s", scratch, source, orderBy),
+	}
+	if codec != "" {
+		for _, column := range table.Columns {
+			if slices.Contains(candidateCodecs(column.Type), codec) {
+				statements = append(statements, fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN `%s` CODEC(%s)", scratch, column.Name, codec))
+			}
+		}
+	}
+	statements = append(statements,
+		fmt.Sprintf("INSERT INTO %s SELECT * FROM %s LIMIT %d", scratch, source, sampleRows),
+		fmt.Sprintf("OPTIMIZE TABLE %s FINAL", scratch),
+	)
+
+	defer func() {
+		if err := p.sink.Execute(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", scratch), nil); err != nil {
+			log.Warn().Err(err).Str("table", scratch).Msg("failed to drop scratch table")
+		}
+	}()
+
+	for _, statement := range statements {
+		if err := p.sink.Execute(ctx, statement, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	query := fmt.Sprintf("SELECT name, data_compressed_bytes FROM system.columns WHERE database = %s AND table = %s",
+		clickhouse.QuoteString(table.Database), clickhouse.QuoteString(tuneScratchPrefix+table.Name))
+
+	bytes := make(map[string]uint64)
+	err := q.Query(ctx, query, func(raw json.RawMessage) error {
+		var row struct {
+			Name            string `json:"name"`
+			CompressedBytes uint64 `json:"data_compressed_bytes,string"`
+		}
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return err
+		}
+		bytes[row.Name] = row.CompressedBytes
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure scratch table: %w", err)
+	}
+
+	return bytes, nil
+}
+
+// suggestCodecs picks the best candidate codec of every column and estimates the size of the table with it
+func suggestCodecs(table *TuneTable) {
+	table.EstimatedBytes = 0
+	table.Alters = nil
+
+	for _, column := range table.Columns {
+		column.EstimatedBytes = column.CompressedBytes
+		column.BestCodec = ""
+
+		best, bestBytes := "", column.SampleBytes
+		for _, codec := range sortedKeys(column.Candidates) {
+			if bytes := column.Candidates[codec]; bytes < bestBytes {
+				best, bestBytes = codec, bytes
+			}
+		}
+
+		if best != "" && column.SampleBytes > 0 && float64(bestBytes) <= float64(column.SampleBytes)*(1-minTuneSavings) {
+			column.BestCodec = best
+			column.EstimatedBytes = uint64(float64(column.CompressedBytes) * float64(bestBytes) / float64(column.SampleBytes))
+			table.Alters = append(table.Alters, fmt.Sprintf("ALTER TABLE %s.`%s` MODIFY COLUMN `%s` CODEC(%s)",
+				table.Database, table.Name, column.Name, best))
+		}
+
+		table.EstimatedBytes += column.EstimatedBytes
+	}
+}
+
+// tuneCodecs returns the distinct candidate codecs of the columns
+func tuneCodecs(columns []*TuneColumn) []string {
+	seen := make(map[string]bool)
+	var codecs []string
+	for _, column := range columns {
+		for _, codec := range candidateCodecs(column.Type) {
+			if !seen[codec] {
+				seen[codec] = true
+				codecs = append(codecs, codec)
+			}
+		}
+	}
+	return codecs
+}
+
+// candidateCodecs returns the codecs worth benchmarking for a column of the given type
+func candidateCodecs(columnType string) []string {
+	base := columnType
+	if strings.HasPrefix(base, "Nullable(") {
+		base = strings.TrimSuffix(strings.TrimPrefix(base, "Nullable("), ")")
+	}
+
+	switch {
+	case strings.HasPrefix(base, "JSON"), strings.HasPrefix(base, "Object"),
+		strings.HasPrefix(base, "Dynamic"), strings.HasPrefix(base, "Variant"):
+		// Codecs of dynamic subcolumns cannot be changed
+		return nil
+	case strings.HasPrefix(base, "Int"), strings.HasPrefix(base, "UInt"):
+		return slices.Concat(generalCodecs, []string{"Delta, ZSTD(1)", "DoubleDelta, ZSTD(1)", "T64, ZSTD(1)"})
+	case strings.HasPrefix(base, "Date"):
+		return slices.Concat(generalCodecs, []string{"Delta, ZSTD(1)", "DoubleDelta, ZSTD(1)"})
+	case strings.HasPrefix(base, "Float"):
+		return slices.Concat(generalCodecs, []string{"Gorilla, ZSTD(1)"})
+	default:
+		return generalCodecs
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
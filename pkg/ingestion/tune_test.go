@@ -0,0 +1,34 @@
+package ingestion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCandidateCodecs(t *testing.T) {
+	assert.Contains(t, candidateCodecs("Nullable(Float64)"), "Gorilla, ZSTD(1)")
+	assert.Contains(t, candidateCodecs("DateTime64(3, 'UTC')"), "DoubleDelta, ZSTD(1)")
+	assert.NotContains(t, candidateCodecs("LowCardinality(String)"), "Delta, ZSTD(1)")
+	assert.Empty(t, candidateCodecs("JSON"))
+	assert.Len(t, generalCodecs, 4, "candidates must not append to the general codecs")
+}
+
+func TestSuggestCodecs(t *testing.T) {
+	table := &TuneTable{
+		Database: "hass",
+		Name:     "sensor",
+		Columns: []*TuneColumn{
+			{Name: "state", CompressedBytes: 1000, SampleBytes: 100, Candidates: map[string]uint64{"ZSTD(1)": 80, "ZSTD(3)": 60}},
+			{Name: "entity_id", CompressedBytes: 500, SampleBytes: 100, Candidates: map[string]uint64{"ZSTD(1)": 97}},
+		},
+	}
+
+	suggestCodecs(table)
+
+	assert.Equal(t, "ZSTD(3)", table.Columns[0].BestCodec)
+	assert.Equal(t, uint64(600), table.Columns[0].EstimatedBytes)
+	assert.Empty(t, table.Columns[1].BestCodec, "savings below the threshold")
+	assert.Equal(t, uint64(1100), table.EstimatedBytes)
+	assert.Equal(t, []string{"ALTER TABLE hass.`sensor` MODIFY COLUMN `state` CODEC(ZSTD(3))"}, table.Alters)
+}
@@ -0,0 +1,348 @@
+package ingestion
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// walReplayInterval is how often segments of the write-ahead log are replayed while ClickHouse is down
+const walReplayInterval = 5 * time.Second
+
+const (
+	walSegmentSuffix  = ".jsonl"
+	walRejectedSuffix = ".rejected"
+	walTempSuffix     = ".tmp"
+)
+
+// errWALFull is returned when a batch does not fit into the write-ahead log anymore
+var errWALFull = errors.New("write-ahead log is full")
+
+// WithWAL spills batches that could not be inserted after all retries, e.g. during a ClickHouse outage,
+// to segment files in dir instead of dropping them. Segments are replayed in order once ClickHouse recovers,
+// and batches are spilled behind them until then. Batches are dropped as without the write-ahead log
+// once its segments take maxSize bytes, 0 means no limit.
+func WithWAL(dir string, maxSize uint64) PipelineOption {
+	return func(p *Pipeline) {
+		p.walDir = dir
+		p.walMaxSize = maxSize
+	}
+}
+
+// wal is a write-ahead log of batches as segment files of JSONEachRow rows named
+// <sequence>_<rows>_<database>.<table>.jsonl
+type wal struct {
+	dir     string
+	maxSize uint64
+
+	mu       sync.Mutex
+	seq      uint64
+	size     uint64
+	segments []walSegment
+}
+
+// walSegment is a spilled batch of rows of a table
+type walSegment struct {
+	path     string
+	seq      uint64
+	rows     int
+	database string
+	table    string
+	size     uint64
+}
+
+// openWAL opens the write-ahead log in dir, picking up the segments left by a previous run
+func openWAL(dir string, maxSize uint64) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create write-ahead log directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write-ahead log directory: %w", err)
+	}
+
+	w := &wal{dir: dir, maxSize: maxSize}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+
+		// Segments interrupted while being written were never acknowledged
+		if strings.HasSuffix(name, walTempSuffix) {
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+
+		segment, ok := parseWALSegmentName(name)
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat write-ahead log segment %s: %w", name, err)
+		}
+		segment.path = filepath.Join(dir, name)
+		segment.size = uint64(info.Size())
+
+		w.segments = append(w.segments, segment)
+		w.size += segment.size
+		w.seq = max(w.seq, segment.seq)
+	}
+
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].seq < w.segments[j].seq
+	})
+	w.updateMetrics()
+
+	if len(w.segments) > 0 {
+		log.Info().Str("dir", dir).Int("segments", len(w.segments)).Uint64("bytes", w.size).Msg("found write-ahead log segments to replay")
+	}
+	return w, nil
+}
+
+func walSegmentName(seq uint64, rows int, database, table string) string {
+	return fmt.Sprintf("%020d_%d_%s.%s%s", seq, rows, database, table, walSegmentSuffix)
+}
+
+func parseWALSegmentName(name string) (walSegment, bool) {
+	if !strings.HasSuffix(name, walSegmentSuffix) {
+		return walSegment{}, false
+	}
+
+	parts := strings.SplitN(strings.TrimSuffix(name, walSegmentSuffix), "_", 3)
+	if len(parts) != 3 {
+		return walSegment{}, false
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return walSegment{}, false
+	}
+	rows, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return walSegment{}, false
+	}
+	database, table, ok := strings.Cut(parts[2], ".")
+	if !ok {
+		return walSegment{}, false
+	}
+
+	return walSegment{seq: seq, rows: rows, database: database, table: table}, true
+}
+
+// pending reports whether segments are waiting for replay
+func (w *wal) pending() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.segments) > 0
+}
+
+// append writes rows of a table to a new segment, synced to disk before it is visible to the replay
+func (w *wal) append(database, table string, rows int, r io.Reader) error {
+	w.mu.Lock()
+	w.seq++
+	seq := w.seq
+	w.mu.Unlock()
+
+	path := filepath.Join(w.dir, walSegmentName(seq, rows, database, table))
+	size, err := writeFileSync(path+walTempSuffix, r)
+	if err != nil {
+		_ = os.Remove(path + walTempSuffix)
+		return fmt.Errorf("failed to write write-ahead log segment: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxSize > 0 && w.size+size > w.maxSize {
+		_ = os.Remove(path + walTempSuffix)
+		return errWALFull
+	}
+	if err := os.Rename(path+walTempSuffix, path); err != nil {
+		_ = os.Remove(path + walTempSuffix)
+		return fmt.Errorf("failed to commit write-ahead log segment: %w", err)
+	}
+
+	// Segments are kept in order of their sequence, an earlier one might be committed later
+	segment := walSegment{path: path, seq: seq, rows: rows, database: database, table: table, size: size}
+	i := sort.Search(len(w.segments), func(i int) bool {
+		return w.segments[i].seq > seq
+	})
+	w.segments = append(w.segments, walSegment{})
+	copy(w.segments[i+1:], w.segments[i:])
+	w.segments[i] = segment
+	w.size += size
+	w.updateMetrics()
+	return nil
+}
+
+func writeFileSync(path string, r io.Reader) (uint64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return uint64(n), f.Close()
+}
+
+// replaceFileSync atomically replaces a file with the data, syncing the file before the rename and its directory
+// after it, so the replacement survives a crash
+func replaceFileSync(path string, data []byte) error {
+	tmp := path + walTempSuffix
+	if _, err := writeFileSync(tmp, bytes.NewReader(data)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// oldest returns the segment to replay next
+func (w *wal) oldest() (walSegment, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.segments) == 0 {
+		return walSegment{}, false
+	}
+	return w.segments[0], true
+}
+
+// remove removes a replayed segment, or renames it to keep it for inspection if it has been rejected
+func (w *wal) remove(segment walSegment, rejected bool) error {
+	var err error
+	if rejected {
+		err = os.Rename(segment.path, segment.path+walRejectedSuffix)
+	} else {
+		err = os.Remove(segment.path)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove write-ahead log segment: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.segments {
+		if w.segments[i].seq == segment.seq {
+			w.segments = append(w.segments[:i], w.segments[i+1:]...)
+			w.size -= segment.size
+			break
+		}
+	}
+	w.updateMetrics()
+	return nil
+}
+
+func (w *wal) updateMetrics() {
+	metrics.WALSegments.Set(float64(len(w.segments)))
+	metrics.WALBytes.Set(float64(w.size))
+}
+
+// spill writes rows of a table to the write-ahead log
+func (p *Pipeline) spill(database, tableName string, values []any) error {
+	if err := p.wal.append(database, tableName, len(values), p.newRowReader(values)); err != nil {
+		return err
+	}
+	metrics.WALSpilledRows.Add(float64(len(values)))
+	return nil
+}
+
+// replayWAL periodically replays segments of the write-ahead log until the context is done
+func (p *Pipeline) replayWAL(ctx context.Context) {
+	ticker := p.clock.NewTicker(walReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		p.drainWAL(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// drainWAL inserts segments oldest first until all are replayed or one fails. Segments rejected by
+// ClickHouse because of their data are set aside, so they do not block the ones behind them.
+func (p *Pipeline) drainWAL(ctx context.Context) {
+	for ctx.Err() == nil {
+		segment, ok := p.wal.oldest()
+		if !ok {
+			return
+		}
+
+		err := p.replaySegment(ctx, segment)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Warn().Str("segment", segment.path).Msg("write-ahead log segment has been removed, skipping it")
+			_ = p.wal.remove(segment, false)
+			continue
+		}
+		if err != nil && !clickhouse.IsDataError(err) {
+			log.Debug().Err(err).Str("segment", segment.path).Msg("ClickHouse is still unavailable, write-ahead log replay postponed")
+			return
+		}
+
+		rejected := err != nil
+		if rejected {
+			metrics.WALRejectedSegments.Inc()
+			log.Error().Err(err).Str("segment", segment.path+walRejectedSuffix).Msg("ClickHouse rejected a write-ahead log segment, setting it aside")
+		} else {
+			metrics.WALReplayedRows.Add(float64(segment.rows))
+			log.Info().
+				Str("database", segment.database).
+				Str("table", segment.table).
+				Int("rows", segment.rows).
+				Msg("replayed write-ahead log segment")
+		}
+
+		if err := p.wal.remove(segment, rejected); err != nil {
+			log.Error().Err(err).Str("segment", segment.path).Msg("failed to remove write-ahead log segment")
+			return
+		}
+	}
+}
+
+// replaySegment inserts the rows of a segment as they were spilled, with the labels of the time
+func (p *Pipeline) replaySegment(ctx context.Context, segment walSegment) error {
+	f, err := os.Open(segment.path)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log segment: %w", err)
+	}
+	defer f.Close()
+
+	query := fmt.Sprintf("INSERT INTO %s.%s FORMAT JSONEachRow", segment.database, segment.table)
+	opts := append(p.insertOptions(), clickhouse.WithLogCommentField("wal_segment", filepath.Base(segment.path)))
+	return p.sink.Execute(ctx, query, f, opts...)
+}
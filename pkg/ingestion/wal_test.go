@@ -0,0 +1,72 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/hass2ch/pkg/clickhouse"
+)
+
+// outageSink fails all queries while it is down and records the bodies of inserts otherwise
+type outageSink struct {
+	down     bool
+	inserted []string
+}
+
+func (s *outageSink) Execute(_ context.Context, query string, body io.ReadSeeker, _ ...clickhouse.QueryOption) error {
+	if s.down {
+		return errors.New("connection refused")
+	}
+	if body != nil {
+		b, _ := io.ReadAll(body)
+		s.inserted = append(s.inserted, strings.TrimPrefix(query, "INSERT INTO ")+" "+strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+func TestPipeline_WAL(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sink := &outageSink{down: true}
+
+	p := NewPipeline(nil, sink, "hass", WithoutDDL(), WithWAL(dir, 0))
+	var err error
+	p.wal, err = openWAL(dir, 0)
+	require.NoError(t, err)
+
+	// Batches failing after all retries are spilled and reported as stored
+	require.NoError(t, p.insertBatch(ctx, newBatchID(), "hass", "light", []any{map[string]any{"n": 1}}, 1, 0))
+	sink.down = false
+
+	// Batches are queued behind the spilled ones until they are replayed
+	require.NoError(t, p.insertBatch(ctx, newBatchID(), "hass", "switch", []any{map[string]any{"n": 2}}, 1, 0))
+	assert.Empty(t, sink.inserted)
+
+	// Segments left by a previous run are picked up in order
+	p.wal, err = openWAL(dir, 0)
+	require.NoError(t, err)
+	p.drainWAL(ctx)
+
+	assert.Equal(t, []string{
+		`hass.light FORMAT JSONEachRow {"n":1}`,
+		`hass.switch FORMAT JSONEachRow {"n":2}`,
+	}, sink.inserted)
+	assert.False(t, p.wal.pending())
+
+	require.NoError(t, p.insertBatch(ctx, newBatchID(), "hass", "light", []any{map[string]any{"n": 3}}, 1, 0))
+	assert.Len(t, sink.inserted, 3)
+}
+
+func TestWAL_MaxSize(t *testing.T) {
+	w, err := openWAL(t.TempDir(), 10)
+	require.NoError(t, err)
+
+	require.NoError(t, w.append("hass", "light", 1, strings.NewReader(`{"n":1}`)))
+	assert.ErrorIs(t, w.append("hass", "light", 1, strings.NewReader(`{"n":2}`)), errWALFull)
+}
@@ -0,0 +1,109 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+)
+
+// Handler processes a single item submitted to the pool
+type Handler[T any] func(ctx context.Context, item T) error
+
+// Pool processes submitted items with a bounded number of workers.
+// A panicking handler is recovered, so it does not take down the worker nor the process.
+type Pool[T any] struct {
+	name    string
+	handler Handler[T]
+
+	items chan T
+	wg    sync.WaitGroup
+}
+
+// New creates a pool with the given number of workers and starts them.
+// The name is used in logs and metrics. The context is passed to the handler.
+func New[T any](ctx context.Context, name string, workers int, handler Handler[T]) *Pool[T] {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &Pool[T]{
+		name:    name,
+		handler: handler,
+		items:   make(chan T),
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work(ctx, strconv.Itoa(i))
+	}
+
+	return p
+}
+
+// Submit passes an item to the next free worker.
+// It blocks until a worker accepts the item or the context is canceled.
+func (p *Pool[T]) Submit(ctx context.Context, item T) error {
+	select {
+	case p.items <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting items and waits for the workers to finish the items being processed.
+// Submit must not be called after Close.
+func (p *Pool[T]) Close() {
+	close(p.items)
+	p.wg.Wait()
+}
+
+func (p *Pool[T]) work(ctx context.Context, worker string) {
+	defer p.wg.Done()
+
+	workerTasks := metrics.PoolWorkerTasksTotal.WithLabelValues(p.name, worker)
+	workerBusy := metrics.PoolWorkerBusySeconds.WithLabelValues(p.name, worker)
+
+	for item := range p.items {
+		start := time.Now()
+		metrics.PoolBusyWorkers.WithLabelValues(p.name).Inc()
+		status := "success"
+		if err := p.handle(ctx, item); err != nil {
+			status = "error"
+			if _, ok := err.(*PanicError); ok {
+				status = "panic"
+			}
+		}
+		metrics.PoolTasksTotal.WithLabelValues(p.name, status).Inc()
+		metrics.PoolBusyWorkers.WithLabelValues(p.name).Dec()
+		workerTasks.Inc()
+		workerBusy.Add(time.Since(start).Seconds())
+	}
+}
+
+func (p *Pool[T]) handle(ctx context.Context, item T) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+			recovery.Handle("pool_"+p.name, r)
+		}
+	}()
+
+	return p.handler(ctx, item)
+}
+
+// PanicError is returned for items whose handler panicked
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
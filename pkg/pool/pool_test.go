@@ -0,0 +1,80 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	var mtx sync.Mutex
+	var processed []int
+	var running, maxRunning atomic.Int32
+
+	p := New(context.Background(), "test", 2, func(ctx context.Context, item int) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+
+		time.Sleep(5 * time.Millisecond)
+
+		mtx.Lock()
+		processed = append(processed, item)
+		mtx.Unlock()
+		return nil
+	})
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, p.Submit(context.Background(), i))
+	}
+	p.Close()
+
+	assert.ElementsMatch(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, processed)
+	assert.LessOrEqual(t, maxRunning.Load(), int32(2), "no more than 2 items are processed at once")
+}
+
+func TestPool_RecoversFromPanic(t *testing.T) {
+	var processed atomic.Int32
+
+	p := New(context.Background(), "test", 1, func(ctx context.Context, item int) error {
+		if item == 0 {
+			panic("malformed item")
+		}
+		processed.Add(1)
+		return nil
+	})
+
+	require.NoError(t, p.Submit(context.Background(), 0))
+	require.NoError(t, p.Submit(context.Background(), 1))
+	p.Close()
+
+	assert.Equal(t, int32(1), processed.Load(), "worker keeps processing items after a panic")
+}
+
+func TestPool_SubmitCanceled(t *testing.T) {
+	release := make(chan struct{})
+	p := New(context.Background(), "test", 1, func(ctx context.Context, item int) error {
+		<-release
+		return nil
+	})
+
+	// Occupy the only worker
+	require.NoError(t, p.Submit(context.Background(), 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.Submit(ctx, 1), context.DeadlineExceeded)
+
+	close(release)
+	p.Close()
+}
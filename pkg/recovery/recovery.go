@@ -0,0 +1,47 @@
+package recovery
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jkaflik/hass2ch/internal/metrics"
+)
+
+// restartDelay is how long to wait before restarting a component that panicked,
+// so a component panicking over and over does not spin the CPU
+const restartDelay = 100 * time.Millisecond
+
+// Run runs fn and restarts it whenever it panics, until fn returns normally.
+// It is meant for long-running loops, e.g. a pipeline stage ranging over a channel,
+// where the item that caused the panic is dropped and the loop continues with the next one.
+func Run(component string, fn func()) {
+	for !runOnce(component, fn) {
+		log.Warn().Str("component", component).Msg("Restarting component after panic")
+		time.Sleep(restartDelay)
+	}
+}
+
+// runOnce runs fn and reports whether it returned without panicking
+func runOnce(component string, fn func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			Handle(component, r)
+		}
+	}()
+
+	fn()
+	return true
+}
+
+// Handle logs a recovered panic with its stack trace and counts it.
+// It must be called from the deferred function that recovered the panic.
+func Handle(component string, r any) {
+	metrics.PanicsTotal.WithLabelValues(component).Inc()
+	log.Error().
+		Str("component", component).
+		Interface("panic", r).
+		Str("stack", string(debug.Stack())).
+		Msg("Recovered from panic")
+}
@@ -0,0 +1,27 @@
+package recovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun_RestartsAfterPanic(t *testing.T) {
+	in := make(chan int, 3)
+	in <- 1
+	in <- 0
+	in <- 2
+	close(in)
+
+	var processed []int
+	Run("test", func() {
+		for item := range in {
+			if item == 0 {
+				panic("malformed item")
+			}
+			processed = append(processed, item)
+		}
+	})
+
+	assert.Equal(t, []int{1, 2}, processed, "item causing the panic is dropped and the loop continues")
+}
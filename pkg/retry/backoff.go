@@ -7,6 +7,8 @@ import (
 	"math"
 	"math/rand/v2"
 	"time"
+
+	"github.com/jkaflik/hass2ch/pkg/clock"
 )
 
 // Config defines the configuration for backoff-retry mechanism
@@ -21,6 +23,8 @@ type Config struct {
 	Multiplier float64
 	// RandomizationFactor is the randomization factor (0.0-1.0)
 	RandomizationFactor float64
+	// Clock times the backoff, the real clock if nil
+	Clock clock.Clock
 }
 
 // DefaultConfig returns the default retry configuration
@@ -115,12 +119,12 @@ func DoWithCallbacks(ctx context.Context, fn RetryableFunc, isRetryable IsRetrya
 		}
 
 		// Create a timer for the backoff
-		timer := time.NewTimer(backoffTime)
+		timer := clock.OrReal(cfg.Clock).NewTimer(backoffTime)
 		select {
 		case <-ctx.Done():
 			timer.Stop()
 			return fmt.Errorf("context canceled during retry: %w", ctx.Err())
-		case <-timer.C:
+		case <-timer.C():
 			// Backoff period is complete, continue with next attempt
 		}
 	}
@@ -0,0 +1,66 @@
+package singleflight
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jkaflik/hass2ch/pkg/recovery"
+)
+
+// Group deduplicates concurrent calls with the same key, so that only one of them is in flight
+// and all callers receive its result
+type Group[T any] struct {
+	mtx   sync.Mutex
+	calls map[string]*call[T]
+}
+
+type call[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+// Do executes fn unless a call with the same key is already in flight, in which case it waits
+// for that call instead. The returned bool reports whether the result has been shared.
+//
+// fn runs detached from the callers, so a caller giving up on its context does not fail the others.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func() (T, error)) (T, bool, error) {
+	g.mtx.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[T])
+	}
+
+	c, shared := g.calls[key]
+	if !shared {
+		c = &call[T]{done: make(chan struct{})}
+		g.calls[key] = c
+		go g.run(key, c, fn)
+	}
+	g.mtx.Unlock()
+
+	select {
+	case <-ctx.Done():
+		var zero T
+		return zero, shared, ctx.Err()
+	case <-c.done:
+		return c.val, shared, c.err
+	}
+}
+
+func (g *Group[T]) run(key string, c *call[T], fn func() (T, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			recovery.Handle("singleflight", r)
+			c.err = fmt.Errorf("panic in call %q: %v", key, r)
+		}
+
+		g.mtx.Lock()
+		delete(g.calls, key)
+		g.mtx.Unlock()
+
+		close(c.done)
+	}()
+
+	c.val, c.err = fn()
+}
@@ -0,0 +1,62 @@
+package singleflight
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroup_Do(t *testing.T) {
+	var g Group[int]
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]int, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _, err := g.Do(context.Background(), "key", func() (int, error) {
+				calls.Add(1)
+				<-release
+				return 42, nil
+			})
+			require.NoError(t, err)
+			results[i] = v
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, []int{42, 42, 42, 42, 42}, results)
+
+	// The call is forgotten once it completes
+	v, shared, err := g.Do(context.Background(), "key", func() (int, error) { return 7, nil })
+	require.NoError(t, err)
+	assert.False(t, shared)
+	assert.Equal(t, 7, v)
+}
+
+func TestGroup_DoContextCanceled(t *testing.T) {
+	var g Group[int]
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := g.Do(ctx, "key", func() (int, error) {
+		<-release
+		return 0, nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}